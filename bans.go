@@ -0,0 +1,656 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/yuriygr/go-board/utils"
+)
+
+// Статусы апелляций
+const (
+	AppealOpen     = "open"
+	AppealAccepted = "accepted" // Бан снят
+	AppealRejected = "rejected"
+)
+
+type bansResource struct {
+	storage Storage
+	session *Session
+}
+
+func (rs bansResource) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Get("/me", rs.BansMe)
+	r.With(rs.BanCtx).Post("/{banID:[0-9]+}/appeal", rs.AppealCreate)
+
+	return r
+}
+
+//--
+// Middleware
+//--
+
+// BanCtxKey - Key for context
+type BanCtxKey struct{}
+
+// BanCtx - Действующий бан из URL, под который попадает сам запрос.
+// Чужие баны - 404
+func (rs *bansResource) BanCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		banID, err := strconv.ParseInt(chi.URLParam(r, "banID"), 10, 64)
+		if err != nil {
+			render.Render(w, r, ErrBadRequest(errors.New("ID needed")))
+			return
+		}
+
+		ban, err := rs.storage.GetBanByID(banID)
+		if err != nil || !ban.active(time.Now().Unix()) || !ban.matches(requestUserID(r), requestIP(r)) {
+			render.Render(w, r, ErrNotFound(errors.New("Ban not found")))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), BanCtxKey{}, ban)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// BansCtxKey - Key for context
+type BansCtxKey struct{}
+
+// BansCtx - Фильтры банов и апелляций. Доска из board кладется
+// под BoardCtxKey: модератор доски банит и видит баны только на ней
+func (rs *modResource) BansCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := &BansRequest{Status: AppealOpen, Page: 1, Limit: 50} // Initial state
+		if err := request.Bind(r); err != nil {
+			render.Render(w, r, ErrBadRequest(err))
+			return
+		}
+
+		ctx := r.Context()
+		if slug := r.FormValue("board"); slug != "" {
+			board, err := rs.storage.GetBoardBySlug(slug)
+			if err != nil {
+				render.Render(w, r, ErrBadRequest(errors.New("Board not found")))
+				return
+			}
+			request.BoardID = board.ID
+			ctx = context.WithValue(ctx, BoardCtxKey{}, board)
+		}
+
+		ctx = context.WithValue(ctx, BansCtxKey{}, request)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ModBanCtx - Бан по ID из URL для модератора.
+// Его доска кладется под BoardCtxKey: по ней проверяются права
+func (rs *modResource) ModBanCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		banID, err := strconv.ParseInt(chi.URLParam(r, "banID"), 10, 64)
+		if err != nil {
+			render.Render(w, r, ErrBadRequest(errors.New("ID needed")))
+			return
+		}
+
+		ban, err := rs.storage.GetBanByID(banID)
+		if err != nil {
+			render.Render(w, r, ErrNotFound(errors.New("Ban not found")))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), BanCtxKey{}, ban)
+		ctx = context.WithValue(ctx, BoardCtxKey{}, &Board{ID: ban.BoardID, Slug: ban.Board})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// AppealCtxKey - Key for context
+type AppealCtxKey struct{}
+
+// AppealCtx - Апелляция по ID из URL, доска ее бана под BoardCtxKey
+func (rs *modResource) AppealCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		appealID, err := strconv.ParseInt(chi.URLParam(r, "appealID"), 10, 64)
+		if err != nil {
+			render.Render(w, r, ErrBadRequest(errors.New("ID needed")))
+			return
+		}
+
+		appeal, err := rs.storage.GetBanAppealByID(appealID)
+		if err != nil {
+			render.Render(w, r, ErrNotFound(errors.New("Appeal not found")))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), AppealCtxKey{}, appeal)
+		ctx = context.WithValue(ctx, BoardCtxKey{}, &Board{ID: appeal.BoardID, Slug: appeal.Board})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+//--
+// Handler methods
+//--
+
+// BansMe - За что забанен текущий юзер или его адрес и что с апелляциями.
+// Пустой список - банов нет
+func (rs *bansResource) BansMe(w http.ResponseWriter, r *http.Request) {
+	bans, err := requesterBans(rs.storage, r)
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	key := requesterKey(requestUserID(r), requestIP(r))
+	for _, ban := range bans {
+		ban.ModeratorID = 0
+
+		appeal, err := rs.storage.GetBanAppeal(ban.ID, key)
+		if err != nil && err != sql.ErrNoRows {
+			render.Render(w, r, ErrBadRequest(err))
+			return
+		}
+		if appeal != nil {
+			appeal.AnsweredBy = 0
+			ban.Appeal = appeal
+		}
+	}
+
+	if err := render.RenderList(w, r, NewBansListResponse(bans)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// AppealCreate - Апелляция на бан, одна от каждого, кого он касается
+func (rs *bansResource) AppealCreate(w http.ResponseWriter, r *http.Request) {
+	ban := r.Context().Value(BanCtxKey{}).(*Ban)
+
+	appeal := &BanAppeal{BanID: ban.ID}
+	if err := appeal.Bind(r); err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	created, err := rs.storage.CreateBanAppeal(appeal)
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+	if !created {
+		render.Render(w, r, ErrConflict(errors.New("Appeal already sent")))
+		return
+	}
+
+	render.Render(w, r, &SuccessResponse{
+		HTTPStatusCode: 201,
+		StatusText:     "Appeal sent!",
+	})
+}
+
+// BansList - Действующие баны, новые сверху
+func (rs *modResource) BansList(w http.ResponseWriter, r *http.Request) {
+	request := r.Context().Value(BansCtxKey{}).(*BansRequest)
+
+	bans, err := rs.storage.GetBans(request)
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+	for _, ban := range bans {
+		hideBanIP(r, ban)
+	}
+
+	if err := render.RenderList(w, r, NewBansListResponse(bans)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// BanCreate - Банит юзера, адрес или подсеть. Вместо них можно передать
+// topic_id или comment_id: забанится автор, а аноним - по IP поста
+func (rs *modResource) BanCreate(w http.ResponseWriter, r *http.Request) {
+	ban := &Ban{}
+	if err := ban.Bind(r); err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	if board, ok := r.Context().Value(BoardCtxKey{}).(*Board); ok {
+		ban.BoardID = board.ID
+	}
+
+	if ban.UserID == 0 && ban.IP == "" {
+		if err := rs.bindPostAuthor(r, ban); err != nil {
+			render.Render(w, r, ErrBadRequest(err))
+			return
+		}
+	}
+	if ban.UserID != 0 {
+		if _, err := rs.storage.GetUserByID(ban.UserID); err != nil {
+			render.Render(w, r, ErrBadRequest(errors.New("User not found")))
+			return
+		}
+	}
+
+	ban.ModeratorID = requestUserID(r)
+
+	err := rs.storage.WithTx(r.Context(), func(tx Storage) error {
+		created, err := tx.CreateBan(ban)
+		if err != nil {
+			return err
+		}
+		*ban = *created
+
+		entry := &ModLogEntry{BoardID: ban.BoardID, TargetType: "ban", TargetID: ban.ID, Action: "ban", Reason: ban.Reason}
+		return logModeration(tx, r, entry, nil, banModState(ban))
+	})
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	hideBanIP(r, ban)
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, ban)
+}
+
+// BanLift - Снимает бан раньше срока
+func (rs *modResource) BanLift(w http.ResponseWriter, r *http.Request) {
+	ban := r.Context().Value(BanCtxKey{}).(*Ban)
+
+	if !ban.active(time.Now().Unix()) {
+		render.Render(w, r, ErrConflict(errors.New("Ban already expired")))
+		return
+	}
+
+	err := rs.storage.WithTx(r.Context(), func(tx Storage) error {
+		return rs.liftBan(tx, r, ban, "unban")
+	})
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	hideBanIP(r, ban)
+	render.Render(w, r, ban)
+}
+
+// AppealsList - Апелляции, старые сверху
+func (rs *modResource) AppealsList(w http.ResponseWriter, r *http.Request) {
+	request := r.Context().Value(BansCtxKey{}).(*BansRequest)
+
+	appeals, err := rs.storage.GetBanAppeals(request)
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	if err := render.RenderList(w, r, NewBanAppealsListResponse(appeals)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// answerAppeal - Отвечает на апелляцию. Принятая снимает бан
+func (rs *modResource) answerAppeal(status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		appeal := r.Context().Value(AppealCtxKey{}).(*BanAppeal)
+
+		if appeal.Status != AppealOpen {
+			render.Render(w, r, ErrConflict(errors.New("Appeal already answered")))
+			return
+		}
+
+		err := rs.storage.WithTx(r.Context(), func(tx Storage) error {
+			appeal.Status = status
+			appeal.AnsweredBy = requestUserID(r)
+			appeal.AnsweredAt = time.Now().Unix()
+			if err := tx.UpdateBanAppeal(appeal); err != nil {
+				return err
+			}
+
+			ban, err := tx.GetBanByID(appeal.BanID)
+			if err != nil {
+				return err
+			}
+			if status == AppealAccepted && ban.active(appeal.AnsweredAt) {
+				return rs.liftBan(tx, r, ban, "accept_appeal")
+			}
+
+			// Бан уже истек или снят - снимать нечего, но решение пишем как есть
+			action := "reject_appeal"
+			if status == AppealAccepted {
+				action = "accept_appeal"
+			}
+			entry := &ModLogEntry{BoardID: ban.BoardID, TargetType: "ban", TargetID: ban.ID, Action: action}
+			return logModeration(tx, r, entry, nil, nil)
+		})
+		if err != nil {
+			render.Render(w, r, ErrBadRequest(err))
+			return
+		}
+
+		render.Render(w, r, appeal)
+	}
+}
+
+//--
+// Struct
+//--
+
+// Ban - Бан юзера, адреса или подсети, на всех досках или на одной
+type Ban struct {
+	ID          int64      `json:"id" db:"bn.id"`
+	UserID      int64      `json:"user_id,omitempty" db:"bn.user_id"`
+	IP          string     `json:"ip,omitempty" db:"bn.ip"` // Адрес или подсеть в CIDR
+	BoardID     int64      `json:"-" db:"bn.board_id"`      // 0 - на всех досках
+	Board       string     `json:"board" db:"slug"`
+	Reason      string     `json:"reason" db:"bn.reason"`
+	ModeratorID int64      `json:"moderator_id,omitempty" db:"bn.moderator_id"`
+	CreatedAt   int64      `json:"created_at" db:"bn.created_at"`
+	ExpiresAt   int64      `json:"expires_at" db:"bn.expires_at"` // 0 - навсегда
+	Appeal      *BanAppeal `json:"appeal,omitempty" db:"-"`       // Только в /bans/me
+}
+
+// Render - Render, wtf
+func (b *Ban) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// Bind - Bind HTTP request data and validate it.
+// Юзер или адрес могут не прийти, если бан по посту
+func (b *Ban) Bind(r *http.Request) error {
+	b.Reason = strings.TrimSpace(r.FormValue("reason"))
+	if b.Reason == "" {
+		return errors.New("Reason must be filled")
+	}
+	if utf8.RuneCountInString(b.Reason) > 255 {
+		return errors.New("Reason is too long")
+	}
+
+	if userID := r.FormValue("user_id"); userID != "" {
+		id, err := strconv.ParseInt(userID, 10, 64)
+		if err != nil || id <= 0 {
+			return errors.New("Invalid user_id")
+		}
+		if id == 1 {
+			return errors.New("Anonymous can be banned only by IP")
+		}
+		b.UserID = id
+	}
+
+	if ip := strings.TrimSpace(r.FormValue("ip")); ip != "" {
+		normalized, err := normalizeBanIP(ip)
+		if err != nil {
+			return err
+		}
+		b.IP = normalized
+	}
+
+	b.CreatedAt = time.Now().Unix()
+	if duration := r.FormValue("duration"); duration != "" {
+		seconds, err := strconv.ParseInt(duration, 10, 64)
+		if err != nil || seconds < 0 {
+			return errors.New("Invalid duration")
+		}
+		if seconds > 0 {
+			b.ExpiresAt = b.CreatedAt + seconds
+		}
+	}
+
+	return nil
+}
+
+// active - Не истек и не снят
+func (b *Ban) active(now int64) bool {
+	return b.ExpiresAt == 0 || b.ExpiresAt > now
+}
+
+// matches - Касается ли бан юзера или адреса
+func (b *Ban) matches(userID int64, ip string) bool {
+	if b.UserID != 0 && b.UserID == userID {
+		return true
+	}
+	if b.IP == "" {
+		return false
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	if _, network, err := net.ParseCIDR(b.IP); err == nil {
+		return network.Contains(addr)
+	}
+	return addr.Equal(net.ParseIP(b.IP))
+}
+
+// BanAppeal - Апелляция на бан
+type BanAppeal struct {
+	ID           int64  `json:"id" db:"ba.id"`
+	BanID        int64  `json:"ban_id" db:"ba.ban_id"`
+	UserID       int64  `json:"user_id" db:"ba.user_id"`
+	IP           string `json:"ip" db:"ba.ip"`
+	AppellantKey string `json:"-" db:"ba.appellant_key"` // user:{id} или ip:{ip} для анонимов
+	Text         string `json:"text" db:"ba.text"`
+	Status       string `json:"status" db:"ba.status"`
+	CreatedAt    int64  `json:"created_at" db:"ba.created_at"`
+	AnsweredBy   int64  `json:"answered_by,omitempty" db:"ba.answered_by"`
+	AnsweredAt   int64  `json:"answered_at,omitempty" db:"ba.answered_at"`
+	BanReason    string `json:"ban_reason" db:"bn.reason"`
+	BoardID      int64  `json:"-" db:"bn.board_id"`
+	Board        string `json:"board" db:"slug"`
+}
+
+// Render - Render, wtf
+func (ba *BanAppeal) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// Bind - Bind HTTP request data and validate it
+func (ba *BanAppeal) Bind(r *http.Request) error {
+	ba.Text = strings.TrimSpace(r.FormValue("text"))
+	if ba.Text == "" {
+		return errors.New("Text must be filled")
+	}
+	if utf8.RuneCountInString(ba.Text) > 1000 {
+		return errors.New("Text is too long")
+	}
+
+	ba.UserID = requestUserID(r)
+	ba.IP = requestIP(r)
+	ba.AppellantKey = requesterKey(ba.UserID, ba.IP)
+	ba.Status = AppealOpen
+	ba.CreatedAt = time.Now().Unix()
+
+	return nil
+}
+
+// BansRequest - Фильтры банов и апелляций
+type BansRequest struct {
+	Status  string // Только для апелляций
+	BoardID int64  // Заполняет BansCtx по slug
+	Now     int64  // Баны, действующие на этот момент
+	Page    int64
+	Limit   int64
+}
+
+// Bind - Bind HTTP request data and validate it
+func (br *BansRequest) Bind(r *http.Request) error {
+	query := r.URL.Query()
+
+	if status := query.Get("status"); status != "" {
+		if status != AppealOpen && status != AppealAccepted && status != AppealRejected {
+			return errors.New("Invalid status")
+		}
+		br.Status = status
+	}
+
+	if page := query.Get("page"); page != "" {
+		if pageInt, err := strconv.ParseInt(page, 10, 64); err == nil {
+			br.Page = utils.LimitMinValue(utils.Abs(pageInt), 1)
+		}
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		if limitInt, err := strconv.ParseInt(limit, 10, 64); err == nil {
+			br.Limit = utils.LimitMaxValue(utils.Abs(limitInt), 100)
+		}
+	}
+
+	br.Now = time.Now().Unix()
+
+	return nil
+}
+
+// NewBansListResponse - Условности CHI
+func NewBansListResponse(bans []*Ban) []render.Renderer {
+	list := []render.Renderer{}
+	for _, ban := range bans {
+		list = append(list, ban)
+	}
+	return list
+}
+
+// NewBanAppealsListResponse - Условности CHI
+func NewBanAppealsListResponse(appeals []*BanAppeal) []render.Renderer {
+	list := []render.Renderer{}
+	for _, appeal := range appeals {
+		list = append(list, appeal)
+	}
+	return list
+}
+
+//--
+// Helpers function
+//--
+
+// checkBan - 403, если запрос попадает под бан на доске boardID.
+// boardID 0 - только глобальные баны, как у загрузок без поста
+func checkBan(storage Storage, r *http.Request, boardID int64) render.Renderer {
+	bans, err := requesterBans(storage, r)
+	if err != nil {
+		return ErrBadRequest(err)
+	}
+
+	for _, ban := range bans {
+		if ban.BoardID == 0 || ban.BoardID == boardID {
+			return ErrForbidden(fmt.Errorf("You are banned: %s", ban.Reason))
+		}
+	}
+
+	return nil
+}
+
+// requesterBans - Действующие баны на юзера или адрес запроса
+func requesterBans(storage Storage, r *http.Request) ([]*Ban, error) {
+	userID, ip := requestUserID(r), requestIP(r)
+
+	// Баны по одному адресу хранятся в виде normalizeBanIP
+	banIP, _ := normalizeBanIP(ip)
+	bans, err := storage.GetActiveBans(userID, banIP, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	matched := []*Ban{}
+	for _, ban := range bans {
+		if ban.matches(userID, ip) {
+			matched = append(matched, ban)
+		}
+	}
+	return matched, nil
+}
+
+// bindPostAuthor - Бан по посту: автор, а для анонима - адрес, с которого писали.
+// Бан на доске можно выдать только по посту с этой доски
+func (rs *modResource) bindPostAuthor(r *http.Request, ban *Ban) error {
+	var userID, boardID int64
+	var ip string
+
+	if topicID := r.FormValue("topic_id"); topicID != "" {
+		id, _ := strconv.ParseInt(topicID, 10, 64)
+		topic, err := rs.storage.GetTopicByID(id)
+		if err != nil {
+			return errors.New("Topic not found")
+		}
+		userID, ip, boardID = topic.UserID, topic.UserIP, topic.BoardID
+	} else if commentID := r.FormValue("comment_id"); commentID != "" {
+		id, _ := strconv.ParseInt(commentID, 10, 64)
+		comment, err := rs.storage.GetCommentByID(id)
+		if err != nil {
+			return errors.New("Comment not found")
+		}
+		topic, err := rs.storage.GetTopicByID(comment.TopicID)
+		if err != nil {
+			return errors.New("Comment not found")
+		}
+		userID, ip, boardID = comment.UserID, comment.UserIP, topic.BoardID
+	} else {
+		return errors.New("User, IP or post needed")
+	}
+
+	if ban.BoardID != 0 && ban.BoardID != boardID {
+		return errors.New("Post is on another board")
+	}
+
+	if userID != 1 {
+		ban.UserID = userID
+		return nil
+	}
+
+	normalized, err := normalizeBanIP(ip)
+	if err != nil {
+		return errors.New("Post has no IP")
+	}
+	ban.IP = normalized
+	return nil
+}
+
+// hideBanIP - Адреса банов видят только модераторы всех досок
+func hideBanIP(r *http.Request, ban *Ban) {
+	if auth, ok := r.Context().Value(AuthCtxKey{}).(*SessionResponse); !ok || !auth.Can(PermUsersBan, 0) {
+		ban.IP = ""
+	}
+}
+
+// liftBan - Снимает бан с этого момента и пишет это в журнал
+func (rs *modResource) liftBan(tx Storage, r *http.Request, ban *Ban, action string) error {
+	before := banModState(ban)
+	if err := tx.LiftBan(ban.ID, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	updated, err := tx.GetBanByID(ban.ID)
+	if err != nil {
+		return err
+	}
+	*ban = *updated
+
+	entry := &ModLogEntry{BoardID: ban.BoardID, TargetType: "ban", TargetID: ban.ID, Action: action}
+	return logModeration(tx, r, entry, before, banModState(ban))
+}
+
+// banModState - Кого и до какого времени банит бан
+func banModState(ban *Ban) map[string]interface{} {
+	return map[string]interface{}{
+		"user_id":    ban.UserID,
+		"ip":         ban.IP,
+		"board":      ban.Board,
+		"expires_at": ban.ExpiresAt,
+	}
+}
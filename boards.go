@@ -9,7 +9,7 @@ import (
 )
 
 type boardsResource struct {
-	storage *Storage
+	storage Storage
 	session *Session
 }
 
@@ -68,6 +68,8 @@ type Board struct {
 	Type      string `json:"type" db:"b.type"`
 	Available bool   `json:"-" db:"b.available"`
 	NSFW      bool   `json:"nsfw" db:"b.nsfw"`
+
+	MaxFilesBytes int64 `json:"-" db:"b.max_files_bytes"` // 0 - общий лимит UPLOAD_MAX_BOARD_BYTES
 }
 
 // Render - Render, wtf
@@ -10,7 +10,7 @@ import (
 )
 
 type bugsResource struct {
-	storage *Storage
+	storage Storage
 	session *Session
 }
 
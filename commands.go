@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuriygr/go-board/migrations"
+	"github.com/yuriygr/go-board/uploader"
+)
+
+// command - Консольная команда: go-board <name> [args]
+type command func(args []string) error
+
+// commands - Все консольные команды
+var commands = map[string]command{
+	"migrate":    migrateCommand,
+	"thumbnails": thumbnailsCommand,
+	"ban-file":   banFileCommand,
+	"gc":         gcCommand,
+	"role":       roleCommand,
+}
+
+// runCommand - Выполняет команду, если она указана в аргументах.
+// Возвращает false, если нужно просто запустить сервер.
+func runCommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return true, fmt.Errorf("Unknown command %q", args[0])
+	}
+
+	return true, cmd(args[1:])
+}
+
+// migrateCommand - go-board migrate up|down|status
+func migrateCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: go-board migrate up|down|status")
+	}
+
+	db := ConnectMySQL(os.Getenv("DB_DSN"))
+	defer db.Close()
+
+	migrator := migrations.NewMigrator(db)
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up()
+		for _, m := range applied {
+			fmt.Printf("Applied %04d %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("Nothing to migrate")
+		}
+	case "down":
+		m, err := migrator.Down()
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			fmt.Println("Nothing to roll back")
+			return nil
+		}
+		fmt.Printf("Rolled back %04d %s\n", m.Version, m.Name)
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.AppliedAt > 0 {
+				state = "applied " + time.Unix(s.AppliedAt, 0).Format(time.RFC3339)
+			}
+			fmt.Printf("%04d %-24s %s\n", s.Migration.Version, s.Migration.Name, state)
+		}
+	default:
+		return errors.New("Usage: go-board migrate up|down|status")
+	}
+
+	return nil
+}
+
+// banFileCommand - go-board ban-file <md5> [reason]
+// Файлы с этим хешем больше нельзя загрузить.
+func banFileCommand(args []string) error {
+	if len(args) < 1 || len(args[0]) != 32 {
+		return errors.New("Usage: go-board ban-file <md5> [reason]")
+	}
+
+	ban := &FileBan{Md5: strings.ToLower(args[0]), CreatedAt: time.Now().Unix()}
+	ban.Reason = strings.Join(args[1:], " ")
+
+	storage := NewMySQLStorage(os.Getenv("DB_DSN"))
+	if err := storage.CreateFileBan(ban); err != nil {
+		return err
+	}
+
+	fmt.Printf("Banned %s\n", ban.Md5)
+
+	return nil
+}
+
+// thumbnailsCommand - go-board thumbnails [-force]
+// Создает миниатюры для уже загруженных файлов из таблицы files.
+// Без -force существующие миниатюры не трогаем.
+func thumbnailsCommand(args []string) error {
+	force := false
+	for _, arg := range args {
+		if arg != "-force" {
+			return errors.New("Usage: go-board thumbnails [-force]")
+		}
+		force = true
+	}
+
+	storage := NewMySQLStorage(os.Getenv("DB_DSN"))
+	created, failed, err := writeThumbnails(storage, blobStore(), force)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created %d thumbnails, %d failed\n", created, failed)
+
+	return nil
+}
+
+// writeThumbnails - Обходит файлы пачками и пишет миниатюры в хранилище
+func writeThumbnails(storage Storage, store uploader.BlobStore, force bool) (int, int, error) {
+	created, failed := 0, 0
+
+	for afterID := int64(0); ; {
+		files, err := storage.GetFilesAfter(afterID, 100)
+		if err != nil {
+			return created, failed, err
+		}
+		if len(files) == 0 {
+			return created, failed, nil
+		}
+		afterID = files[len(files)-1].ID
+
+		for _, file := range files {
+			if !force {
+				if thumb, err := store.Get(file.ThumbKey()); err == nil {
+					thumb.Close()
+					continue
+				}
+			}
+
+			if _, err := writeThumbnail(store, file); err != nil {
+				fmt.Printf("Skipped %s: %s\n", file.Key(), err)
+				failed++
+				continue
+			}
+			created++
+		}
+	}
+}
+
+// gcCommand - go-board gc [-dry-run] [-grace=<seconds>]
+// Удаляет загрузки, которые так и не прикрепили к постам.
+func gcCommand(args []string) error {
+	opts := gcOptions()
+	for _, arg := range args {
+		switch {
+		case arg == "-dry-run":
+			opts.DryRun = true
+		case strings.HasPrefix(arg, "-grace="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(arg, "-grace="))
+			if err != nil || seconds < 0 {
+				return errors.New("Usage: go-board gc [-dry-run] [-grace=<seconds>]")
+			}
+			opts.Grace = time.Duration(seconds) * time.Second
+		default:
+			return errors.New("Usage: go-board gc [-dry-run] [-grace=<seconds>]")
+		}
+	}
+
+	storage := NewMySQLStorage(os.Getenv("DB_DSN"))
+	report, err := collectGarbage(storage, gcStores(), opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.DryRun {
+		fmt.Printf("Would delete %s\n", report)
+		return nil
+	}
+	fmt.Printf("Deleted %s\n", report)
+
+	return nil
+}
+
+// roleCommand - go-board role grant|revoke <user_id> <role> [board]
+// Первого админа иначе как из консоли не назначить. В журнал модерации
+// запись попадает без модератора и с причиной "cli".
+func roleCommand(args []string) error {
+	usage := errors.New("Usage: go-board role grant|revoke <user_id> moderator|board-owner|admin [board]")
+	if len(args) < 3 || len(args) > 4 || args[0] != "grant" && args[0] != "revoke" {
+		return usage
+	}
+
+	userID, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || userID <= 1 {
+		return usage
+	}
+
+	role := &UserRole{UserID: userID, Role: args[2], CreatedAt: time.Now().Unix()}
+	if _, ok := rolePermissions[role.Role]; !ok || role.Role == RoleUser {
+		return usage
+	}
+
+	storage := NewMySQLStorage(os.Getenv("DB_DSN"))
+	if len(args) == 4 {
+		if role.Role == RoleAdmin {
+			return errors.New("Admin role can not be scoped to a board")
+		}
+		board, err := storage.GetBoardBySlug(args[3])
+		if err != nil {
+			return fmt.Errorf("Board %q not found", args[3])
+		}
+		role.BoardID, role.Board = board.ID, board.Slug
+	}
+
+	if _, err := storage.GetUserByID(userID); err != nil {
+		return fmt.Errorf("User %d not found", userID)
+	}
+
+	err = storage.WithTx(context.Background(), func(tx Storage) error {
+		entry := &ModLogEntry{BoardID: role.BoardID, TargetType: "user", TargetID: userID, Action: args[0], Reason: "cli"}
+
+		if args[0] == "grant" {
+			if err := tx.CreateUserRole(role); err != nil {
+				return err
+			}
+			return writeModLog(tx, entry, nil, roleModState(role))
+		}
+
+		if err := tx.DeleteUserRole(role.UserID, role.Role, role.BoardID); err != nil {
+			return err
+		}
+		return writeModLog(tx, entry, roleModState(role), nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Done: %s %s for user %d\n", args[0], role.Role, userID)
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+type commentsResource struct {
+	storage Storage
+	session *Session
+}
+
+func (rs commentsResource) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Route("/{commentID:[0-9]+}", func(r chi.Router) {
+		r.Use(rs.CommentCtx)
+		r.Get("/", rs.CommentGet)
+		r.Post("/report", rs.ReportCreate)
+
+		// Модерация, роль на доске топика тоже подходит
+		r.Group(func(r chi.Router) {
+			r.Use(RequirePermission(PermPostsModerate))
+			r.Post("/pin", rs.moderateComment("pin", func(c *Comment) { c.States.IsPinned = 1 }))
+			r.Post("/unpin", rs.moderateComment("unpin", func(c *Comment) { c.States.IsPinned = 0 }))
+			r.Post("/delete", rs.moderateComment("delete", func(c *Comment) { c.States.IsDeleted = 1 }))
+			r.Post("/restore", rs.moderateComment("restore", func(c *Comment) { c.States.IsDeleted = 0 }))
+		})
+	})
+
+	return r
+}
+
+//--
+// Middleware
+//--
+
+// CommentCtxKey - Key for context
+type CommentCtxKey struct{}
+
+// CommentCtx - Загружает комментарий по ID из URL и его топик,
+// иначе 404. Топик кладется под TopicCtxKey: по нему проверяются права
+func (rs *commentsResource) CommentCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		commentID, err := strconv.ParseInt(chi.URLParam(r, "commentID"), 10, 64)
+		if err != nil {
+			render.Render(w, r, ErrBadRequest(errors.New("ID needed")))
+			return
+		}
+
+		comment, err := rs.storage.GetCommentByID(commentID)
+		if err != nil {
+			render.Render(w, r, ErrNotFound(errors.New("Comment not found")))
+			return
+		}
+
+		topic, err := rs.storage.GetTopicByID(comment.TopicID)
+		if err != nil || topic.States.IsDeleted && !canModerate(r, topic.BoardID) {
+			render.Render(w, r, ErrNotFound(errors.New("Comment not found")))
+			return
+		}
+
+		if err := setCommentsBadges(rs.storage, topic.BoardID, comment); err != nil {
+			render.Render(w, r, ErrBadRequest(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), CommentCtxKey{}, comment)
+		ctx = context.WithValue(ctx, TopicCtxKey{}, topic)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+//--
+// Handler methods
+//--
+
+// CommentGet - Вывод комментария исходя из контекста
+func (rs *commentsResource) CommentGet(w http.ResponseWriter, r *http.Request) {
+	comment := r.Context().Value(CommentCtxKey{}).(*Comment)
+	topic := r.Context().Value(TopicCtxKey{}).(*Topic)
+
+	if !canModerate(r, topic.BoardID) {
+		hideDeletedComment(comment)
+	}
+
+	if err := render.Render(w, r, comment); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// ReportCreate - Создает жалобу на комментарий
+func (rs *commentsResource) ReportCreate(w http.ResponseWriter, r *http.Request) {
+	comment := r.Context().Value(CommentCtxKey{}).(*Comment)
+	topic := r.Context().Value(TopicCtxKey{}).(*Topic)
+
+	createReport(rs.storage, w, r, &Report{
+		TargetType: "comment",
+		TargetID:   comment.ID,
+		TopicID:    topic.ID,
+		BoardID:    topic.BoardID,
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+type filesResource struct {
+	storage Storage
+	session *Session
+}
+
+func (rs filesResource) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	r.With(RequirePermission(PermFilesModerate)).Get("/flagged", rs.FlaggedList)
+	r.Route("/{fileID:[0-9]+}", func(r chi.Router) {
+		r.Use(rs.FileCtx)
+		r.Get("/", rs.FileGet)
+		r.Get("/posts", rs.FilePostsGet)
+		r.With(RequirePermission(PermFilesModerate)).Post("/ban", rs.BanFile)
+		r.With(RequirePermission(PermFilesModerate)).Post("/approve", rs.ApproveFile)
+	})
+
+	return r
+}
+
+//--
+// Middleware
+//--
+
+// FileCtxKey - Key for context
+type FileCtxKey struct{}
+
+// FileCtx - Загружает файл по ID из URL, иначе 404
+func (rs *filesResource) FileCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileID, err := strconv.ParseInt(chi.URLParam(r, "fileID"), 10, 64)
+		if err != nil {
+			render.Render(w, r, ErrBadRequest(errors.New("ID needed")))
+			return
+		}
+
+		file, err := rs.storage.GetFileByID(fileID)
+		if err != nil {
+			render.Render(w, r, ErrNotFound(errors.New("File not found")))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), FileCtxKey{}, file)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+//--
+// Handler methods
+//--
+
+// FileGet - Возвращает файл
+func (rs *filesResource) FileGet(w http.ResponseWriter, r *http.Request) {
+	file := r.Context().Value(FileCtxKey{}).(*File)
+
+	if err := render.Render(w, r, file); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// FilePostsGet - Топики и комментарии, к которым прикреплен файл
+func (rs *filesResource) FilePostsGet(w http.ResponseWriter, r *http.Request) {
+	file := r.Context().Value(FileCtxKey{}).(*File)
+
+	refs, err := rs.storage.GetFilePosts(file.ID)
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	// Удаленное видно только модераторам доски, как и в тредах
+	posts := &FilePosts{Topics: []*Topic{}, Comments: []*Comment{}}
+	topics := map[int64]*Topic{}
+	for _, ref := range refs {
+		topic, ok := topics[ref.TopicID]
+		if !ok {
+			topic, _ = rs.storage.GetTopicByID(ref.TopicID)
+			topics[ref.TopicID] = topic
+		}
+		if topic == nil {
+			continue
+		}
+		moderator := canModerate(r, topic.BoardID)
+		if topic.States.IsDeleted && !moderator {
+			continue
+		}
+
+		if ref.CommentID == 0 {
+			posts.Topics = append(posts.Topics, topic)
+			continue
+		}
+		if comment, err := rs.storage.GetCommentByID(ref.CommentID); err == nil {
+			if !moderator {
+				hideDeletedComment(comment)
+			}
+			posts.Comments = append(posts.Comments, comment)
+		}
+	}
+
+	if err := render.Render(w, r, posts); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// FlaggedList - Файлы, похожие на забаненные
+func (rs *filesResource) FlaggedList(w http.ResponseWriter, r *http.Request) {
+	files, err := rs.storage.GetFlaggedFiles()
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	list := []render.Renderer{}
+	for _, file := range files {
+		list = append(list, file)
+	}
+
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// BanFile - Банит файл по md5 и перцептивному хешу
+func (rs *filesResource) BanFile(w http.ResponseWriter, r *http.Request) {
+	file := r.Context().Value(FileCtxKey{}).(*File)
+
+	ban := &FileBan{
+		Md5:       file.Md5,
+		Phash:     file.Phash,
+		Reason:    r.FormValue("reason"),
+		CreatedAt: time.Now().Unix(),
+	}
+
+	before := fileModState(file, false)
+	err := rs.storage.WithTx(r.Context(), func(tx Storage) error {
+		if err := tx.CreateFileBan(ban); err != nil {
+			return err
+		}
+		if err := tx.UpdateFileFlag(file.ID, false); err != nil {
+			return err
+		}
+		file.IsFlagged = false
+
+		entry := &ModLogEntry{TargetType: "file", TargetID: file.ID, Action: "ban", Reason: ban.Reason}
+		return logModeration(tx, r, entry, before, fileModState(file, true))
+	})
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, ban)
+}
+
+// ApproveFile - Снимает флаг проверки
+func (rs *filesResource) ApproveFile(w http.ResponseWriter, r *http.Request) {
+	file := r.Context().Value(FileCtxKey{}).(*File)
+
+	before := fileModState(file, false)
+	err := rs.storage.WithTx(r.Context(), func(tx Storage) error {
+		if err := tx.UpdateFileFlag(file.ID, false); err != nil {
+			return err
+		}
+		file.IsFlagged = false
+
+		entry := &ModLogEntry{TargetType: "file", TargetID: file.ID, Action: "approve"}
+		return logModeration(tx, r, entry, before, fileModState(file, false))
+	})
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	render.Render(w, r, file)
+}
+
+//--
+// Struct
+//--
+
+// FileBan - Хеш файла, который нельзя загружать
+type FileBan struct {
+	Md5       string `json:"md5" db:"fb.md5"`
+	Phash     string `json:"phash" db:"fb.phash"`
+	Reason    string `json:"reason" db:"fb.reason"`
+	CreatedAt int64  `json:"created_at" db:"fb.created_at"`
+}
+
+// Render - Render, wtf
+func (fb *FileBan) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// FilePosts - Где используется файл
+type FilePosts struct {
+	Topics   []*Topic   `json:"topics"`
+	Comments []*Comment `json:"comments"`
+}
+
+// Render - Render, wtf
+func (fp *FilePosts) Render(w http.ResponseWriter, r *http.Request) error {
+	for _, topic := range fp.Topics {
+		topic.Render(w, r)
+	}
+	for _, comment := range fp.Comments {
+		comment.Render(w, r)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/yuriygr/go-board/uploader"
+
+	"github.com/google/uuid"
+)
+
+// GCOptions - Настройки сборщика файлов-сирот
+type GCOptions struct {
+	Grace  time.Duration // Сколько ждать, пока файл прикрепят к посту
+	DryRun bool          // Только посчитать, ничего не удалять
+}
+
+// GCReport - Что удалил (или удалил бы) сборщик
+type GCReport struct {
+	Files    int   // Строки files без постов
+	Blobs    int   // Объекты в хранилище без строки в files
+	Sessions int   // Просроченные загрузки по частям
+	Bytes    int64 // Сколько места освободилось
+}
+
+// String - Для логов и консоли
+func (r *GCReport) String() string {
+	return fmt.Sprintf("%d files, %d blobs, %d upload sessions, %s", r.Files, r.Blobs, r.Sessions, formatBytes(r.Bytes))
+}
+
+// gcOptions - Настройки из GC_GRACE (секунды, по умолчанию сутки)
+func gcOptions() GCOptions {
+	return GCOptions{Grace: time.Duration(envInt("GC_GRACE", 86400)) * time.Second}
+}
+
+// gcStores - Хранилище файлов и, если есть, закрытое хранилище оригиналов
+func gcStores() []uploader.BlobStore {
+	stores := []uploader.BlobStore{blobStore()}
+	if originals := originalsStore(); originals != nil {
+		stores = append(stores, originals)
+	}
+	return stores
+}
+
+// collectGarbage - Удаляет файлы, которые так и не прикрепили ни к одному посту,
+// и объекты в хранилищах, для которых нет строки в files
+// (например, от откатившихся транзакций). Трогает только то, что старше Grace.
+// Заодно убирает просроченные загрузки по частям, у них свой срок.
+func collectGarbage(storage Storage, stores []uploader.BlobStore, opts GCOptions) (*GCReport, error) {
+	report := &GCReport{}
+	before := time.Now().Add(-opts.Grace)
+
+	// Размеры объектов, если хранилище умеет их перечислить
+	sizes := make([]map[string]int64, len(stores))
+	listed := make([]bool, len(stores))
+	for i, store := range stores {
+		sizes[i] = map[string]int64{}
+		if lister, ok := store.(uploader.BlobLister); ok {
+			listed[i] = true
+			err := lister.List(func(blob uploader.BlobInfo) error {
+				if blob.ModTime.Before(before) {
+					sizes[i][blob.Key] = blob.Size
+				}
+				return nil
+			})
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+
+	files, err := storage.GetOrphanFiles(before.Unix())
+	if err != nil {
+		return report, err
+	}
+
+	for _, file := range files {
+		if !opts.DryRun {
+			// Сначала строка: если файл успели прикрепить, он останется
+			deleted, err := storage.DeleteOrphanFile(file.ID)
+			if err != nil {
+				return report, err
+			}
+			if !deleted {
+				continue
+			}
+		}
+
+		report.Files++
+		for i, store := range stores {
+			// Без листинга знаем только размер оригинала
+			if !listed[i] {
+				report.Bytes += file.Size
+			}
+			for _, key := range []string{file.Key(), file.ThumbKey()} {
+				report.Bytes += sizes[i][key]
+				delete(sizes[i], key)
+
+				if opts.DryRun {
+					continue
+				}
+				if err := store.Delete(key); err != nil {
+					// Объект без строки подберем в следующий раз
+					log.Printf("gc: %s: %s", key, err)
+				}
+			}
+		}
+	}
+
+	sessions, err := storage.GetExpiredUploadSessions(time.Now().Unix())
+	if err != nil {
+		return report, err
+	}
+	for _, session := range sessions {
+		if !opts.DryRun {
+			if err := removeUploadSession(storage, session); err != nil {
+				return report, err
+			}
+		}
+		report.Sessions++
+		report.Bytes += session.Offset
+	}
+
+	// Остались объекты, про которые база ничего не знает
+	for i, store := range stores {
+		for key, size := range sizes[i] {
+			// Чужие файлы в каталоге не трогаем
+			id := blobUUID(key)
+			if _, err := uuid.Parse(id); err != nil {
+				continue
+			}
+			if _, err := storage.GetFileByUUID(id); err != sql.ErrNoRows {
+				if err != nil {
+					return report, err
+				}
+				continue
+			}
+
+			if !opts.DryRun {
+				if err := store.Delete(key); err != nil {
+					return report, err
+				}
+			}
+			report.Blobs++
+			report.Bytes += size
+		}
+	}
+
+	return report, nil
+}
+
+// runGarbageCollector - Фоновый сборщик раз в GC_INTERVAL секунд, 0 - выключен
+func runGarbageCollector(storage Storage) {
+	interval := envInt("GC_INTERVAL", 0)
+	if interval == 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(time.Duration(interval) * time.Second) {
+			report, err := collectGarbage(storage, gcStores(), gcOptions())
+			if err != nil {
+				log.Printf("gc: %s", err)
+			}
+			if report.Files > 0 || report.Blobs > 0 || report.Sessions > 0 {
+				log.Printf("gc: deleted %s", report)
+			}
+		}
+	}()
+}
+
+// blobUUID - UUID из ключа {uuid}.{ext} или {uuid}-thumb.{ext}
+func blobUUID(key string) string {
+	base := strings.TrimSuffix(key, path.Ext(key))
+	return strings.TrimSuffix(base, "-thumb")
+}
+
+// formatBytes - 1536 -> 1.5 KB
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
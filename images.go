@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/yuriygr/go-board/uploader"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+)
+
+// imagesResource - Раздача файлов из хранилища самим API.
+// Для маленьких инсталляций без отдельного веб-сервера, включается SERVE_IMAGES.
+type imagesResource struct {
+	storage Storage
+}
+
+func (rs imagesResource) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Get("/{name}", rs.ImageGet)
+	r.Head("/{name}", rs.ImageGet)
+
+	return r
+}
+
+//--
+// Handler methods
+//--
+
+// ImageGet - Отдает оригинал или миниатюру: {uuid}.{ext} и {uuid}-thumb.{ext}.
+// Range и If-None-Match обрабатывает http.ServeContent
+func (rs *imagesResource) ImageGet(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	id := blobUUID(name)
+	if _, err := uuid.Parse(id); err != nil {
+		render.Render(w, r, ErrNotFound(errors.New("File not found")))
+		return
+	}
+
+	file, err := rs.storage.GetFileByUUID(id)
+	if err != nil || (name != file.Key() && name != file.ThumbKey()) {
+		render.Render(w, r, ErrNotFound(errors.New("File not found")))
+		return
+	}
+
+	thumb, etag := name == file.ThumbKey(), `"`+file.Md5+`"`
+	if thumb {
+		etag = `"` + file.Md5 + `-thumb"`
+	}
+
+	// Файлы не меняются, кеш можно не перепроверять
+	cache := func() {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+
+	if r.Header.Get("If-None-Match") == etag {
+		cache()
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Файл не читается целиком: ServeContent читает только запрошенный Range
+	var content io.ReadSeeker
+	blob, err := blobStore().Open(name)
+	if err == nil {
+		defer blob.Close()
+		content = blob
+	}
+	if thumb && err == uploader.ErrBlobNotFound {
+		var thumbnail []byte
+		thumbnail, err = writeThumbnail(blobStore(), file)
+		content = bytes.NewReader(thumbnail)
+	}
+	if err == uploader.ErrBlobNotFound {
+		render.Render(w, r, ErrNotFound(errors.New("File not found")))
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		render.Render(w, r, ErrBadGateway(errors.New("File storage error")))
+		return
+	}
+
+	cache()
+	w.Header().Set("Content-Type", contentType(name))
+	http.ServeContent(w, r, name, time.Unix(file.CreatedAt, 0), content)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// requestIP - IP клиента: адрес соединения. X-Forwarded-For читается, только
+// если соединились доверенные прокси из TRUSTED_PROXIES, и справа налево:
+// клиент - первый адрес, который добавил не доверенный прокси
+func requestIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	proxies := trustedProxies()
+	if !isTrustedProxy(proxies, ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop.String()
+		if !isTrustedProxy(proxies, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// trustedProxies - Адреса и подсети из TRUSTED_PROXIES через запятую,
+// неверные пропускаются
+func trustedProxies() []*net.IPNet {
+	proxies := []*net.IPNet{}
+	for _, value := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		if _, network, err := net.ParseCIDR(value); err == nil {
+			proxies = append(proxies, network)
+		}
+	}
+	return proxies
+}
+
+// isTrustedProxy - Адрес из списка доверенных прокси
+func isTrustedProxy(proxies []*net.IPNet, ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range proxies {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// requesterKey - Кто прислал запрос: анонимов различаем по IP, остальных по ID
+func requesterKey(userID int64, ip string) string {
+	if userID == 1 {
+		return "ip:" + ip
+	}
+	return "user:" + strconv.FormatInt(userID, 10)
+}
+
+// normalizeBanIP - Адрес или подсеть в каноничной записи: 10.0.0.1/8 -> 10.0.0.0/8
+func normalizeBanIP(value string) (string, error) {
+	if _, network, err := net.ParseCIDR(value); err == nil {
+		return network.String(), nil
+	}
+	if ip := net.ParseIP(value); ip != nil {
+		return ip.String(), nil
+	}
+	return "", errors.New("Invalid IP")
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/yuriygr/go-board/uploader"
+
+	"github.com/go-chi/render"
+)
+
+// Ошибки лимитов загрузки
+var (
+	ErrFileTooLarge    = errors.New("File is too large")
+	ErrRequestTooLarge = errors.New("Request is too large")
+	ErrBoardFull       = errors.New("Board files limit exceeded")
+	ErrImageTooBig     = errors.New("Image dimensions are too big")
+	ErrTooManyFiles    = errors.New("Too many attachments")
+	ErrFileFormat      = errors.New("File format is not valid")
+	ErrAVIF            = errors.New("AVIF images are not supported")
+	ErrFileBanned      = errors.New("File is banned")
+	ErrFileFlagged     = errors.New("File is awaiting moderator review")
+	ErrVideoTooLong    = errors.New("Video is too long")
+)
+
+// UploadLimits - Лимиты на загрузку файлов. 0 значит без лимита.
+type UploadLimits struct {
+	MaxFileBytes  int64 // Размер одного файла
+	MaxWidth      int   // Размеры изображения в пикселях
+	MaxHeight     int
+	MaxPixels     int   // Ширина на высоту: столько пикселей придется раскодировать в память
+	MaxPerPost    int   // Вложений в одном топике или комментарии
+	MaxPerTopic   int   // Вложений в треде вместе с комментариями
+	MaxBoardBytes int64 // Всего байт на доске, если у доски нет своего лимита
+	MaxDuration   int   // Длина видео в секундах
+}
+
+// uploadLimits - Лимиты из окружения
+func uploadLimits() UploadLimits {
+	return UploadLimits{
+		MaxFileBytes:  int64(envInt("UPLOAD_MAX_FILE_BYTES", 10<<20)),
+		MaxWidth:      envInt("UPLOAD_MAX_WIDTH", 6000),
+		MaxHeight:     envInt("UPLOAD_MAX_HEIGHT", 6000),
+		MaxPixels:     envInt("UPLOAD_MAX_PIXELS", 20000000),
+		MaxPerPost:    envInt("UPLOAD_MAX_PER_POST", 4),
+		MaxPerTopic:   envInt("UPLOAD_MAX_PER_TOPIC", 500),
+		MaxBoardBytes: int64(envInt("UPLOAD_MAX_BOARD_BYTES", 0)),
+		MaxDuration:   envInt("UPLOAD_MAX_DURATION", 300),
+	}
+}
+
+// envInt - Положительное число из окружения или значение по умолчанию
+func envInt(key string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// MaxRequestBytes - Сколько может весить запрос со всеми вложениями
+func (l UploadLimits) MaxRequestBytes() int64 {
+	if l.MaxFileBytes == 0 {
+		return 0
+	}
+	return l.MaxFileBytes*int64(maxInt(l.MaxPerPost, 1)) + 1<<20
+}
+
+// BoardBytes - Лимит доски: свой или общий
+func (l UploadLimits) BoardBytes(board *Board) int64 {
+	if board.MaxFilesBytes > 0 {
+		return board.MaxFilesBytes
+	}
+	return l.MaxBoardBytes
+}
+
+// CheckFile - Проверка одного файла до записи на диск
+func (l UploadLimits) CheckFile(size int64, width, height int) error {
+	if l.MaxFileBytes > 0 && size > l.MaxFileBytes {
+		return ErrFileTooLarge
+	}
+	if (l.MaxWidth > 0 && width > l.MaxWidth) || (l.MaxHeight > 0 && height > l.MaxHeight) {
+		return ErrImageTooBig
+	}
+	// Несколько килобайт PNG могут раскодироваться в сотни мегабайт
+	if l.MaxPixels > 0 && int64(width)*int64(height) > int64(l.MaxPixels) {
+		return ErrImageTooBig
+	}
+	return nil
+}
+
+// CheckDuration - Длина видео
+func (l UploadLimits) CheckDuration(seconds float64) error {
+	if l.MaxDuration > 0 && seconds > float64(l.MaxDuration) {
+		return ErrVideoTooLong
+	}
+	return nil
+}
+
+// CheckPost - Сколько вложений можно в одном посте
+func (l UploadLimits) CheckPost(attachments *PostAttachments) error {
+	if l.MaxPerPost > 0 && attachments.Len() > l.MaxPerPost {
+		return ErrTooManyFiles
+	}
+	return nil
+}
+
+// CheckBoard - Лимиты треда и доски для уже сохраненных вложений поста.
+// topicID 0 - это новый топик.
+func (l UploadLimits) CheckBoard(tx Storage, board *Board, topicID int64, files []*File) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	if l.MaxPerTopic > 0 && topicID > 0 {
+		count, err := tx.CountTopicFiles(topicID)
+		if err != nil {
+			return err
+		}
+		if count+int64(len(files)) > int64(l.MaxPerTopic) {
+			return ErrTooManyFiles
+		}
+	}
+
+	if limit := l.BoardBytes(board); limit > 0 {
+		used, err := tx.GetBoardFilesSize(board.ID)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			used += file.Size
+		}
+		if used > limit {
+			return ErrBoardFull
+		}
+	}
+
+	return nil
+}
+
+// PhashPolicy - Что делать с картинкой, похожей на забаненную
+type PhashPolicy struct {
+	Distance int  // Максимальное расстояние Хэмминга, -1 - не проверять
+	Flag     bool // Пропустить, но пометить для модератора, вместо отказа
+}
+
+// phashPolicy - Политика из PHASH_DISTANCE и PHASH_ACTION (reject или flag)
+func phashPolicy() PhashPolicy {
+	policy := PhashPolicy{Distance: 6}
+
+	if value, err := strconv.Atoi(os.Getenv("PHASH_DISTANCE")); err == nil {
+		policy.Distance = value
+	}
+	policy.Flag = os.Getenv("PHASH_ACTION") == "flag"
+
+	return policy
+}
+
+// Check - Сверяет хеш с банами. Вернет ErrFileBanned или
+// true, если файл надо пометить для проверки.
+func (p PhashPolicy) Check(tx Storage, phash uint64) (bool, error) {
+	if p.Distance < 0 {
+		return false, nil
+	}
+
+	bans, err := tx.GetFileBansWithPhash()
+	if err != nil {
+		return false, err
+	}
+
+	for _, ban := range bans {
+		banned, err := uploader.ParseHash(ban.Phash)
+		if err != nil {
+			continue
+		}
+		if uploader.HammingDistance(phash, banned) > p.Distance {
+			continue
+		}
+		if p.Flag {
+			return true, nil
+		}
+		return false, ErrFileBanned
+	}
+
+	return false, nil
+}
+
+// ErrUpload - Ошибки лимитов отдают 413 и 422, бан 403,
+// ошибки загрузки по частям 404 и 409, остальное 400
+func ErrUpload(err error) render.Renderer {
+	switch err {
+	case ErrFileTooLarge, ErrRequestTooLarge, ErrBoardFull:
+		return ErrTooLarge(err)
+	case ErrImageTooBig, ErrTooManyFiles, ErrFileFormat, ErrAVIF, ErrVideoTooLong, ErrChecksumMismatch:
+		return ErrUnprocessable(err)
+	case ErrFileBanned, ErrFileFlagged:
+		return ErrForbidden(err)
+	case ErrUploadSessionNotFound:
+		return ErrNotFound(err)
+	case ErrUploadOffset, ErrUploadIncomplete:
+		return ErrConflict(err)
+	}
+	return ErrBadRequest(err)
+}
+
+// LimitBody - Обрезает тело запроса по лимиту вложений.
+// Явно слишком большой запрос отбивается сразу с 413.
+func LimitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limit := uploadLimits().MaxRequestBytes(); limit > 0 {
+			if r.ContentLength > limit {
+				render.Render(w, r, ErrTooLarge(ErrRequestTooLarge))
+				return
+			}
+			body := &limitedBody{ReadCloser: r.Body, left: limit}
+			r.Body = body
+
+			// Разбираем форму здесь, чтобы отличить обрезанное тело от пустой формы.
+			// multipart может обернуть ошибку чтения, поэтому смотрим на само тело
+			err := r.ParseMultipartForm(32 << 20)
+			if err != nil && body.exceeded {
+				render.Render(w, r, ErrTooLarge(ErrRequestTooLarge))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitedBody - Тело запроса не длиннее left байт. Лишний байт
+// не отдается, вместо него ErrRequestTooLarge
+type limitedBody struct {
+	io.ReadCloser
+	left     int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, ErrRequestTooLarge
+	}
+	// На байт больше остатка, чтобы заметить превышение
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.left {
+		n, b.left, b.exceeded = int(b.left), 0, true
+		return n, ErrRequestTooLarge
+	}
+	b.left -= int64(n)
+	return n, err
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"encoding/gob"
+	"log"
 	"net/http"
 	"os"
 
@@ -17,17 +17,31 @@ import (
 const APIVersion1 = "v1"
 
 func main() {
-	gob.Register(User{})
+	if ok, err := runCommand(os.Args[1:]); ok {
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
 
 	session := NewSession()
 	storage := NewStorage()
+	limiter := NewRateLimiter()
+
+	runGarbageCollector(storage)
+
+	http.ListenAndServe(":3000", NewRouter(storage, session, limiter))
+}
+
+// NewRouter - Собирает все ресурсы API в один роутер
+func NewRouter(storage Storage, session *Session, limiter *RateLimiter) chi.Router {
 	r := chi.NewRouter()
 
 	cors := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Set-Cookie"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedMethods:   []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Set-Cookie", "Upload-Offset"},
+		ExposedHeaders:   []string{"Link", "Upload-Offset"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	})
@@ -52,33 +66,43 @@ func main() {
 		render.Render(w, r, ErrMethodNotAllowed())
 	})
 
+	// Обычно файлы отдает внешний веб-сервер по STORAGE_HOST/images
+	if os.Getenv("SERVE_IMAGES") == "true" {
+		r.Mount("/images", imagesResource{storage}.Routes())
+	}
+
 	r.Route("/v1", func(r chi.Router) {
-		r.Use(AuthCtx(session))
+		r.Use(AuthCtx(session, storage))
+		r.Use(RateLimiterCtx(limiter))
 		r.Use(APIVersionCtx(APIVersion1))
 		r.Mount("/boards", boardsResource{storage, session}.Routes())
 		r.Mount("/topics", topicsResource{storage, session}.Routes())
+		r.Mount("/comments", commentsResource{storage, session}.Routes())
+		r.Mount("/tags", tagsResource{storage, session}.Routes())
 		r.Mount("/pages", pagesResource{storage, session}.Routes())
 		r.Mount("/bugs", bugsResource{storage, session}.Routes())
 		r.Mount("/users", usersResource{storage, session}.Routes())
 		r.Mount("/uploader", uploadResource{storage, session}.Routes())
+		r.Mount("/files", filesResource{storage, session}.Routes())
+		r.Mount("/mod", modResource{storage, session}.Routes())
+		r.Mount("/bans", bansResource{storage, session}.Routes())
 	})
 
-	http.ListenAndServe(":3000", r)
+	return r
 }
 
 // AuthCtxKey - Key for context
 type AuthCtxKey struct{}
 
-// AuthCtx - Контекст с авторизацией
+// AuthCtx - Контекст с авторизацией и ролями
 // Очень помогает жить и вообще
-func AuthCtx(session *Session) func(next http.Handler) http.Handler {
+func AuthCtx(session *Session, storage Storage) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			sessionNew, _ := session.Auth(r)
 
 			if _, ok := sessionNew.Values["auth"].(bool); ok {
-				sessionResponse := &SessionResponse{}
-				sessionResponse.Bind(sessionNew)
+				sessionResponse := newSessionResponse(storage, sessionNew)
 
 				ctx := context.WithValue(r.Context(), AuthCtxKey{}, sessionResponse)
 				next.ServeHTTP(w, r.WithContext(ctx))
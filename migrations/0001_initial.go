@@ -0,0 +1,129 @@
+package migrations
+
+func init() {
+	register(&Migration{
+		Version: 1,
+		Name:    "initial",
+		Up: []string{
+			`CREATE TABLE boards (
+				id int unsigned NOT NULL AUTO_INCREMENT,
+				title varchar(255) NOT NULL,
+				slug varchar(32) NOT NULL,
+				type varchar(32) NOT NULL DEFAULT 'normal',
+				available tinyint(1) NOT NULL DEFAULT 1,
+				nsfw tinyint(1) NOT NULL DEFAULT 0,
+				PRIMARY KEY (id),
+				UNIQUE KEY boards_slug (slug)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE pages (
+				id int unsigned NOT NULL AUTO_INCREMENT,
+				slug varchar(64) NOT NULL,
+				title varchar(255) NOT NULL,
+				content text NOT NULL,
+				created_at bigint NOT NULL DEFAULT 0,
+				modified_in bigint NOT NULL DEFAULT 0,
+				is_comments tinyint(1) NOT NULL DEFAULT 0,
+				is_hidden tinyint(1) NOT NULL DEFAULT 0,
+				meta_description varchar(255) NOT NULL DEFAULT '',
+				meta_keywords varchar(255) NOT NULL DEFAULT '',
+				PRIMARY KEY (id),
+				UNIQUE KEY pages_slug (slug)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE users (
+				id int unsigned NOT NULL AUTO_INCREMENT,
+				username varchar(64) NOT NULL,
+				password varchar(255) NOT NULL,
+				created_at bigint NOT NULL DEFAULT 0,
+				is_banned tinyint(1) NOT NULL DEFAULT 0,
+				is_deleted tinyint(1) NOT NULL DEFAULT 0,
+				PRIMARY KEY (id),
+				UNIQUE KEY users_username (username)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE users_profile (
+				user_id int unsigned NOT NULL,
+				screen_name varchar(64) NOT NULL DEFAULT '',
+				sex varchar(16) NOT NULL DEFAULT '',
+				PRIMARY KEY (user_id),
+				CONSTRAINT users_profile_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE users_stats (
+				id int unsigned NOT NULL AUTO_INCREMENT,
+				user_id int unsigned NOT NULL,
+				created_topics int unsigned NOT NULL DEFAULT 0,
+				created_comments int unsigned NOT NULL DEFAULT 0,
+				uploaded_files int unsigned NOT NULL DEFAULT 0,
+				PRIMARY KEY (id),
+				UNIQUE KEY users_stats_user (user_id),
+				CONSTRAINT users_stats_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE topics (
+				id int unsigned NOT NULL AUTO_INCREMENT,
+				type varchar(32) NOT NULL DEFAULT 'normal',
+				board_id int unsigned NOT NULL,
+				user_id int unsigned NOT NULL,
+				subject varchar(255) NOT NULL,
+				message text NOT NULL,
+				created_at bigint NOT NULL DEFAULT 0,
+				bumped_at bigint NOT NULL DEFAULT 0,
+				user_ip varchar(64) NOT NULL DEFAULT '',
+				user_agent varchar(255) NOT NULL DEFAULT '',
+				is_closed tinyint(1) NOT NULL DEFAULT 0,
+				is_pinned tinyint(1) NOT NULL DEFAULT 0,
+				is_deleted tinyint(1) NOT NULL DEFAULT 0,
+				allow_attach tinyint(1) NOT NULL DEFAULT 1,
+				only_anonymously tinyint(1) NOT NULL DEFAULT 0,
+				PRIMARY KEY (id),
+				KEY topics_board_bump (board_id, is_pinned, bumped_at),
+				CONSTRAINT topics_board FOREIGN KEY (board_id) REFERENCES boards (id),
+				CONSTRAINT topics_user FOREIGN KEY (user_id) REFERENCES users (id)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE comments (
+				id int unsigned NOT NULL AUTO_INCREMENT,
+				topic_id int unsigned NOT NULL,
+				user_id int unsigned NOT NULL,
+				message text NOT NULL,
+				created_at bigint NOT NULL DEFAULT 0,
+				user_ip varchar(64) NOT NULL DEFAULT '',
+				user_agent varchar(255) NOT NULL DEFAULT '',
+				is_pinned tinyint(1) NOT NULL DEFAULT 0,
+				is_deleted tinyint(1) NOT NULL DEFAULT 0,
+				PRIMARY KEY (id),
+				KEY comments_topic (topic_id, created_at),
+				CONSTRAINT comments_topic FOREIGN KEY (topic_id) REFERENCES topics (id) ON DELETE CASCADE,
+				CONSTRAINT comments_user FOREIGN KEY (user_id) REFERENCES users (id)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE files (
+				id int unsigned NOT NULL AUTO_INCREMENT,
+				uuid char(36) NOT NULL,
+				md5 char(32) NOT NULL,
+				name varchar(255) NOT NULL DEFAULT '',
+				type varchar(16) NOT NULL,
+				size bigint NOT NULL DEFAULT 0,
+				width int unsigned NOT NULL DEFAULT 0,
+				height int unsigned NOT NULL DEFAULT 0,
+				created_at bigint NOT NULL DEFAULT 0,
+				PRIMARY KEY (id),
+				UNIQUE KEY files_uuid (uuid),
+				KEY files_md5 (md5)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE topics_files (
+				topic_id int unsigned NOT NULL,
+				file_id int unsigned NOT NULL,
+				PRIMARY KEY (topic_id, file_id),
+				CONSTRAINT topics_files_topic FOREIGN KEY (topic_id) REFERENCES topics (id) ON DELETE CASCADE,
+				CONSTRAINT topics_files_file FOREIGN KEY (file_id) REFERENCES files (id) ON DELETE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+		Down: []string{
+			"DROP TABLE topics_files",
+			"DROP TABLE files",
+			"DROP TABLE comments",
+			"DROP TABLE topics",
+			"DROP TABLE users_stats",
+			"DROP TABLE users_profile",
+			"DROP TABLE users",
+			"DROP TABLE pages",
+			"DROP TABLE boards",
+		},
+	})
+}
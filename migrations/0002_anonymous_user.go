@@ -0,0 +1,19 @@
+package migrations
+
+// Топики и комментарии без сессии пишутся от пользователя с ID 1
+func init() {
+	register(&Migration{
+		Version: 2,
+		Name:    "anonymous_user",
+		Up: []string{
+			"INSERT INTO users (id, username, password, created_at) VALUES (1, 'anonymous', '', 0)",
+			"INSERT INTO users_profile (user_id, screen_name) VALUES (1, 'Anonymous')",
+			"INSERT INTO users_stats (user_id) VALUES (1)",
+		},
+		Down: []string{
+			"DELETE FROM users_stats WHERE user_id = 1",
+			"DELETE FROM users_profile WHERE user_id = 1",
+			"DELETE FROM users WHERE id = 1",
+		},
+	})
+}
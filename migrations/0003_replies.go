@@ -0,0 +1,27 @@
+package migrations
+
+// Ссылки >>N между постами. comment_id = 0 означает сам топик.
+func init() {
+	register(&Migration{
+		Version: 3,
+		Name:    "replies",
+		Up: []string{
+			`CREATE TABLE replies (
+				id int unsigned NOT NULL AUTO_INCREMENT,
+				from_topic_id int unsigned NOT NULL,
+				from_comment_id int unsigned NOT NULL DEFAULT 0,
+				to_topic_id int unsigned NOT NULL,
+				to_comment_id int unsigned NOT NULL DEFAULT 0,
+				created_at bigint NOT NULL DEFAULT 0,
+				PRIMARY KEY (id),
+				UNIQUE KEY replies_link (from_topic_id, from_comment_id, to_topic_id, to_comment_id),
+				KEY replies_to (to_topic_id, to_comment_id),
+				CONSTRAINT replies_from_topic FOREIGN KEY (from_topic_id) REFERENCES topics (id) ON DELETE CASCADE,
+				CONSTRAINT replies_to_topic FOREIGN KEY (to_topic_id) REFERENCES topics (id) ON DELETE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+		Down: []string{
+			"DROP TABLE replies",
+		},
+	})
+}
@@ -0,0 +1,31 @@
+package migrations
+
+// Индекс хештегов из топиков и комментариев
+func init() {
+	register(&Migration{
+		Version: 4,
+		Name:    "tags",
+		Up: []string{
+			`CREATE TABLE tags (
+				id int unsigned NOT NULL AUTO_INCREMENT,
+				name varchar(64) NOT NULL,
+				PRIMARY KEY (id),
+				UNIQUE KEY tags_name (name)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin`,
+			`CREATE TABLE tags_posts (
+				tag_id int unsigned NOT NULL,
+				topic_id int unsigned NOT NULL,
+				comment_id int unsigned NOT NULL DEFAULT 0,
+				created_at bigint NOT NULL DEFAULT 0,
+				PRIMARY KEY (tag_id, topic_id, comment_id),
+				KEY tags_posts_created (created_at),
+				CONSTRAINT tags_posts_tag FOREIGN KEY (tag_id) REFERENCES tags (id) ON DELETE CASCADE,
+				CONSTRAINT tags_posts_topic FOREIGN KEY (topic_id) REFERENCES topics (id) ON DELETE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+		Down: []string{
+			"DROP TABLE tags_posts",
+			"DROP TABLE tags",
+		},
+	})
+}
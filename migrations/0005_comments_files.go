@@ -0,0 +1,23 @@
+package migrations
+
+// Вложения комментариев и автор загрузки
+func init() {
+	register(&Migration{
+		Version: 5,
+		Name:    "comments_files",
+		Up: []string{
+			"ALTER TABLE files ADD COLUMN user_id int unsigned NOT NULL DEFAULT 1 AFTER uuid",
+			`CREATE TABLE comments_files (
+				comment_id int unsigned NOT NULL,
+				file_id int unsigned NOT NULL,
+				PRIMARY KEY (comment_id, file_id),
+				CONSTRAINT comments_files_comment FOREIGN KEY (comment_id) REFERENCES comments (id) ON DELETE CASCADE,
+				CONSTRAINT comments_files_file FOREIGN KEY (file_id) REFERENCES files (id) ON DELETE CASCADE
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+		Down: []string{
+			"DROP TABLE comments_files",
+			"ALTER TABLE files DROP COLUMN user_id",
+		},
+	})
+}
@@ -0,0 +1,15 @@
+package migrations
+
+// Свой лимит на общий размер файлов доски. 0 - общий из окружения.
+func init() {
+	register(&Migration{
+		Version: 6,
+		Name:    "boards_files_limit",
+		Up: []string{
+			"ALTER TABLE boards ADD COLUMN max_files_bytes bigint NOT NULL DEFAULT 0",
+		},
+		Down: []string{
+			"ALTER TABLE boards DROP COLUMN max_files_bytes",
+		},
+	})
+}
@@ -0,0 +1,20 @@
+package migrations
+
+// Запрещенные к загрузке файлы по md5
+func init() {
+	register(&Migration{
+		Version: 7,
+		Name:    "files_bans",
+		Up: []string{
+			`CREATE TABLE files_bans (
+				md5 char(32) NOT NULL,
+				reason varchar(255) NOT NULL DEFAULT '',
+				created_at bigint NOT NULL DEFAULT 0,
+				PRIMARY KEY (md5)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+		Down: []string{
+			"DROP TABLE files_bans",
+		},
+	})
+}
@@ -0,0 +1,17 @@
+package migrations
+
+// Перцептивный хеш файлов и банов, флаг для ручной проверки
+func init() {
+	register(&Migration{
+		Version: 8,
+		Name:    "files_phash",
+		Up: []string{
+			"ALTER TABLE files ADD COLUMN phash char(16) NOT NULL DEFAULT '' AFTER md5, ADD COLUMN is_flagged tinyint(1) NOT NULL DEFAULT 0, ADD KEY files_flagged (is_flagged)",
+			"ALTER TABLE files_bans ADD COLUMN phash char(16) NOT NULL DEFAULT '' AFTER md5",
+		},
+		Down: []string{
+			"ALTER TABLE files_bans DROP COLUMN phash",
+			"ALTER TABLE files DROP KEY files_flagged, DROP COLUMN is_flagged, DROP COLUMN phash",
+		},
+	})
+}
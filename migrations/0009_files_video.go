@@ -0,0 +1,15 @@
+package migrations
+
+// Видео: вид файла и длительность в секундах
+func init() {
+	register(&Migration{
+		Version: 9,
+		Name:    "files_video",
+		Up: []string{
+			"ALTER TABLE files ADD COLUMN kind varchar(16) NOT NULL DEFAULT 'image' AFTER type, ADD COLUMN duration double NOT NULL DEFAULT 0 AFTER height",
+		},
+		Down: []string{
+			"ALTER TABLE files DROP COLUMN duration, DROP COLUMN kind",
+		},
+	})
+}
@@ -0,0 +1,16 @@
+package migrations
+
+// Формат миниатюры может отличаться от оригинала: WebP и перекодированные PNG
+func init() {
+	register(&Migration{
+		Version: 10,
+		Name:    "files_thumb_type",
+		Up: []string{
+			"ALTER TABLE files ADD COLUMN thumb_type varchar(16) NOT NULL DEFAULT '' AFTER kind",
+			"UPDATE files SET thumb_type = IF(kind = 'video', 'jpeg', type)",
+		},
+		Down: []string{
+			"ALTER TABLE files DROP COLUMN thumb_type",
+		},
+	})
+}
@@ -0,0 +1,26 @@
+package migrations
+
+// Загрузки по частям: сколько байт уже пришло и до какого времени ждем остальное
+func init() {
+	register(&Migration{
+		Version: 11,
+		Name:    "upload_sessions",
+		Up: []string{
+			`CREATE TABLE upload_sessions (
+				id char(36) NOT NULL,
+				user_id int unsigned NOT NULL,
+				name varchar(255) NOT NULL DEFAULT '',
+				size bigint NOT NULL,
+				received bigint NOT NULL DEFAULT 0,
+				checksum varchar(80) NOT NULL,
+				created_at bigint NOT NULL DEFAULT 0,
+				expires_at bigint NOT NULL DEFAULT 0,
+				PRIMARY KEY (id),
+				KEY upload_sessions_expires (expires_at)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+		Down: []string{
+			"DROP TABLE upload_sessions",
+		},
+	})
+}
@@ -0,0 +1,23 @@
+package migrations
+
+// Роли пользователей. board_id 0 - роль на всех досках.
+// Обычный пользователь (user) здесь не хранится
+func init() {
+	register(&Migration{
+		Version: 12,
+		Name:    "users_roles",
+		Up: []string{
+			`CREATE TABLE users_roles (
+				user_id int unsigned NOT NULL,
+				role varchar(16) NOT NULL,
+				board_id int unsigned NOT NULL DEFAULT 0,
+				created_at bigint NOT NULL DEFAULT 0,
+				PRIMARY KEY (user_id, role, board_id),
+				KEY users_roles_board (board_id)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+		Down: []string{
+			"DROP TABLE users_roles",
+		},
+	})
+}
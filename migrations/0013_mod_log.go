@@ -0,0 +1,31 @@
+package migrations
+
+// Журнал действий модераторов. Только дописывается: строки не меняются и не удаляются
+func init() {
+	register(&Migration{
+		Version: 13,
+		Name:    "mod_log",
+		Up: []string{
+			`CREATE TABLE mod_log (
+				id int unsigned NOT NULL AUTO_INCREMENT,
+				moderator_id int unsigned NOT NULL,
+				board_id int unsigned NOT NULL DEFAULT 0,
+				target_type varchar(16) NOT NULL,
+				target_id int unsigned NOT NULL,
+				action varchar(32) NOT NULL,
+				reason varchar(255) NOT NULL DEFAULT '',
+				state_before text NULL,
+				state_after text NULL,
+				ip varchar(45) NOT NULL DEFAULT '',
+				created_at bigint NOT NULL DEFAULT 0,
+				PRIMARY KEY (id),
+				KEY mod_log_moderator (moderator_id, id),
+				KEY mod_log_board (board_id, id),
+				KEY mod_log_created (created_at)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+		Down: []string{
+			"DROP TABLE mod_log",
+		},
+	})
+}
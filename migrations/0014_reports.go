@@ -0,0 +1,34 @@
+package migrations
+
+// Жалобы на топики и комментарии. От одного жалобщика на один пост - одна строка:
+// анонимов различаем по IP, остальных по ID
+func init() {
+	register(&Migration{
+		Version: 14,
+		Name:    "reports",
+		Up: []string{
+			`CREATE TABLE reports (
+				id int unsigned NOT NULL AUTO_INCREMENT,
+				target_type varchar(16) NOT NULL,
+				target_id int unsigned NOT NULL,
+				topic_id int unsigned NOT NULL,
+				board_id int unsigned NOT NULL,
+				reporter_id int unsigned NOT NULL,
+				reporter_ip varchar(45) NOT NULL DEFAULT '',
+				reporter_key varchar(64) NOT NULL,
+				category varchar(16) NOT NULL,
+				text varchar(1000) NOT NULL DEFAULT '',
+				status varchar(16) NOT NULL DEFAULT 'open',
+				created_at bigint NOT NULL DEFAULT 0,
+				resolved_by int unsigned NOT NULL DEFAULT 0,
+				resolved_at bigint NOT NULL DEFAULT 0,
+				PRIMARY KEY (id),
+				UNIQUE KEY reports_reporter (target_type, target_id, reporter_key),
+				KEY reports_status (status, board_id, id)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+		Down: []string{
+			"DROP TABLE reports",
+		},
+	})
+}
@@ -0,0 +1,44 @@
+package migrations
+
+// Баны по юзеру, IP или подсети и апелляции на них.
+// Снятый бан не удаляется: ему ставится expires_at в момент снятия
+func init() {
+	register(&Migration{
+		Version: 15,
+		Name:    "bans",
+		Up: []string{
+			`CREATE TABLE bans (
+				id int unsigned NOT NULL AUTO_INCREMENT,
+				user_id int unsigned NOT NULL DEFAULT 0,
+				ip varchar(49) NOT NULL DEFAULT '',
+				board_id int unsigned NOT NULL DEFAULT 0,
+				reason varchar(255) NOT NULL,
+				moderator_id int unsigned NOT NULL,
+				created_at bigint NOT NULL DEFAULT 0,
+				expires_at bigint NOT NULL DEFAULT 0,
+				PRIMARY KEY (id),
+				KEY bans_user (user_id, expires_at),
+				KEY bans_ip (ip, expires_at)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE bans_appeals (
+				id int unsigned NOT NULL AUTO_INCREMENT,
+				ban_id int unsigned NOT NULL,
+				user_id int unsigned NOT NULL,
+				ip varchar(45) NOT NULL DEFAULT '',
+				appellant_key varchar(64) NOT NULL,
+				text varchar(1000) NOT NULL,
+				status varchar(16) NOT NULL DEFAULT 'open',
+				created_at bigint NOT NULL DEFAULT 0,
+				answered_by int unsigned NOT NULL DEFAULT 0,
+				answered_at bigint NOT NULL DEFAULT 0,
+				PRIMARY KEY (id),
+				UNIQUE KEY bans_appeals_appellant (ban_id, appellant_key),
+				KEY bans_appeals_status (status, id)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+		Down: []string{
+			"DROP TABLE bans_appeals",
+			"DROP TABLE bans",
+		},
+	})
+}
@@ -0,0 +1,19 @@
+package migrations
+
+// Повторная жалоба схлопывается только с открытой: после решения модератора
+// тот же жалобщик может пожаловаться на пост снова. open_key пуст у закрытых
+// жалоб, а NULL в уникальном ключе не конфликтует
+func init() {
+	register(&Migration{
+		Version: 16,
+		Name:    "reports_open_key",
+		Up: []string{
+			"ALTER TABLE reports ADD COLUMN open_key varchar(64) GENERATED ALWAYS AS (IF(status = 'open', reporter_key, NULL)) VIRTUAL AFTER reporter_key",
+			"ALTER TABLE reports DROP INDEX reports_reporter, ADD UNIQUE KEY reports_reporter_open (target_type, target_id, open_key)",
+		},
+		Down: []string{
+			"ALTER TABLE reports DROP INDEX reports_reporter_open, ADD UNIQUE KEY reports_reporter (target_type, target_id, reporter_key)",
+			"ALTER TABLE reports DROP COLUMN open_key",
+		},
+	})
+}
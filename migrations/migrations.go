@@ -0,0 +1,204 @@
+package migrations
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	createSchemaMigrations = "CREATE TABLE IF NOT EXISTS schema_migrations (version int unsigned NOT NULL, name varchar(255) NOT NULL, applied_at bigint NOT NULL, PRIMARY KEY (version)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+	selectCurrentVersion   = "SELECT COALESCE(MAX(version), 0) FROM schema_migrations"
+	selectAppliedVersions  = "SELECT sm.version, sm.applied_at FROM schema_migrations as sm"
+	insertVersion          = "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"
+	deleteVersion          = "DELETE FROM schema_migrations WHERE version = ?"
+)
+
+// Migration - Одна версия схемы.
+// Up и Down это списки выражений, по одному на Exec,
+// чтобы не требовать multiStatements в DSN.
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// registry - Все миграции, зашитые в бинарник
+var registry = []*Migration{}
+
+// register - Вызывается из init() файлов с миграциями
+func register(m *Migration) {
+	registry = append(registry, m)
+	sort.Slice(registry, func(i, j int) bool {
+		return registry[i].Version < registry[j].Version
+	})
+}
+
+// All - Return all migrations ordered by version
+func All() []*Migration {
+	return registry
+}
+
+// Latest - Версия схемы, которую ожидает код
+func Latest() int {
+	if len(registry) == 0 {
+		return 0
+	}
+	return registry[len(registry)-1].Version
+}
+
+// Pending - Миграции новее current
+func Pending(current int) []*Migration {
+	pending := []*Migration{}
+	for _, m := range registry {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// Find - Return migration by version
+func Find(version int) *Migration {
+	for _, m := range registry {
+		if m.Version == version {
+			return m
+		}
+	}
+	return nil
+}
+
+// Migrator - Применяет миграции к базе
+type Migrator struct {
+	db *sqlx.DB
+}
+
+// NewMigrator - init new migrator
+func NewMigrator(db *sqlx.DB) *Migrator {
+	return &Migrator{db}
+}
+
+// ensure - Создает schema_migrations, если ее еще нет
+func (m *Migrator) ensure() error {
+	_, err := m.db.Exec(createSchemaMigrations)
+	return err
+}
+
+// Current - Return current schema version
+func (m *Migrator) Current() (int, error) {
+	if err := m.ensure(); err != nil {
+		return 0, err
+	}
+
+	var version int
+	if err := m.db.Get(&version, selectCurrentVersion); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// Check - Ошибка, если схема не совпадает с Latest()
+func (m *Migrator) Check() error {
+	current, err := m.Current()
+	if err != nil {
+		return err
+	}
+
+	if current != Latest() {
+		return fmt.Errorf("Schema version is %d, expected %d. Run `go-board migrate up`", current, Latest())
+	}
+
+	return nil
+}
+
+// Up - Применяет все недостающие миграции.
+// Возвращает список примененных.
+func (m *Migrator) Up() ([]*Migration, error) {
+	current, err := m.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []*Migration{}
+	for _, migration := range Pending(current) {
+		for _, statement := range migration.Up {
+			if _, err := m.db.Exec(statement); err != nil {
+				return applied, fmt.Errorf("Migration %d (%s): %s", migration.Version, migration.Name, err)
+			}
+		}
+
+		if _, err := m.db.Exec(insertVersion, migration.Version, migration.Name, time.Now().Unix()); err != nil {
+			return applied, err
+		}
+
+		applied = append(applied, migration)
+	}
+
+	return applied, nil
+}
+
+// Down - Откатывает последнюю примененную миграцию
+func (m *Migrator) Down() (*Migration, error) {
+	current, err := m.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	if current == 0 {
+		return nil, nil
+	}
+
+	migration := Find(current)
+	if migration == nil {
+		return nil, fmt.Errorf("Migration %d is unknown to this binary", current)
+	}
+
+	for _, statement := range migration.Down {
+		if _, err := m.db.Exec(statement); err != nil {
+			return nil, fmt.Errorf("Migration %d (%s): %s", migration.Version, migration.Name, err)
+		}
+	}
+
+	if _, err := m.db.Exec(deleteVersion, migration.Version); err != nil {
+		return nil, err
+	}
+
+	return migration, nil
+}
+
+// Status - Состояние одной миграции
+type Status struct {
+	Migration *Migration
+	AppliedAt int64 // 0 - не применена
+}
+
+// Status - Return status of every known migration
+func (m *Migrator) Status() ([]*Status, error) {
+	if err := m.ensure(); err != nil {
+		return nil, err
+	}
+
+	rows := []struct {
+		Version   int   `db:"sm.version"`
+		AppliedAt int64 `db:"sm.applied_at"`
+	}{}
+	if err := m.db.Select(&rows, selectAppliedVersions); err != nil {
+		return nil, err
+	}
+
+	applied := map[int]int64{}
+	for _, row := range rows {
+		applied[row.Version] = row.AppliedAt
+	}
+
+	statuses := []*Status{}
+	for _, migration := range registry {
+		statuses = append(statuses, &Status{migration, applied[migration.Version]})
+	}
+
+	return statuses, nil
+}
@@ -0,0 +1,45 @@
+package migrations
+
+import "testing"
+
+func TestRegistry(t *testing.T) {
+	seen := map[int]bool{}
+	for i, m := range All() {
+		if m.Version != i+1 {
+			t.Errorf("got version %d at position %d; want %d", m.Version, i, i+1)
+		}
+		if seen[m.Version] {
+			t.Errorf("duplicate version %d", m.Version)
+		}
+		seen[m.Version] = true
+
+		if m.Name == "" || len(m.Up) == 0 || len(m.Down) == 0 {
+			t.Errorf("migration %d must have name, up and down", m.Version)
+		}
+	}
+
+	if Latest() != len(All()) {
+		t.Errorf("got latest %d; want %d", Latest(), len(All()))
+	}
+}
+
+func TestPending(t *testing.T) {
+	testCases := []struct {
+		name    string
+		current int
+		want    int
+	}{
+		{"Empty database", 0, len(All())},
+		{"Up to date", Latest(), 0},
+		{"One behind", Latest() - 1, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Pending(tc.current)
+			if len(got) != tc.want {
+				t.Errorf("got %d; want %d", len(got), tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/render"
+)
+
+// canModerate - Может ли текущий юзер модерировать посты доски
+func canModerate(r *http.Request, boardID int64) bool {
+	auth, ok := r.Context().Value(AuthCtxKey{}).(*SessionResponse)
+	return ok && auth.Can(PermPostsModerate, boardID)
+}
+
+// hideDeletedComment - От удаленного комментария остается только место в треде
+func hideDeletedComment(comment *Comment) {
+	if comment.States.IsDeleted == 0 {
+		return
+	}
+	comment.Message = ""
+	comment.Attachments = []*File{}
+}
+
+//--
+// Topics
+//--
+
+// moderateTopic - Меняет состояния топика из контекста и отдает его заново
+func (rs *topicsResource) moderateTopic(action string, change func(topic *Topic)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		topic := r.Context().Value(TopicCtxKey{}).(*Topic)
+
+		change(topic)
+		rs.saveTopic(w, r, action, topic)
+	}
+}
+
+// TopicMove - Переносит топик на другую доску. Права нужны на обеих
+func (rs *topicsResource) TopicMove(w http.ResponseWriter, r *http.Request) {
+	topic := r.Context().Value(TopicCtxKey{}).(*Topic)
+
+	board, err := rs.storage.GetBoardBySlug(r.FormValue("board"))
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(errors.New("Board not found")))
+		return
+	}
+	if !canModerate(r, board.ID) {
+		render.Render(w, r, ErrForbidden(errors.New("Permission denied")))
+		return
+	}
+
+	topic.BoardID = board.ID
+	rs.saveTopic(w, r, "move", topic)
+}
+
+// saveTopic - Сохраняет топик, пишет действие в журнал
+// и отдает топик, как TopicGet
+func (rs *topicsResource) saveTopic(w http.ResponseWriter, r *http.Request, action string, topic *Topic) {
+	err := rs.storage.WithTx(r.Context(), func(tx Storage) error {
+		before, err := tx.GetTopicByID(topic.ID)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.UpdateTopic(topic); err != nil {
+			return err
+		}
+
+		updated, err := tx.GetTopicByID(topic.ID)
+		if err != nil {
+			return err
+		}
+		*topic = *updated
+
+		entry := &ModLogEntry{BoardID: before.BoardID, TargetType: "topic", TargetID: topic.ID, Action: action}
+		if err := logModeration(tx, r, entry, topicModState(before), topicModState(topic)); err != nil {
+			return err
+		}
+
+		return setTopicsBadges(tx, topic)
+	})
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	if err := render.Render(w, r, topic); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+//--
+// Comments
+//--
+
+// moderateComment - Меняет состояния комментария из контекста и отдает его заново
+func (rs *commentsResource) moderateComment(action string, change func(comment *Comment)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		comment := r.Context().Value(CommentCtxKey{}).(*Comment)
+		topic := r.Context().Value(TopicCtxKey{}).(*Topic)
+
+		before := commentModState(comment)
+		change(comment)
+
+		err := rs.storage.WithTx(r.Context(), func(tx Storage) error {
+			if err := tx.UpdateComment(comment); err != nil {
+				return err
+			}
+
+			updated, err := tx.GetCommentByID(comment.ID)
+			if err != nil {
+				return err
+			}
+			*comment = *updated
+
+			entry := &ModLogEntry{BoardID: topic.BoardID, TargetType: "comment", TargetID: comment.ID, Action: action}
+			if err := logModeration(tx, r, entry, before, commentModState(comment)); err != nil {
+				return err
+			}
+
+			return setCommentsBadges(tx, topic.BoardID, comment)
+		})
+		if err != nil {
+			render.Render(w, r, ErrBadRequest(err))
+			return
+		}
+
+		if err := render.Render(w, r, comment); err != nil {
+			render.Render(w, r, ErrRender(err))
+			return
+		}
+	}
+}
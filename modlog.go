@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/yuriygr/go-board/utils"
+)
+
+type modResource struct {
+	storage Storage
+	session *Session
+}
+
+func (rs modResource) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Route("/log", func(r chi.Router) {
+		r.Use(rs.ModLogCtx)
+		r.With(RequirePermission(PermModLogView)).Get("/", rs.ModLogList)
+		r.Get("/public", rs.ModLogPublic)
+	})
+
+	r.Route("/reports", func(r chi.Router) {
+		r.With(rs.ReportsCtx, RequirePermission(PermPostsModerate)).Get("/", rs.ReportsList)
+		r.Route("/{reportID:[0-9]+}", func(r chi.Router) {
+			r.Use(rs.ReportCtx, RequirePermission(PermPostsModerate))
+			r.Post("/resolve", rs.closeReports("resolve", ReportResolved))
+			r.Post("/dismiss", rs.closeReports("dismiss", ReportDismissed))
+		})
+	})
+
+	r.Route("/bans", func(r chi.Router) {
+		r.Use(rs.BansCtx)
+		r.With(RequirePermission(PermUsersBan)).Get("/", rs.BansList)
+		r.With(RequirePermission(PermUsersBan)).Post("/", rs.BanCreate)
+		r.With(rs.ModBanCtx, RequirePermission(PermUsersBan)).Delete("/{banID:[0-9]+}", rs.BanLift)
+	})
+
+	r.Route("/appeals", func(r chi.Router) {
+		r.With(rs.BansCtx, RequirePermission(PermUsersBan)).Get("/", rs.AppealsList)
+		r.Route("/{appealID:[0-9]+}", func(r chi.Router) {
+			r.Use(rs.AppealCtx, RequirePermission(PermUsersBan))
+			r.Post("/accept", rs.answerAppeal(AppealAccepted))
+			r.Post("/reject", rs.answerAppeal(AppealRejected))
+		})
+	})
+
+	return r
+}
+
+//--
+// Middleware
+//--
+
+// BoardCtxKey - Key for context
+type BoardCtxKey struct{}
+
+// ModLogCtxKey - Key for context
+type ModLogCtxKey struct{}
+
+// ModLogCtx - Фильтры журнала из запроса. Доска из ?board= кладется
+// под BoardCtxKey: модератор доски видит журнал только по ней
+func (rs *modResource) ModLogCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := &ModLogRequest{Page: 1, Limit: 50} // Initial state
+		if err := request.Bind(r); err != nil {
+			render.Render(w, r, ErrBadRequest(err))
+			return
+		}
+
+		ctx := r.Context()
+		if slug := r.URL.Query().Get("board"); slug != "" {
+			board, err := rs.storage.GetBoardBySlug(slug)
+			if err != nil {
+				render.Render(w, r, ErrBadRequest(errors.New("Board not found")))
+				return
+			}
+			request.BoardID = board.ID
+			ctx = context.WithValue(ctx, BoardCtxKey{}, board)
+		}
+
+		ctx = context.WithValue(ctx, ModLogCtxKey{}, request)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+//--
+// Handler methods
+//--
+
+// ModLogList - Журнал целиком, для модераторов
+func (rs *modResource) ModLogList(w http.ResponseWriter, r *http.Request) {
+	request := r.Context().Value(ModLogCtxKey{}).(*ModLogRequest)
+
+	entries, err := rs.storage.GetModLog(request)
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	if err := render.RenderList(w, r, NewModLogListResponse(entries)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// ModLogPublic - Журнал для всех: без модераторов, IP и содержимого постов
+func (rs *modResource) ModLogPublic(w http.ResponseWriter, r *http.Request) {
+	request := r.Context().Value(ModLogCtxKey{}).(*ModLogRequest)
+	request.ModeratorID = 0 // По модератору снаружи не ищем
+
+	entries, err := rs.storage.GetModLog(request)
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	for _, entry := range entries {
+		entry.Redact()
+	}
+
+	if err := render.RenderList(w, r, NewModLogListResponse(entries)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+//--
+// Struct
+//--
+
+// ModLogEntry - Строка журнала модерации
+type ModLogEntry struct {
+	ID          int64           `json:"id" db:"ml.id"`
+	ModeratorID int64           `json:"moderator_id,omitempty" db:"ml.moderator_id"`
+	Moderator   string          `json:"moderator,omitempty" db:"screen_name"`
+	BoardID     int64           `json:"-" db:"ml.board_id"` // 0 - не относится к доске
+	Board       string          `json:"board" db:"slug"`
+	TargetType  string          `json:"target_type" db:"ml.target_type"` // topic, comment, file, user
+	TargetID    int64           `json:"target_id" db:"ml.target_id"`
+	Action      string          `json:"action" db:"ml.action"`
+	Reason      string          `json:"reason" db:"ml.reason"`
+	Before      json.RawMessage `json:"before,omitempty" db:"ml.state_before"`
+	After       json.RawMessage `json:"after,omitempty" db:"ml.state_after"`
+	IP          string          `json:"ip,omitempty" db:"ml.ip"`
+	CreatedAt   int64           `json:"created_at" db:"ml.created_at"`
+}
+
+// Render - Render, wtf
+func (e *ModLogEntry) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// Redact - Оставляет только что, где и почему сделано
+func (e *ModLogEntry) Redact() {
+	e.ModeratorID = 0
+	e.Moderator = ""
+	e.Before = nil
+	e.After = nil
+	e.IP = ""
+}
+
+// ModLogRequest - Фильтры журнала
+type ModLogRequest struct {
+	ModeratorID int64
+	BoardID     int64 // Заполняет ModLogCtx по slug
+	Action      string
+	Since       int64
+	Until       int64
+	Page        int64
+	Limit       int64
+}
+
+// Bind - Bind HTTP request data and validate it
+func (mr *ModLogRequest) Bind(r *http.Request) error {
+	query := r.URL.Query()
+
+	for key, value := range map[string]*int64{"moderator": &mr.ModeratorID, "since": &mr.Since, "until": &mr.Until} {
+		if query.Get(key) == "" {
+			continue
+		}
+		number, err := strconv.ParseInt(query.Get(key), 10, 64)
+		if err != nil || number < 0 {
+			return errors.New("Invalid " + key)
+		}
+		*value = number
+	}
+
+	mr.Action = query.Get("action")
+
+	if page := query.Get("page"); page != "" {
+		if pageInt, err := strconv.ParseInt(page, 10, 64); err == nil {
+			mr.Page = utils.LimitMinValue(utils.Abs(pageInt), 1)
+		}
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		if limitInt, err := strconv.ParseInt(limit, 10, 64); err == nil {
+			mr.Limit = utils.LimitMaxValue(utils.Abs(limitInt), 100)
+		}
+	}
+
+	return nil
+}
+
+// NewModLogListResponse - Условности CHI
+func NewModLogListResponse(entries []*ModLogEntry) []render.Renderer {
+	list := []render.Renderer{}
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	return list
+}
+
+//--
+// Helpers function
+//--
+
+// logModeration - Пишет действие в журнал от имени текущего юзера.
+// Вызывать в той же транзакции, что и само действие
+func logModeration(tx Storage, r *http.Request, entry *ModLogEntry, before, after interface{}) error {
+	if auth, ok := r.Context().Value(AuthCtxKey{}).(*SessionResponse); ok {
+		entry.ModeratorID = auth.User.ID
+	}
+	if entry.Reason == "" {
+		entry.Reason = r.FormValue("reason")
+	}
+	entry.IP = requestIP(r)
+
+	return writeModLog(tx, entry, before, after)
+}
+
+// writeModLog - Пишет запись с состояниями до и после, время - текущее
+func writeModLog(tx Storage, entry *ModLogEntry, before, after interface{}) error {
+	entry.CreatedAt = time.Now().Unix()
+
+	var err error
+	if entry.Before, err = modLogState(before); err != nil {
+		return err
+	}
+	if entry.After, err = modLogState(after); err != nil {
+		return err
+	}
+
+	return tx.CreateModLogEntry(entry)
+}
+
+// modLogState - Состояние до или после в JSON, nil - не было
+func modLogState(state interface{}) (json.RawMessage, error) {
+	if state == nil {
+		return nil, nil
+	}
+	return json.Marshal(state)
+}
+
+// topicModState - Что меняют модераторы у топика
+func topicModState(topic *Topic) map[string]interface{} {
+	return map[string]interface{}{
+		"board":      topic.Board.Slug,
+		"is_pinned":  topic.States.IsPinned,
+		"is_closed":  topic.States.IsClosed,
+		"is_deleted": topic.States.IsDeleted,
+	}
+}
+
+// commentModState - Что меняют модераторы у комментария
+func commentModState(comment *Comment) map[string]interface{} {
+	return map[string]interface{}{
+		"is_pinned":  comment.States.IsPinned == 1,
+		"is_deleted": comment.States.IsDeleted == 1,
+	}
+}
+
+// fileModState - Флаг проверки и бан файла
+func fileModState(file *File, banned bool) map[string]interface{} {
+	return map[string]interface{}{
+		"md5":        file.Md5,
+		"is_flagged": file.IsFlagged,
+		"is_banned":  banned,
+	}
+}
+
+// roleModState - Выданная роль, nil - роли нет
+func roleModState(role *UserRole) interface{} {
+	if role == nil {
+		return nil
+	}
+	return map[string]interface{}{"role": role.Role, "board": role.Board}
+}
@@ -10,7 +10,7 @@ import (
 )
 
 type pagesResource struct {
-	storage *Storage
+	storage Storage
 	session *Session
 }
 
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/go-chi/render"
+)
+
+// ErrRateLimited - Слишком часто, ждать Retry-After секунд
+var ErrRateLimited = errors.New("Too many requests, slow down")
+
+// RateRule - Не больше Count действий за Window. Count 0 - без лимита
+type RateRule struct {
+	Count  int64
+	Window time.Duration
+}
+
+// RateLimits - Лимиты по действиям: topic, comment, upload, login, register.
+// Cooldown - пауза между действиями в одном месте: топиками на доске, комментариями в топике
+type RateLimits struct {
+	IP       map[string]RateRule
+	User     map[string]RateRule // У login - на логин, под которым входят
+	Cooldown map[string]time.Duration
+}
+
+// rateActions - Действия с лимитами и их значения по умолчанию
+var rateActions = map[string]struct{ ip, user, cooldown string }{
+	"topic":    {"10/1h", "10/1h", "2m"},
+	"comment":  {"30/10m", "30/10m", "10s"},
+	"upload":   {"60/10m", "60/10m", ""},
+	"login":    {"10/10m", "5/10m", ""},
+	"register": {"3/1h", "", ""},
+}
+
+// rateLimits - Лимиты из RATE_{ACTION}_IP, RATE_{ACTION}_USER ("10/1h") и
+// RATE_{ACTION}_COOLDOWN ("2m"). 0 - выключить, пусто - по умолчанию
+func rateLimits() (RateLimits, error) {
+	limits := RateLimits{IP: map[string]RateRule{}, User: map[string]RateRule{}, Cooldown: map[string]time.Duration{}}
+
+	for action, defaults := range rateActions {
+		prefix := "RATE_" + strings.ToUpper(action)
+
+		ip, err := parseRateRule(envString(prefix+"_IP", defaults.ip))
+		if err != nil {
+			return limits, fmt.Errorf("%s_IP: %s", prefix, err)
+		}
+		user, err := parseRateRule(envString(prefix+"_USER", defaults.user))
+		if err != nil {
+			return limits, fmt.Errorf("%s_USER: %s", prefix, err)
+		}
+		cooldown, err := parseRateDuration(envString(prefix+"_COOLDOWN", defaults.cooldown))
+		if err != nil {
+			return limits, fmt.Errorf("%s_COOLDOWN: %s", prefix, err)
+		}
+
+		limits.IP[action], limits.User[action], limits.Cooldown[action] = ip, user, cooldown
+	}
+
+	return limits, nil
+}
+
+// envString - Переменная окружения или значение по умолчанию
+func envString(key, fallback string) string {
+	if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// parseRateRule - "10/1h" -> 10 за час, "" и "0" - без лимита
+func parseRateRule(value string) (RateRule, error) {
+	if value == "" || value == "0" {
+		return RateRule{}, nil
+	}
+
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return RateRule{}, errors.New("want count/window, like 10/1h")
+	}
+	count, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || count < 0 {
+		return RateRule{}, errors.New("invalid count")
+	}
+	window, err := parseRateDuration(parts[1])
+	if err != nil {
+		return RateRule{}, err
+	}
+	if window == 0 {
+		return RateRule{}, nil
+	}
+
+	return RateRule{Count: count, Window: window}, nil
+}
+
+// parseRateDuration - "2m", "1h", "" и "0" - ноль
+func parseRateDuration(value string) (time.Duration, error) {
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, errors.New("invalid duration")
+	}
+	return duration, nil
+}
+
+//--
+// Limiter
+//--
+
+// RateStore - Счетчики в окне фиксированной длины
+type RateStore interface {
+	// Hit - Засчитывает действие, вернет сколько их в текущем окне
+	// и сколько окну осталось
+	Hit(key string, window time.Duration) (int64, time.Duration, error)
+	// TTL - Сколько осталось окну, 0 - окна нет
+	TTL(key string) (time.Duration, error)
+}
+
+// RateLimiter - Лимиты и где хранятся счетчики
+type RateLimiter struct {
+	store  RateStore
+	limits RateLimits
+}
+
+// NewRateLimiter - Счетчики в Redis, RATE_LIMIT_DRIVER=memory - в памяти процесса
+// (для одного инстанса и локальной разработки)
+func NewRateLimiter() *RateLimiter {
+	limits, err := rateLimits()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if os.Getenv("RATE_LIMIT_DRIVER") == "memory" {
+		return &RateLimiter{NewMemoryRateStore(), limits}
+	}
+
+	return &RateLimiter{NewRedisRateStore(fmt.Sprintf("%s:%s", host, port), pass), limits}
+}
+
+// hit - Засчитывает действие по правилу. 0 - можно, иначе сколько ждать
+func (l *RateLimiter) hit(key string, rule RateRule) (time.Duration, error) {
+	if rule.Count == 0 {
+		return 0, nil
+	}
+
+	count, ttl, err := l.store.Hit("rate:"+key, rule.Window)
+	if err != nil || count <= rule.Count {
+		return 0, err
+	}
+	return ttl, nil
+}
+
+// RateLimiterCtxKey - Key for context
+type RateLimiterCtxKey struct{}
+
+// RateLimiterCtx - Кладет лимитер в контекст для RateLimit и checkCooldown, nil - без лимитов
+func RateLimiterCtx(limiter *RateLimiter) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), RateLimiterCtxKey{}, limiter)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RateLimit - Лимиты действия по IP и по юзеру. Засчитываются все попытки,
+// в том числе неудачные: для входа это и нужно
+func RateLimit(action string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limiter, ok := r.Context().Value(RateLimiterCtxKey{}).(*RateLimiter)
+			if !ok || limiter == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			wait, err := limiter.hit(action+":ip:"+requestIP(r), limiter.limits.IP[action])
+			if wait == 0 && err == nil {
+				if user := rateUser(r, action); user != "" {
+					wait, err = limiter.hit(action+":"+user, limiter.limits.User[action])
+				}
+			}
+			if rateLimited(w, r, wait, err) {
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// checkCooldown - Пауза между действиями в одном месте (scope - доска или топик)
+// от одного юзера или анонимного адреса. Только проверяет, паузу начинает
+// recordCooldown, когда действие удалось. true - ответ уже отдан
+func checkCooldown(w http.ResponseWriter, r *http.Request, action, scope string) bool {
+	limiter, key := cooldownKey(r, action, scope)
+	if limiter == nil {
+		return false
+	}
+
+	wait, err := limiter.store.TTL(key)
+	return rateLimited(w, r, wait, err)
+}
+
+// recordCooldown - Начинает паузу после удачного действия
+func recordCooldown(r *http.Request, action, scope string) {
+	limiter, key := cooldownKey(r, action, scope)
+	if limiter == nil {
+		return
+	}
+
+	if _, _, err := limiter.store.Hit(key, limiter.limits.Cooldown[action]); err != nil {
+		log.Printf("rate limit: %s", err)
+	}
+}
+
+// cooldownKey - Лимитер и ключ паузы, nil - паузы у действия нет
+func cooldownKey(r *http.Request, action, scope string) (*RateLimiter, string) {
+	limiter, ok := r.Context().Value(RateLimiterCtxKey{}).(*RateLimiter)
+	if !ok || limiter == nil || limiter.limits.Cooldown[action] == 0 {
+		return nil, ""
+	}
+	return limiter, "rate:" + action + ":cooldown:" + scope + ":" + requesterKey(requestUserID(r), requestIP(r))
+}
+
+// rateLimited - Отдает 429 с Retry-After, если надо ждать.
+// Недоступные счетчики запрос не блокируют
+func rateLimited(w http.ResponseWriter, r *http.Request, wait time.Duration, err error) bool {
+	if err != nil {
+		log.Printf("rate limit: %s", err)
+		return false
+	}
+	if wait == 0 {
+		return false
+	}
+
+	seconds := int64(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	render.Render(w, r, ErrTooManyRequests(ErrRateLimited))
+	return true
+}
+
+// rateUser - Чей лимит "на юзера": вошедший юзер, а у входа - логин,
+// под которым пытаются войти. У анонимов его нет
+func rateUser(r *http.Request, action string) string {
+	if action == "login" {
+		if username := strings.ToLower(r.FormValue("username")); username != "" {
+			return "name:" + username
+		}
+		return ""
+	}
+	if userID := requestUserID(r); userID != 1 {
+		return "user:" + strconv.FormatInt(userID, 10)
+	}
+	return ""
+}
+
+//--
+// Memory store
+//--
+
+// MemoryRateStore - Счетчики в памяти процесса
+type MemoryRateStore struct {
+	mu       sync.Mutex
+	counters map[string]*memoryRateCounter
+	now      func() time.Time // Подменяется в тестах
+	hits     int
+}
+
+type memoryRateCounter struct {
+	count   int64
+	resetAt time.Time
+}
+
+// NewMemoryRateStore - init new memory rate store
+func NewMemoryRateStore() *MemoryRateStore {
+	return &MemoryRateStore{counters: map[string]*memoryRateCounter{}, now: time.Now}
+}
+
+// Hit - Засчитывает действие, вернет сколько их в текущем окне
+// и сколько окну осталось
+func (s *MemoryRateStore) Hit(key string, window time.Duration) (int64, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	// Иногда выметаем истекшие окна, чтобы карта не росла бесконечно
+	if s.hits++; s.hits%1000 == 0 {
+		for k, counter := range s.counters {
+			if !now.Before(counter.resetAt) {
+				delete(s.counters, k)
+			}
+		}
+	}
+
+	counter, ok := s.counters[key]
+	if !ok || !now.Before(counter.resetAt) {
+		counter = &memoryRateCounter{resetAt: now.Add(window)}
+		s.counters[key] = counter
+	}
+	counter.count++
+
+	return counter.count, counter.resetAt.Sub(now), nil
+}
+
+// TTL - Сколько осталось окну, 0 - окна нет
+func (s *MemoryRateStore) TTL(key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if counter, ok := s.counters[key]; ok && now.Before(counter.resetAt) {
+		return counter.resetAt.Sub(now), nil
+	}
+	return 0, nil
+}
+
+//--
+// Redis store
+//--
+
+// RedisRateStore - Счетчики в Redis, общие для всех инстансов.
+// Пока Redis недоступен, считает в памяти
+type RedisRateStore struct {
+	pool     *redis.Pool
+	fallback *MemoryRateStore
+}
+
+// NewRedisRateStore - init new redis rate store
+func NewRedisRateStore(address, password string) *RedisRateStore {
+	pool := &redis.Pool{
+		MaxIdle:     16,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", address, redis.DialPassword(password), redis.DialConnectTimeout(time.Second))
+		},
+	}
+
+	return &RedisRateStore{pool: pool, fallback: NewMemoryRateStore()}
+}
+
+// Hit - Засчитывает действие, вернет сколько их в текущем окне
+// и сколько окну осталось
+func (s *RedisRateStore) Hit(key string, window time.Duration) (int64, time.Duration, error) {
+	count, ttl, err := s.hit(key, window)
+	if err != nil {
+		log.Printf("rate limit: redis: %s, counting in memory", err)
+		return s.fallback.Hit(key, window)
+	}
+	return count, ttl, nil
+}
+
+// TTL - Сколько осталось окну, 0 - окна нет
+func (s *RedisRateStore) TTL(key string) (time.Duration, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	ttl, err := redis.Int64(conn.Do("PTTL", key))
+	if err != nil {
+		log.Printf("rate limit: redis: %s, counting in memory", err)
+		return s.fallback.TTL(key)
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+	return time.Duration(ttl) * time.Millisecond, nil
+}
+
+// hit - Окно ставится только первым действием в нем, все одной транзакцией
+func (s *RedisRateStore) hit(key string, window time.Duration) (int64, time.Duration, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("SET", key, 0, "PX", window.Nanoseconds()/int64(time.Millisecond), "NX")
+	conn.Send("INCR", key)
+	conn.Send("PTTL", key)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(values) != 3 {
+		return 0, 0, errors.New("unexpected EXEC reply")
+	}
+
+	count, err := redis.Int64(values[1], nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	ttl, err := redis.Int64(values[2], nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return count, time.Duration(ttl) * time.Millisecond, nil
+}
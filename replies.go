@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/yuriygr/go-board/utils"
+)
+
+//--
+// Replies structure
+//--
+
+// Reply - Ссылка >>N из одного поста на другой.
+// CommentID == 0 означает сам топик (OP-пост).
+type Reply struct {
+	FromTopicID   int64 `db:"r.from_topic_id"`
+	FromCommentID int64 `db:"r.from_comment_id"`
+	ToTopicID     int64 `db:"r.to_topic_id"`
+	ToCommentID   int64 `db:"r.to_comment_id"`
+	CreatedAt     int64 `db:"r.created_at"`
+}
+
+// ReplyTarget - Неудаленный пост, на который может вести ссылка
+type ReplyTarget struct {
+	TopicID   int64  `db:"topic_id"`
+	CommentID int64  `db:"comment_id"` // 0 - сам топик
+	Board     string `db:"slug"`
+}
+
+// PostRef - Пост в списках replies_to и replied_by
+type PostRef struct {
+	TopicID   int64 `json:"topic_id" db:"topic_id"`
+	CommentID int64 `json:"comment_id" db:"comment_id"` // 0 - сам топик
+}
+
+//--
+// Helpers function
+//--
+
+// maxReplyRefs - Сколько разных ссылок >>N в одном сообщении размечаем,
+// остальные остаются текстом
+const maxReplyRefs = 50
+
+// linkReplies - Размечает >>N на существующие посты и возвращает связи
+// без источника: его заполняет saveReplies после вставки поста.
+// topic - топик, в котором пишут, или nil для нового топика.
+// Все посты ищутся одним запросом.
+func linkReplies(storage Storage, topic *Topic, message string) (string, []*Reply, error) {
+	refs := utils.ExtractReplies(message)
+	if len(refs) > maxReplyRefs {
+		refs = refs[:maxReplyRefs]
+	}
+
+	ids := []int64{}
+	for _, ref := range refs {
+		ids = append(ids, ref.ID)
+	}
+	targets, err := storage.GetReplyTargets(ids)
+	if err != nil {
+		return "", nil, err
+	}
+
+	replies := []*Reply{}
+	links := map[utils.ReplyRef]string{}
+	seen := map[PostRef]bool{}
+	for _, ref := range refs {
+		reply, slug := resolveReply(targets, topic, ref)
+		if reply == nil {
+			continue
+		}
+
+		if to := (PostRef{reply.ToTopicID, reply.ToCommentID}); !seen[to] {
+			seen[to] = true
+			replies = append(replies, reply)
+		}
+		links[ref] = fmt.Sprintf("/%s/%d#%d", slug, reply.ToTopicID, ref.ID)
+	}
+
+	message = utils.MarkupReplies(message, func(ref utils.ReplyRef) string {
+		return links[ref]
+	})
+
+	return message, replies, nil
+}
+
+// resolveReply - Ищет пост по ссылке среди найденных. Удаленных постов там нет.
+func resolveReply(targets []*ReplyTarget, topic *Topic, ref utils.ReplyRef) (*Reply, string) {
+	// >>N внутри топика. Номер самого топика важнее
+	// совпадающего номера комментария.
+	if ref.Board == "" {
+		if topic == nil {
+			return nil, ""
+		}
+
+		if ref.ID == topic.ID {
+			return &Reply{ToTopicID: topic.ID}, topic.Board.Slug
+		}
+
+		for _, target := range targets {
+			if target.CommentID == ref.ID && target.TopicID == topic.ID {
+				return &Reply{ToTopicID: topic.ID, ToCommentID: target.CommentID}, topic.Board.Slug
+			}
+		}
+		return nil, ""
+	}
+
+	// >>>/board/N - топик или комментарий на другой доске
+	var comment *ReplyTarget
+	for _, target := range targets {
+		if target.Board != ref.Board {
+			continue
+		}
+		if target.CommentID == 0 && target.TopicID == ref.ID {
+			return &Reply{ToTopicID: target.TopicID}, target.Board
+		}
+		if target.CommentID == ref.ID {
+			comment = target
+		}
+	}
+	if comment == nil {
+		return nil, ""
+	}
+
+	return &Reply{ToTopicID: comment.TopicID, ToCommentID: comment.CommentID}, comment.Board
+}
+
+// saveReplies - Сохраняет связи от поста (topicID, commentID)
+func saveReplies(storage Storage, replies []*Reply, topicID, commentID, createdAt int64) error {
+	if len(replies) == 0 {
+		return nil
+	}
+
+	for _, reply := range replies {
+		reply.FromTopicID = topicID
+		reply.FromCommentID = commentID
+		reply.CreatedAt = createdAt
+	}
+
+	return storage.CreateReplies(replies)
+}
+
+// attachCommentReplies - Раскладывает связи топика по его комментариям
+func attachCommentReplies(comments []*Comment, replies []*Reply) {
+	for _, comment := range comments {
+		comment.RepliesTo = []*PostRef{}
+		comment.RepliedBy = []*PostRef{}
+
+		for _, reply := range replies {
+			if reply.FromTopicID == comment.TopicID && reply.FromCommentID == comment.ID {
+				comment.RepliesTo = append(comment.RepliesTo, &PostRef{reply.ToTopicID, reply.ToCommentID})
+			}
+			if reply.ToTopicID == comment.TopicID && reply.ToCommentID == comment.ID {
+				comment.RepliedBy = append(comment.RepliedBy, &PostRef{reply.FromTopicID, reply.FromCommentID})
+			}
+		}
+	}
+}
+
+// attachTopicReplies - То же самое для OP-поста
+func attachTopicReplies(topic *Topic, replies []*Reply) {
+	topic.RepliesTo = []*PostRef{}
+	topic.RepliedBy = []*PostRef{}
+
+	for _, reply := range replies {
+		if reply.FromTopicID == topic.ID && reply.FromCommentID == 0 {
+			topic.RepliesTo = append(topic.RepliesTo, &PostRef{reply.ToTopicID, reply.ToCommentID})
+		}
+		if reply.ToTopicID == topic.ID && reply.ToCommentID == 0 {
+			topic.RepliedBy = append(topic.RepliedBy, &PostRef{reply.FromTopicID, reply.FromCommentID})
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/yuriygr/go-board/utils"
+)
+
+// Статусы жалоб
+const (
+	ReportOpen      = "open"
+	ReportResolved  = "resolved"  // Меры приняты
+	ReportDismissed = "dismissed" // Жалоба необоснованна
+)
+
+// reportCategories - За что можно пожаловаться
+var reportCategories = map[string]bool{
+	"spam":     true,
+	"illegal":  true,
+	"abuse":    true,
+	"offtopic": true,
+	"other":    true, // Только с текстом
+}
+
+//--
+// Middleware
+//--
+
+// ReportsCtxKey - Key for context
+type ReportsCtxKey struct{}
+
+// ReportsCtx - Фильтры очереди из запроса. Доска из ?board= кладется
+// под BoardCtxKey: модератор доски видит жалобы только на ней
+func (rs *modResource) ReportsCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := &ReportsRequest{Status: ReportOpen, Page: 1, Limit: 50} // Initial state
+		if err := request.Bind(r); err != nil {
+			render.Render(w, r, ErrBadRequest(err))
+			return
+		}
+
+		ctx := r.Context()
+		if slug := r.URL.Query().Get("board"); slug != "" {
+			board, err := rs.storage.GetBoardBySlug(slug)
+			if err != nil {
+				render.Render(w, r, ErrBadRequest(errors.New("Board not found")))
+				return
+			}
+			request.BoardID = board.ID
+			ctx = context.WithValue(ctx, BoardCtxKey{}, board)
+		}
+
+		ctx = context.WithValue(ctx, ReportsCtxKey{}, request)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ReportCtxKey - Key for context
+type ReportCtxKey struct{}
+
+// ReportCtx - Загружает жалобу по ID из URL, иначе 404.
+// Ее доска кладется под BoardCtxKey: по ней проверяются права
+func (rs *modResource) ReportCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reportID, err := strconv.ParseInt(chi.URLParam(r, "reportID"), 10, 64)
+		if err != nil {
+			render.Render(w, r, ErrBadRequest(errors.New("ID needed")))
+			return
+		}
+
+		report, err := rs.storage.GetReportByID(reportID)
+		if err != nil {
+			render.Render(w, r, ErrNotFound(errors.New("Report not found")))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ReportCtxKey{}, report)
+		ctx = context.WithValue(ctx, BoardCtxKey{}, &Board{ID: report.BoardID, Slug: report.Board})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+//--
+// Handler methods
+//--
+
+// ReportsList - Очередь жалоб, у каждой число открытых жалоб на тот же пост
+func (rs *modResource) ReportsList(w http.ResponseWriter, r *http.Request) {
+	request := r.Context().Value(ReportsCtxKey{}).(*ReportsRequest)
+
+	reports, err := rs.storage.GetReports(request)
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	if err := render.RenderList(w, r, NewReportsListResponse(reports)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// closeReports - Закрывает все открытые жалобы на пост из жалобы в контексте
+func (rs *modResource) closeReports(action, status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := r.Context().Value(ReportCtxKey{}).(*Report)
+		auth := r.Context().Value(AuthCtxKey{}).(*SessionResponse)
+
+		if report.Status != ReportOpen {
+			render.Render(w, r, ErrConflict(errors.New("Report already closed")))
+			return
+		}
+
+		err := rs.storage.WithTx(r.Context(), func(tx Storage) error {
+			closed, err := tx.CloseReports(report.TargetType, report.TargetID, status, auth.User.ID, time.Now().Unix())
+			if err != nil {
+				return err
+			}
+
+			updated, err := tx.GetReportByID(report.ID)
+			if err != nil {
+				return err
+			}
+			*report = *updated
+
+			entry := &ModLogEntry{BoardID: report.BoardID, TargetType: report.TargetType, TargetID: report.TargetID, Action: action}
+			before := map[string]interface{}{"status": ReportOpen, "reports": closed}
+			after := map[string]interface{}{"status": status, "reports": closed}
+			return logModeration(tx, r, entry, before, after)
+		})
+		if err != nil {
+			render.Render(w, r, ErrBadRequest(err))
+			return
+		}
+
+		if err := render.Render(w, r, report); err != nil {
+			render.Render(w, r, ErrRender(err))
+			return
+		}
+	}
+}
+
+//--
+// Struct
+//--
+
+// Report - Жалоба на топик или комментарий
+type Report struct {
+	ID            int64  `json:"id" db:"r.id"`
+	TargetType    string `json:"target_type" db:"r.target_type"` // topic, comment
+	TargetID      int64  `json:"target_id" db:"r.target_id"`
+	TopicID       int64  `json:"topic_id" db:"r.topic_id"`
+	BoardID       int64  `json:"-" db:"r.board_id"`
+	Board         string `json:"board" db:"slug"`
+	ReporterID    int64  `json:"reporter_id" db:"r.reporter_id"`
+	ReporterIP    string `json:"reporter_ip" db:"r.reporter_ip"`
+	ReporterKey   string `json:"-" db:"r.reporter_key"` // user:{id} или ip:{ip} для анонимов
+	Category      string `json:"category" db:"r.category"`
+	Text          string `json:"text" db:"r.text"`
+	Status        string `json:"status" db:"r.status"`
+	TargetReports int64  `json:"target_reports" db:"target_reports"` // Открытых жалоб на тот же пост
+	CreatedAt     int64  `json:"created_at" db:"r.created_at"`
+	ResolvedBy    int64  `json:"resolved_by,omitempty" db:"r.resolved_by"`
+	ResolvedAt    int64  `json:"resolved_at,omitempty" db:"r.resolved_at"`
+}
+
+// Render - Render, wtf
+func (rp *Report) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// Bind - Bind HTTP request data and validate it.
+// Цель жалобы заполняет обработчик
+func (rp *Report) Bind(r *http.Request) error {
+	rp.Category = r.FormValue("category")
+	if !reportCategories[rp.Category] {
+		return errors.New("Unknown category")
+	}
+
+	rp.Text = strings.TrimSpace(r.FormValue("text"))
+	if rp.Category == "other" && rp.Text == "" {
+		return errors.New("Text must be filled")
+	}
+	if utf8.RuneCountInString(rp.Text) > 1000 {
+		return errors.New("Text is too long")
+	}
+
+	rp.ReporterID = requestUserID(r)
+	rp.ReporterIP = requestIP(r)
+	rp.ReporterKey = requesterKey(rp.ReporterID, rp.ReporterIP)
+
+	rp.Status = ReportOpen
+	rp.CreatedAt = time.Now().Unix()
+
+	return nil
+}
+
+// ReportsRequest - Фильтры очереди жалоб
+type ReportsRequest struct {
+	Status  string
+	BoardID int64 // Заполняет ReportsCtx по slug
+	Page    int64
+	Limit   int64
+}
+
+// Bind - Bind HTTP request data and validate it
+func (rr *ReportsRequest) Bind(r *http.Request) error {
+	query := r.URL.Query()
+
+	if status := query.Get("status"); status != "" {
+		if status != ReportOpen && status != ReportResolved && status != ReportDismissed {
+			return errors.New("Invalid status")
+		}
+		rr.Status = status
+	}
+
+	if page := query.Get("page"); page != "" {
+		if pageInt, err := strconv.ParseInt(page, 10, 64); err == nil {
+			rr.Page = utils.LimitMinValue(utils.Abs(pageInt), 1)
+		}
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		if limitInt, err := strconv.ParseInt(limit, 10, 64); err == nil {
+			rr.Limit = utils.LimitMaxValue(utils.Abs(limitInt), 100)
+		}
+	}
+
+	return nil
+}
+
+// NewReportsListResponse - Условности CHI
+func NewReportsListResponse(reports []*Report) []render.Renderer {
+	list := []render.Renderer{}
+	for _, report := range reports {
+		list = append(list, report)
+	}
+	return list
+}
+
+//--
+// Helpers function
+//--
+
+// createReport - Сохраняет жалобу. Повторная от того же жалобщика
+// не создается, а обновляет открытую
+func createReport(storage Storage, w http.ResponseWriter, r *http.Request, report *Report) {
+	if err := report.Bind(r); err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	created, err := storage.CreateReport(report)
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	if !created {
+		render.Render(w, r, &SuccessResponse{
+			HTTPStatusCode: 200,
+			StatusText:     "Report already sent",
+		})
+		return
+	}
+
+	render.Render(w, r, &SuccessResponse{
+		HTTPStatusCode: 201,
+		StatusText:     "Report created!",
+	})
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/gorilla/sessions"
+)
+
+// Роли. RoleUser есть у любого вошедшего и в базе не хранится
+const (
+	RoleUser       = "user"
+	RoleModerator  = "moderator"
+	RoleBoardOwner = "board-owner"
+	RoleAdmin      = "admin"
+)
+
+// Права, которые дают роли
+const (
+	PermPostsModerate = "posts.moderate" // Закреплять, закрывать, удалять посты
+	PermFilesModerate = "files.moderate" // Банить и одобрять файлы
+	PermRolesManage   = "roles.manage"   // Выдавать и снимать роли
+	PermModLogView    = "modlog.view"    // Читать журнал модерации целиком
+	PermUsersBan      = "users.ban"      // Банить по юзеру и IP, разбирать апелляции
+)
+
+// rolePermissions - Что дает каждая роль. Роль на доске дает
+// те же права, но только на ней
+var rolePermissions = map[string][]string{
+	RoleUser:       {},
+	RoleModerator:  {PermPostsModerate, PermFilesModerate, PermModLogView, PermUsersBan},
+	RoleBoardOwner: {PermPostsModerate, PermFilesModerate, PermModLogView, PermUsersBan, PermRolesManage},
+	RoleAdmin:      {PermPostsModerate, PermFilesModerate, PermModLogView, PermUsersBan, PermRolesManage},
+}
+
+// roleRanks - Старшинство ролей для бейджа на постах
+var roleRanks = map[string]int{
+	RoleUser:       0,
+	RoleModerator:  1,
+	RoleBoardOwner: 2,
+	RoleAdmin:      3,
+}
+
+// UserRole - Роль пользователя, глобальная или на одной доске
+type UserRole struct {
+	UserID    int64  `json:"user_id" db:"ur.user_id"`
+	Role      string `json:"role" db:"ur.role"`
+	BoardID   int64  `json:"-" db:"ur.board_id"` // 0 - на всех досках
+	Board     string `json:"board" db:"slug"`    // Slug доски, пусто для глобальной
+	CreatedAt int64  `json:"created_at" db:"ur.created_at"`
+}
+
+// Render - Render, wtf
+func (ur *UserRole) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// Permissions - Права роли. На доске к праву дописывается @slug
+func (ur *UserRole) Permissions() []string {
+	permissions := []string{}
+	for _, permission := range rolePermissions[ur.Role] {
+		if ur.BoardID != 0 {
+			permission += "@" + ur.Board
+		}
+		permissions = append(permissions, permission)
+	}
+	return permissions
+}
+
+// grants - Дает ли роль право на доске boardID
+func (ur *UserRole) grants(permission string, boardID int64) bool {
+	if ur.BoardID != 0 && ur.BoardID != boardID {
+		return false
+	}
+	for _, p := range rolePermissions[ur.Role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleRequest - Выдать или снять роль
+type RoleRequest struct {
+	Role  string
+	Board string // Slug доски, пусто - на всех досках
+}
+
+// Bind - Bind HTTP request data and validate it
+func (rr *RoleRequest) Bind(r *http.Request) error {
+	if role := chi.URLParam(r, "role"); role != "" {
+		rr.Role = role
+	} else {
+		rr.Role = r.FormValue("role")
+	}
+	rr.Board = r.FormValue("board")
+
+	if _, ok := roleRanks[rr.Role]; !ok || rr.Role == RoleUser {
+		return errors.New("Unknown role")
+	}
+	if rr.Role == RoleAdmin && rr.Board != "" {
+		return errors.New("Admin role can not be scoped to a board")
+	}
+
+	return nil
+}
+
+//--
+// Session
+//--
+
+// newSessionResponse - Состояние юзера из сессии и его роли.
+// Роли читаются из базы на каждый запрос: снятая роль перестает
+// действовать сразу, а не после нового входа
+func newSessionResponse(storage Storage, session *sessions.Session) *SessionResponse {
+	sessionResponse := &SessionResponse{}
+	sessionResponse.Bind(session)
+
+	roles, err := storage.GetUserRoles(sessionResponse.User.ID)
+	if err != nil {
+		// Без ролей - только права обычного пользователя
+		log.Printf("roles: user %d: %s", sessionResponse.User.ID, err)
+		roles = nil
+	}
+	sessionResponse.SetRoles(roles)
+
+	return sessionResponse
+}
+
+// SetRoles - Роли из базы плюс RoleUser и список прав по ним
+func (sr *SessionResponse) SetRoles(roles []*UserRole) {
+	sr.Roles = append([]*UserRole{{UserID: sr.User.ID, Role: RoleUser}}, roles...)
+
+	sr.Permissions = []string{}
+	seen := map[string]bool{}
+	for _, role := range sr.Roles {
+		for _, permission := range role.Permissions() {
+			if !seen[permission] {
+				seen[permission] = true
+				sr.Permissions = append(sr.Permissions, permission)
+			}
+		}
+	}
+}
+
+// Can - Есть ли право на доске boardID. При boardID 0 подходят только глобальные роли
+func (sr *SessionResponse) Can(permission string, boardID int64) bool {
+	for _, role := range sr.Roles {
+		if role.grants(permission, boardID) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole - Есть ли глобальная роль
+func (sr *SessionResponse) HasRole(role string) bool {
+	for _, r := range sr.Roles {
+		if r.Role == role && r.BoardID == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+//--
+// Middleware
+//--
+
+// RequirePermission - Пускает только тех, у кого есть право.
+// Роль на доске подходит, если топик или сама доска уже в контексте
+func RequirePermission(permission string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth, ok := r.Context().Value(AuthCtxKey{}).(*SessionResponse)
+			if !ok {
+				render.Render(w, r, ErrForbidden(errors.New("Authorization required")))
+				return
+			}
+
+			if !auth.Can(permission, permissionBoardID(r)) {
+				render.Render(w, r, ErrForbidden(errors.New("Permission denied")))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// permissionBoardID - Доска, на которой проверяется право. 0 - только глобальные роли
+func permissionBoardID(r *http.Request) int64 {
+	if topic, ok := r.Context().Value(TopicCtxKey{}).(*Topic); ok {
+		return topic.BoardID
+	}
+	if board, ok := r.Context().Value(BoardCtxKey{}).(*Board); ok {
+		return board.ID
+	}
+	return 0
+}
+
+//--
+// Handler methods
+//--
+
+// RolesGet - Роли пользователя, они и так видны по бейджам
+func (rs *usersResource) RolesGet(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(UserCtxKey{}).(*User)
+
+	roles, err := rs.storage.GetUserRoles(user.ID)
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	if err := render.RenderList(w, r, NewRolesListResponse(roles)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// RoleGrant - Выдает роль. Админ выдает любую, владелец доски - модератора на своей доске
+func (rs *usersResource) RoleGrant(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(UserCtxKey{}).(*User)
+
+	if user.ID == 1 {
+		render.Render(w, r, ErrBadRequest(errors.New("Anonymous can not have roles")))
+		return
+	}
+
+	role, errResponse := rs.bindRole(r)
+	if errResponse != nil {
+		render.Render(w, r, errResponse)
+		return
+	}
+	role.UserID = user.ID
+	role.CreatedAt = time.Now().Unix()
+
+	err := rs.storage.WithTx(r.Context(), func(tx Storage) error {
+		if err := tx.CreateUserRole(role); err != nil {
+			return err
+		}
+
+		entry := &ModLogEntry{BoardID: role.BoardID, TargetType: "user", TargetID: user.ID, Action: "grant"}
+		return logModeration(tx, r, entry, nil, roleModState(role))
+	})
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, role)
+}
+
+// RoleRevoke - Снимает роль, права те же, что на выдачу
+func (rs *usersResource) RoleRevoke(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(UserCtxKey{}).(*User)
+
+	role, errResponse := rs.bindRole(r)
+	if errResponse != nil {
+		render.Render(w, r, errResponse)
+		return
+	}
+
+	err := rs.storage.WithTx(r.Context(), func(tx Storage) error {
+		if err := tx.DeleteUserRole(user.ID, role.Role, role.BoardID); err != nil {
+			return err
+		}
+
+		entry := &ModLogEntry{BoardID: role.BoardID, TargetType: "user", TargetID: user.ID, Action: "revoke"}
+		return logModeration(tx, r, entry, roleModState(role), nil)
+	})
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// bindRole - Разбирает запрос и проверяет, может ли текущий юзер
+// распоряжаться этой ролью
+func (rs *usersResource) bindRole(r *http.Request) (*UserRole, render.Renderer) {
+	auth, ok := r.Context().Value(AuthCtxKey{}).(*SessionResponse)
+	if !ok {
+		return nil, ErrForbidden(errors.New("Authorization required"))
+	}
+
+	request := &RoleRequest{}
+	if err := request.Bind(r); err != nil {
+		return nil, ErrBadRequest(err)
+	}
+
+	role := &UserRole{Role: request.Role, Board: request.Board}
+	if request.Board != "" {
+		board, err := rs.storage.GetBoardBySlug(request.Board)
+		if err != nil {
+			return nil, ErrBadRequest(errors.New("Board not found"))
+		}
+		role.BoardID = board.ID
+	}
+
+	allowed := auth.HasRole(RoleAdmin) ||
+		role.Role == RoleModerator && role.BoardID != 0 && auth.Can(PermRolesManage, role.BoardID)
+	if !allowed {
+		return nil, ErrForbidden(errors.New("Permission denied"))
+	}
+
+	return role, nil
+}
+
+//--
+// Badges
+//--
+
+// authorsRoles - Роли авторов по ID. Анонима пропускаем
+func authorsRoles(storage Storage, userIDs []int64) (map[int64][]*UserRole, error) {
+	ids := []int64{}
+	seen := map[int64]bool{1: true}
+	for _, id := range userIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	roles := map[int64][]*UserRole{}
+	if len(ids) == 0 {
+		return roles, nil
+	}
+
+	rows, err := storage.GetRolesByUserIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range rows {
+		roles[role.UserID] = append(roles[role.UserID], role)
+	}
+
+	return roles, nil
+}
+
+// badgeRole - Старшая роль автора, действующая на доске поста
+func badgeRole(roles []*UserRole, boardID int64) string {
+	badge := ""
+	for _, role := range roles {
+		if role.BoardID != 0 && role.BoardID != boardID {
+			continue
+		}
+		if roleRanks[role.Role] > roleRanks[badge] {
+			badge = role.Role
+		}
+	}
+	return badge
+}
+
+// setTopicsBadges - Заполняет IsAdmin и бейдж роли у авторов топиков
+func setTopicsBadges(storage Storage, topics ...*Topic) error {
+	ids := []int64{}
+	for _, topic := range topics {
+		ids = append(ids, topic.UserID)
+	}
+
+	roles, err := authorsRoles(storage, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, topic := range topics {
+		topic.User.Role = badgeRole(roles[topic.UserID], topic.BoardID)
+		topic.User.IsAdmin = topic.User.Role == RoleAdmin
+	}
+
+	return nil
+}
+
+// setCommentsBadges - То же для комментариев топика с доски boardID
+func setCommentsBadges(storage Storage, boardID int64, comments ...*Comment) error {
+	ids := []int64{}
+	for _, comment := range comments {
+		ids = append(ids, comment.UserID)
+	}
+
+	roles, err := authorsRoles(storage, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, comment := range comments {
+		comment.User.Role = badgeRole(roles[comment.UserID], boardID)
+		comment.User.IsAdmin = comment.User.Role == RoleAdmin
+	}
+
+	return nil
+}
+
+// NewRolesListResponse - Условности CHI
+func NewRolesListResponse(roles []*UserRole) []render.Renderer {
+	list := []render.Renderer{}
+	for _, role := range roles {
+		list = append(list, role)
+	}
+	return list
+}
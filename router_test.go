@@ -0,0 +1,2131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yuriygr/go-board/uploader"
+)
+
+// testAPI - Поднимает /v1 поверх MemoryStorage и cookie-сессий.
+// Не забываем defer api.Close()
+type testAPI struct {
+	t       *testing.T
+	server  *httptest.Server
+	client  *http.Client
+	storage *MemoryStorage
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	return newLimitedTestAPI(t, RateLimits{})
+}
+
+// newLimitedTestAPI - То же с лимитами частоты, пустые RateLimits - без лимитов
+func newLimitedTestAPI(t *testing.T, limits RateLimits) *testAPI {
+	storage := NewMemoryStorage()
+	storage.AddBoard(&Board{Title: "Random", Slug: "b", Type: "normal", Available: true})
+	storage.AddBoard(&Board{Title: "Technology", Slug: "t", Type: "normal", Available: true})
+
+	limiter := &RateLimiter{NewMemoryRateStore(), limits}
+	server := httptest.NewServer(NewRouter(storage, NewCookieSession([]byte("test-key")), limiter))
+
+	jar, _ := cookiejar.New(nil)
+
+	return &testAPI{t, server, &http.Client{Jar: jar}, storage}
+}
+
+// do - Выполняет запрос и декодирует JSON ответа в out
+func (api *testAPI) do(method, path string, form url.Values, out interface{}) int {
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+
+	contentType := ""
+	if form != nil {
+		contentType = "application/x-www-form-urlencoded"
+	}
+
+	return api.send(method, path, body, contentType, out)
+}
+
+// testFile - Файл для multipart-запроса
+type testFile struct {
+	Field       string
+	Name        string
+	ContentType string
+	Body        []byte
+}
+
+// doMultipart - Как do, но форма и файлы уходят multipart'ом
+func (api *testAPI) doMultipart(method, path string, form url.Values, files []testFile, out interface{}) int {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	for key, values := range form {
+		for _, value := range values {
+			writer.WriteField(key, value)
+		}
+	}
+	for _, file := range files {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="`+file.Field+`"; filename="`+file.Name+`"`)
+		header.Set("Content-Type", file.ContentType)
+		part, _ := writer.CreatePart(header)
+		part.Write(file.Body)
+	}
+	writer.Close()
+
+	return api.send(method, path, body, writer.FormDataContentType(), out)
+}
+
+func (api *testAPI) send(method, path string, body io.Reader, contentType string, out interface{}) int {
+	req, err := http.NewRequest(method, api.server.URL+path, body)
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := api.client.Do(req)
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			api.t.Fatalf("%s %s: decode: %s", method, path, err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func (api *testAPI) Close() {
+	api.server.Close()
+}
+
+// storageDir - Временный STORAGE_PATH, вернет функцию для уборки
+func storageDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "go-board")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := os.Getenv("STORAGE_PATH")
+	os.Setenv("STORAGE_PATH", dir)
+
+	return func() {
+		os.Setenv("STORAGE_PATH", old)
+		os.RemoveAll(dir)
+	}
+}
+
+// testPNG - PNG заданного размера
+func testPNG(width, height int) []byte {
+	buf := &bytes.Buffer{}
+	png.Encode(buf, image.NewRGBA(image.Rect(0, 0, width, height)))
+	return buf.Bytes()
+}
+
+func (api *testAPI) createTopic(board, subject string) *Topic {
+	topic := &Topic{}
+	form := url.Values{"board": {board}, "subject": {subject}, "message": {"Some long enough message"}}
+	if code := api.do("POST", "/v1/topics/", form, topic); code != http.StatusCreated {
+		api.t.Fatalf("create topic: got %d; want %d", code, http.StatusCreated)
+	}
+	return topic
+}
+
+func (api *testAPI) createComment(topicID int64, message string) *Comment {
+	comment := &Comment{}
+	path := "/v1/topics/" + itoa(topicID) + "/comments"
+	if code := api.do("POST", path, url.Values{"message": {message}}, comment); code != http.StatusCreated {
+		api.t.Fatalf("create comment: got %d; want %d", code, http.StatusCreated)
+	}
+	return comment
+}
+
+func TestBoardsList(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.Close()
+
+	boards := []*Board{}
+	if code := api.do("GET", "/v1/boards/", nil, &boards); code != http.StatusOK {
+		t.Fatalf("got %d; want %d", code, http.StatusOK)
+	}
+
+	if len(boards) != 2 || boards[0].Slug != "b" || boards[1].Slug != "t" {
+		t.Errorf("got %+v; want boards b and t", boards)
+	}
+}
+
+func TestTopicsFlow(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.Close()
+
+	first := api.createTopic("b", "First")
+	api.createTopic("b", "Second")
+	api.createTopic("t", "Other board")
+
+	if first.Board.Slug != "b" || first.User.ScreenName != "Anonymous" {
+		t.Errorf("got %+v; want topic on /b/ by Anonymous", first)
+	}
+
+	comment := api.createComment(first.ID, "Hello there")
+
+	topic := &Topic{}
+	if code := api.do("GET", "/v1/topics/"+itoa(first.ID)+"/", nil, topic); code != http.StatusOK {
+		t.Fatalf("got %d; want %d", code, http.StatusOK)
+	}
+	if topic.CommentsCount != 1 {
+		t.Errorf("got comments_count %d; want 1", topic.CommentsCount)
+	}
+	if topic.BumpedAt != comment.CreatedAt {
+		t.Errorf("got bumped_at %d; want %d", topic.BumpedAt, comment.CreatedAt)
+	}
+
+	topics := []*Topic{}
+	api.do("GET", "/v1/topics/?slug=b", nil, &topics)
+	if len(topics) != 2 {
+		t.Fatalf("got %d topics; want 2", len(topics))
+	}
+
+	comments := []*Comment{}
+	api.do("GET", "/v1/topics/"+itoa(first.ID)+"/comments", nil, &comments)
+	if len(comments) != 1 || comments[0].Message != "Hello there" {
+		t.Errorf("got %+v; want one comment", comments)
+	}
+}
+
+func TestTopicCreateValidation(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.Close()
+
+	testCases := []struct {
+		name string
+		form url.Values
+		want int
+	}{
+		{"No board", url.Values{"subject": {"Subj"}, "message": {"Some long enough message"}}, http.StatusBadRequest},
+		{"Unknown board", url.Values{"board": {"nope"}, "subject": {"Subj"}, "message": {"Some long enough message"}}, http.StatusBadRequest},
+		{"Short message", url.Values{"board": {"b"}, "subject": {"Subj"}, "message": {"short"}}, http.StatusBadRequest},
+		{"Long message", url.Values{"board": {"b"}, "subject": {"Subj"}, "message": {strings.Repeat("~~a ", maxMessageLength)}}, http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := api.do("POST", "/v1/topics/", tc.form, nil); got != tc.want {
+				t.Errorf("got %d; want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUsersFlow(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.Close()
+
+	form := url.Values{"username": {"mario"}, "password": {"princess"}, "password_confirm": {"princess"}}
+	created := &SuccessResponse{}
+	if code := api.do("POST", "/v1/users/create", form, created); code != http.StatusCreated {
+		t.Fatalf("create: got %d; want %d", code, http.StatusCreated)
+	}
+
+	if code := api.do("GET", "/v1/users/session", nil, nil); code != http.StatusCreated {
+		t.Errorf("session: got %d; want %d", code, http.StatusCreated)
+	}
+
+	topic := api.createTopic("b", "From mario")
+	if topic.User.ScreenName != "mario" {
+		t.Errorf("got author %s; want mario", topic.User.ScreenName)
+	}
+
+	statistic := &UserStatistic{}
+	if code := api.do("GET", "/v1/users/"+itoa(topic.User.ID)+"/statistic", nil, statistic); code != http.StatusOK {
+		t.Fatalf("statistic: got %d; want %d", code, http.StatusOK)
+	}
+
+	// Logged in again
+	if code := api.do("POST", "/v1/users/login", form, nil); code != http.StatusBadRequest {
+		t.Errorf("login: got %d; want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.Close()
+
+	testCases := []struct {
+		name string
+		path string
+		want int
+	}{
+		{"Topic", "/v1/topics/100/", http.StatusNotFound},
+		{"User", "/v1/users/100/", http.StatusNotFound},
+		{"Page", "/v1/pages/about/", http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := api.do("GET", tc.path, nil, nil); got != tc.want {
+				t.Errorf("got %d; want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReplies(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.Close()
+
+	// Номера топиков и комментариев идут раздельно, разводим их
+	api.createTopic("b", "Padding")
+	api.createTopic("b", "Padding")
+
+	topic := api.createTopic("b", "Replies")
+	first := api.createComment(topic.ID, "first")
+	second := api.createComment(topic.ID, ">>"+itoa(first.ID)+" >>"+itoa(topic.ID)+" >>999")
+
+	if !strings.Contains(second.Message, `href="/b/`+itoa(topic.ID)+`#`+itoa(first.ID)+`"`) {
+		t.Errorf("got message %s; want link to first comment", second.Message)
+	}
+	if !strings.Contains(second.Message, "&gt;&gt;999") || strings.Contains(second.Message, `data-id="999"`) {
+		t.Errorf("got message %s; want >>999 left as text", second.Message)
+	}
+
+	want := []*PostRef{{topic.ID, first.ID}, {topic.ID, 0}}
+	if len(second.RepliesTo) != len(want) || *second.RepliesTo[0] != *want[0] || *second.RepliesTo[1] != *want[1] {
+		t.Errorf("got replies_to %v; want %v", second.RepliesTo, want)
+	}
+
+	comments := []*Comment{}
+	api.do("GET", "/v1/topics/"+itoa(topic.ID)+"/comments", nil, &comments)
+	if len(comments[0].RepliedBy) != 1 || comments[0].RepliedBy[0].CommentID != second.ID {
+		t.Errorf("got replied_by %v; want [%d]", comments[0].RepliedBy, second.ID)
+	}
+
+	got := &Topic{}
+	api.do("GET", "/v1/topics/"+itoa(topic.ID)+"/", nil, got)
+	if len(got.RepliedBy) != 1 || got.RepliedBy[0].CommentID != second.ID {
+		t.Errorf("got topic replied_by %v; want [%d]", got.RepliedBy, second.ID)
+	}
+
+	// Повторы не считаются, ссылки сверх лимита остаются текстом
+	flood := strings.Repeat(">>"+itoa(first.ID)+" ", 100)
+	for i := 0; i < maxReplyRefs; i++ {
+		flood += ">>" + itoa(int64(1000+i)) + " "
+	}
+	flooded := api.createComment(topic.ID, flood+">>"+itoa(topic.ID))
+	if len(flooded.RepliesTo) != 1 || strings.Contains(flooded.Message, `data-id="`+itoa(topic.ID)+`"`) {
+		t.Errorf("got replies_to %v; want only the first %d refs resolved", flooded.RepliesTo, maxReplyRefs)
+	}
+
+	// Cross board link
+	form := url.Values{"board": {"t"}, "subject": {"Cross"}, "message": {"Look at >>>/b/" + itoa(topic.ID) + " and >>>/t/" + itoa(topic.ID)}}
+	cross := &Topic{}
+	api.do("POST", "/v1/topics/", form, cross)
+	if len(cross.RepliesTo) != 1 || *cross.RepliesTo[0] != (PostRef{topic.ID, 0}) {
+		t.Errorf("got replies_to %v; want only link to /b/ topic", cross.RepliesTo)
+	}
+}
+
+func TestTags(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.Close()
+
+	form := url.Values{"board": {"b"}, "subject": {"Tagged"}, "message": {"Talking about #Golang and #chi"}}
+	tagged := &Topic{}
+	if code := api.do("POST", "/v1/topics/", form, tagged); code != http.StatusCreated {
+		t.Fatalf("got %d; want %d", code, http.StatusCreated)
+	}
+	if !strings.Contains(tagged.Message, `<a class="markup --tag" href="/tags/golang">#Golang</a>`) {
+		t.Errorf("got message %s; want tag link", tagged.Message)
+	}
+
+	plain := api.createTopic("t", "Plain")
+	api.createComment(plain.ID, "me too #golang")
+	api.createTopic("b", "Untagged")
+
+	topics := []*Topic{}
+	if code := api.do("GET", "/v1/tags/golang/topics", nil, &topics); code != http.StatusOK {
+		t.Fatalf("got %d; want %d", code, http.StatusOK)
+	}
+	if len(topics) != 2 {
+		t.Errorf("got %d topics; want 2", len(topics))
+	}
+
+	// Регистр тега не важен
+	topics = []*Topic{}
+	api.do("GET", "/v1/tags/GoLang/topics?slug=b", nil, &topics)
+	if len(topics) != 1 || topics[0].ID != tagged.ID {
+		t.Errorf("got %+v; want only tagged topic", topics)
+	}
+
+	tags := []*Tag{}
+	if code := api.do("GET", "/v1/tags/trending", nil, &tags); code != http.StatusOK {
+		t.Fatalf("got %d; want %d", code, http.StatusOK)
+	}
+	want := []Tag{{"golang", 2}, {"chi", 1}}
+	if len(tags) != len(want) || *tags[0] != want[0] || *tags[1] != want[1] {
+		t.Errorf("got %v; want %v", tags, want)
+	}
+
+	tags = []*Tag{}
+	api.do("GET", "/v1/tags/trending?limit=1", nil, &tags)
+	if len(tags) != 1 {
+		t.Errorf("got %d tags; want 1", len(tags))
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	defer storageDir(t)()
+
+	api := newTestAPI(t)
+	defer api.Close()
+
+	uploaded := &File{}
+	files := []testFile{{"file", "cat.png", "image/png", testPNG(640, 480)}}
+	if code := api.doMultipart("POST", "/v1/uploader/upload", nil, files, uploaded); code != http.StatusCreated {
+		t.Fatalf("upload: got %d; want %d", code, http.StatusCreated)
+	}
+	if uploaded.ID == 0 || uploaded.Resolution != "640x480" {
+		t.Errorf("got %+v; want saved 640x480 file", uploaded)
+	}
+	if stored, _ := filepath.Glob(filepath.Join(os.Getenv("STORAGE_PATH"), "*-thumb.png")); len(stored) != 1 {
+		t.Errorf("got thumbnails %v; want one", stored)
+	}
+
+	form := url.Values{"board": {"b"}, "subject": {"Cats"}, "message": {"Some long enough message"}, "files": {itoa(uploaded.ID)}}
+	topic := &Topic{}
+	if code := api.do("POST", "/v1/topics/", form, topic); code != http.StatusCreated {
+		t.Fatalf("topic: got %d; want %d", code, http.StatusCreated)
+	}
+	if topic.FilesCount != 1 || len(topic.Attachments) != 1 || topic.Attachments[0].ID != uploaded.ID {
+		t.Errorf("got %+v; want topic with uploaded file", topic.Attachments)
+	}
+
+	// Inline multipart file
+	files = []testFile{{"file", "dog.png", "image/png", testPNG(10, 10)}}
+	comment := &Comment{}
+	path := "/v1/topics/" + itoa(topic.ID) + "/comments"
+	if code := api.doMultipart("POST", path, url.Values{"message": {"Inline"}}, files, comment); code != http.StatusCreated {
+		t.Fatalf("comment: got %d; want %d", code, http.StatusCreated)
+	}
+
+	comments := []*Comment{}
+	api.do("GET", path, nil, &comments)
+	if len(comments) != 1 || len(comments[0].Attachments) != 1 || comments[0].Attachments[0].Resolution != "10x10" {
+		t.Errorf("got %+v; want comment with inline file", comments)
+	}
+
+	// Unknown file rolls back the whole post
+	form.Set("files", "999")
+	if code := api.do("POST", "/v1/topics/", form, nil); code != http.StatusBadRequest {
+		t.Errorf("unknown file: got %d; want %d", code, http.StatusBadRequest)
+	}
+
+	statistic, _ := api.storage.GetUserStatistic(1)
+	if statistic.Statistic.UploadedFiles != 2 {
+		t.Errorf("got uploaded_files %d; want 2", statistic.Statistic.UploadedFiles)
+	}
+}
+
+// setenv - Подменяет переменные окружения, вернет функцию для отката
+func setenv(env map[string]string) func() {
+	old := map[string]string{}
+	for key, value := range env {
+		old[key] = os.Getenv(key)
+		os.Setenv(key, value)
+	}
+
+	return func() {
+		for key, value := range old {
+			os.Setenv(key, value)
+		}
+	}
+}
+
+// Тело без Content-Length обрезается по лимиту и отбивается с 413
+func TestLimitBody(t *testing.T) {
+	defer setenv(map[string]string{"UPLOAD_MAX_FILE_BYTES": "1000", "UPLOAD_MAX_PER_POST": "1"})()
+	limit := uploadLimits().MaxRequestBytes()
+
+	handler := LimitBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	send := func(size int64) int {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", "a.bin")
+		part.Write(make([]byte, size))
+		writer.Close()
+
+		req := httptest.NewRequest("POST", "/v1/uploader/upload", ioutil.NopCloser(body))
+		req.ContentLength = -1
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := send(limit / 2); code != http.StatusNoContent {
+		t.Errorf("within limit: got %d; want %d", code, http.StatusNoContent)
+	}
+	if code := send(limit); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("over limit: got %d; want %d", code, http.StatusRequestEntityTooLarge)
+	}
+
+	// Ровно limit байт - еще не превышение
+	body := &limitedBody{ReadCloser: ioutil.NopCloser(bytes.NewReader(make([]byte, 10))), left: 10}
+	if data, err := ioutil.ReadAll(body); err != nil || len(data) != 10 || body.exceeded {
+		t.Errorf("exact limit: got %d bytes, %v; want 10 bytes", len(data), err)
+	}
+	body = &limitedBody{ReadCloser: ioutil.NopCloser(bytes.NewReader(make([]byte, 11))), left: 10}
+	if data, err := ioutil.ReadAll(body); err != ErrRequestTooLarge || len(data) != 10 || !body.exceeded {
+		t.Errorf("over limit: got %d bytes, %v; want 10 bytes and %v", len(data), err, ErrRequestTooLarge)
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	defer storageDir(t)()
+	defer setenv(map[string]string{
+		"UPLOAD_MAX_FILE_BYTES": "20000",
+		"UPLOAD_MAX_WIDTH":      "1000",
+		"UPLOAD_MAX_HEIGHT":     "1000",
+		"UPLOAD_MAX_PIXELS":     "250000",
+		"UPLOAD_MAX_PER_POST":   "2",
+		"UPLOAD_MAX_PER_TOPIC":  "3",
+	})()
+
+	api := newTestAPI(t)
+	defer api.Close()
+	api.storage.AddBoard(&Board{Title: "Small", Slug: "s", Type: "normal", Available: true, MaxFilesBytes: 1000})
+
+	small := testPNG(10, 10)
+	png := func(body []byte) testFile { return testFile{"file", "a.png", "image/png", body} }
+
+	noise := make([]byte, 30000)
+	for i := range noise {
+		noise[i] = byte(i * 7)
+	}
+
+	uploads := []struct {
+		name     string
+		file     testFile
+		want     int
+		wantType string
+	}{
+		{"Ok", png(small), http.StatusCreated, "png"},
+		{"Too many bytes", png(append(testPNG(10, 10), noise...)), http.StatusRequestEntityTooLarge, ""},
+		{"Too wide", png(testPNG(1001, 1)), http.StatusUnprocessableEntity, ""},
+		{"Too many pixels", png(testPNG(600, 600)), http.StatusUnprocessableEntity, ""},
+		{"Not an image", png([]byte("GIF89a, honestly")), http.StatusUnprocessableEntity, ""},
+		{"Lying header", testFile{"file", "a.gif", "image/gif", small}, http.StatusCreated, "png"},
+	}
+
+	for _, tc := range uploads {
+		t.Run(tc.name, func(t *testing.T) {
+			file := &File{}
+			code := api.doMultipart("POST", "/v1/uploader/upload", nil, []testFile{tc.file}, file)
+			if code != tc.want {
+				t.Errorf("got %d; want %d", code, tc.want)
+			}
+			if tc.wantType != "" && file.Type != tc.wantType {
+				t.Errorf("got type %s; want %s", file.Type, tc.wantType)
+			}
+		})
+	}
+
+	// AVIF не поддерживается, и клиенту говорится об этом прямо
+	avif := testFile{"file", "a.avif", "image/avif", []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00mif1miafmp41")}
+	resp := &ErrResponse{}
+	if code := api.doMultipart("POST", "/v1/uploader/upload", nil, []testFile{avif}, resp); code != http.StatusUnprocessableEntity || resp.StatusText != ErrAVIF.Error() {
+		t.Errorf("avif: got %d %q; want %d %q", code, resp.StatusText, http.StatusUnprocessableEntity, ErrAVIF.Error())
+	}
+
+	form := url.Values{"board": {"b"}, "subject": {"Limits"}, "message": {"Some long enough message"}}
+	topic := &Topic{}
+	if code := api.doMultipart("POST", "/v1/topics/", form, []testFile{png(testPNG(1, 1)), png(testPNG(2, 2))}, topic); code != http.StatusCreated {
+		t.Fatalf("topic: got %d; want %d", code, http.StatusCreated)
+	}
+
+	path := "/v1/topics/" + itoa(topic.ID) + "/comments"
+	posts := []struct {
+		name  string
+		files int
+		want  int
+	}{
+		{"Per post", 3, http.StatusUnprocessableEntity},
+		{"Per topic", 2, http.StatusUnprocessableEntity},
+		{"Last one", 1, http.StatusCreated},
+	}
+
+	for _, tc := range posts {
+		t.Run(tc.name, func(t *testing.T) {
+			files := []testFile{}
+			for i := 0; i < tc.files; i++ {
+				files = append(files, png(testPNG(20+i, 20)))
+			}
+			if code := api.doMultipart("POST", path, url.Values{"message": {"files"}}, files, nil); code != tc.want {
+				t.Errorf("got %d; want %d", code, tc.want)
+			}
+		})
+	}
+
+	// Доска со своим лимитом в 1000 байт
+	form.Set("board", "s")
+	if code := api.doMultipart("POST", "/v1/topics/", form, []testFile{png(testPNG(300, 300))}, nil); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("board: got %d; want %d", code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestFileDedup(t *testing.T) {
+	defer storageDir(t)()
+
+	api := newTestAPI(t)
+	defer api.Close()
+
+	meme := []testFile{{"file", "meme.png", "image/png", testPNG(32, 32)}}
+
+	first, second := &File{}, &File{}
+	api.doMultipart("POST", "/v1/uploader/upload", nil, meme, first)
+	if code := api.doMultipart("POST", "/v1/uploader/upload", nil, meme, second); code != http.StatusCreated {
+		t.Fatalf("got %d; want %d", code, http.StatusCreated)
+	}
+	if first.ID == 0 || second.ID != first.ID {
+		t.Errorf("got IDs %d and %d; want same file", first.ID, second.ID)
+	}
+	if stored, _ := filepath.Glob(filepath.Join(os.Getenv("STORAGE_PATH"), "*.png")); len(stored) != 2 {
+		t.Errorf("got %v; want one original and one thumbnail", stored)
+	}
+
+	form := url.Values{"board": {"b"}, "subject": {"Meme"}, "message": {"Some long enough message"}, "files": {itoa(first.ID)}}
+	topic := &Topic{}
+	api.do("POST", "/v1/topics/", form, topic)
+	comment := &Comment{}
+	path := "/v1/topics/" + itoa(topic.ID) + "/comments"
+	api.doMultipart("POST", path, url.Values{"message": {"Again"}}, meme, comment)
+	api.createComment(topic.ID, "No files")
+
+	posts := &FilePosts{}
+	if code := api.do("GET", "/v1/files/"+itoa(first.ID)+"/posts", nil, posts); code != http.StatusOK {
+		t.Fatalf("got %d; want %d", code, http.StatusOK)
+	}
+	if len(posts.Topics) != 1 || posts.Topics[0].ID != topic.ID || len(posts.Comments) != 1 || posts.Comments[0].ID != comment.ID {
+		t.Errorf("got %+v; want topic %d and comment %d", posts, topic.ID, comment.ID)
+	}
+
+	// Удаленные посты анониму не показываются
+	deleted, _ := api.storage.GetCommentByID(comment.ID)
+	deleted.States.IsDeleted = 1
+	api.storage.UpdateComment(deleted)
+	posts = &FilePosts{}
+	api.do("GET", "/v1/files/"+itoa(first.ID)+"/posts", nil, posts)
+	if len(posts.Comments) != 1 || posts.Comments[0].Message != "" || len(posts.Comments[0].Attachments) != 0 {
+		t.Errorf("got %+v; want deleted comment hidden", posts.Comments)
+	}
+
+	deletedTopic, _ := api.storage.GetTopicByID(topic.ID)
+	deletedTopic.States.IsDeleted = true
+	api.storage.UpdateTopic(deletedTopic)
+	posts = &FilePosts{}
+	api.do("GET", "/v1/files/"+itoa(first.ID)+"/posts", nil, posts)
+	if len(posts.Topics) != 0 || len(posts.Comments) != 0 {
+		t.Errorf("got %+v; want no posts from deleted topic", posts)
+	}
+
+	if code := api.do("GET", "/v1/files/999/posts", nil, nil); code != http.StatusNotFound {
+		t.Errorf("got %d; want %d", code, http.StatusNotFound)
+	}
+
+	// Banned hash
+	api.storage.CreateFileBan(&FileBan{Md5: first.Md5, Reason: "spam"})
+	if code := api.doMultipart("POST", "/v1/uploader/upload", nil, meme, nil); code != http.StatusForbidden {
+		t.Errorf("banned: got %d; want %d", code, http.StatusForbidden)
+	}
+}
+
+// testGradientPNG - Непустая картинка, у пустых одинаковый dHash
+func testGradientPNG(width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8((x*3*255/width + y*255/height) % 256) // Пила по диагонали
+			img.Set(x, y, color.RGBA{v, v / 2, 255 - v, 255})
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	png.Encode(buf, img)
+	return buf.Bytes()
+}
+
+func TestPerceptualBan(t *testing.T) {
+	defer storageDir(t)()
+	defer setenv(map[string]string{"PHASH_ACTION": "reject"})()
+
+	api := newTestAPI(t)
+	defer api.Close()
+
+	upload := func(body []byte) (*File, int) {
+		file := &File{}
+		code := api.doMultipart("POST", "/v1/uploader/upload", nil, []testFile{{"file", "a.png", "image/png", body}}, file)
+		return file, code
+	}
+
+	original, _ := upload(testGradientPNG(200, 150))
+	banPath := "/v1/files/" + itoa(original.ID) + "/ban"
+
+	if code := api.do("POST", banPath, url.Values{"reason": {"spam"}}, nil); code != http.StatusForbidden {
+		t.Errorf("anonymous ban: got %d; want %d", code, http.StatusForbidden)
+	}
+
+	form := url.Values{"username": {"mod"}, "password": {"password"}, "password_confirm": {"password"}}
+	api.do("POST", "/v1/users/create", form, nil)
+
+	if code := api.do("POST", banPath, url.Values{"reason": {"spam"}}, nil); code != http.StatusForbidden {
+		t.Errorf("user ban: got %d; want %d", code, http.StatusForbidden)
+	}
+	api.storage.CreateUserRole(&UserRole{UserID: 2, Role: RoleModerator})
+
+	ban := &FileBan{}
+	if code := api.do("POST", banPath, url.Values{"reason": {"spam"}}, ban); code != http.StatusCreated {
+		t.Fatalf("ban: got %d; want %d", code, http.StatusCreated)
+	}
+	if ban.Md5 != original.Md5 || len(ban.Phash) != 16 {
+		t.Errorf("got %+v; want ban with md5 and phash", ban)
+	}
+
+	// Забаненный файл не прикрепить и по номеру
+	post := func(fileID int64) int {
+		form := url.Values{"board": {"b"}, "subject": {"Repost"}, "message": {"Some long enough message"}, "files": {itoa(fileID)}}
+		return api.do("POST", "/v1/topics/", form, nil)
+	}
+	if code := post(original.ID); code != http.StatusForbidden {
+		t.Errorf("banned file by id: got %d; want %d", code, http.StatusForbidden)
+	}
+
+	// Уменьшенная копия, md5 другой
+	if _, code := upload(testGradientPNG(100, 75)); code != http.StatusForbidden {
+		t.Errorf("resized copy: got %d; want %d", code, http.StatusForbidden)
+	}
+	if _, code := upload(testPNG(100, 75)); code != http.StatusCreated {
+		t.Errorf("other image: got %d; want %d", code, http.StatusCreated)
+	}
+
+	os.Setenv("PHASH_ACTION", "flag")
+	flagged, code := upload(testGradientPNG(120, 90))
+	if code != http.StatusCreated {
+		t.Fatalf("flag mode: got %d; want %d", code, http.StatusCreated)
+	}
+
+	files := []*File{}
+	api.do("GET", "/v1/files/flagged", nil, &files)
+	if len(files) != 1 || files[0].ID != flagged.ID {
+		t.Errorf("got flagged %+v; want file %d", files, flagged.ID)
+	}
+
+	// Файл на проверке прикрепляет только модератор
+	modClient := api.client
+	api.client = &http.Client{}
+	if code := post(flagged.ID); code != http.StatusForbidden {
+		t.Errorf("flagged file by id: got %d; want %d", code, http.StatusForbidden)
+	}
+	api.client = modClient
+	if code := post(flagged.ID); code != http.StatusCreated {
+		t.Errorf("flagged file by moderator: got %d; want %d", code, http.StatusCreated)
+	}
+
+	api.do("POST", "/v1/files/"+itoa(flagged.ID)+"/approve", nil, nil)
+	files = []*File{}
+	api.do("GET", "/v1/files/flagged", nil, &files)
+	if len(files) != 0 {
+		t.Errorf("got flagged %+v after approve; want none", files)
+	}
+}
+
+func TestUploadStripsMetadata(t *testing.T) {
+	defer storageDir(t)()
+
+	originals, err := ioutil.TempDir("", "originals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(originals)
+	defer setenv(map[string]string{"ORIGINALS_PATH": originals})()
+
+	api := newTestAPI(t)
+	defer api.Close()
+
+	buf := &bytes.Buffer{}
+	jpeg.Encode(buf, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil)
+
+	// APP1 с EXIF сразу после SOI
+	exif := "Exif\x00\x00GPS 59.43N 24.75E"
+	segment := []byte{0xFF, 0xE1, 0, byte(len(exif) + 2)}
+	photo := append(append(append([]byte{}, buf.Bytes()[:2]...), append(segment, exif...)...), buf.Bytes()[2:]...)
+
+	file := &File{}
+	files := []testFile{{"file", "photo.jpg", "image/jpeg", photo}}
+	if code := api.doMultipart("POST", "/v1/uploader/upload", nil, files, file); code != http.StatusCreated {
+		t.Fatalf("got %d; want %d", code, http.StatusCreated)
+	}
+
+	stored, _ := filepath.Glob(filepath.Join(os.Getenv("STORAGE_PATH"), "*[^b].jpeg"))
+	if len(stored) != 1 {
+		t.Fatalf("got %v; want one stored original", stored)
+	}
+	content, _ := ioutil.ReadFile(stored[0])
+	if bytes.Contains(content, []byte("GPS")) {
+		t.Error("got EXIF in stored file")
+	}
+	if file.Size != int64(len(content)) || file.Md5 != fmt.Sprintf("%x", md5.Sum(content)) {
+		t.Errorf("got size %d md5 %s; want those of sanitized file", file.Size, file.Md5)
+	}
+
+	kept, _ := filepath.Glob(filepath.Join(originals, "*.jpeg"))
+	if len(kept) != 1 {
+		t.Fatalf("got %v; want one kept original", kept)
+	}
+	if content, _ := ioutil.ReadFile(kept[0]); !bytes.Equal(content, photo) {
+		t.Error("got modified private original")
+	}
+}
+
+func TestUploadS3(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		key := strings.TrimPrefix(r.URL.Path, "/board/")
+		switch r.Method {
+		case "PUT":
+			objects[key], _ = ioutil.ReadAll(r.Body)
+		case "GET":
+			if _, ok := objects[key]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(objects[key])
+		case "DELETE":
+			delete(objects, key)
+		}
+	}))
+	defer bucket.Close()
+
+	defer setenv(map[string]string{
+		"BLOB_STORE":    "s3",
+		"S3_ENDPOINT":   bucket.URL,
+		"S3_BUCKET":     "board",
+		"S3_PUBLIC_URL": "https://cdn.example",
+	})()
+
+	api := newTestAPI(t)
+	defer api.Close()
+
+	file := &File{}
+	files := []testFile{{"file", "cat.png", "image/png", testPNG(300, 100)}}
+	if code := api.doMultipart("POST", "/v1/uploader/upload", nil, files, file); code != http.StatusCreated {
+		t.Fatalf("got %d; want %d", code, http.StatusCreated)
+	}
+
+	stored, _ := api.storage.GetFileByID(file.ID)
+	if file.Origin != "https://cdn.example/"+stored.Key() || file.Thumb != "https://cdn.example/"+stored.ThumbKey() {
+		t.Errorf("got %s and %s; want bucket URLs", file.Origin, file.Thumb)
+	}
+	if len(objects) != 2 || objects[stored.Key()] == nil || objects[stored.ThumbKey()] == nil {
+		t.Errorf("got %d objects; want file and thumbnail", len(objects))
+	}
+
+	// thumbnails пересоздает потерянную миниатюру
+	delete(objects, stored.ThumbKey())
+	created, failed, err := writeThumbnails(api.storage, blobStore(), false)
+	if err != nil || created != 1 || failed != 0 || objects[stored.ThumbKey()] == nil {
+		t.Errorf("got %d created, %d failed, %v; want thumbnail back", created, failed, err)
+	}
+	if created, _, _ := writeThumbnails(api.storage, blobStore(), false); created != 0 {
+		t.Errorf("got %d created; want existing thumbnail kept", created)
+	}
+}
+
+func TestServeImages(t *testing.T) {
+	defer storageDir(t)()
+	defer setenv(map[string]string{"SERVE_IMAGES": "true"})()
+
+	api := newTestAPI(t)
+	defer api.Close()
+
+	file := &File{}
+	files := []testFile{{"file", "cat.png", "image/png", testPNG(300, 100)}}
+	if code := api.doMultipart("POST", "/v1/uploader/upload", nil, files, file); code != http.StatusCreated {
+		t.Fatalf("got %d; want %d", code, http.StatusCreated)
+	}
+	stored, _ := api.storage.GetFileByID(file.ID)
+	content, _ := ioutil.ReadFile(filepath.Join(os.Getenv("STORAGE_PATH"), stored.Key()))
+
+	get := func(name string, header map[string]string) (*http.Response, []byte) {
+		req, _ := http.NewRequest("GET", api.server.URL+"/images/"+name, nil)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := api.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, body := get(stored.Key(), nil)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, content) {
+		t.Fatalf("got %d with %d bytes; want stored file", resp.StatusCode, len(body))
+	}
+	if resp.Header.Get("Content-Type") != "image/png" || resp.Header.Get("ETag") != `"`+stored.Md5+`"` ||
+		!strings.Contains(resp.Header.Get("Cache-Control"), "immutable") {
+		t.Errorf("got headers %v", resp.Header)
+	}
+
+	resp, body = get(stored.Key(), map[string]string{"Range": "bytes=0-9"})
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, content[:10]) ||
+		resp.Header.Get("Content-Range") != fmt.Sprintf("bytes 0-9/%d", len(content)) {
+		t.Errorf("range: got %d %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+
+	resp, _ = get(stored.Key(), map[string]string{"If-None-Match": `"` + stored.Md5 + `"`})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("etag: got %d; want %d", resp.StatusCode, http.StatusNotModified)
+	}
+
+	// Потерянная миниатюра создается при первом запросе
+	thumbPath := filepath.Join(os.Getenv("STORAGE_PATH"), stored.ThumbKey())
+	os.Remove(thumbPath)
+	resp, body = get(stored.ThumbKey(), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("thumb: got %d; want %d", resp.StatusCode, http.StatusOK)
+	}
+	if img, _, err := image.Decode(bytes.NewReader(body)); err != nil || img.Bounds().Dx() != 200 {
+		t.Errorf("got thumb %v; want 200px wide png", err)
+	}
+	if _, err := os.Stat(thumbPath); err != nil {
+		t.Errorf("got %v; want thumbnail written back", err)
+	}
+
+	for _, name := range []string{stored.UUID + ".jpeg", "00000000-0000-0000-0000-000000000000.png", "nope.png"} {
+		if resp, _ := get(name, nil); resp.StatusCode != http.StatusNotFound || resp.Header.Get("Cache-Control") != "" {
+			t.Errorf("%s: got %d; want uncached 404", name, resp.StatusCode)
+		}
+	}
+}
+
+func TestGarbageCollector(t *testing.T) {
+	defer storageDir(t)()
+	dir := os.Getenv("STORAGE_PATH")
+
+	api := newTestAPI(t)
+	defer api.Close()
+
+	upload := func(width int) *File {
+		file := &File{}
+		files := []testFile{{"file", "cat.png", "image/png", testPNG(width, 10)}}
+		if code := api.doMultipart("POST", "/v1/uploader/upload", nil, files, file); code != http.StatusCreated {
+			t.Fatalf("got %d; want %d", code, http.StatusCreated)
+		}
+		stored, _ := api.storage.GetFileByID(file.ID)
+		return stored
+	}
+
+	attached, orphan := upload(10), upload(20)
+	form := url.Values{"board": {"b"}, "subject": {"Cats"}, "message": {"Some long enough message"}, "files": {itoa(attached.ID)}}
+	if code := api.do("POST", "/v1/topics/", form, nil); code != http.StatusCreated {
+		t.Fatalf("topic: got %d; want %d", code, http.StatusCreated)
+	}
+
+	// Блоб от откатившейся загрузки и чужой файл в каталоге
+	stray := "00000000-0000-0000-0000-000000000000.png"
+	ioutil.WriteFile(filepath.Join(dir, stray), []byte("stray"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("keep"), 0644)
+
+	exists := func(key string) bool {
+		_, err := os.Stat(filepath.Join(dir, key))
+		return err == nil
+	}
+	stores := []uploader.BlobStore{blobStore()}
+
+	// Свежие файлы не трогаем
+	report, err := collectGarbage(api.storage, stores, GCOptions{Grace: time.Hour})
+	if err != nil || report.Files != 0 || report.Blobs != 0 {
+		t.Errorf("grace: got %+v, %v; want nothing", report, err)
+	}
+
+	// Отрицательный grace - все уже старое
+	old := GCOptions{Grace: -time.Minute, DryRun: true}
+	report, err = collectGarbage(api.storage, stores, old)
+	if err != nil || report.Files != 1 || report.Blobs != 1 || report.Bytes == 0 {
+		t.Errorf("dry run: got %+v, %v; want 1 file and 1 blob", report, err)
+	}
+	if !exists(orphan.Key()) || !exists(stray) {
+		t.Error("dry run deleted files")
+	}
+
+	old.DryRun = false
+	deleted, err := collectGarbage(api.storage, stores, old)
+	if err != nil || *deleted != *report {
+		t.Errorf("got %+v, %v; want same as dry run %+v", deleted, err, report)
+	}
+	if exists(orphan.Key()) || exists(orphan.ThumbKey()) || exists(stray) {
+		t.Error("got orphan blobs left")
+	}
+	if _, err := api.storage.GetFileByID(orphan.ID); err == nil {
+		t.Error("got orphan row left")
+	}
+	if !exists(attached.Key()) || !exists(attached.ThumbKey()) || !exists("notes.txt") {
+		t.Error("got attached or foreign file deleted")
+	}
+}
+
+// testMP4 - Минимальный MP4: ftyp и moov с видеодорожкой, длина в миллисекундах
+func testMP4(width, height, millis int) []byte {
+	box := func(kind string, payload ...[]byte) []byte {
+		body := bytes.Join(payload, nil)
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint32(header, uint32(8+len(body)))
+		copy(header[4:], kind)
+		return append(header, body...)
+	}
+
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], uint32(millis))
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], uint32(width)<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], uint32(height)<<16)
+	hdlr := append(make([]byte, 8), "vide\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"...)
+
+	return bytes.Join([][]byte{
+		box("ftyp", []byte("mp42\x00\x00\x00\x00isommp42")),
+		box("moov", box("mvhd", mvhd), box("trak", box("tkhd", tkhd), box("mdia", box("hdlr", hdlr)))),
+		box("mdat", []byte("frames")),
+	}, nil)
+}
+
+func TestVideoUpload(t *testing.T) {
+	defer storageDir(t)()
+	dir := os.Getenv("STORAGE_PATH")
+
+	// Вместо ffmpeg скрипт, который отдает готовый кадр
+	frame := filepath.Join(dir, ".frame.png")
+	ioutil.WriteFile(frame, testGradientPNG(64, 36), 0644)
+	ffmpeg := filepath.Join(dir, ".ffmpeg")
+	ioutil.WriteFile(ffmpeg, []byte("#!/bin/sh\ncat "+frame+"\n"), 0755)
+
+	defer setenv(map[string]string{
+		"FFMPEG_PATH":         filepath.Join(dir, ".missing"),
+		"UPLOAD_MAX_DURATION": "60",
+	})()
+
+	api := newTestAPI(t)
+	defer api.Close()
+
+	upload := func(body []byte, out interface{}) int {
+		files := []testFile{{"file", "clip.mp4", "video/mp4", body}}
+		return api.doMultipart("POST", "/v1/uploader/upload", nil, files, out)
+	}
+
+	// Без ffmpeg постер - заглушка
+	file := &File{}
+	if code := upload(testMP4(640, 360, 2500), file); code != http.StatusCreated {
+		t.Fatalf("got %d; want %d", code, http.StatusCreated)
+	}
+	if file.Kind != "video" || file.Type != "mp4" || file.Duration != 2.5 || file.Resolution != "640x360" {
+		t.Errorf("got %+v; want 640x360 mp4 video of 2.5s", file)
+	}
+	stored, _ := api.storage.GetFileByID(file.ID)
+	if !strings.HasSuffix(file.Thumb, stored.UUID+"-thumb.jpeg") || stored.Phash != "" {
+		t.Errorf("got thumb %s, phash %q; want jpeg poster and no phash", file.Thumb, stored.Phash)
+	}
+	poster, _ := ioutil.ReadFile(filepath.Join(dir, stored.ThumbKey()))
+	if img, format, err := image.Decode(bytes.NewReader(poster)); err != nil || format != "jpeg" || img.Bounds().Dx() != 200 {
+		t.Errorf("got poster %s, %v; want 200px jpeg", format, err)
+	}
+
+	// С ffmpeg постер из кадра, по нему же phash
+	os.Setenv("FFMPEG_PATH", ffmpeg)
+	file = &File{}
+	if code := upload(testMP4(640, 360, 3000), file); code != http.StatusCreated {
+		t.Fatalf("got %d; want %d", code, http.StatusCreated)
+	}
+	if stored, _ := api.storage.GetFileByID(file.ID); stored.Phash == "" || stored.Phash == "0000000000000000" {
+		t.Errorf("got phash %q; want hash of extracted frame", stored.Phash)
+	}
+
+	testCases := []struct {
+		name string
+		body []byte
+	}{
+		{"Too long", testMP4(640, 360, 61000)},
+		{"No video track", testMP4(0, 0, 2500)},
+		{"No moov", testMP4(640, 360, 2500)[:24]},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := upload(tc.body, nil); code != http.StatusUnprocessableEntity {
+				t.Errorf("got %d; want %d", code, http.StatusUnprocessableEntity)
+			}
+		})
+	}
+}
+
+// testWebP - Однотонный lossless WebP 64x48, как testWebP в uploader
+var testWebP = []byte("RIFF\x1a\x00\x00\x00WEBPVP8L\x0d\x00\x00\x00\x2f\x3f\xc0\x0b\x10\x28\x64\x41\x0a\xdd\xff\x02\x00\x00")
+
+func TestWebPUpload(t *testing.T) {
+	defer storageDir(t)()
+	dir := os.Getenv("STORAGE_PATH")
+
+	// Вместо ffmpeg скрипт, который всегда отдает готовый WebP
+	encoded := filepath.Join(dir, ".encoded.webp")
+	ioutil.WriteFile(encoded, testWebP, 0644)
+	ffmpeg := filepath.Join(dir, ".ffmpeg")
+	ioutil.WriteFile(ffmpeg, []byte("#!/bin/sh\ncat >/dev/null\ncat "+encoded+"\n"), 0755)
+
+	defer setenv(map[string]string{
+		"FFMPEG_PATH":          filepath.Join(dir, ".missing"),
+		"THUMB_TRANSCODE":      "",
+		"THUMB_TRANSCODE_SIZE": "1000",
+	})()
+
+	api := newTestAPI(t)
+	defer api.Close()
+
+	upload := func(name string, body []byte) (*File, *File) {
+		file := &File{}
+		files := []testFile{{"file", name, "application/octet-stream", body}}
+		if code := api.doMultipart("POST", "/v1/uploader/upload", nil, files, file); code != http.StatusCreated {
+			t.Fatalf("got %d for %s; want %d", code, name, http.StatusCreated)
+		}
+		stored, _ := api.storage.GetFileByID(file.ID)
+		return file, stored
+	}
+	thumbFormat := func(stored *File) string {
+		thumb, _ := ioutil.ReadFile(filepath.Join(dir, stored.ThumbKey()))
+		_, format, _ := image.DecodeConfig(bytes.NewReader(thumb))
+		return format
+	}
+
+	// WebP кодировать нечем, миниатюра в PNG
+	file, stored := upload("photo.webp", testWebP)
+	if file.Type != "webp" || file.ThumbType != "png" || file.Resolution != "64x48" {
+		t.Errorf("got %+v; want 64x48 webp with png thumb", file)
+	}
+	if !strings.HasSuffix(file.Origin, stored.UUID+".webp") || !strings.HasSuffix(file.Thumb, stored.UUID+"-thumb.png") {
+		t.Errorf("got %s and %s", file.Origin, file.Thumb)
+	}
+	if format := thumbFormat(stored); format != "png" {
+		t.Errorf("got thumb %s; want png", format)
+	}
+
+	// Политика выключена - как у оригинала
+	if file, _ := upload("heavy.png", testGradientPNG(300, 200)); file.ThumbType != "png" {
+		t.Errorf("got %s thumb; want png without policy", file.ThumbType)
+	}
+
+	// Тяжелый PNG получает JPEG-миниатюру, оригинал не трогаем
+	os.Setenv("THUMB_TRANSCODE", "jpeg")
+	file, stored = upload("heavy.png", testGradientPNG(300, 201))
+	if file.Type != "png" || file.ThumbType != "jpeg" || !strings.HasSuffix(file.Thumb, "-thumb.jpeg") {
+		t.Errorf("got %s with %s thumb; want png with jpeg thumb", file.Type, file.Thumb)
+	}
+	if format := thumbFormat(stored); format != "jpeg" {
+		t.Errorf("got thumb %s; want jpeg", format)
+	}
+	if original, _ := ioutil.ReadFile(filepath.Join(dir, stored.Key())); !bytes.Equal(original, testGradientPNG(300, 201)) {
+		t.Error("got modified original")
+	}
+	if file, _ := upload("light.png", testPNG(4, 4)); file.ThumbType != "png" {
+		t.Errorf("got %s thumb for small png; want png", file.ThumbType)
+	}
+
+	// С ffmpeg - WebP, в том числе для WebP-оригиналов
+	os.Setenv("THUMB_TRANSCODE", "webp")
+	os.Setenv("FFMPEG_PATH", ffmpeg)
+	file, stored = upload("heavy.png", testGradientPNG(300, 202))
+	if file.ThumbType != "webp" || thumbFormat(stored) != "webp" {
+		t.Errorf("got %s thumb; want webp", file.ThumbType)
+	}
+
+	// ffmpeg без libwebp - обратно к встроенным форматам
+	ioutil.WriteFile(ffmpeg, []byte("#!/bin/sh\necho 'Unknown encoder libwebp' >&2\nexit 1\n"), 0755)
+	file, stored = upload("heavy.png", testGradientPNG(300, 203))
+	if file.ThumbType != "jpeg" || thumbFormat(stored) != "jpeg" {
+		t.Errorf("got %s thumb; want jpeg fallback", file.ThumbType)
+	}
+}
+
+func TestUploadSessions(t *testing.T) {
+	defer storageDir(t)()
+
+	parts, err := ioutil.TempDir("", "parts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parts)
+	defer setenv(map[string]string{"UPLOAD_SESSIONS_PATH": parts})()
+
+	api := newTestAPI(t)
+	defer api.Close()
+
+	content := testGradientPNG(120, 80)
+	half := len(content) / 2
+
+	create := func(checksum string) *UploadSession {
+		session := &UploadSession{}
+		form := url.Values{"name": {"big.png"}, "size": {itoa(int64(len(content)))}, "checksum": {checksum}}
+		if code := api.do("POST", "/v1/uploader/sessions", form, session); code != http.StatusCreated {
+			t.Fatalf("create: got %d; want %d", code, http.StatusCreated)
+		}
+		return session
+	}
+
+	// PATCH с заголовком смещения, send его не умеет
+	patch := func(id string, offset int, chunk []byte) (int, string) {
+		req, _ := http.NewRequest("PATCH", api.server.URL+"/v1/uploader/sessions/"+id, bytes.NewReader(chunk))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", itoa(int64(offset)))
+		resp, err := api.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("Upload-Offset")
+	}
+
+	form := url.Values{"size": {"10"}, "checksum": {"crc32:abcd"}}
+	if code := api.do("POST", "/v1/uploader/sessions", form, nil); code != http.StatusBadRequest {
+		t.Errorf("bad checksum: got %d; want %d", code, http.StatusBadRequest)
+	}
+
+	sum := sha256.Sum256(content)
+	session := create(fmt.Sprintf("sha256:%X", sum))
+	if session.Offset != 0 || session.Size != int64(len(content)) || session.ExpiresAt <= time.Now().Unix() {
+		t.Fatalf("got %+v", session)
+	}
+	path := "/v1/uploader/sessions/" + session.ID
+
+	if code, offset := patch(session.ID, 0, content[:half]); code != http.StatusOK || offset != itoa(int64(half)) {
+		t.Fatalf("first chunk: got %d, offset %s", code, offset)
+	}
+
+	// Повтор того же куска после обрыва - 409 и где продолжать
+	if code, offset := patch(session.ID, 0, content[:half]); code != http.StatusConflict || offset != itoa(int64(half)) {
+		t.Errorf("stale offset: got %d, offset %s; want 409 at %d", code, offset, half)
+	}
+	resumed := &UploadSession{}
+	if code := api.do("GET", path, nil, resumed); code != http.StatusOK || resumed.Offset != int64(half) {
+		t.Errorf("got %d, offset %d; want %d", code, resumed.Offset, half)
+	}
+	if code := api.do("POST", path+"/finalize", nil, nil); code != http.StatusConflict {
+		t.Errorf("incomplete: got %d; want %d", code, http.StatusConflict)
+	}
+
+	if code, _ := patch(session.ID, half, append(content[half:], 'x')); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("overflow: got %d; want %d", code, http.StatusRequestEntityTooLarge)
+	}
+	if code, _ := patch(session.ID, half, content[half:]); code != http.StatusOK {
+		t.Fatalf("last chunk: got %d", code)
+	}
+
+	file := &File{}
+	if code := api.do("POST", path+"/finalize", nil, file); code != http.StatusCreated {
+		t.Fatalf("finalize: got %d; want %d", code, http.StatusCreated)
+	}
+	if file.Md5 != fmt.Sprintf("%x", md5.Sum(content)) || file.Resolution != "120x80" {
+		t.Errorf("got %+v; want 120x80 png", file)
+	}
+	if code := api.do("GET", path, nil, nil); code != http.StatusNotFound {
+		t.Errorf("finalized session: got %d; want %d", code, http.StatusNotFound)
+	}
+	if left, _ := ioutil.ReadDir(parts); len(left) != 0 {
+		t.Errorf("got %d part files left", len(left))
+	}
+
+	// Битая сборка удаляется целиком
+	session = create(fmt.Sprintf("md5:%x", md5.Sum([]byte("other"))))
+	patch(session.ID, 0, content)
+	if code := api.do("POST", "/v1/uploader/sessions/"+session.ID+"/finalize", nil, nil); code != http.StatusUnprocessableEntity {
+		t.Errorf("checksum mismatch: got %d; want %d", code, http.StatusUnprocessableEntity)
+	}
+	if _, err := api.storage.GetUploadSession(session.ID); err == nil {
+		t.Error("got session left after checksum mismatch")
+	}
+
+	// Забаненный посреди загрузки ее не завершит
+	session = create(fmt.Sprintf("md5:%x", md5.Sum(content)))
+	patch(session.ID, 0, content)
+	api.storage.CreateBan(&Ban{IP: "127.0.0.1", Reason: "Wipe", CreatedAt: time.Now().Unix()})
+	if code := api.do("POST", "/v1/uploader/sessions/"+session.ID+"/finalize", nil, nil); code != http.StatusForbidden {
+		t.Errorf("banned finalize: got %d; want %d", code, http.StatusForbidden)
+	}
+
+	// Просроченная недоступна, ее part-файл убирает сборщик
+	expired := &UploadSession{ID: "00000000-0000-0000-0000-000000000001", UserID: 1, Size: 10, Offset: 4, ExpiresAt: time.Now().Unix() - 1}
+	api.storage.CreateUploadSession(expired)
+	ioutil.WriteFile(expired.partPath(), []byte("part"), 0600)
+
+	if code := api.do("GET", "/v1/uploader/sessions/"+expired.ID, nil, nil); code != http.StatusNotFound {
+		t.Errorf("expired: got %d; want %d", code, http.StatusNotFound)
+	}
+	report, err := collectGarbage(api.storage, nil, GCOptions{Grace: time.Hour})
+	if err != nil || report.Sessions != 1 {
+		t.Errorf("got %+v, %v; want 1 expired session", report, err)
+	}
+	if _, err := os.Stat(expired.partPath()); !os.IsNotExist(err) {
+		t.Error("got expired part file left")
+	}
+}
+
+// signup - Регистрирует пользователя в новой cookie-сессии и возвращает его сессию
+func (api *testAPI) signup(username string) *SessionResponse {
+	jar, _ := cookiejar.New(nil)
+	api.client = &http.Client{Jar: jar}
+
+	form := url.Values{"username": {username}, "password": {"password"}, "password_confirm": {"password"}}
+	if code := api.do("POST", "/v1/users/create", form, nil); code != http.StatusCreated {
+		api.t.Fatalf("signup %s: got %d; want %d", username, code, http.StatusCreated)
+	}
+
+	return api.session()
+}
+
+// session - Текущая сессия с ролями и правами
+func (api *testAPI) session() *SessionResponse {
+	response := &struct{ Payload *SessionResponse }{}
+	api.do("GET", "/v1/users/session", nil, response)
+	return response.Payload
+}
+
+func TestRoles(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.Close()
+
+	admin := api.signup("admin")
+	owner := api.signup("owner")
+	mod := api.signup("mod")
+
+	if len(mod.Roles) != 1 || mod.Roles[0].Role != RoleUser || len(mod.Permissions) != 0 {
+		t.Errorf("got roles %+v, permissions %v; want only user", mod.Roles, mod.Permissions)
+	}
+	if code := api.do("GET", "/v1/files/flagged", nil, nil); code != http.StatusForbidden {
+		t.Errorf("user flagged: got %d; want %d", code, http.StatusForbidden)
+	}
+	if code := api.do("POST", "/v1/users/"+itoa(mod.User.ID)+"/roles", url.Values{"role": {"admin"}}, nil); code != http.StatusForbidden {
+		t.Errorf("self grant: got %d; want %d", code, http.StatusForbidden)
+	}
+
+	// Первый админ - из консоли, дальше через API
+	api.storage.CreateUserRole(&UserRole{UserID: admin.User.ID, Role: RoleAdmin})
+	api.client.Jar, _ = cookiejar.New(nil)
+	api.do("POST", "/v1/users/login", url.Values{"username": {"admin"}, "password": {"password"}}, nil)
+
+	if session := api.session(); len(session.Permissions) != len(rolePermissions[RoleAdmin]) {
+		t.Errorf("admin: got permissions %v; want all", session.Permissions)
+	}
+	if code := api.do("GET", "/v1/files/flagged", nil, nil); code != http.StatusOK {
+		t.Errorf("admin flagged: got %d; want %d", code, http.StatusOK)
+	}
+	grant := func(userID int64, role, board string) int {
+		return api.do("POST", "/v1/users/"+itoa(userID)+"/roles", url.Values{"role": {role}, "board": {board}}, nil)
+	}
+	if code := grant(owner.User.ID, RoleBoardOwner, "b"); code != http.StatusCreated {
+		t.Fatalf("grant owner: got %d; want %d", code, http.StatusCreated)
+	}
+	if code := grant(owner.User.ID, "root", ""); code != http.StatusBadRequest {
+		t.Errorf("unknown role: got %d; want %d", code, http.StatusBadRequest)
+	}
+	if code := grant(1, RoleModerator, ""); code != http.StatusBadRequest {
+		t.Errorf("anonymous: got %d; want %d", code, http.StatusBadRequest)
+	}
+
+	// Владелец /b/ назначает модераторов только на /b/
+	api.client.Jar, _ = cookiejar.New(nil)
+	api.do("POST", "/v1/users/login", url.Values{"username": {"owner"}, "password": {"password"}}, nil)
+
+	want := []string{}
+	for _, permission := range rolePermissions[RoleBoardOwner] {
+		want = append(want, permission+"@b")
+	}
+	if session := api.session(); strings.Join(session.Permissions, ",") != strings.Join(want, ",") {
+		t.Errorf("owner: got permissions %v; want %v", session.Permissions, want)
+	}
+	if code := api.do("GET", "/v1/files/flagged", nil, nil); code != http.StatusForbidden {
+		t.Errorf("owner flagged: got %d; want %d", code, http.StatusForbidden)
+	}
+	if code := grant(mod.User.ID, RoleModerator, "t"); code != http.StatusForbidden {
+		t.Errorf("owner grants on /t/: got %d; want %d", code, http.StatusForbidden)
+	}
+	if code := grant(mod.User.ID, RoleAdmin, ""); code != http.StatusForbidden {
+		t.Errorf("owner grants admin: got %d; want %d", code, http.StatusForbidden)
+	}
+	if code := grant(mod.User.ID, RoleModerator, "b"); code != http.StatusCreated {
+		t.Errorf("owner grants on /b/: got %d; want %d", code, http.StatusCreated)
+	}
+
+	roles := []*UserRole{}
+	api.do("GET", "/v1/users/"+itoa(mod.User.ID)+"/roles", nil, &roles)
+	if len(roles) != 1 || roles[0].Role != RoleModerator || roles[0].Board != "b" {
+		t.Errorf("got roles %+v; want moderator on b", roles)
+	}
+
+	// Бейджи: роль на /b/ видна только на /b/
+	onB, onT := api.createTopic("b", "Owner on b"), api.createTopic("t", "Owner on t")
+	if onB.User.Role != RoleBoardOwner || onB.User.IsAdmin || onT.User.Role != "" {
+		t.Errorf("got badges %q on b, %q on t; want board-owner on b only", onB.User.Role, onT.User.Role)
+	}
+	comment := api.createComment(onB.ID, "Comment from the owner")
+	comments := []*Comment{}
+	api.do("GET", "/v1/topics/"+itoa(onB.ID)+"/comments", nil, &comments)
+	if comment.User.Role != RoleBoardOwner || len(comments) != 1 || comments[0].User.Role != RoleBoardOwner {
+		t.Errorf("got comment badges %q, %+v; want board-owner", comment.User.Role, comments)
+	}
+
+	api.client.Jar, _ = cookiejar.New(nil)
+	api.do("POST", "/v1/users/login", url.Values{"username": {"admin"}, "password": {"password"}}, nil)
+
+	topic := api.createTopic("t", "Admin on t")
+	if topic.User.Role != RoleAdmin || !topic.User.IsAdmin {
+		t.Errorf("got admin badge %q, is_admin %v", topic.User.Role, topic.User.IsAdmin)
+	}
+	topics := []*Topic{}
+	api.do("GET", "/v1/topics/?slug=t", nil, &topics)
+	for _, topic := range topics {
+		if want := topic.Subject == "Admin on t"; topic.User.IsAdmin != want {
+			t.Errorf("topic %q: got is_admin %v; want %v", topic.Subject, topic.User.IsAdmin, want)
+		}
+	}
+
+	// Снятая роль перестает действовать сразу
+	if code := api.do("DELETE", "/v1/users/"+itoa(owner.User.ID)+"/roles/board-owner?board=b", nil, nil); code != http.StatusNoContent {
+		t.Fatalf("revoke: got %d; want %d", code, http.StatusNoContent)
+	}
+	api.client.Jar, _ = cookiejar.New(nil)
+	api.do("POST", "/v1/users/login", url.Values{"username": {"owner"}, "password": {"password"}}, nil)
+	if session := api.session(); len(session.Permissions) != 0 {
+		t.Errorf("revoked: got permissions %v; want none", session.Permissions)
+	}
+}
+
+func TestModeration(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.Close()
+
+	topic := api.createTopic("b", "Moderated")
+	comment := api.createComment(topic.ID, "To be deleted")
+	topicPath := "/v1/topics/" + itoa(topic.ID)
+	commentPath := "/v1/comments/" + itoa(comment.ID)
+
+	if code := api.do("POST", topicPath+"/pin", nil, nil); code != http.StatusForbidden {
+		t.Errorf("anonymous pin: got %d; want %d", code, http.StatusForbidden)
+	}
+
+	anon := api.client
+	mod := api.signup("mod")
+	modClient := api.client
+	api.storage.CreateUserRole(&UserRole{UserID: mod.User.ID, Role: RoleModerator, BoardID: 1})
+
+	moderate := func(path string) *Topic {
+		updated := &Topic{}
+		if code := api.do("POST", path, nil, updated); code != http.StatusOK {
+			t.Fatalf("%s: got %d; want %d", path, code, http.StatusOK)
+		}
+		return updated
+	}
+
+	if updated := moderate(topicPath + "/pin"); !updated.States.IsPinned || updated.ID != topic.ID {
+		t.Errorf("pin: got %+v", updated.States)
+	}
+	if updated := moderate(topicPath + "/close"); !updated.States.IsClosed {
+		t.Errorf("close: got %+v", updated.States)
+	}
+	if code := api.do("POST", topicPath+"/comments", url.Values{"message": {"Closed"}}, nil); code != http.StatusForbidden {
+		t.Errorf("comment in closed topic: got %d; want %d", code, http.StatusForbidden)
+	}
+	if updated := moderate(topicPath + "/reopen"); updated.States.IsClosed || !updated.States.IsPinned {
+		t.Errorf("reopen: got %+v", updated.States)
+	}
+
+	// Удаленный топик видит только модератор
+	moderate(topicPath + "/delete")
+	api.client = anon
+	topics := []*Topic{}
+	api.do("GET", "/v1/topics/?slug=b", nil, &topics)
+	if len(topics) != 0 {
+		t.Errorf("got %d topics after delete; want 0", len(topics))
+	}
+	if code := api.do("GET", topicPath+"/", nil, nil); code != http.StatusNotFound {
+		t.Errorf("anonymous deleted topic: got %d; want %d", code, http.StatusNotFound)
+	}
+	if code := api.do("GET", topicPath+"/comments", nil, nil); code != http.StatusNotFound {
+		t.Errorf("anonymous deleted comments: got %d; want %d", code, http.StatusNotFound)
+	}
+	api.client = modClient
+	if updated := moderate(topicPath + "/restore"); updated.States.IsDeleted {
+		t.Errorf("restore: got %+v", updated.States)
+	}
+
+	// Роль только на /b/: на /t/ не перенести
+	if code := api.do("POST", topicPath+"/move", url.Values{"board": {"t"}}, nil); code != http.StatusForbidden {
+		t.Errorf("move without rights on target: got %d; want %d", code, http.StatusForbidden)
+	}
+	api.storage.CreateUserRole(&UserRole{UserID: mod.User.ID, Role: RoleModerator, BoardID: 2})
+	moved := &Topic{}
+	if code := api.do("POST", topicPath+"/move", url.Values{"board": {"t"}}, moved); code != http.StatusOK {
+		t.Fatalf("move: got %d; want %d", code, http.StatusOK)
+	}
+	if moved.Board.Slug != "t" {
+		t.Errorf("got board %s after move; want t", moved.Board.Slug)
+	}
+
+	// Комментарии
+	updated := &Comment{}
+	if code := api.do("POST", commentPath+"/pin", nil, updated); code != http.StatusOK || updated.States.IsPinned != 1 {
+		t.Errorf("comment pin: got %d, %+v", code, updated.States)
+	}
+	if code := api.do("POST", commentPath+"/delete", nil, updated); code != http.StatusOK || updated.States.IsDeleted != 1 || updated.Message == "" {
+		t.Errorf("comment delete: got %d, %+v; want deleted with message for moderator", code, updated)
+	}
+
+	api.client = anon
+	if code := api.do("POST", commentPath+"/restore", nil, nil); code != http.StatusForbidden {
+		t.Errorf("anonymous restore: got %d; want %d", code, http.StatusForbidden)
+	}
+	comments := []*Comment{}
+	api.do("GET", topicPath+"/comments", nil, &comments)
+	if len(comments) != 1 || comments[0].States.IsDeleted != 1 || comments[0].Message != "" {
+		t.Errorf("got %+v; want deleted comment without message", comments)
+	}
+	got := &Comment{}
+	if code := api.do("GET", commentPath+"/", nil, got); code != http.StatusOK || got.Message != "" {
+		t.Errorf("anonymous deleted comment: got %d, %q", code, got.Message)
+	}
+
+	api.client = modClient
+	if code := api.do("POST", commentPath+"/restore", nil, updated); code != http.StatusOK || updated.States.IsDeleted != 0 {
+		t.Errorf("comment restore: got %d, %+v", code, updated.States)
+	}
+}
+
+func TestModLog(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.Close()
+
+	onB, onT := api.createTopic("b", "On b"), api.createTopic("t", "On t")
+	anon := api.client
+
+	admin := api.signup("admin")
+	adminClient := api.client
+	api.storage.CreateUserRole(&UserRole{UserID: admin.User.ID, Role: RoleAdmin})
+
+	mod := api.signup("mod")
+	api.storage.CreateUserRole(&UserRole{UserID: mod.User.ID, Role: RoleModerator, BoardID: 1})
+
+	if code := api.do("POST", "/v1/topics/"+itoa(onB.ID)+"/pin", url.Values{"reason": {"Important"}}, nil); code != http.StatusOK {
+		t.Fatalf("pin: got %d; want %d", code, http.StatusOK)
+	}
+
+	log := func(query string) ([]*ModLogEntry, int) {
+		entries := []*ModLogEntry{}
+		code := api.do("GET", "/v1/mod/log/"+query, nil, nil)
+		if code == http.StatusOK {
+			api.do("GET", "/v1/mod/log/"+query, nil, &entries)
+		}
+		return entries, code
+	}
+
+	// Модератор доски видит журнал только по своей доске
+	if _, code := log(""); code != http.StatusForbidden {
+		t.Errorf("board moderator, whole log: got %d; want %d", code, http.StatusForbidden)
+	}
+	if _, code := log("?board=t"); code != http.StatusForbidden {
+		t.Errorf("board moderator, other board: got %d; want %d", code, http.StatusForbidden)
+	}
+	entries, code := log("?board=b")
+	if code != http.StatusOK || len(entries) != 1 {
+		t.Fatalf("board moderator: got %d, %d entries; want one", code, len(entries))
+	}
+	entry := entries[0]
+	if entry.Action != "pin" || entry.TargetType != "topic" || entry.TargetID != onB.ID || entry.Board != "b" ||
+		entry.Moderator != "mod" || entry.Reason != "Important" || entry.IP != "127.0.0.1" {
+		t.Errorf("got %+v; want pin of topic %d on b by mod", entry, onB.ID)
+	}
+	if !strings.Contains(string(entry.Before), `"is_pinned":false`) || !strings.Contains(string(entry.After), `"is_pinned":true`) {
+		t.Errorf("got before %s, after %s; want pin change", entry.Before, entry.After)
+	}
+
+	api.client = adminClient
+	api.do("POST", "/v1/topics/"+itoa(onT.ID)+"/delete", nil, nil)
+
+	testCases := []struct {
+		query string
+		want  int
+	}{
+		{"", 2},
+		{"?action=pin", 1},
+		{"?moderator=" + itoa(admin.User.ID), 1},
+		{"?board=t", 1},
+		{"?since=" + itoa(time.Now().Unix()+60), 0},
+		{"?until=" + itoa(time.Now().Unix()+60) + "&limit=1", 1},
+	}
+	for _, tc := range testCases {
+		if entries, code := log(tc.query); code != http.StatusOK || len(entries) != tc.want {
+			t.Errorf("%s: got %d, %d entries; want %d", tc.query, code, len(entries), tc.want)
+		}
+	}
+	if entries, _ := log(""); entries[0].Action != "delete" {
+		t.Errorf("got %s first; want newest entry first", entries[0].Action)
+	}
+	if _, code := log("?since=yesterday"); code != http.StatusBadRequest {
+		t.Errorf("bad since: got %d; want %d", code, http.StatusBadRequest)
+	}
+
+	// Публичный журнал без модераторов, IP и состояний
+	api.client = anon
+	if _, code := log(""); code != http.StatusForbidden {
+		t.Errorf("anonymous log: got %d; want %d", code, http.StatusForbidden)
+	}
+	entries = []*ModLogEntry{}
+	if code := api.do("GET", "/v1/mod/log/public", nil, &entries); code != http.StatusOK || len(entries) != 2 {
+		t.Fatalf("public log: got %d, %d entries; want 2", code, len(entries))
+	}
+	for _, entry := range entries {
+		if entry.ModeratorID != 0 || entry.Moderator != "" || entry.IP != "" || entry.Before != nil || entry.After != nil {
+			t.Errorf("got %+v; want redacted entry", entry)
+		}
+	}
+	if entries[1].Reason != "Important" || entries[1].Board != "b" {
+		t.Errorf("got %+v; want reason and board kept", entries[1])
+	}
+}
+
+func TestReports(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.Close()
+
+	topic := api.createTopic("b", "Reported")
+	comment := api.createComment(topic.ID, "Reported comment")
+	other := api.createTopic("t", "Other board")
+	anon := api.client
+
+	report := func(path string, form url.Values) (int, string) {
+		response := &SuccessResponse{}
+		code := api.do("POST", path, form, response)
+		return code, response.StatusText
+	}
+
+	testCases := []struct {
+		name string
+		path string
+		form url.Values
+		want int
+	}{
+		{"Topic", "/v1/topics/" + itoa(topic.ID) + "/report", url.Values{"category": {"spam"}}, http.StatusCreated},
+		{"Same anonymous", "/v1/topics/" + itoa(topic.ID) + "/report", url.Values{"category": {"abuse"}, "text": {"Rude"}}, http.StatusOK},
+		{"Comment", "/v1/comments/" + itoa(comment.ID) + "/report", url.Values{"category": {"offtopic"}}, http.StatusCreated},
+		{"Other board", "/v1/topics/" + itoa(other.ID) + "/report", url.Values{"category": {"illegal"}}, http.StatusCreated},
+		{"Unknown category", "/v1/topics/" + itoa(topic.ID) + "/report", url.Values{"category": {"boring"}}, http.StatusBadRequest},
+		{"Other without text", "/v1/topics/" + itoa(topic.ID) + "/report", url.Values{"category": {"other"}}, http.StatusBadRequest},
+		{"Missing topic", "/v1/topics/999/report", url.Values{"category": {"spam"}}, http.StatusNotFound},
+		{"Missing comment", "/v1/comments/999/report", url.Values{"category": {"spam"}}, http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		if code, _ := report(tc.path, tc.form); code != tc.want {
+			t.Errorf("%s: got %d; want %d", tc.name, code, tc.want)
+		}
+	}
+
+	// Вошедший юзер - отдельный жалобщик, даже с того же IP
+	api.signup("reporter")
+	if code, status := report("/v1/topics/"+itoa(topic.ID)+"/report", url.Values{"category": {"spam"}}); code != http.StatusCreated {
+		t.Errorf("user report: got %d %s; want %d", code, status, http.StatusCreated)
+	}
+
+	reports := func(query string) ([]*Report, int) {
+		list := []*Report{}
+		code := api.do("GET", "/v1/mod/reports/"+query, nil, nil)
+		if code == http.StatusOK {
+			api.do("GET", "/v1/mod/reports/"+query, nil, &list)
+		}
+		return list, code
+	}
+
+	if _, code := reports(""); code != http.StatusForbidden {
+		t.Errorf("user queue: got %d; want %d", code, http.StatusForbidden)
+	}
+
+	mod := api.signup("mod")
+	api.storage.CreateUserRole(&UserRole{UserID: mod.User.ID, Role: RoleModerator, BoardID: 1})
+
+	if _, code := reports(""); code != http.StatusForbidden {
+		t.Errorf("board moderator, whole queue: got %d; want %d", code, http.StatusForbidden)
+	}
+	queue, code := reports("?board=b")
+	if code != http.StatusOK || len(queue) != 3 {
+		t.Fatalf("board queue: got %d, %d reports; want 3", code, len(queue))
+	}
+	// Топик с двумя жалобами первым, повторная жалоба анонима обновила первую
+	first, second := queue[0], queue[1]
+	if first.TargetType != "topic" || first.TargetID != topic.ID || first.TargetReports != 2 || second.TargetReports != 2 {
+		t.Errorf("got %+v, %+v; want topic with 2 reports first", first, second)
+	}
+	if anonymous := second; anonymous.ReporterID != 1 || anonymous.Category != "abuse" || anonymous.Text != "Rude" || anonymous.ReporterIP != "127.0.0.1" {
+		t.Errorf("got %+v; want updated anonymous report", anonymous)
+	}
+	if queue[2].TargetType != "comment" || queue[2].TopicID != topic.ID || queue[2].Board != "b" {
+		t.Errorf("got %+v; want comment report", queue[2])
+	}
+
+	// Решение по одной жалобе закрывает все жалобы на пост
+	resolved := &Report{}
+	if code := api.do("POST", "/v1/mod/reports/"+itoa(first.ID)+"/resolve", url.Values{"reason": {"Deleted"}}, resolved); code != http.StatusOK {
+		t.Fatalf("resolve: got %d; want %d", code, http.StatusOK)
+	}
+	if resolved.Status != ReportResolved || resolved.ResolvedBy != mod.User.ID || resolved.TargetReports != 0 {
+		t.Errorf("got %+v; want resolved by mod", resolved)
+	}
+	if code := api.do("POST", "/v1/mod/reports/"+itoa(second.ID)+"/dismiss", nil, nil); code != http.StatusConflict {
+		t.Errorf("closed report: got %d; want %d", code, http.StatusConflict)
+	}
+	if code := api.do("POST", "/v1/mod/reports/"+itoa(queue[2].ID)+"/dismiss", nil, nil); code != http.StatusOK {
+		t.Errorf("dismiss: got %d; want %d", code, http.StatusOK)
+	}
+	if queue, _ := reports("?board=b"); len(queue) != 0 {
+		t.Errorf("got %d open reports; want 0", len(queue))
+	}
+	if queue, _ := reports("?board=b&status=resolved"); len(queue) != 2 {
+		t.Errorf("got %d resolved reports; want 2", len(queue))
+	}
+
+	// Чужая доска недоступна
+	otherReports, _ := api.storage.GetReports(&ReportsRequest{Status: ReportOpen, BoardID: 2, Page: 1, Limit: 10})
+	if len(otherReports) != 1 {
+		t.Fatalf("got %d reports on t; want 1", len(otherReports))
+	}
+	if code := api.do("POST", "/v1/mod/reports/"+itoa(otherReports[0].ID)+"/resolve", nil, nil); code != http.StatusForbidden {
+		t.Errorf("other board: got %d; want %d", code, http.StatusForbidden)
+	}
+
+	// После решения тот же жалобщик жалуется заново, закрытая жалоба не меняется
+	api.client = anon
+	if code, _ := report("/v1/topics/"+itoa(topic.ID)+"/report", url.Values{"category": {"spam"}}); code != http.StatusCreated {
+		t.Errorf("report after resolve: got %d; want %d", code, http.StatusCreated)
+	}
+	if code, _ := report("/v1/topics/"+itoa(topic.ID)+"/report", url.Values{"category": {"illegal"}}); code != http.StatusOK {
+		t.Errorf("repeated report after resolve: got %d; want %d", code, http.StatusOK)
+	}
+	if closed, _ := api.storage.GetReportByID(second.ID); closed.Status != ReportResolved || closed.Category != "abuse" {
+		t.Errorf("got %+v; want resolved report untouched", closed)
+	}
+	if reopened, _ := api.storage.GetReports(&ReportsRequest{Status: ReportOpen, BoardID: 1, Page: 1, Limit: 10}); len(reopened) != 1 || reopened[0].Category != "illegal" || reopened[0].ReporterID != 1 {
+		t.Errorf("got %d open reports; want one new anonymous report", len(reopened))
+	}
+
+	entries, _ := api.storage.GetModLog(&ModLogRequest{Page: 1, Limit: 10})
+	if len(entries) != 2 || entries[1].Action != "resolve" || entries[1].Reason != "Deleted" || entries[0].Action != "dismiss" {
+		t.Errorf("got %d log entries; want resolve and dismiss", len(entries))
+	}
+}
+
+func TestBans(t *testing.T) {
+	defer storageDir(t)()
+
+	api := newTestAPI(t)
+	defer api.Close()
+
+	anonTopic := api.createTopic("b", "Anonymous")
+	otherTopic := api.createTopic("t", "Elsewhere")
+	anon := api.client
+
+	victim := api.signup("victim")
+	victimClient := api.client
+	mod := api.signup("mod")
+	api.storage.CreateUserRole(&UserRole{UserID: mod.User.ID, Role: RoleModerator, BoardID: 1})
+	modClient := api.client
+	admin := api.signup("admin")
+	api.storage.CreateUserRole(&UserRole{UserID: admin.User.ID, Role: RoleAdmin})
+	adminClient := api.client
+
+	post := func(board string) int {
+		form := url.Values{"board": {board}, "subject": {"Banned?"}, "message": {"Some long enough message"}}
+		return api.do("POST", "/v1/topics/", form, nil)
+	}
+
+	// Модератор доски банит только на своей доске
+	api.client = modClient
+	form := url.Values{"user_id": {itoa(victim.User.ID)}, "reason": {"Spam"}, "duration": {"3600"}}
+	if code := api.do("POST", "/v1/mod/bans/", form, nil); code != http.StatusForbidden {
+		t.Errorf("global ban by board moderator: got %d; want %d", code, http.StatusForbidden)
+	}
+	form.Set("board", "b")
+	ban := &Ban{}
+	if code := api.do("POST", "/v1/mod/bans/", form, ban); code != http.StatusCreated {
+		t.Fatalf("ban: got %d; want %d", code, http.StatusCreated)
+	}
+	if ban.UserID != victim.User.ID || ban.Board != "b" || ban.ModeratorID != mod.User.ID || ban.ExpiresAt != ban.CreatedAt+3600 {
+		t.Errorf("got %+v; want victim banned on b for an hour", ban)
+	}
+
+	invalid := []url.Values{
+		{"user_id": {"1"}, "reason": {"Anon"}, "board": {"b"}},
+		{"ip": {"300.0.0.1"}, "reason": {"Bad IP"}, "board": {"b"}},
+		{"user_id": {"999"}, "reason": {"Nobody"}, "board": {"b"}},
+		{"user_id": {itoa(victim.User.ID)}, "board": {"b"}},
+		{"reason": {"Nothing"}, "board": {"b"}},
+	}
+	for _, form := range invalid {
+		if code := api.do("POST", "/v1/mod/bans/", form, nil); code != http.StatusBadRequest {
+			t.Errorf("%v: got %d; want %d", form, code, http.StatusBadRequest)
+		}
+	}
+
+	// Пост с чужой доски не годится, а адрес модератору доски не показывается
+	form = url.Values{"topic_id": {itoa(otherTopic.ID)}, "reason": {"Wipe"}, "board": {"b"}}
+	if code := api.do("POST", "/v1/mod/bans/", form, nil); code != http.StatusBadRequest {
+		t.Errorf("post on another board: got %d; want %d", code, http.StatusBadRequest)
+	}
+	boardBan := &Ban{}
+	form.Set("topic_id", itoa(anonTopic.ID))
+	if code := api.do("POST", "/v1/mod/bans/", form, boardBan); code != http.StatusCreated {
+		t.Fatalf("board ip ban: got %d; want %d", code, http.StatusCreated)
+	}
+	if boardBan.IP != "" {
+		t.Errorf("got ip %q; want hidden from board moderator", boardBan.IP)
+	}
+	lifted := &Ban{}
+	if code := api.do("DELETE", "/v1/mod/bans/"+itoa(boardBan.ID), nil, lifted); code != http.StatusOK || lifted.IP != "" {
+		t.Errorf("lift board ip ban: got %d, ip %q; want %d and hidden ip", code, lifted.IP, http.StatusOK)
+	}
+
+	// Уже вошедший юзер больше не пишет на доске бана, но пишет на других
+	api.client = victimClient
+	if code := post("b"); code != http.StatusForbidden {
+		t.Errorf("banned topic: got %d; want %d", code, http.StatusForbidden)
+	}
+	if code := api.do("POST", "/v1/topics/"+itoa(anonTopic.ID)+"/comments", url.Values{"message": {"Hi"}}, nil); code != http.StatusForbidden {
+		t.Errorf("banned comment: got %d; want %d", code, http.StatusForbidden)
+	}
+	if code := post("t"); code != http.StatusCreated {
+		t.Errorf("other board: got %d; want %d", code, http.StatusCreated)
+	}
+
+	bans := []*Ban{}
+	if code := api.do("GET", "/v1/bans/me", nil, &bans); code != http.StatusOK || len(bans) != 1 {
+		t.Fatalf("my bans: got %d, %d bans; want 1", code, len(bans))
+	}
+	if bans[0].Reason != "Spam" || bans[0].Board != "b" || bans[0].ModeratorID != 0 || bans[0].Appeal != nil {
+		t.Errorf("got %+v; want reason and board without moderator", bans[0])
+	}
+
+	appealPath := "/v1/bans/" + itoa(ban.ID) + "/appeal"
+	if code := api.do("POST", appealPath, nil, nil); code != http.StatusBadRequest {
+		t.Errorf("empty appeal: got %d; want %d", code, http.StatusBadRequest)
+	}
+	if code := api.do("POST", appealPath, url.Values{"text": {"It was not spam"}}, nil); code != http.StatusCreated {
+		t.Errorf("appeal: got %d; want %d", code, http.StatusCreated)
+	}
+	if code := api.do("POST", appealPath, url.Values{"text": {"Again"}}, nil); code != http.StatusConflict {
+		t.Errorf("second appeal: got %d; want %d", code, http.StatusConflict)
+	}
+	api.do("GET", "/v1/bans/me", nil, &bans)
+	if len(bans) != 1 || bans[0].Appeal == nil || bans[0].Appeal.Status != AppealOpen {
+		t.Errorf("got %+v; want open appeal", bans)
+	}
+
+	// На чужой бан апелляцию не подать
+	api.client = anon
+	if code := api.do("POST", appealPath, url.Values{"text": {"Me too"}}, nil); code != http.StatusNotFound {
+		t.Errorf("foreign appeal: got %d; want %d", code, http.StatusNotFound)
+	}
+
+	// Принятая апелляция снимает бан
+	api.client = modClient
+	appeals := []*BanAppeal{}
+	if code := api.do("GET", "/v1/mod/appeals/?board=b", nil, &appeals); code != http.StatusOK || len(appeals) != 1 {
+		t.Fatalf("appeals: got %d, %d appeals; want 1", code, len(appeals))
+	}
+	if appeals[0].BanReason != "Spam" || appeals[0].Text != "It was not spam" || appeals[0].UserID != victim.User.ID {
+		t.Errorf("got %+v; want victim appeal", appeals[0])
+	}
+	if code := api.do("POST", "/v1/mod/appeals/"+itoa(appeals[0].ID)+"/accept", nil, nil); code != http.StatusOK {
+		t.Errorf("accept: got %d; want %d", code, http.StatusOK)
+	}
+	if code := api.do("POST", "/v1/mod/appeals/"+itoa(appeals[0].ID)+"/reject", nil, nil); code != http.StatusConflict {
+		t.Errorf("answered appeal: got %d; want %d", code, http.StatusConflict)
+	}
+
+	api.client = victimClient
+	if code := post("b"); code != http.StatusCreated {
+		t.Errorf("after accepted appeal: got %d; want %d", code, http.StatusCreated)
+	}
+
+	// Аноним банится по IP своего поста
+	api.client = adminClient
+	ipBan := &Ban{}
+	form = url.Values{"topic_id": {itoa(anonTopic.ID)}, "reason": {"Wipe"}}
+	if code := api.do("POST", "/v1/mod/bans/", form, ipBan); code != http.StatusCreated {
+		t.Fatalf("ip ban: got %d; want %d", code, http.StatusCreated)
+	}
+	if ipBan.UserID != 0 || ipBan.IP != "127.0.0.1" || ipBan.Board != "" || ipBan.ExpiresAt != 0 {
+		t.Errorf("got %+v; want permanent global ban of 127.0.0.1", ipBan)
+	}
+
+	api.client = anon
+	if code := post("t"); code != http.StatusForbidden {
+		t.Errorf("anonymous topic: got %d; want %d", code, http.StatusForbidden)
+	}
+	files := []testFile{{"file", "cat.png", "image/png", testPNG(64, 64)}}
+	if code := api.doMultipart("POST", "/v1/uploader/upload", nil, files, nil); code != http.StatusForbidden {
+		t.Errorf("anonymous upload: got %d; want %d", code, http.StatusForbidden)
+	}
+	if code := api.do("POST", "/v1/bans/"+itoa(ipBan.ID)+"/appeal", url.Values{"text": {"Shared IP"}}, nil); code != http.StatusCreated {
+		t.Errorf("anonymous appeal: got %d; want %d", code, http.StatusCreated)
+	}
+
+	api.client = adminClient
+	list := []*Ban{}
+	if api.do("GET", "/v1/mod/bans/", nil, &list); len(list) != 1 || list[0].ID != ipBan.ID {
+		t.Errorf("got %d active bans; want only ip ban", len(list))
+	}
+	if code := api.do("DELETE", "/v1/mod/bans/"+itoa(ipBan.ID), nil, nil); code != http.StatusOK {
+		t.Errorf("lift: got %d; want %d", code, http.StatusOK)
+	}
+	if code := api.do("DELETE", "/v1/mod/bans/"+itoa(ipBan.ID), nil, nil); code != http.StatusConflict {
+		t.Errorf("lift again: got %d; want %d", code, http.StatusConflict)
+	}
+
+	api.client = anon
+	if code := post("t"); code != http.StatusCreated {
+		t.Errorf("after lift: got %d; want %d", code, http.StatusCreated)
+	}
+
+	// Апелляция на уже снятый бан принимается без повторного снятия
+	api.client = adminClient
+	if code := api.do("GET", "/v1/mod/appeals/", nil, &appeals); code != http.StatusOK || len(appeals) != 1 {
+		t.Fatalf("appeals: got %d, %d appeals; want 1", code, len(appeals))
+	}
+	if code := api.do("POST", "/v1/mod/appeals/"+itoa(appeals[0].ID)+"/accept", nil, nil); code != http.StatusOK {
+		t.Errorf("accept after lift: got %d; want %d", code, http.StatusOK)
+	}
+
+	entries, _ := api.storage.GetModLog(&ModLogRequest{Page: 1, Limit: 10})
+	actions := []string{}
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+	}
+	if strings.Join(actions, ",") != "accept_appeal,unban,ban,accept_appeal,unban,ban,ban" {
+		t.Errorf("got log %v; want bans, appeal and lift", actions)
+	}
+}
+
+func TestBanMatches(t *testing.T) {
+	testCases := []struct {
+		ban    Ban
+		userID int64
+		ip     string
+		want   bool
+	}{
+		{Ban{UserID: 5}, 5, "10.0.0.1", true},
+		{Ban{UserID: 5}, 6, "10.0.0.1", false},
+		{Ban{IP: "10.0.0.1"}, 1, "10.0.0.1", true},
+		{Ban{IP: "10.0.0.1"}, 1, "10.0.0.2", false},
+		{Ban{IP: "10.0.0.0/8"}, 1, "10.200.0.1", true},
+		{Ban{IP: "10.0.0.0/8"}, 1, "11.0.0.1", false},
+		{Ban{IP: "2001:db8::/32"}, 1, "2001:db8::1", true},
+		{Ban{IP: "10.0.0.1"}, 1, "unknown", false},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.ban.matches(tc.userID, tc.ip); got != tc.want {
+			t.Errorf("%+v matches(%d, %s): got %v; want %v", tc.ban, tc.userID, tc.ip, got, tc.want)
+		}
+	}
+
+	for value, want := range map[string]string{"10.1.2.3/8": "10.0.0.0/8", "::ffff:10.0.0.1": "10.0.0.1", "2001:DB8::1": "2001:db8::1"} {
+		if got, err := normalizeBanIP(value); err != nil || got != want {
+			t.Errorf("normalizeBanIP(%s): got %s, %v; want %s", value, got, err, want)
+		}
+	}
+}
+
+func TestRequestIP(t *testing.T) {
+	defer setenv(map[string]string{"TRUSTED_PROXIES": "10.0.0.1, 192.168.0.0/16, bad"})()
+
+	testCases := []struct {
+		name      string
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"Direct", "1.2.3.4:5000", "", "1.2.3.4"},
+		{"Spoofed", "1.2.3.4:5000", "5.6.7.8", "1.2.3.4"},
+		{"Proxy", "10.0.0.1:5000", "5.6.7.8", "5.6.7.8"},
+		{"Proxy chain", "10.0.0.1:5000", "6.6.6.6, 5.6.7.8, 192.168.1.1", "5.6.7.8"},
+		{"Spoofed through proxy", "10.0.0.1:5000", "6.6.6.6, 5.6.7.8", "5.6.7.8"},
+		{"Garbage", "10.0.0.1:5000", "5.6.7.8, nope", "10.0.0.1"},
+		{"No header", "10.0.0.1:5000", "", "10.0.0.1"},
+		{"Untrusted proxy", "10.0.0.2:5000", "5.6.7.8", "10.0.0.2"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remote
+			if tc.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tc.forwarded)
+			}
+			if got := requestIP(r); got != tc.want {
+				t.Errorf("got %s; want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	defer setenv(map[string]string{
+		"RATE_TOPIC_IP":       "4/1h",
+		"RATE_TOPIC_USER":     "0",
+		"RATE_TOPIC_COOLDOWN": "1m",
+		"RATE_LOGIN_IP":       "0",
+		"RATE_LOGIN_USER":     "2/10m",
+	})()
+
+	limits, err := rateLimits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := newLimitedTestAPI(t, limits)
+	defer api.Close()
+
+	// Каждый запрос будто с нового адреса: без доверенных прокси
+	// X-Forwarded-For не меняет IP, и счетчик остается общим
+	hops := 0
+	post := func(path string, form url.Values) (int, string) {
+		req, _ := http.NewRequest("POST", api.server.URL+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		hops++
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("10.1.0.%d", hops))
+		resp, err := api.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("Retry-After")
+	}
+	topic := func(board string) url.Values {
+		return url.Values{"board": {board}, "subject": {"Flood"}, "message": {"Some long enough message"}}
+	}
+
+	testCases := []struct {
+		name  string
+		board string
+		files string
+		want  int
+		retry string
+	}{
+		{"Rejected on b", "b", "999", http.StatusBadRequest, ""},
+		{"First on b", "b", "", http.StatusCreated, ""},
+		{"Cooldown on b", "b", "", http.StatusTooManyRequests, "60"},
+		{"Other board", "t", "", http.StatusCreated, ""},
+		{"IP limit", "t", "", http.StatusTooManyRequests, "3600"},
+	}
+	for _, tc := range testCases {
+		form := topic(tc.board)
+		if tc.files != "" {
+			form.Set("files", tc.files)
+		}
+		if code, retry := post("/v1/topics/", form); code != tc.want || retry != tc.retry {
+			t.Errorf("%s: got %d, Retry-After %q; want %d, %q", tc.name, code, retry, tc.want, tc.retry)
+		}
+	}
+
+	// Подбор пароля ограничен по логину, а не только по адресу
+	login := url.Values{"username": {"victim"}, "password": {"wrong"}}
+	for i, want := range []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusTooManyRequests} {
+		if code, _ := post("/v1/users/login", login); code != want {
+			t.Errorf("login %d: got %d; want %d", i+1, code, want)
+		}
+	}
+	if code, _ := post("/v1/users/login", url.Values{"username": {"other"}, "password": {"wrong"}}); code != http.StatusBadRequest {
+		t.Errorf("other login: got %d; want %d", code, http.StatusBadRequest)
+	}
+
+	defer setenv(map[string]string{"RATE_COMMENT_IP": "ten"})()
+	if _, err := rateLimits(); err == nil {
+		t.Error("got nil error for invalid RATE_COMMENT_IP")
+	}
+}
+
+func TestRateStores(t *testing.T) {
+	now := time.Unix(1000, 0)
+	memory := NewMemoryRateStore()
+	memory.now = func() time.Time { return now }
+
+	for i, want := range []int64{1, 2, 3} {
+		count, ttl, _ := memory.Hit("key", time.Minute)
+		if count != want || ttl != time.Minute {
+			t.Errorf("hit %d: got %d, %s; want %d, 1m", i+1, count, ttl, want)
+		}
+	}
+	now = now.Add(59 * time.Second)
+	if count, ttl, _ := memory.Hit("key", time.Minute); count != 4 || ttl != time.Second {
+		t.Errorf("end of window: got %d, %s; want 4, 1s", count, ttl)
+	}
+	if ttl, _ := memory.TTL("key"); ttl != time.Second {
+		t.Errorf("ttl: got %s; want 1s", ttl)
+	}
+	now = now.Add(time.Second)
+	if ttl, _ := memory.TTL("key"); ttl != 0 {
+		t.Errorf("ttl after window: got %s; want 0", ttl)
+	}
+	if count, _, _ := memory.Hit("key", time.Minute); count != 1 {
+		t.Errorf("new window: got %d; want 1", count)
+	}
+
+	// Без Redis считаем в памяти
+	redis := NewRedisRateStore("127.0.0.1:1", "")
+	for i, want := range []int64{1, 2} {
+		if count, _, err := redis.Hit("key", time.Minute); err != nil || count != want {
+			t.Errorf("fallback hit %d: got %d, %v; want %d", i+1, count, err, want)
+		}
+	}
+	if ttl, err := redis.TTL("key"); err != nil || ttl <= 0 {
+		t.Errorf("fallback ttl: got %s, %v", ttl, err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/gob"
 	"fmt"
 	"log"
 	"net/http"
@@ -22,30 +23,51 @@ var (
 	authSessionID = "sid"
 )
 
-// NewSession - init new cookie storage
+func init() {
+	gob.Register(User{})
+}
+
+// NewSession - init new session storage
+// SESSION_DRIVER=cookie позволяет жить без Redis.
 func NewSession() *Session {
+	if os.Getenv("SESSION_DRIVER") == "cookie" {
+		return NewCookieSession([]byte(skey))
+	}
+
 	path := fmt.Sprintf("%s:%s", host, port)
 	session, err := redistore.NewRediStore(256, "tcp", path, pass, []byte(skey))
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	session.Options = &sessions.Options{
+	session.Options = sessionOptions()
+
+	return &Session{store: session}
+}
+
+// NewCookieSession - init new cookie storage
+func NewCookieSession(keyPairs ...[]byte) *Session {
+	session := sessions.NewCookieStore(keyPairs...)
+	session.Options = sessionOptions()
+
+	return &Session{store: session}
+}
+
+func sessionOptions() *sessions.Options {
+	return &sessions.Options{
 		Domain:   shost,
 		Path:     "/",
 		MaxAge:   86400 * 256, // 256 Days
 		HttpOnly: true,
 	}
-
-	return &Session{rs: session}
 }
 
 // Session - Нечто такое обстрактное я хз
 type Session struct {
-	rs *redistore.RediStore
+	store sessions.Store
 }
 
 // Auth - Прокси грубо говоря для стандартного Get с ключем authSessionID
 func (s *Session) Auth(r *http.Request) (*sessions.Session, error) {
-	return s.rs.Get(r, authSessionID)
+	return s.store.Get(r, authSessionID)
 }
@@ -1,121 +1,166 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"strconv"
-	"time"
 
 	"github.com/yuriygr/go-board/utils"
 
 	"github.com/go-chi/chi"
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/jmoiron/sqlx"
 )
 
-const (
-	selectBoards         = "select b.* from boards as b"
-	selectPages          = "select p.* from pages as p"
-	selectTopics         = "select t.*, b.title, b.slug, COUNT(c.id) as comments_count, up.user_id, up.screen_name, (select count(*) from files as f left join topics_files as tf on tf.file_id = f.id where tf.topic_id = t.id) as files_count from topics as t left join boards as b on t.board_id = b.id left join comments as c on c.topic_id = t.id left join users_profile as up on up.user_id = t.user_id"
-	selectComments       = "select c.*, up.screen_name from comments as c left join users_profile as up on up.user_id = c.user_id"
-	selectUsers          = "select u.*, up.screen_name, up.sex from users as u left join users_profile as up on up.user_id = u.id"
-	selectUsersStatistic = "select us.*, u.created_at from users_stats as us left join users as u on us.user_id = u.id"
-
-	selectBoardBySlug                 = selectBoards + " where b.slug = '%s'"
-	selectPageBySlug                  = selectPages + " where p.slug = '%s'"
-	selectCommentByID                 = selectComments + " where c.id = '%d'"
-	selectCommentsByTopicID           = selectComments + " where c.topic_id = '%d' order by c.is_pinned desc, c.created_at asc"
-	selectCommentsByTopicIDWithOffset = selectComments + " where c.topic_id = '%d' and c.created_at > '%d' order by c.is_pinned desc, c.created_at asc"
-
-	insertComment    = "INSERT INTO comments (topic_id, user_id, message, created_at, user_ip, user_agent, is_pinned, is_deleted) VALUES (:c.topic_id, :c.user_id, :c.message, :c.created_at, :c.user_ip, :c.user_agent, :c.is_pinned, :c.is_deleted)"
-	inserTopic       = "INSERT INTO topics (type, board_id, user_id, subject, message, created_at, bumped_at, user_ip, user_agent, is_closed, is_pinned, is_deleted, allow_attach, only_anonymously) VALUES (:t.type, :t.board_id, :t.user_id, :t.subject, :t.message, :t.created_at, :t.bumped_at, :t.user_ip, :t.user_agent, :t.is_closed, :t.is_pinned, :t.is_deleted, :t.allow_attach, :t.only_anonymously)"
-	inserUser        = "INSERT INTO users (username, password, created_at, is_banned, is_deleted) VALUES (:u.username, :u.password, :u.created_at, :u.is_banned, :u.is_deleted)"
-	inserUserProfile = "INSERT INTO users_profile (user_id, screen_name) VALUES (:u.id, :up.screen_name)"
-	inserUserStats   = "INSERT INTO users_stats (user_id) values (:u.id)"
-
-	updateTopicBumpTime = "UPDATE topics as t SET t.bumped_at = '%d' WHERE t.id = '%d'"
+// Storage - Всё, что ресурсам нужно от хранилища.
+// Реализации: MySQLStorage для прода и MemoryStorage
+// для тестов и локальной разработки.
+type Storage interface {
+	// WithTx - Unit of work: fn получает хранилище, все записи
+	// через которое коммитятся или откатываются вместе.
+	WithTx(ctx context.Context, fn func(tx Storage) error) error
+
+	// Boards
+	GetBoardsList() ([]*Board, error)
+	GetBoardBySlug(slug string) (*Board, error)
+
+	// Pages
+	GetPageBySlug(slug string) (*Page, error)
+
+	// Topics
+	GetTopicsList(request *TopicsRequest) ([]*Topic, error)
+	GetTopicByID(id int64) (*Topic, error)
+	CreateTopic(request *Topic) (*Topic, error)
+	UpdateTopicBumpTime(request *Comment) error
+	UpdateTopic(request *Topic) error
+	GetTopicFiles(topic *Topic) []*File
+
+	// Comments
+	GetCommentsList(request *CommentsRequest) ([]*Comment, error)
+	GetCommentByID(id int64) (*Comment, error)
+	CreateComment(request *Comment) (*Comment, error)
+	UpdateComment(request *Comment) error
+	GetCommentFiles(comment *Comment) []*File
+
+	// Files
+	CreateFile(request *File) (*File, error)
+	GetFileByID(id int64) (*File, error)
+	GetFileByMd5(md5 string) (*File, error)
+	GetFileByUUID(uuid string) (*File, error)
+	GetFilePosts(fileID int64) ([]*PostRef, error)
+	GetFileBan(md5 string) (*FileBan, error)
+	CreateFileBan(request *FileBan) error
+	GetFileBansWithPhash() ([]*FileBan, error)
+	GetFlaggedFiles() ([]*File, error)
+	GetFilesAfter(afterID, limit int64) ([]*File, error)
+	GetOrphanFiles(before int64) ([]*File, error)
+	DeleteOrphanFile(id int64) (bool, error)
+	UpdateFileFlag(id int64, flagged bool) error
+	CountTopicFiles(topicID int64) (int64, error)
+	GetBoardFilesSize(boardID int64) (int64, error)
+
+	// Upload sessions
+	CreateUploadSession(request *UploadSession) (*UploadSession, error)
+	GetUploadSession(id string) (*UploadSession, error)
+	UpdateUploadSessionOffset(id string, from, to int64) (bool, error)
+	DeleteUploadSession(id string) error
+	GetExpiredUploadSessions(before int64) ([]*UploadSession, error)
+
+	// Replies
+	CreateReplies(replies []*Reply) error
+	GetRepliesByTopicID(topicID int64) ([]*Reply, error)
+	GetReplyTargets(ids []int64) ([]*ReplyTarget, error)
+
+	// Tags
+	CreatePostTags(topicID, commentID int64, tags []string, createdAt int64) error
+	GetTrendingTags(since int64, limit int64) ([]*Tag, error)
+
+	// Bugs
+	GetBugByID(id int) (*Bug, error)
+	CreateBugReport(request *BugCreateRequest) (*Bug, error)
+
+	// Users
+	GetUserByUsername(username string) (*User, error)
+	GetUserByID(id int64) (*User, error)
+	CreateUser(request *User) (*User, error)
+	GetUserStatistic(id int64) (*UserStatistic, error)
+	UpdateUserStatistic(id int64, field string) error
+
+	// Moderation log
+	CreateModLogEntry(request *ModLogEntry) error
+	GetModLog(request *ModLogRequest) ([]*ModLogEntry, error)
+
+	// Reports
+	CreateReport(request *Report) (bool, error)
+	GetReportByID(id int64) (*Report, error)
+	GetReports(request *ReportsRequest) ([]*Report, error)
+	CloseReports(targetType string, targetID int64, status string, moderatorID, closedAt int64) (int64, error)
+
+	// Bans
+	CreateBan(request *Ban) (*Ban, error)
+	GetBanByID(id int64) (*Ban, error)
+	GetActiveBans(userID int64, ip string, now int64) ([]*Ban, error)
+	GetBans(request *BansRequest) ([]*Ban, error)
+	LiftBan(id, now int64) error
+	CreateBanAppeal(request *BanAppeal) (bool, error)
+	GetBanAppealByID(id int64) (*BanAppeal, error)
+	GetBanAppeal(banID int64, appellantKey string) (*BanAppeal, error)
+	GetBanAppeals(request *BansRequest) ([]*BanAppeal, error)
+	UpdateBanAppeal(request *BanAppeal) error
+
+	// Roles
+	GetUserRoles(userID int64) ([]*UserRole, error)
+	GetRolesByUserIDs(ids []int64) ([]*UserRole, error)
+	CreateUserRole(request *UserRole) error
+	DeleteUserRole(userID int64, role string, boardID int64) error
+}
+
+var (
+	_ Storage = (*MySQLStorage)(nil)
+	_ Storage = (*MemoryStorage)(nil)
 )
 
 // NewStorage - init new storage
-func NewStorage() *Storage {
-	db, err := sqlx.Connect("mysql", os.Getenv("DB_DSN"))
-	if err != nil {
-		log.Fatalln(err)
-	}
-	db.SetConnMaxLifetime(time.Hour)
-	// Unsafe becouse i sleep
-	return &Storage{db.Unsafe()}
-}
-
-// BeginTx - Start transaction
-func (s *Storage) BeginTx() {
-	// s.db.BeginTransaction()
-}
-
-// Storage - Нечто такое обстрактное я хз
-// попозже придумаю что тут написать так то
-// штука крутая.
-type Storage struct {
-	db *sqlx.DB
-}
-
-//--
-// Boards methods
-//--
-
-// GetBoardsList - Get list of boards
-func (s *Storage) GetBoardsList() ([]*Board, error) {
-	boards := []*Board{}
-	sql := selectBoards
-
-	err := s.db.Select(&boards, sql)
-	if err != nil {
-		return nil, err
-	}
-
-	return boards, nil
-}
-
-// GetBoardBySlug - Get boarf by slug
-func (s *Storage) GetBoardBySlug(slug string) (*Board, error) {
-	board := Board{}
-	sql := fmt.Sprintf(selectBoardBySlug, slug)
-
-	err := s.db.Get(&board, sql)
-	if err != nil {
-		return nil, err
-	}
+// Драйвер выбирается через STORAGE_DRIVER, по умолчанию mysql.
+func NewStorage() Storage {
+	switch os.Getenv("STORAGE_DRIVER") {
+	case "memory":
+		storage := NewMemoryStorage()
+		storage.AddBoard(&Board{Title: "Random", Slug: "b", Type: "normal", Available: true})
+		return storage
+	default:
+		return NewMySQLStorage(os.Getenv("DB_DSN"))
+	}
+}
+
+// Ошибки белых списков
+var (
+	ErrUnknownSort      = errors.New("Unknown sort field")
+	ErrUnknownStatistic = errors.New("Unknown statistic field")
+)
 
-	return &board, nil
+// topicsSortColumns - Белый список сортировок топиков.
+// Ключ приходит из запроса, значение уходит в order by.
+var topicsSortColumns = map[string]string{
+	"bumped_at":  "t.bumped_at",
+	"created_at": "t.created_at",
 }
 
-//--
-// Page methods
-//--
-
-// GetPageBySlug - Return page by Slug
-func (s *Storage) GetPageBySlug(slug string) (*Page, error) {
-	page := Page{}
-	sql := fmt.Sprintf(selectPageBySlug, slug)
-
-	err := s.db.Get(&page, sql)
-	if err != nil {
-		return nil, err
-	}
-
-	return &page, nil
+// userStatisticFields - Белый список счетчиков users_stats
+var userStatisticFields = map[string]string{
+	"created_topics":   "us.created_topics",
+	"created_comments": "us.created_comments",
+	"uploaded_files":   "us.uploaded_files",
 }
 
 //--
-// Topic methods & structs
+// Requests
 //--
 
 // TopicsRequest - Request for fetch topics
 type TopicsRequest struct {
 	Slug  string
+	Tag   string // Только топики, где встречается тег
 	Sort  string
 	Page  int64
 	Limit int64
@@ -125,7 +170,14 @@ type TopicsRequest struct {
 func (tr *TopicsRequest) Bind(r *http.Request) error {
 
 	if slug := r.URL.Query().Get("slug"); slug != "" {
-		tr.Slug = utils.EscapeString(slug)
+		tr.Slug = slug
+	}
+
+	if sort := r.URL.Query().Get("sort"); sort != "" {
+		if _, ok := topicsSortColumns[sort]; !ok {
+			return ErrUnknownSort
+		}
+		tr.Sort = sort
 	}
 
 	if page := r.URL.Query().Get("page"); page != "" {
@@ -143,104 +195,6 @@ func (tr *TopicsRequest) Bind(r *http.Request) error {
 	return nil
 }
 
-// GetTopicsList - Return topics list with params
-func (s *Storage) GetTopicsList(request *TopicsRequest) ([]*Topic, error) {
-	topics := []*Topic{}
-	sql := selectTopics
-
-	if len(request.Slug) > 0 {
-		sql = sql + " " + fmt.Sprintf("where b.slug = '%s'", request.Slug)
-	}
-
-	limit := request.Limit
-	offset := request.Limit * (request.Page - 1)
-
-	sql = sql + " " + fmt.Sprintf("group by t.id order by t.is_pinned desc, %s desc limit %d offset %d", request.Sort, limit, offset)
-
-	err := s.db.Select(&topics, sql)
-	if err != nil {
-		return nil, err
-	}
-
-	for _, topic := range topics {
-		if topic.FilesCount > 0 {
-			topic.Attachments = s.GetTopicFiles(topic)
-		} else {
-			topic.Attachments = []*File{}
-		}
-	}
-
-	return topics, nil
-}
-
-// GetTopicByID - Return topic by ID
-func (s *Storage) GetTopicByID(id int64) (*Topic, error) {
-	topic := Topic{}
-	sql := selectTopics
-
-	if id != 0 {
-		sql = sql + " " + fmt.Sprintf("where t.id = '%d'", id)
-	}
-
-	sql = sql + " group by t.id"
-
-	err := s.db.Get(&topic, sql)
-	if err != nil {
-		return nil, err
-	}
-
-	topic.Attachments = s.GetTopicFiles(&topic)
-
-	return &topic, nil
-}
-
-// CreateTopic - Create topic and return him, or error
-func (s *Storage) CreateTopic(request *Topic) (*Topic, error) {
-	result, err := s.db.NamedExec(inserTopic, request)
-	if err != nil {
-		return nil, err
-	}
-
-	topicID, err := result.LastInsertId()
-	if err != nil {
-		return nil, err
-	}
-
-	topic, err := s.GetTopicByID(topicID)
-	if err != nil {
-		return nil, err
-	}
-
-	return topic, nil
-}
-
-// UpdateTopicBumpTime - Update topic bump time with comment data
-func (s *Storage) UpdateTopicBumpTime(request *Comment) error {
-	sql := fmt.Sprintf(updateTopicBumpTime, request.CreatedAt, request.TopicID)
-
-	_, err := s.db.Exec(sql)
-
-	return err
-}
-
-// GetTopicFiles - Возвращает файлы топика
-// TODO: Ну что за фигня. Надо сделать проще
-func (s *Storage) GetTopicFiles(topic *Topic) []*File {
-	files := []*File{}
-	sql := fmt.Sprintf("select f.* from topics_files as tf left join files as f on tf.file_id = f.id where tf.topic_id = '%d' group by tf.file_id", topic.ID)
-
-	err := s.db.Select(&files, sql)
-	if err != nil {
-		return nil
-	}
-
-	return files
-}
-
-// --
-// Comments methods
-// --
-
 // CommentsRequest - Request for fetch comments
 type CommentsRequest struct {
 	TopicID int
@@ -268,150 +222,3 @@ func (cr *CommentsRequest) Bind(r *http.Request) error {
 
 	return nil
 }
-
-// GetCommentsList - Return list of comments by topic ID
-func (s *Storage) GetCommentsList(request *CommentsRequest) ([]*Comment, error) {
-	comments := []*Comment{}
-	sql := fmt.Sprintf(selectCommentsByTopicIDWithOffset, request.TopicID, request.Offset)
-
-	err := s.db.Select(&comments, sql)
-	if err != nil {
-		return nil, err
-	}
-
-	return comments, nil
-}
-
-// GetCommentByID - Return comment by ID
-func (s *Storage) GetCommentByID(id int64) (*Comment, error) {
-	comment := Comment{}
-	sql := fmt.Sprintf(selectCommentByID, id)
-
-	err := s.db.Get(&comment, sql)
-	if err != nil {
-		return nil, err
-	}
-
-	return &comment, nil
-}
-
-// CreateComment - Create comment and return him, or error
-func (s *Storage) CreateComment(request *Comment) (*Comment, error) {
-	result, err := s.db.NamedExec(insertComment, request)
-	if err != nil {
-		return nil, err
-	}
-
-	commentID, err := result.LastInsertId()
-	if err != nil {
-		return nil, err
-	}
-
-	comment, err := s.GetCommentByID(commentID)
-	if err != nil {
-		return nil, err
-	}
-
-	return comment, nil
-}
-
-//--
-// Bugs methods
-//--
-
-// GetBugByID - Return bug by ID
-func (s *Storage) GetBugByID(id int) (*Bug, error) {
-	return &Bug{Number: 1}, errors.New("Bug not found")
-}
-
-// CreateBugReport - Create bug report with data
-func (s *Storage) CreateBugReport(request *BugCreateRequest) (*Bug, error) {
-	fmt.Println(request)
-	return &Bug{Number: 1}, nil
-}
-
-//--
-// Users methods
-//--
-
-// GetUserByUsername - Return user by username
-func (s *Storage) GetUserByUsername(username string) (*User, error) {
-	user := User{}
-	sql := selectUsers + " " + fmt.Sprintf("where u.username = '%s'", username)
-
-	err := s.db.Get(&user, sql)
-	if err != nil {
-		return nil, err
-	}
-
-	return &user, nil
-}
-
-// GetUserByID - Return user by ID
-func (s *Storage) GetUserByID(id int64) (*User, error) {
-	user := User{}
-	sql := selectUsers + " " + fmt.Sprintf("where u.id = '%d'", id)
-
-	err := s.db.Get(&user, sql)
-	if err != nil {
-		return nil, err
-	}
-
-	return &user, nil
-}
-
-// CreateUser - Create user and return him, or error
-// TODO: транзакции
-func (s *Storage) CreateUser(request *User) (*User, error) {
-	result, err := s.db.NamedExec(inserUser, request)
-	if err != nil {
-		return nil, err
-	}
-
-	UserID, err := result.LastInsertId()
-	if err != nil {
-		return nil, err
-	}
-
-	// And we must create profile and stats to user...
-	// TODO: Transfer to user controller? Like comment bump
-
-	request.ID = UserID
-
-	if _, err := s.db.NamedExec(inserUserProfile, request); err != nil {
-		return nil, err
-	}
-
-	if _, err := s.db.NamedExec(inserUserStats, request); err != nil {
-		return nil, err
-	}
-
-	user, err := s.GetUserByID(UserID)
-	if err != nil {
-		return nil, err
-	}
-
-	return user, nil
-}
-
-// GetUserStatistic - Get user stats
-func (s *Storage) GetUserStatistic(id int64) (*UserStatistic, error) {
-	statistic := UserStatistic{}
-	sql := selectUsersStatistic + " " + fmt.Sprintf("where us.user_id = '%d'", id)
-
-	err := s.db.Get(&statistic, sql)
-	if err != nil {
-		return nil, err
-	}
-
-	return &statistic, nil
-}
-
-// UpdateUserStatistic - Update user stats fields
-func (s *Storage) UpdateUserStatistic(id int64, field string) error {
-	sql := fmt.Sprintf("UPDATE users_stats as us SET us.%s = us.%s + 1 WHERE us.user_id = '%d'", field, field, id)
-
-	_, err := s.db.Exec(sql)
-
-	return err
-}
@@ -0,0 +1,1784 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryStorage - Хранилище в памяти с той же семантикой, что и MySQLStorage:
+// закрепленные топики первыми, сортировка по бампу, счетчики комментариев и файлов.
+// Нужно для тестов и локальной разработки без базы.
+type MemoryStorage struct {
+	*memoryDB
+	inTx bool
+}
+
+// memoryDB - Общее состояние для хранилища и его транзакций
+type memoryDB struct {
+	mu   sync.RWMutex // Защищает таблицы
+	txMu sync.Mutex   // Транзакции и записи вне их идут по очереди
+
+	memoryTables
+}
+
+// memoryTables - Собственно таблицы
+type memoryTables struct {
+	boards        []*Board
+	pages         []*Page
+	topics        []*Topic
+	comments      []*Comment
+	files         []*File
+	topicsFiles   []memoryTopicFile
+	commentsFiles []memoryCommentFile
+	fileBans      []*FileBan
+	users         []*User
+	stats         []*UserStatistic
+	replies       []*Reply
+	tags          []*memoryTag
+	tagsPosts     []memoryTagPost
+
+	uploadSessions []*UploadSession
+	roles          []*UserRole
+	modLog         []*ModLogEntry
+	reports        []*Report
+	bans           []*Ban
+	bansAppeals    []*BanAppeal
+
+	sequences map[string]int64
+}
+
+// memoryTopicFile - Строка таблицы topics_files
+type memoryTopicFile struct {
+	TopicID int64
+	FileID  int64
+}
+
+// memoryCommentFile - Строка таблицы comments_files
+type memoryCommentFile struct {
+	CommentID int64
+	FileID    int64
+}
+
+// memoryTag - Строка таблицы tags
+type memoryTag struct {
+	ID   int64
+	Name string
+}
+
+// memoryTagPost - Строка таблицы tags_posts
+type memoryTagPost struct {
+	TagID     int64
+	TopicID   int64
+	CommentID int64
+	CreatedAt int64
+}
+
+// NewMemoryStorage - init new memory storage
+// Анонимный профиль (ID 1) создается сразу, как и в боевой базе.
+func NewMemoryStorage() *MemoryStorage {
+	s := &MemoryStorage{memoryDB: &memoryDB{}}
+	s.sequences = map[string]int64{}
+
+	anon := &User{Username: "anonymous", CreatedAt: 0}
+	anon.Profile.ScreenName = "Anonymous"
+	s.insertUser(anon)
+
+	return s
+}
+
+// nextID - Аналог auto_increment
+func (s *MemoryStorage) nextID(table string) int64 {
+	s.sequences[table]++
+	return s.sequences[table]
+}
+
+// WithTx - Unit of work. При ошибке таблицы откатываются к снимку,
+// сделанному перед началом транзакции.
+func (s *MemoryStorage) WithTx(ctx context.Context, fn func(tx Storage) error) (err error) {
+	if s.inTx {
+		return fn(s)
+	}
+
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	s.mu.RLock()
+	snapshot := s.memoryTables.clone()
+	s.mu.RUnlock()
+
+	rollback := func() {
+		s.mu.Lock()
+		s.memoryTables = snapshot
+		s.mu.Unlock()
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			rollback()
+			panic(p)
+		}
+	}()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := fn(&MemoryStorage{memoryDB: s.memoryDB, inTx: true}); err != nil {
+		rollback()
+		return err
+	}
+
+	return nil
+}
+
+// lockTx - Запись вне транзакции ждет окончания текущей транзакции
+func (s *MemoryStorage) lockTx() func() {
+	if s.inTx {
+		return func() {}
+	}
+	s.txMu.Lock()
+	return s.txMu.Unlock
+}
+
+// clone - Глубокая копия таблиц для отката
+func (t memoryTables) clone() memoryTables {
+	c := memoryTables{sequences: map[string]int64{}}
+
+	for _, row := range t.boards {
+		board := *row
+		c.boards = append(c.boards, &board)
+	}
+	for _, row := range t.pages {
+		page := *row
+		c.pages = append(c.pages, &page)
+	}
+	for _, row := range t.topics {
+		topic := *row
+		c.topics = append(c.topics, &topic)
+	}
+	for _, row := range t.comments {
+		comment := *row
+		c.comments = append(c.comments, &comment)
+	}
+	for _, row := range t.files {
+		file := *row
+		c.files = append(c.files, &file)
+	}
+	c.topicsFiles = append(c.topicsFiles, t.topicsFiles...)
+	c.commentsFiles = append(c.commentsFiles, t.commentsFiles...)
+	for _, row := range t.fileBans {
+		ban := *row
+		c.fileBans = append(c.fileBans, &ban)
+	}
+	for _, row := range t.users {
+		user := *row
+		c.users = append(c.users, &user)
+	}
+	for _, row := range t.stats {
+		stats := *row
+		c.stats = append(c.stats, &stats)
+	}
+	for _, row := range t.replies {
+		reply := *row
+		c.replies = append(c.replies, &reply)
+	}
+	for _, row := range t.tags {
+		tag := *row
+		c.tags = append(c.tags, &tag)
+	}
+	c.tagsPosts = append(c.tagsPosts, t.tagsPosts...)
+	for _, row := range t.uploadSessions {
+		session := *row
+		c.uploadSessions = append(c.uploadSessions, &session)
+	}
+	for _, row := range t.roles {
+		role := *row
+		c.roles = append(c.roles, &role)
+	}
+	for _, row := range t.modLog {
+		entry := *row
+		c.modLog = append(c.modLog, &entry)
+	}
+	for _, row := range t.reports {
+		report := *row
+		c.reports = append(c.reports, &report)
+	}
+	for _, row := range t.bans {
+		ban := *row
+		c.bans = append(c.bans, &ban)
+	}
+	for _, row := range t.bansAppeals {
+		appeal := *row
+		c.bansAppeals = append(c.bansAppeals, &appeal)
+	}
+	for table, id := range t.sequences {
+		c.sequences[table] = id
+	}
+
+	return c
+}
+
+//--
+// Seed methods
+//--
+
+// AddBoard - Add board to storage
+func (s *MemoryStorage) AddBoard(board *Board) *Board {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row := *board
+	row.ID = s.nextID("boards")
+	s.boards = append(s.boards, &row)
+
+	result := row
+	return &result
+}
+
+// AddPage - Add page to storage
+func (s *MemoryStorage) AddPage(page *Page) *Page {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row := *page
+	row.ID = int32(s.nextID("pages"))
+	s.pages = append(s.pages, &row)
+
+	result := row
+	return &result
+}
+
+// AddTopicFile - Add file and attach it to topic
+func (s *MemoryStorage) AddTopicFile(topicID int64, file *File) *File {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row := *file
+	row.ID = s.nextID("files")
+	s.files = append(s.files, &row)
+	s.topicsFiles = append(s.topicsFiles, memoryTopicFile{topicID, row.ID})
+
+	result := row
+	return &result
+}
+
+//--
+// Boards methods
+//--
+
+// GetBoardsList - Get list of boards
+func (s *MemoryStorage) GetBoardsList() ([]*Board, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	boards := []*Board{}
+	for _, row := range s.boards {
+		board := *row
+		boards = append(boards, &board)
+	}
+
+	return boards, nil
+}
+
+// GetBoardBySlug - Get board by slug
+func (s *MemoryStorage) GetBoardBySlug(slug string) (*Board, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, row := range s.boards {
+		if row.Slug == slug {
+			board := *row
+			return &board, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (s *MemoryStorage) boardByID(id int64) *Board {
+	for _, row := range s.boards {
+		if row.ID == id {
+			return row
+		}
+	}
+	return nil
+}
+
+//--
+// Page methods
+//--
+
+// GetPageBySlug - Return page by Slug
+func (s *MemoryStorage) GetPageBySlug(slug string) (*Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, row := range s.pages {
+		if row.Slug == slug {
+			page := *row
+			return &page, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+//--
+// Topic methods
+//--
+
+// GetTopicsList - Return topics list with params
+func (s *MemoryStorage) GetTopicsList(request *TopicsRequest) ([]*Topic, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sortValue, err := memoryTopicSort(request.Sort)
+	if err != nil {
+		return nil, err
+	}
+
+	topics := []*Topic{}
+	for _, row := range s.topics {
+		if row.States.IsDeleted {
+			continue
+		}
+		topic := s.topic(row)
+		if len(request.Slug) > 0 && topic.Board.Slug != request.Slug {
+			continue
+		}
+		if len(request.Tag) > 0 && !s.topicHasTag(topic.ID, request.Tag) {
+			continue
+		}
+		topics = append(topics, topic)
+	}
+
+	sort.SliceStable(topics, func(i, j int) bool {
+		if topics[i].States.IsPinned != topics[j].States.IsPinned {
+			return topics[i].States.IsPinned
+		}
+		return sortValue(topics[i]) > sortValue(topics[j])
+	})
+
+	offset := request.Limit * (request.Page - 1)
+	if offset < 0 || offset > int64(len(topics)) {
+		offset = int64(len(topics))
+	}
+	end := offset + request.Limit
+	if end > int64(len(topics)) {
+		end = int64(len(topics))
+	}
+	topics = topics[offset:end]
+
+	for _, topic := range topics {
+		if topic.FilesCount > 0 {
+			topic.Attachments = s.topicFiles(topic.ID)
+		} else {
+			topic.Attachments = []*File{}
+		}
+	}
+
+	return topics, nil
+}
+
+// memoryTopicSort - Колонка сортировки для GetTopicsList
+func memoryTopicSort(sort string) (func(*Topic) int64, error) {
+	switch topicsSortColumns[sort] {
+	case "t.bumped_at":
+		return func(t *Topic) int64 { return t.BumpedAt }, nil
+	case "t.created_at":
+		return func(t *Topic) int64 { return t.CreatedAt }, nil
+	}
+	return nil, ErrUnknownSort
+}
+
+// GetTopicByID - Return topic by ID
+func (s *MemoryStorage) GetTopicByID(id int64) (*Topic, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, row := range s.topics {
+		if row.ID == id {
+			topic := s.topic(row)
+			topic.Attachments = s.topicFiles(topic.ID)
+			attachTopicReplies(topic, s.topicReplies(topic.ID))
+			return topic, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// CreateTopic - Create topic and return him, or error
+// Вложения из request.Attachments привязываются к топику.
+func (s *MemoryStorage) CreateTopic(request *Topic) (*Topic, error) {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	row := *request
+	row.ID = s.nextID("topics")
+	row.Attachments = nil
+	s.topics = append(s.topics, &row)
+	for _, file := range request.Attachments {
+		s.topicsFiles = append(s.topicsFiles, memoryTopicFile{row.ID, file.ID})
+	}
+	s.mu.Unlock()
+
+	return s.GetTopicByID(row.ID)
+}
+
+// UpdateTopicBumpTime - Update topic bump time with comment data
+func (s *MemoryStorage) UpdateTopicBumpTime(request *Comment) error {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range s.topics {
+		if row.ID == request.TopicID {
+			row.BumpedAt = request.CreatedAt
+		}
+	}
+
+	return nil
+}
+
+// UpdateTopic - Сохраняет доску и состояния топика
+func (s *MemoryStorage) UpdateTopic(request *Topic) error {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range s.topics {
+		if row.ID == request.ID {
+			row.BoardID = request.BoardID
+			row.States.IsClosed = request.States.IsClosed
+			row.States.IsPinned = request.States.IsPinned
+			row.States.IsDeleted = request.States.IsDeleted
+		}
+	}
+
+	return nil
+}
+
+// GetTopicFiles - Возвращает файлы топика
+func (s *MemoryStorage) GetTopicFiles(topic *Topic) []*File {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.topicFiles(topic.ID)
+}
+
+// topic - Собирает топик со всеми join'ами, как selectTopics
+func (s *MemoryStorage) topic(row *Topic) *Topic {
+	topic := *row
+	topic.Attachments = nil
+
+	if board := s.boardByID(row.BoardID); board != nil {
+		topic.Board.Title = board.Title
+		topic.Board.Slug = board.Slug
+	}
+
+	if user := s.userByID(row.UserID); user != nil {
+		topic.User.ID = user.ID
+		topic.User.ScreenName = user.Profile.ScreenName
+	}
+
+	topic.CommentsCount = 0
+	for _, comment := range s.comments {
+		if comment.TopicID == row.ID {
+			topic.CommentsCount++
+		}
+	}
+
+	topic.FilesCount = 0
+	for _, tf := range s.topicsFiles {
+		if tf.TopicID == row.ID && s.fileByID(tf.FileID) != nil {
+			topic.FilesCount++
+		}
+	}
+
+	return &topic
+}
+
+func (s *MemoryStorage) topicFiles(topicID int64) []*File {
+	files := []*File{}
+	seen := map[int64]bool{}
+	for _, tf := range s.topicsFiles {
+		if tf.TopicID != topicID || seen[tf.FileID] {
+			continue
+		}
+		if row := s.fileByID(tf.FileID); row != nil {
+			file := *row
+			files = append(files, &file)
+			seen[tf.FileID] = true
+		}
+	}
+	return files
+}
+
+func (s *MemoryStorage) fileByID(id int64) *File {
+	for _, row := range s.files {
+		if row.ID == id {
+			return row
+		}
+	}
+	return nil
+}
+
+// --
+// Comments methods
+// --
+
+// GetCommentsList - Return list of comments by topic ID
+func (s *MemoryStorage) GetCommentsList(request *CommentsRequest) ([]*Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	comments := []*Comment{}
+	for _, row := range s.comments {
+		if row.TopicID == int64(request.TopicID) && row.CreatedAt > int64(request.Offset) {
+			comments = append(comments, s.comment(row))
+		}
+	}
+
+	sort.SliceStable(comments, func(i, j int) bool {
+		if comments[i].States.IsPinned != comments[j].States.IsPinned {
+			return comments[i].States.IsPinned > comments[j].States.IsPinned
+		}
+		return comments[i].CreatedAt < comments[j].CreatedAt
+	})
+
+	attachCommentReplies(comments, s.topicReplies(int64(request.TopicID)))
+
+	return comments, nil
+}
+
+// GetCommentByID - Return comment by ID
+func (s *MemoryStorage) GetCommentByID(id int64) (*Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, row := range s.comments {
+		if row.ID == id {
+			comment := s.comment(row)
+			attachCommentReplies([]*Comment{comment}, s.topicReplies(comment.TopicID))
+			return comment, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// CreateComment - Create comment and return him, or error
+// Вложения из request.Attachments привязываются к комментарию.
+func (s *MemoryStorage) CreateComment(request *Comment) (*Comment, error) {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	row := *request
+	row.ID = s.nextID("comments")
+	row.Attachments = nil
+	s.comments = append(s.comments, &row)
+	for _, file := range request.Attachments {
+		s.commentsFiles = append(s.commentsFiles, memoryCommentFile{row.ID, file.ID})
+	}
+	s.mu.Unlock()
+
+	return s.GetCommentByID(row.ID)
+}
+
+// UpdateComment - Сохраняет состояния комментария
+func (s *MemoryStorage) UpdateComment(request *Comment) error {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range s.comments {
+		if row.ID == request.ID {
+			row.States.IsPinned = request.States.IsPinned
+			row.States.IsDeleted = request.States.IsDeleted
+		}
+	}
+
+	return nil
+}
+
+// GetCommentFiles - Возвращает файлы комментария
+func (s *MemoryStorage) GetCommentFiles(comment *Comment) []*File {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.commentFiles(comment.ID)
+}
+
+// comment - Собирает комментарий с профилем автора и вложениями
+func (s *MemoryStorage) comment(row *Comment) *Comment {
+	comment := *row
+	comment.User.ScreenName = ""
+	if user := s.userByID(row.UserID); user != nil {
+		comment.User.ScreenName = user.Profile.ScreenName
+	}
+	comment.Attachments = s.commentFiles(row.ID)
+	return &comment
+}
+
+func (s *MemoryStorage) commentFiles(commentID int64) []*File {
+	files := []*File{}
+	seen := map[int64]bool{}
+	for _, cf := range s.commentsFiles {
+		if cf.CommentID != commentID || seen[cf.FileID] {
+			continue
+		}
+		if row := s.fileByID(cf.FileID); row != nil {
+			file := *row
+			files = append(files, &file)
+			seen[cf.FileID] = true
+		}
+	}
+	return files
+}
+
+//--
+// Files methods
+//--
+
+// CreateFile - Save uploaded file and return him, or error
+func (s *MemoryStorage) CreateFile(request *File) (*File, error) {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	row := *request
+	row.ID = s.nextID("files")
+	s.files = append(s.files, &row)
+	s.mu.Unlock()
+
+	return s.GetFileByID(row.ID)
+}
+
+// GetFileByID - Return file by ID
+func (s *MemoryStorage) GetFileByID(id int64) (*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if row := s.fileByID(id); row != nil {
+		file := *row
+		return &file, nil
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// GetFileByMd5 - Первый файл с таким md5
+func (s *MemoryStorage) GetFileByMd5(md5 string) (*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, row := range s.files {
+		if row.Md5 == md5 {
+			file := *row
+			return &file, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// GetFileByUUID - Файл по имени в хранилище
+func (s *MemoryStorage) GetFileByUUID(uuid string) (*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, row := range s.files {
+		if row.UUID == uuid {
+			file := *row
+			return &file, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// GetFilePosts - Топики и комментарии, где прикреплен файл
+func (s *MemoryStorage) GetFilePosts(fileID int64) ([]*PostRef, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	posts := []*PostRef{}
+	for _, tf := range s.topicsFiles {
+		if tf.FileID == fileID {
+			posts = append(posts, &PostRef{tf.TopicID, 0})
+		}
+	}
+	for _, cf := range s.commentsFiles {
+		if cf.FileID != fileID {
+			continue
+		}
+		for _, comment := range s.comments {
+			if comment.ID == cf.CommentID {
+				posts = append(posts, &PostRef{comment.TopicID, comment.ID})
+			}
+		}
+	}
+
+	sort.SliceStable(posts, func(i, j int) bool {
+		if posts[i].TopicID != posts[j].TopicID {
+			return posts[i].TopicID < posts[j].TopicID
+		}
+		return posts[i].CommentID < posts[j].CommentID
+	})
+
+	return posts, nil
+}
+
+// GetFileBan - Return ban by file hash
+func (s *MemoryStorage) GetFileBan(md5 string) (*FileBan, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, row := range s.fileBans {
+		if row.Md5 == md5 {
+			ban := *row
+			return &ban, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// CreateFileBan - Ban file hash, повторный бан обновляет причину
+func (s *MemoryStorage) CreateFileBan(request *FileBan) error {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range s.fileBans {
+		if row.Md5 == request.Md5 {
+			row.Phash = request.Phash
+			row.Reason = request.Reason
+			return nil
+		}
+	}
+
+	ban := *request
+	s.fileBans = append(s.fileBans, &ban)
+
+	return nil
+}
+
+// GetFileBansWithPhash - Баны, по которым ищем похожие картинки
+func (s *MemoryStorage) GetFileBansWithPhash() ([]*FileBan, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bans := []*FileBan{}
+	for _, row := range s.fileBans {
+		if row.Phash != "" {
+			ban := *row
+			bans = append(bans, &ban)
+		}
+	}
+
+	return bans, nil
+}
+
+// GetFlaggedFiles - Файлы, ждущие проверки модератором
+func (s *MemoryStorage) GetFlaggedFiles() ([]*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	files := []*File{}
+	for _, row := range s.files {
+		if row.IsFlagged {
+			file := *row
+			files = append(files, &file)
+		}
+	}
+
+	return files, nil
+}
+
+// GetFilesAfter - Файлы по порядку id, чтобы обойти все пачками
+func (s *MemoryStorage) GetFilesAfter(afterID, limit int64) ([]*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	files := []*File{}
+	for _, row := range s.files {
+		if row.ID > afterID && int64(len(files)) < limit {
+			file := *row
+			files = append(files, &file)
+		}
+	}
+
+	return files, nil
+}
+
+// GetOrphanFiles - Никуда не прикрепленные файлы, загруженные до before
+func (s *MemoryStorage) GetOrphanFiles(before int64) ([]*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	files := []*File{}
+	for _, row := range s.files {
+		if row.CreatedAt < before && s.fileIsOrphan(row.ID) {
+			file := *row
+			files = append(files, &file)
+		}
+	}
+
+	return files, nil
+}
+
+// DeleteOrphanFile - Удаляет файл, только если его так никуда и не прикрепили.
+// false - файл успели прикрепить или уже удалили
+func (s *MemoryStorage) DeleteOrphanFile(id int64) (bool, error) {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, row := range s.files {
+		if row.ID == id && s.fileIsOrphan(id) {
+			s.files = append(s.files[:i], s.files[i+1:]...)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// fileIsOrphan - Нет ни в topics_files, ни в comments_files. Вызывать под s.mu
+func (s *MemoryStorage) fileIsOrphan(id int64) bool {
+	for _, tf := range s.topicsFiles {
+		if tf.FileID == id {
+			return false
+		}
+	}
+	for _, cf := range s.commentsFiles {
+		if cf.FileID == id {
+			return false
+		}
+	}
+	return true
+}
+
+// UpdateFileFlag - Поставить или снять флаг проверки
+func (s *MemoryStorage) UpdateFileFlag(id int64, flagged bool) error {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if row := s.fileByID(id); row != nil {
+		row.IsFlagged = flagged
+	}
+
+	return nil
+}
+
+// CountTopicFiles - Файлы топика вместе с файлами комментариев
+func (s *MemoryStorage) CountTopicFiles(topicID int64) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := int64(len(s.topicFiles(topicID)))
+	for _, comment := range s.comments {
+		if comment.TopicID == topicID {
+			count += int64(len(s.commentFiles(comment.ID)))
+		}
+	}
+
+	return count, nil
+}
+
+// GetBoardFilesSize - Сколько байт занимают файлы постов доски
+func (s *MemoryStorage) GetBoardFilesSize(boardID int64) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := map[int64]bool{}
+	size := int64(0)
+	add := func(files []*File) {
+		for _, file := range files {
+			if !seen[file.ID] {
+				seen[file.ID] = true
+				size += file.Size
+			}
+		}
+	}
+
+	for _, topic := range s.topics {
+		if topic.BoardID != boardID {
+			continue
+		}
+		add(s.topicFiles(topic.ID))
+		for _, comment := range s.comments {
+			if comment.TopicID == topic.ID {
+				add(s.commentFiles(comment.ID))
+			}
+		}
+	}
+
+	return size, nil
+}
+
+//--
+// Upload sessions methods
+//--
+
+// CreateUploadSession - Новая загрузка по частям
+func (s *MemoryStorage) CreateUploadSession(request *UploadSession) (*UploadSession, error) {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	row := *request
+	s.uploadSessions = append(s.uploadSessions, &row)
+	s.mu.Unlock()
+
+	return s.GetUploadSession(row.ID)
+}
+
+// GetUploadSession - Загрузка по ID, в том числе просроченная
+func (s *MemoryStorage) GetUploadSession(id string) (*UploadSession, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, row := range s.uploadSessions {
+		if row.ID == id {
+			session := *row
+			return &session, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// UpdateUploadSessionOffset - Сдвигает смещение с from на to.
+// false - смещение уже не from: параллельный PATCH успел раньше
+func (s *MemoryStorage) UpdateUploadSessionOffset(id string, from, to int64) (bool, error) {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range s.uploadSessions {
+		if row.ID == id && row.Offset == from {
+			row.Offset = to
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// DeleteUploadSession - Удаляет загрузку, если она есть
+func (s *MemoryStorage) DeleteUploadSession(id string) error {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, row := range s.uploadSessions {
+		if row.ID == id {
+			s.uploadSessions = append(s.uploadSessions[:i], s.uploadSessions[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// GetExpiredUploadSessions - Загрузки, которые истекли раньше before
+func (s *MemoryStorage) GetExpiredUploadSessions(before int64) ([]*UploadSession, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sessions := []*UploadSession{}
+	for _, row := range s.uploadSessions {
+		if row.ExpiresAt < before {
+			session := *row
+			sessions = append(sessions, &session)
+		}
+	}
+
+	return sessions, nil
+}
+
+//--
+// Replies methods
+//--
+
+// CreateReplies - Save links between posts
+func (s *MemoryStorage) CreateReplies(replies []*Reply) error {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, reply := range replies {
+		if s.hasReply(reply) {
+			continue
+		}
+		row := *reply
+		s.replies = append(s.replies, &row)
+	}
+
+	return nil
+}
+
+// GetRepliesByTopicID - Все связи из топика и в топик
+func (s *MemoryStorage) GetRepliesByTopicID(topicID int64) ([]*Reply, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.topicReplies(topicID), nil
+}
+
+// GetReplyTargets - Неудаленные топики и комментарии с такими номерами,
+// для ссылок >>N
+func (s *MemoryStorage) GetReplyTargets(ids []int64) ([]*ReplyTarget, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	wanted := map[int64]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	targets := []*ReplyTarget{}
+	slug := func(topicID int64) (string, bool) {
+		for _, topic := range s.topics {
+			if topic.ID != topicID || topic.States.IsDeleted {
+				continue
+			}
+			if board := s.boardByID(topic.BoardID); board != nil {
+				return board.Slug, true
+			}
+		}
+		return "", false
+	}
+
+	for _, topic := range s.topics {
+		if wanted[topic.ID] {
+			if board, ok := slug(topic.ID); ok {
+				targets = append(targets, &ReplyTarget{TopicID: topic.ID, Board: board})
+			}
+		}
+	}
+	for _, comment := range s.comments {
+		if wanted[comment.ID] && comment.States.IsDeleted == 0 {
+			if board, ok := slug(comment.TopicID); ok {
+				targets = append(targets, &ReplyTarget{comment.TopicID, comment.ID, board})
+			}
+		}
+	}
+
+	return targets, nil
+}
+
+func (s *MemoryStorage) topicReplies(topicID int64) []*Reply {
+	replies := []*Reply{}
+	for _, row := range s.replies {
+		if row.FromTopicID == topicID || row.ToTopicID == topicID {
+			reply := *row
+			replies = append(replies, &reply)
+		}
+	}
+	return replies
+}
+
+// hasReply - Аналог UNIQUE KEY replies_link
+func (s *MemoryStorage) hasReply(reply *Reply) bool {
+	for _, row := range s.replies {
+		if row.FromTopicID == reply.FromTopicID && row.FromCommentID == reply.FromCommentID &&
+			row.ToTopicID == reply.ToTopicID && row.ToCommentID == reply.ToCommentID {
+			return true
+		}
+	}
+	return false
+}
+
+//--
+// Tags methods
+//--
+
+// CreatePostTags - Index post hashtags
+func (s *MemoryStorage) CreatePostTags(topicID, commentID int64, tags []string, createdAt int64) error {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, name := range tags {
+		tag := s.tagByName(name)
+		if tag == nil {
+			tag = &memoryTag{ID: s.nextID("tags"), Name: name}
+			s.tags = append(s.tags, tag)
+		}
+
+		post := memoryTagPost{tag.ID, topicID, commentID, createdAt}
+		if !s.hasTagPost(post) {
+			s.tagsPosts = append(s.tagsPosts, post)
+		}
+	}
+
+	return nil
+}
+
+// GetTrendingTags - Самые упоминаемые теги с момента since
+func (s *MemoryStorage) GetTrendingTags(since int64, limit int64) ([]*Tag, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tags := []*Tag{}
+	counts := map[int64]*Tag{}
+	for _, row := range s.tagsPosts {
+		if row.CreatedAt < since {
+			continue
+		}
+		tag, ok := counts[row.TagID]
+		if !ok {
+			tag = &Tag{Name: s.tagByID(row.TagID).Name}
+			counts[row.TagID] = tag
+			tags = append(tags, tag)
+		}
+		tag.Count++
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Name < tags[j].Name
+	})
+
+	if int64(len(tags)) > limit {
+		tags = tags[:limit]
+	}
+
+	return tags, nil
+}
+
+func (s *MemoryStorage) tagByName(name string) *memoryTag {
+	for _, row := range s.tags {
+		if row.Name == name {
+			return row
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) tagByID(id int64) *memoryTag {
+	for _, row := range s.tags {
+		if row.ID == id {
+			return row
+		}
+	}
+	return nil
+}
+
+// hasTagPost - Аналог PRIMARY KEY tags_posts
+func (s *MemoryStorage) hasTagPost(post memoryTagPost) bool {
+	for _, row := range s.tagsPosts {
+		if row.TagID == post.TagID && row.TopicID == post.TopicID && row.CommentID == post.CommentID {
+			return true
+		}
+	}
+	return false
+}
+
+// topicHasTag - Тег есть в топике или в любом его комментарии
+func (s *MemoryStorage) topicHasTag(topicID int64, name string) bool {
+	tag := s.tagByName(name)
+	if tag == nil {
+		return false
+	}
+	for _, row := range s.tagsPosts {
+		if row.TagID == tag.ID && row.TopicID == topicID {
+			return true
+		}
+	}
+	return false
+}
+
+//--
+// Bugs methods
+//--
+
+// GetBugByID - Return bug by ID
+func (s *MemoryStorage) GetBugByID(id int) (*Bug, error) {
+	return &Bug{Number: 1}, errors.New("Bug not found")
+}
+
+// CreateBugReport - Create bug report with data
+func (s *MemoryStorage) CreateBugReport(request *BugCreateRequest) (*Bug, error) {
+	return &Bug{Number: 1}, nil
+}
+
+//--
+// Users methods
+//--
+
+// GetUserByUsername - Return user by username
+func (s *MemoryStorage) GetUserByUsername(username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, row := range s.users {
+		if row.Username == username {
+			user := *row
+			return &user, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// GetUserByID - Return user by ID
+func (s *MemoryStorage) GetUserByID(id int64) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if row := s.userByID(id); row != nil {
+		user := *row
+		return &user, nil
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// CreateUser - Create user and return him, or error
+// Профиль и статистика создаются вместе с пользователем.
+func (s *MemoryStorage) CreateUser(request *User) (*User, error) {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	for _, row := range s.users {
+		if row.Username == request.Username {
+			s.mu.Unlock()
+			return nil, fmt.Errorf("Duplicate entry '%s' for key 'username'", request.Username)
+		}
+	}
+	userID := s.insertUser(request)
+	s.mu.Unlock()
+
+	return s.GetUserByID(userID)
+}
+
+// insertUser - Вставка в users, users_profile и users_stats
+func (s *MemoryStorage) insertUser(request *User) int64 {
+	row := *request
+	row.ID = s.nextID("users")
+	s.users = append(s.users, &row)
+
+	stats := &UserStatistic{ID: s.nextID("users_stats"), UserID: row.ID}
+	s.stats = append(s.stats, stats)
+
+	return row.ID
+}
+
+func (s *MemoryStorage) userByID(id int64) *User {
+	for _, row := range s.users {
+		if row.ID == id {
+			return row
+		}
+	}
+	return nil
+}
+
+// GetUserStatistic - Get user stats
+func (s *MemoryStorage) GetUserStatistic(id int64) (*UserStatistic, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, row := range s.stats {
+		if row.UserID == id {
+			statistic := *row
+			if user := s.userByID(id); user != nil {
+				statistic.Statistic.AccountCreated = user.CreatedAt
+			}
+			return &statistic, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// UpdateUserStatistic - Update user stats fields
+func (s *MemoryStorage) UpdateUserStatistic(id int64, field string) error {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range s.stats {
+		if row.UserID != id {
+			continue
+		}
+		switch userStatisticFields[field] {
+		case "us.created_topics":
+			row.Statistic.СreatedTopics++
+		case "us.created_comments":
+			row.Statistic.СreatedComments++
+		case "us.uploaded_files":
+			row.Statistic.UploadedFiles++
+		default:
+			return ErrUnknownStatistic
+		}
+	}
+
+	return nil
+}
+
+//--
+// Moderation log methods
+//--
+
+// CreateModLogEntry - Дописывает действие в журнал
+func (s *MemoryStorage) CreateModLogEntry(request *ModLogEntry) error {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row := *request
+	row.ID = s.nextID("mod_log")
+	s.modLog = append(s.modLog, &row)
+
+	return nil
+}
+
+// GetModLog - Журнал с фильтрами, новые сверху
+func (s *MemoryStorage) GetModLog(request *ModLogRequest) ([]*ModLogEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := []*ModLogEntry{}
+	for i := len(s.modLog) - 1; i >= 0; i-- {
+		row := s.modLog[i]
+		switch {
+		case request.ModeratorID > 0 && row.ModeratorID != request.ModeratorID,
+			request.BoardID > 0 && row.BoardID != request.BoardID,
+			request.Action != "" && row.Action != request.Action,
+			request.Since > 0 && row.CreatedAt < request.Since,
+			request.Until > 0 && row.CreatedAt >= request.Until:
+			continue
+		}
+
+		entry := *row
+		if board := s.boardByID(row.BoardID); board != nil {
+			entry.Board = board.Slug
+		}
+		if user := s.userByID(row.ModeratorID); user != nil {
+			entry.Moderator = user.Profile.ScreenName
+		}
+		entries = append(entries, &entry)
+	}
+
+	offset := request.Limit * (request.Page - 1)
+	if offset < 0 || offset > int64(len(entries)) {
+		offset = int64(len(entries))
+	}
+	end := offset + request.Limit
+	if end > int64(len(entries)) {
+		end = int64(len(entries))
+	}
+
+	return entries[offset:end], nil
+}
+
+//--
+// Reports methods
+//--
+
+// CreateReport - Сохраняет жалобу. false - от этого жалобщика она уже есть
+func (s *MemoryStorage) CreateReport(request *Report) (bool, error) {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Повторная жалоба обновляет открытую, закрытые не в счет
+	for _, row := range s.reports {
+		if row.TargetType != request.TargetType || row.TargetID != request.TargetID || row.ReporterKey != request.ReporterKey || row.Status != ReportOpen {
+			continue
+		}
+		row.Category = request.Category
+		row.Text = request.Text
+		return false, nil
+	}
+
+	row := *request
+	row.ID = s.nextID("reports")
+	s.reports = append(s.reports, &row)
+
+	return true, nil
+}
+
+// GetReportByID - Жалоба с числом открытых жалоб на тот же пост
+func (s *MemoryStorage) GetReportByID(id int64) (*Report, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, row := range s.reports {
+		if row.ID == id {
+			return s.reportRow(row), nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// GetReports - Очередь жалоб: сначала посты, на которые жалуются чаще
+func (s *MemoryStorage) GetReports(request *ReportsRequest) ([]*Report, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	reports := []*Report{}
+	for _, row := range s.reports {
+		if row.Status != request.Status || request.BoardID > 0 && row.BoardID != request.BoardID {
+			continue
+		}
+		reports = append(reports, s.reportRow(row))
+	}
+
+	sort.SliceStable(reports, func(i, j int) bool {
+		if reports[i].TargetReports != reports[j].TargetReports {
+			return reports[i].TargetReports > reports[j].TargetReports
+		}
+		return reports[i].ID > reports[j].ID
+	})
+
+	offset := request.Limit * (request.Page - 1)
+	if offset < 0 || offset > int64(len(reports)) {
+		offset = int64(len(reports))
+	}
+	end := offset + request.Limit
+	if end > int64(len(reports)) {
+		end = int64(len(reports))
+	}
+
+	return reports[offset:end], nil
+}
+
+// CloseReports - Закрывает все открытые жалобы на пост, вернет сколько закрыли
+func (s *MemoryStorage) CloseReports(targetType string, targetID int64, status string, moderatorID, closedAt int64) (int64, error) {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var closed int64
+	for _, row := range s.reports {
+		if row.TargetType != targetType || row.TargetID != targetID || row.Status != ReportOpen {
+			continue
+		}
+		row.Status = status
+		row.ResolvedBy = moderatorID
+		row.ResolvedAt = closedAt
+		closed++
+	}
+
+	return closed, nil
+}
+
+// reportRow - Копия жалобы с доской и счетчиком, как из join
+func (s *MemoryStorage) reportRow(row *Report) *Report {
+	report := *row
+	if board := s.boardByID(row.BoardID); board != nil {
+		report.Board = board.Slug
+	}
+	report.TargetReports = 0
+	for _, other := range s.reports {
+		if other.TargetType == row.TargetType && other.TargetID == row.TargetID && other.Status == ReportOpen {
+			report.TargetReports++
+		}
+	}
+	return &report
+}
+
+//--
+// Bans methods
+//--
+
+// CreateBan - Сохраняет бан
+func (s *MemoryStorage) CreateBan(request *Ban) (*Ban, error) {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	row := *request
+	row.ID = s.nextID("bans")
+	s.bans = append(s.bans, &row)
+	s.mu.Unlock()
+
+	return s.GetBanByID(row.ID)
+}
+
+// GetBanByID - Бан по ID, в том числе истекший
+func (s *MemoryStorage) GetBanByID(id int64) (*Ban, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, row := range s.bans {
+		if row.ID == id {
+			return s.banRow(row), nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// GetActiveBans - Действующие баны юзера, адреса ip и все баны по подсетям:
+// подсеть сверяет вызывающий
+func (s *MemoryStorage) GetActiveBans(userID int64, ip string, now int64) ([]*Ban, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bans := []*Ban{}
+	for _, row := range s.bans {
+		byIP := row.IP != "" && (row.IP == ip || strings.Contains(row.IP, "/"))
+		if (row.UserID == userID || byIP) && row.active(now) {
+			bans = append(bans, s.banRow(row))
+		}
+	}
+
+	return bans, nil
+}
+
+// GetBans - Действующие баны, новые сверху
+func (s *MemoryStorage) GetBans(request *BansRequest) ([]*Ban, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bans := []*Ban{}
+	for i := len(s.bans) - 1; i >= 0; i-- {
+		row := s.bans[i]
+		if !row.active(request.Now) || request.BoardID > 0 && row.BoardID != request.BoardID {
+			continue
+		}
+		bans = append(bans, s.banRow(row))
+	}
+
+	offset := request.Limit * (request.Page - 1)
+	if offset < 0 || offset > int64(len(bans)) {
+		offset = int64(len(bans))
+	}
+	end := offset + request.Limit
+	if end > int64(len(bans)) {
+		end = int64(len(bans))
+	}
+
+	return bans[offset:end], nil
+}
+
+// LiftBan - Снимает бан с момента now, если он еще действует
+func (s *MemoryStorage) LiftBan(id, now int64) error {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range s.bans {
+		if row.ID == id && row.active(now) {
+			row.ExpiresAt = now
+		}
+	}
+
+	return nil
+}
+
+// CreateBanAppeal - Сохраняет апелляцию. false - от этого юзера она уже есть
+func (s *MemoryStorage) CreateBanAppeal(request *BanAppeal) (bool, error) {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range s.bansAppeals {
+		if row.BanID == request.BanID && row.AppellantKey == request.AppellantKey {
+			return false, nil
+		}
+	}
+
+	row := *request
+	row.ID = s.nextID("bans_appeals")
+	s.bansAppeals = append(s.bansAppeals, &row)
+
+	return true, nil
+}
+
+// GetBanAppealByID - Апелляция с причиной и доской бана
+func (s *MemoryStorage) GetBanAppealByID(id int64) (*BanAppeal, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, row := range s.bansAppeals {
+		if row.ID == id {
+			return s.banAppealRow(row), nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// GetBanAppeal - Апелляция на бан от конкретного юзера или адреса
+func (s *MemoryStorage) GetBanAppeal(banID int64, appellantKey string) (*BanAppeal, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, row := range s.bansAppeals {
+		if row.BanID == banID && row.AppellantKey == appellantKey {
+			return s.banAppealRow(row), nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// GetBanAppeals - Апелляции по статусу, старые сверху
+func (s *MemoryStorage) GetBanAppeals(request *BansRequest) ([]*BanAppeal, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	appeals := []*BanAppeal{}
+	for _, row := range s.bansAppeals {
+		appeal := s.banAppealRow(row)
+		if appeal.Status != request.Status || request.BoardID > 0 && appeal.BoardID != request.BoardID {
+			continue
+		}
+		appeals = append(appeals, appeal)
+	}
+
+	offset := request.Limit * (request.Page - 1)
+	if offset < 0 || offset > int64(len(appeals)) {
+		offset = int64(len(appeals))
+	}
+	end := offset + request.Limit
+	if end > int64(len(appeals)) {
+		end = int64(len(appeals))
+	}
+
+	return appeals[offset:end], nil
+}
+
+// UpdateBanAppeal - Ответ модератора на апелляцию
+func (s *MemoryStorage) UpdateBanAppeal(request *BanAppeal) error {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range s.bansAppeals {
+		if row.ID == request.ID {
+			row.Status = request.Status
+			row.AnsweredBy = request.AnsweredBy
+			row.AnsweredAt = request.AnsweredAt
+		}
+	}
+
+	return nil
+}
+
+// banRow - Копия бана с доской, как из join
+func (s *MemoryStorage) banRow(row *Ban) *Ban {
+	ban := *row
+	if board := s.boardByID(row.BoardID); board != nil {
+		ban.Board = board.Slug
+	}
+	return &ban
+}
+
+// banAppealRow - Копия апелляции с причиной и доской бана, как из join
+func (s *MemoryStorage) banAppealRow(row *BanAppeal) *BanAppeal {
+	appeal := *row
+	for _, ban := range s.bans {
+		if ban.ID == row.BanID {
+			appeal.BanReason = ban.Reason
+			appeal.BoardID = ban.BoardID
+			appeal.Board = s.banRow(ban).Board
+		}
+	}
+	return &appeal
+}
+
+//--
+// Roles methods
+//--
+
+// GetUserRoles - Роли пользователя, глобальные и на досках
+func (s *MemoryStorage) GetUserRoles(userID int64) ([]*UserRole, error) {
+	return s.GetRolesByUserIDs([]int64{userID})
+}
+
+// GetRolesByUserIDs - Роли сразу нескольких пользователей, для бейджей на постах
+func (s *MemoryStorage) GetRolesByUserIDs(ids []int64) ([]*UserRole, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	roles := []*UserRole{}
+	for _, id := range ids {
+		for _, row := range s.roles {
+			if row.UserID != id {
+				continue
+			}
+			role := *row
+			if board := s.boardByID(row.BoardID); board != nil {
+				role.Board = board.Slug
+			}
+			roles = append(roles, &role)
+		}
+	}
+
+	return roles, nil
+}
+
+// CreateUserRole - Выдает роль, повторная выдача ничего не меняет
+func (s *MemoryStorage) CreateUserRole(request *UserRole) error {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range s.roles {
+		if row.UserID == request.UserID && row.Role == request.Role && row.BoardID == request.BoardID {
+			return nil
+		}
+	}
+
+	row := *request
+	row.Board = ""
+	s.roles = append(s.roles, &row)
+
+	return nil
+}
+
+// DeleteUserRole - Снимает роль, если она есть
+func (s *MemoryStorage) DeleteUserRole(userID int64, role string, boardID int64) error {
+	defer s.lockTx()()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, row := range s.roles {
+		if row.UserID == userID && row.Role == role && row.BoardID == boardID {
+			s.roles = append(s.roles[:i], s.roles[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+func TestMemoryStorageTopicsOrder(t *testing.T) {
+	s := NewMemoryStorage()
+	board := s.AddBoard(&Board{Title: "Random", Slug: "b"})
+
+	create := func(subject string, bumpedAt int64, pinned bool) *Topic {
+		request := &Topic{BoardID: board.ID, UserID: 1, Subject: subject, CreatedAt: bumpedAt, BumpedAt: bumpedAt}
+		request.States.IsPinned = pinned
+		topic, err := s.CreateTopic(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return topic
+	}
+
+	old := create("old", 100, false)
+	create("new", 200, false)
+	create("pinned", 50, true)
+
+	// Bump old topic
+	if err := s.UpdateTopicBumpTime(&Comment{TopicID: old.ID, CreatedAt: 300}); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name    string
+		request *TopicsRequest
+		want    []string
+	}{
+		{"Bump order", &TopicsRequest{Slug: "b", Sort: "bumped_at", Page: 1, Limit: 30}, []string{"pinned", "old", "new"}},
+		{"Created order", &TopicsRequest{Sort: "created_at", Page: 1, Limit: 30}, []string{"pinned", "new", "old"}},
+		{"Pagination", &TopicsRequest{Sort: "bumped_at", Page: 2, Limit: 2}, []string{"new"}},
+		{"Other board", &TopicsRequest{Slug: "t", Sort: "bumped_at", Page: 1, Limit: 30}, []string{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			topics, err := s.GetTopicsList(tc.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+			for _, topic := range topics {
+				got = append(got, topic.Subject)
+			}
+
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v; want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("got %v; want %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStorageCounters(t *testing.T) {
+	s := NewMemoryStorage()
+	board := s.AddBoard(&Board{Title: "Random", Slug: "b"})
+
+	topic, _ := s.CreateTopic(&Topic{BoardID: board.ID, UserID: 1, Subject: "files"})
+	s.AddTopicFile(topic.ID, &File{UUID: "a", Type: "png"})
+	s.AddTopicFile(topic.ID, &File{UUID: "b", Type: "gif"})
+	s.CreateComment(&Comment{TopicID: topic.ID, UserID: 1, Message: "one"})
+	s.CreateComment(&Comment{TopicID: topic.ID, UserID: 1, Message: "two"})
+	s.CreateComment(&Comment{TopicID: topic.ID, UserID: 1, Message: "three"})
+
+	got, err := s.GetTopicByID(topic.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.CommentsCount != 3 {
+		t.Errorf("got comments_count %d; want 3", got.CommentsCount)
+	}
+	if got.FilesCount != 2 || len(got.Attachments) != 2 {
+		t.Errorf("got files_count %d and %d attachments; want 2", got.FilesCount, len(got.Attachments))
+	}
+
+	if err := s.UpdateUserStatistic(1, "created_comments"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateUserStatistic(1, "password"); err == nil {
+		t.Error("got nil error for unknown stat field")
+	}
+
+	statistic, _ := s.GetUserStatistic(1)
+	if statistic.Statistic.СreatedComments != 1 {
+		t.Errorf("got created_comments %d; want 1", statistic.Statistic.СreatedComments)
+	}
+}
+
+func TestMemoryStorageWithTx(t *testing.T) {
+	s := NewMemoryStorage()
+	board := s.AddBoard(&Board{Title: "Random", Slug: "b"})
+
+	var topicID int64
+	failure := errors.New("failure")
+
+	err := s.WithTx(context.Background(), func(tx Storage) error {
+		topic, err := tx.CreateTopic(&Topic{BoardID: board.ID, UserID: 1, Subject: "rolled back"})
+		if err != nil {
+			return err
+		}
+		topicID = topic.ID
+
+		if err := tx.UpdateUserStatistic(1, "created_topics"); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("got %v; want %v", err, failure)
+	}
+
+	if _, err := s.GetTopicByID(topicID); err == nil {
+		t.Error("got topic after rollback")
+	}
+
+	statistic, _ := s.GetUserStatistic(1)
+	if statistic.Statistic.СreatedTopics != 0 {
+		t.Errorf("got created_topics %d after rollback; want 0", statistic.Statistic.СreatedTopics)
+	}
+
+	err = s.WithTx(context.Background(), func(tx Storage) error {
+		_, err := tx.CreateTopic(&Topic{BoardID: board.ID, UserID: 1, Subject: "committed"})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topics, _ := s.GetTopicsList(&TopicsRequest{Sort: "bumped_at", Page: 1, Limit: 30})
+	if len(topics) != 1 || topics[0].Subject != "committed" {
+		t.Errorf("got %+v; want only committed topic", topics)
+	}
+}
+
+// Баны по адресам: точный адрес и подсети, чужие адреса не грузятся
+func TestMemoryStorageActiveBans(t *testing.T) {
+	storage := NewMemoryStorage()
+
+	storage.CreateBan(&Ban{UserID: 2, Reason: "User", CreatedAt: 1})
+	storage.CreateBan(&Ban{IP: "10.0.0.1", Reason: "Exact", CreatedAt: 1})
+	storage.CreateBan(&Ban{IP: "10.0.0.2", Reason: "Other", CreatedAt: 1})
+	storage.CreateBan(&Ban{IP: "192.168.0.0/16", Reason: "Subnet", CreatedAt: 1})
+	storage.CreateBan(&Ban{UserID: 3, Reason: "Expired", CreatedAt: 1, ExpiresAt: 50})
+
+	bans, err := storage.GetActiveBans(2, "10.0.0.1", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := []string{}
+	for _, ban := range bans {
+		reasons = append(reasons, ban.Reason)
+	}
+	if strings.Join(reasons, ",") != "User,Exact,Subnet" {
+		t.Errorf("got %v; want user, exact ip and subnet bans", reasons)
+	}
+
+	if bans, _ := storage.GetActiveBans(1, "", 100); len(bans) != 1 || bans[0].Reason != "Subnet" {
+		t.Errorf("got %d bans; want only subnet ban for unknown address", len(bans))
+	}
+}
@@ -0,0 +1,1194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/yuriygr/go-board/migrations"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	selectBoards         = "select b.* from boards as b"
+	selectPages          = "select p.* from pages as p"
+	selectTopics         = "select t.*, b.title, b.slug, COUNT(c.id) as comments_count, up.user_id, up.screen_name, (select count(*) from files as f left join topics_files as tf on tf.file_id = f.id where tf.topic_id = t.id) as files_count from topics as t left join boards as b on t.board_id = b.id left join comments as c on c.topic_id = t.id left join users_profile as up on up.user_id = t.user_id"
+	selectComments       = "select c.*, up.screen_name from comments as c left join users_profile as up on up.user_id = c.user_id"
+	selectUsers          = "select u.*, up.screen_name, up.sex from users as u left join users_profile as up on up.user_id = u.id"
+	selectUsersStatistic = "select us.*, u.created_at from users_stats as us left join users as u on us.user_id = u.id"
+
+	selectBoardBySlug                 = selectBoards + " where b.slug = ?"
+	selectPageBySlug                  = selectPages + " where p.slug = ?"
+	selectTopicByID                   = selectTopics + " where t.id = ? group by t.id"
+	selectTopicFiles                  = "select f.* from topics_files as tf left join files as f on tf.file_id = f.id where tf.topic_id = ? group by tf.file_id"
+	selectCommentFiles                = "select f.* from comments_files as cf left join files as f on cf.file_id = f.id where cf.comment_id = ? group by cf.file_id"
+	selectFileByID                    = "select f.* from files as f where f.id = ?"
+	selectFileByMd5                   = "select f.* from files as f where f.md5 = ? order by f.id limit 1"
+	selectFileByUUID                  = "select f.* from files as f where f.uuid = ?"
+	selectFilePosts                   = "select tf.topic_id as topic_id, 0 as comment_id from topics_files as tf where tf.file_id = ? union all select c.topic_id as topic_id, cf.comment_id as comment_id from comments_files as cf left join comments as c on c.id = cf.comment_id where cf.file_id = ? order by topic_id, comment_id"
+	selectFileBan                     = "select fb.* from files_bans as fb where fb.md5 = ?"
+	selectFileBansWithPhash           = "select fb.* from files_bans as fb where fb.phash != ''"
+	selectFlaggedFiles                = "select f.* from files as f where f.is_flagged = 1 order by f.id"
+	selectOrphanFiles                 = "select f.* from files as f where f.created_at < ? and " + whereFileIsOrphan + " order by f.id"
+	selectFilesAfter                  = "select f.* from files as f where f.id > ? order by f.id limit ?"
+	selectUploadSession               = "select ups.* from upload_sessions as ups where ups.id = ?"
+	selectExpiredUploadSessions       = "select ups.* from upload_sessions as ups where ups.expires_at < ? order by ups.expires_at"
+	selectTopicFilesCount             = "select (select count(*) from topics_files as tf where tf.topic_id = ?) + (select count(*) from comments_files as cf left join comments as c on c.id = cf.comment_id where c.topic_id = ?)"
+	selectBoardFilesSize              = "select coalesce(sum(f.size), 0) from files as f where f.id in (select tf.file_id from topics_files as tf left join topics as t on t.id = tf.topic_id where t.board_id = ? union select cf.file_id from comments_files as cf left join comments as c on c.id = cf.comment_id left join topics as t on t.id = c.topic_id where t.board_id = ?)"
+	selectCommentByID                 = selectComments + " where c.id = ?"
+	selectCommentsByTopicID           = selectComments + " where c.topic_id = ? order by c.is_pinned desc, c.created_at asc"
+	selectCommentsByTopicIDWithOffset = selectComments + " where c.topic_id = ? and c.created_at > ? order by c.is_pinned desc, c.created_at asc"
+	selectUserByUsername              = selectUsers + " where u.username = ?"
+	selectUserByID                    = selectUsers + " where u.id = ?"
+	selectUserStatisticByUserID       = selectUsersStatistic + " where us.user_id = ?"
+	selectRepliesByTopicID            = "select r.* from replies as r where r.from_topic_id = ? or r.to_topic_id = ? order by r.id"
+	selectReplyTargets                = "select t.id as topic_id, 0 as comment_id, b.slug as slug from topics as t left join boards as b on b.id = t.board_id where t.id in (?) and t.is_deleted = 0 union all select c.topic_id as topic_id, c.id as comment_id, b.slug as slug from comments as c left join topics as t on t.id = c.topic_id left join boards as b on b.id = t.board_id where c.id in (?) and c.is_deleted = 0 and t.is_deleted = 0"
+	selectTrendingTags                = "select tg.name, count(*) as count from tags_posts as tp left join tags as tg on tg.id = tp.tag_id where tp.created_at >= ? group by tg.id order by count desc, tg.name asc limit ?"
+
+	// Фильтр топиков по тегу из топика или любого его комментария
+	whereTopicHasTag = "t.id in (select tp.topic_id from tags_posts as tp left join tags as tg on tg.id = tp.tag_id where tg.name = ?)"
+	// Файл не прикреплен ни к топику, ни к комментарию
+	whereFileIsOrphan = "not exists (select 1 from topics_files as tf where tf.file_id = f.id) and not exists (select 1 from comments_files as cf where cf.file_id = f.id)"
+
+	insertComment     = "INSERT INTO comments (topic_id, user_id, message, created_at, user_ip, user_agent, is_pinned, is_deleted) VALUES (:c.topic_id, :c.user_id, :c.message, :c.created_at, :c.user_ip, :c.user_agent, :c.is_pinned, :c.is_deleted)"
+	inserTopic        = "INSERT INTO topics (type, board_id, user_id, subject, message, created_at, bumped_at, user_ip, user_agent, is_closed, is_pinned, is_deleted, allow_attach, only_anonymously) VALUES (:t.type, :t.board_id, :t.user_id, :t.subject, :t.message, :t.created_at, :t.bumped_at, :t.user_ip, :t.user_agent, :t.is_closed, :t.is_pinned, :t.is_deleted, :t.allow_attach, :t.only_anonymously)"
+	inserUser         = "INSERT INTO users (username, password, created_at, is_banned, is_deleted) VALUES (:u.username, :u.password, :u.created_at, :u.is_banned, :u.is_deleted)"
+	inserUserProfile  = "INSERT INTO users_profile (user_id, screen_name) VALUES (:u.id, :up.screen_name)"
+	inserUserStats    = "INSERT INTO users_stats (user_id) values (:u.id)"
+	insertTopicFile   = "INSERT INTO topics_files (topic_id, file_id) VALUES (?, ?)"
+	insertCommentFile = "INSERT INTO comments_files (comment_id, file_id) VALUES (?, ?)"
+	insertFileBan     = "INSERT INTO files_bans (md5, phash, reason, created_at) VALUES (:fb.md5, :fb.phash, :fb.reason, :fb.created_at) ON DUPLICATE KEY UPDATE phash = VALUES(phash), reason = VALUES(reason)"
+	insertFile        = "INSERT INTO files (uuid, user_id, md5, phash, name, type, kind, thumb_type, size, width, height, duration, created_at, is_flagged) VALUES (:f.uuid, :f.user_id, :f.md5, :f.phash, :f.name, :f.type, :f.kind, :f.thumb_type, :f.size, :f.width, :f.height, :f.duration, :f.created_at, :f.is_flagged)"
+
+	updateFileFlag = "UPDATE files as f SET f.is_flagged = ? WHERE f.id = ?"
+	insertReply    = "INSERT IGNORE INTO replies (from_topic_id, from_comment_id, to_topic_id, to_comment_id, created_at) VALUES (:r.from_topic_id, :r.from_comment_id, :r.to_topic_id, :r.to_comment_id, :r.created_at)"
+	insertTag      = "INSERT INTO tags (name) VALUES (?) ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)"
+	insertTagPost  = "INSERT IGNORE INTO tags_posts (tag_id, topic_id, comment_id, created_at) VALUES (?, ?, ?, ?)"
+
+	deleteOrphanFile = "DELETE f FROM files as f WHERE f.id = ? AND " + whereFileIsOrphan
+
+	updateTopicBumpTime = "UPDATE topics as t SET t.bumped_at = ? WHERE t.id = ?"
+
+	insertUploadSession = "INSERT INTO upload_sessions (id, user_id, name, size, received, checksum, created_at, expires_at) VALUES (:ups.id, :ups.user_id, :ups.name, :ups.size, :ups.received, :ups.checksum, :ups.created_at, :ups.expires_at)"
+	deleteUploadSession = "DELETE FROM upload_sessions WHERE id = ?"
+	// Смещение двигается, только если его никто не сдвинул раньше
+	updateUploadSessionOffset = "UPDATE upload_sessions as ups SET ups.received = ? WHERE ups.id = ? AND ups.received = ?"
+
+	// Только то, что меняют модераторы
+	updateTopic   = "UPDATE topics as t SET t.board_id = :t.board_id, t.is_closed = :t.is_closed, t.is_pinned = :t.is_pinned, t.is_deleted = :t.is_deleted WHERE t.id = :t.id"
+	updateComment = "UPDATE comments as c SET c.is_pinned = :c.is_pinned, c.is_deleted = :c.is_deleted WHERE c.id = :c.id"
+
+	selectModLog      = "select ml.*, coalesce(b.slug, '') as slug, coalesce(up.screen_name, '') as screen_name from mod_log as ml left join boards as b on b.id = ml.board_id left join users_profile as up on up.user_id = ml.moderator_id"
+	insertModLogEntry = "INSERT INTO mod_log (moderator_id, board_id, target_type, target_id, action, reason, state_before, state_after, ip, created_at) VALUES (:ml.moderator_id, :ml.board_id, :ml.target_type, :ml.target_id, :ml.action, :ml.reason, :ml.state_before, :ml.state_after, :ml.ip, :ml.created_at)"
+
+	selectReports    = "select r.*, coalesce(b.slug, '') as slug, (select count(*) from reports as rt where rt.target_type = r.target_type and rt.target_id = r.target_id and rt.status = 'open') as target_reports from reports as r left join boards as b on b.id = r.board_id"
+	selectReportByID = selectReports + " where r.id = ?"
+	// Повторная жалоба обновляет только открытую
+	insertReport        = "INSERT INTO reports (target_type, target_id, topic_id, board_id, reporter_id, reporter_ip, reporter_key, category, text, status, created_at) VALUES (:r.target_type, :r.target_id, :r.topic_id, :r.board_id, :r.reporter_id, :r.reporter_ip, :r.reporter_key, :r.category, :r.text, :r.status, :r.created_at) ON DUPLICATE KEY UPDATE category = VALUES(category), text = VALUES(text)"
+	updateReportsStatus = "UPDATE reports as r SET r.status = ?, r.resolved_by = ?, r.resolved_at = ? WHERE r.target_type = ? AND r.target_id = ? AND r.status = 'open'"
+
+	selectBans       = "select bn.*, coalesce(b.slug, '') as slug from bans as bn left join boards as b on b.id = bn.board_id"
+	selectBanByID    = selectBans + " where bn.id = ?"
+	selectActiveBans = selectBans + " where (bn.user_id = ? or bn.ip != '' and (bn.ip = ? or bn.ip like '%/%')) and (bn.expires_at = 0 or bn.expires_at > ?)"
+	insertBan        = "INSERT INTO bans (user_id, ip, board_id, reason, moderator_id, created_at, expires_at) VALUES (:bn.user_id, :bn.ip, :bn.board_id, :bn.reason, :bn.moderator_id, :bn.created_at, :bn.expires_at)"
+	liftBan          = "UPDATE bans as bn SET bn.expires_at = ? WHERE bn.id = ? AND (bn.expires_at = 0 OR bn.expires_at > ?)"
+
+	selectBansAppeals   = "select ba.*, bn.reason, bn.board_id, coalesce(b.slug, '') as slug from bans_appeals as ba join bans as bn on bn.id = ba.ban_id left join boards as b on b.id = bn.board_id"
+	selectBanAppealByID = selectBansAppeals + " where ba.id = ?"
+	selectBanAppeal     = selectBansAppeals + " where ba.ban_id = ? and ba.appellant_key = ?"
+	insertBanAppeal     = "INSERT IGNORE INTO bans_appeals (ban_id, user_id, ip, appellant_key, text, status, created_at) VALUES (:ba.ban_id, :ba.user_id, :ba.ip, :ba.appellant_key, :ba.text, :ba.status, :ba.created_at)"
+	updateBanAppeal     = "UPDATE bans_appeals as ba SET ba.status = :ba.status, ba.answered_by = :ba.answered_by, ba.answered_at = :ba.answered_at WHERE ba.id = :ba.id"
+
+	selectUsersRoles     = "select ur.*, coalesce(b.slug, '') as slug from users_roles as ur left join boards as b on b.id = ur.board_id"
+	selectUserRoles      = selectUsersRoles + " where ur.user_id = ? order by ur.board_id, ur.role"
+	selectRolesByUserIDs = selectUsersRoles + " where ur.user_id in (?) order by ur.user_id, ur.board_id, ur.role"
+	insertUserRole       = "INSERT IGNORE INTO users_roles (user_id, role, board_id, created_at) VALUES (:ur.user_id, :ur.role, :ur.board_id, :ur.created_at)"
+	deleteUserRole       = "DELETE FROM users_roles WHERE user_id = ? AND role = ? AND board_id = ?"
+
+	// Колонка берется только из белого списка userStatisticFields
+	updateUserStatistic = "UPDATE users_stats as us SET %[1]s = %[1]s + 1 WHERE us.user_id = ?"
+)
+
+// NewMySQLStorage - init new MySQL storage
+// Отказывается стартовать, если схема базы не совпадает с миграциями.
+func NewMySQLStorage(dsn string) *MySQLStorage {
+	db := ConnectMySQL(dsn)
+
+	if err := migrations.NewMigrator(db).Check(); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Unsafe becouse i sleep
+	return &MySQLStorage{db: db.Unsafe()}
+}
+
+// ConnectMySQL - Open connection or die
+func ConnectMySQL(dsn string) *sqlx.DB {
+	db, err := sqlx.Connect("mysql", dsn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	db.SetConnMaxLifetime(time.Hour)
+	return db
+}
+
+// MySQLStorage - Нечто такое обстрактное я хз
+// попозже придумаю что тут написать так то
+// штука крутая.
+type MySQLStorage struct {
+	db *sqlx.DB
+	tx *sqlx.Tx // Не nil внутри WithTx
+}
+
+// q - Куда слать запросы: в транзакцию, если она есть
+func (s *MySQLStorage) q() sqlx.Ext {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+// WithTx - Unit of work. Все вызовы tx внутри fn идут одной транзакцией,
+// которая откатывается, если fn вернула ошибку или запаниковала.
+// Вложенный WithTx присоединяется к внешней транзакции.
+func (s *MySQLStorage) WithTx(ctx context.Context, fn func(tx Storage) error) error {
+	return s.withTx(ctx, func(tx *MySQLStorage) error {
+		return fn(tx)
+	})
+}
+
+func (s *MySQLStorage) withTx(ctx context.Context, fn func(tx *MySQLStorage) error) (err error) {
+	if s.tx != nil {
+		return fn(s)
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(&MySQLStorage{db: s.db, tx: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//--
+// Boards methods
+//--
+
+// GetBoardsList - Get list of boards
+func (s *MySQLStorage) GetBoardsList() ([]*Board, error) {
+	boards := []*Board{}
+	sql := selectBoards
+
+	err := sqlx.Select(s.q(), &boards, sql)
+	if err != nil {
+		return nil, err
+	}
+
+	return boards, nil
+}
+
+// GetBoardBySlug - Get boarf by slug
+func (s *MySQLStorage) GetBoardBySlug(slug string) (*Board, error) {
+	board := Board{}
+
+	err := sqlx.Get(s.q(), &board, selectBoardBySlug, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	return &board, nil
+}
+
+//--
+// Page methods
+//--
+
+// GetPageBySlug - Return page by Slug
+func (s *MySQLStorage) GetPageBySlug(slug string) (*Page, error) {
+	page := Page{}
+
+	err := sqlx.Get(s.q(), &page, selectPageBySlug, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	return &page, nil
+}
+
+//--
+// Topic methods
+//--
+
+// GetTopicsList - Return topics list with params
+func (s *MySQLStorage) GetTopicsList(request *TopicsRequest) ([]*Topic, error) {
+	topics := []*Topic{}
+	sql := selectTopics
+	args := []interface{}{}
+
+	column, ok := topicsSortColumns[request.Sort]
+	if !ok {
+		return nil, ErrUnknownSort
+	}
+
+	// Удаленные топики в списки не попадают
+	where := []string{"t.is_deleted = 0"}
+
+	if len(request.Slug) > 0 {
+		where = append(where, "b.slug = ?")
+		args = append(args, request.Slug)
+	}
+
+	if len(request.Tag) > 0 {
+		where = append(where, whereTopicHasTag)
+		args = append(args, request.Tag)
+	}
+
+	sql = sql + " where " + strings.Join(where, " and ")
+
+	limit := request.Limit
+	offset := request.Limit * (request.Page - 1)
+
+	sql = sql + " group by t.id order by t.is_pinned desc, " + column + " desc limit ? offset ?"
+	args = append(args, limit, offset)
+
+	err := sqlx.Select(s.q(), &topics, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, topic := range topics {
+		if topic.FilesCount > 0 {
+			topic.Attachments = s.GetTopicFiles(topic)
+		} else {
+			topic.Attachments = []*File{}
+		}
+	}
+
+	return topics, nil
+}
+
+// GetTopicByID - Return topic by ID
+func (s *MySQLStorage) GetTopicByID(id int64) (*Topic, error) {
+	topic := Topic{}
+
+	err := sqlx.Get(s.q(), &topic, selectTopicByID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	topic.Attachments = s.GetTopicFiles(&topic)
+
+	replies, err := s.GetRepliesByTopicID(topic.ID)
+	if err != nil {
+		return nil, err
+	}
+	attachTopicReplies(&topic, replies)
+
+	return &topic, nil
+}
+
+// CreateTopic - Create topic and return him, or error
+// Вложения из request.Attachments привязываются в той же транзакции.
+func (s *MySQLStorage) CreateTopic(request *Topic) (*Topic, error) {
+	var topic *Topic
+
+	err := s.withTx(context.Background(), func(tx *MySQLStorage) error {
+		result, err := sqlx.NamedExec(tx.q(), inserTopic, request)
+		if err != nil {
+			return err
+		}
+
+		topicID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		for _, file := range request.Attachments {
+			if _, err := tx.q().Exec(insertTopicFile, topicID, file.ID); err != nil {
+				return err
+			}
+		}
+
+		topic, err = tx.GetTopicByID(topicID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return topic, nil
+}
+
+// UpdateTopicBumpTime - Update topic bump time with comment data
+func (s *MySQLStorage) UpdateTopicBumpTime(request *Comment) error {
+	_, err := s.q().Exec(updateTopicBumpTime, request.CreatedAt, request.TopicID)
+
+	return err
+}
+
+// UpdateTopic - Сохраняет доску и состояния топика
+func (s *MySQLStorage) UpdateTopic(request *Topic) error {
+	_, err := sqlx.NamedExec(s.q(), updateTopic, request)
+
+	return err
+}
+
+// GetTopicFiles - Возвращает файлы топика
+// TODO: Ну что за фигня. Надо сделать проще
+func (s *MySQLStorage) GetTopicFiles(topic *Topic) []*File {
+	files := []*File{}
+
+	err := sqlx.Select(s.q(), &files, selectTopicFiles, topic.ID)
+	if err != nil {
+		return nil
+	}
+
+	return files
+}
+
+// --
+// Comments methods
+// --
+
+// GetCommentsList - Return list of comments by topic ID
+func (s *MySQLStorage) GetCommentsList(request *CommentsRequest) ([]*Comment, error) {
+	comments := []*Comment{}
+
+	err := sqlx.Select(s.q(), &comments, selectCommentsByTopicIDWithOffset, request.TopicID, request.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, comment := range comments {
+		comment.Attachments = s.GetCommentFiles(comment)
+	}
+
+	replies, err := s.GetRepliesByTopicID(int64(request.TopicID))
+	if err != nil {
+		return nil, err
+	}
+	attachCommentReplies(comments, replies)
+
+	return comments, nil
+}
+
+// GetCommentByID - Return comment by ID
+func (s *MySQLStorage) GetCommentByID(id int64) (*Comment, error) {
+	comment := Comment{}
+
+	err := sqlx.Get(s.q(), &comment, selectCommentByID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	comment.Attachments = s.GetCommentFiles(&comment)
+
+	replies, err := s.GetRepliesByTopicID(comment.TopicID)
+	if err != nil {
+		return nil, err
+	}
+	attachCommentReplies([]*Comment{&comment}, replies)
+
+	return &comment, nil
+}
+
+// CreateComment - Create comment and return him, or error
+// Вложения из request.Attachments привязываются в той же транзакции.
+func (s *MySQLStorage) CreateComment(request *Comment) (*Comment, error) {
+	var comment *Comment
+
+	err := s.withTx(context.Background(), func(tx *MySQLStorage) error {
+		result, err := sqlx.NamedExec(tx.q(), insertComment, request)
+		if err != nil {
+			return err
+		}
+
+		commentID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		for _, file := range request.Attachments {
+			if _, err := tx.q().Exec(insertCommentFile, commentID, file.ID); err != nil {
+				return err
+			}
+		}
+
+		comment, err = tx.GetCommentByID(commentID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return comment, nil
+}
+
+// UpdateComment - Сохраняет состояния комментария
+func (s *MySQLStorage) UpdateComment(request *Comment) error {
+	_, err := sqlx.NamedExec(s.q(), updateComment, request)
+
+	return err
+}
+
+// GetCommentFiles - Возвращает файлы комментария
+func (s *MySQLStorage) GetCommentFiles(comment *Comment) []*File {
+	files := []*File{}
+
+	err := sqlx.Select(s.q(), &files, selectCommentFiles, comment.ID)
+	if err != nil {
+		return nil
+	}
+
+	return files
+}
+
+//--
+// Files methods
+//--
+
+// CreateFile - Save uploaded file and return him, or error
+func (s *MySQLStorage) CreateFile(request *File) (*File, error) {
+	result, err := sqlx.NamedExec(s.q(), insertFile, request)
+	if err != nil {
+		return nil, err
+	}
+
+	fileID, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetFileByID(fileID)
+}
+
+// GetFileByID - Return file by ID
+func (s *MySQLStorage) GetFileByID(id int64) (*File, error) {
+	file := File{}
+
+	err := sqlx.Get(s.q(), &file, selectFileByID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+// GetFileByMd5 - Первый файл с таким md5
+func (s *MySQLStorage) GetFileByMd5(md5 string) (*File, error) {
+	file := File{}
+
+	err := sqlx.Get(s.q(), &file, selectFileByMd5, md5)
+	if err != nil {
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+// GetFileByUUID - Файл по имени в хранилище
+func (s *MySQLStorage) GetFileByUUID(uuid string) (*File, error) {
+	file := File{}
+
+	err := sqlx.Get(s.q(), &file, selectFileByUUID, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+// GetFilePosts - Топики и комментарии, где прикреплен файл
+func (s *MySQLStorage) GetFilePosts(fileID int64) ([]*PostRef, error) {
+	posts := []*PostRef{}
+
+	err := sqlx.Select(s.q(), &posts, selectFilePosts, fileID, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	return posts, nil
+}
+
+// GetFileBan - Return ban by file hash
+func (s *MySQLStorage) GetFileBan(md5 string) (*FileBan, error) {
+	ban := FileBan{}
+
+	err := sqlx.Get(s.q(), &ban, selectFileBan, md5)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ban, nil
+}
+
+// CreateFileBan - Ban file hash, повторный бан обновляет причину
+func (s *MySQLStorage) CreateFileBan(request *FileBan) error {
+	_, err := sqlx.NamedExec(s.q(), insertFileBan, request)
+
+	return err
+}
+
+// GetFileBansWithPhash - Баны, по которым ищем похожие картинки
+func (s *MySQLStorage) GetFileBansWithPhash() ([]*FileBan, error) {
+	bans := []*FileBan{}
+
+	err := sqlx.Select(s.q(), &bans, selectFileBansWithPhash)
+	if err != nil {
+		return nil, err
+	}
+
+	return bans, nil
+}
+
+// GetFlaggedFiles - Файлы, ждущие проверки модератором
+func (s *MySQLStorage) GetFlaggedFiles() ([]*File, error) {
+	files := []*File{}
+
+	err := sqlx.Select(s.q(), &files, selectFlaggedFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// GetFilesAfter - Файлы по порядку id, чтобы обойти все пачками
+func (s *MySQLStorage) GetFilesAfter(afterID, limit int64) ([]*File, error) {
+	files := []*File{}
+
+	err := sqlx.Select(s.q(), &files, selectFilesAfter, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// GetOrphanFiles - Никуда не прикрепленные файлы, загруженные до before
+func (s *MySQLStorage) GetOrphanFiles(before int64) ([]*File, error) {
+	files := []*File{}
+
+	err := sqlx.Select(s.q(), &files, selectOrphanFiles, before)
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// DeleteOrphanFile - Удаляет файл, только если его так никуда и не прикрепили.
+// false - файл успели прикрепить или уже удалили
+func (s *MySQLStorage) DeleteOrphanFile(id int64) (bool, error) {
+	result, err := s.q().Exec(deleteOrphanFile, id)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// UpdateFileFlag - Поставить или снять флаг проверки
+func (s *MySQLStorage) UpdateFileFlag(id int64, flagged bool) error {
+	_, err := s.q().Exec(updateFileFlag, flagged, id)
+
+	return err
+}
+
+// CountTopicFiles - Файлы топика вместе с файлами комментариев
+func (s *MySQLStorage) CountTopicFiles(topicID int64) (int64, error) {
+	var count int64
+
+	err := sqlx.Get(s.q(), &count, selectTopicFilesCount, topicID, topicID)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// GetBoardFilesSize - Сколько байт занимают файлы постов доски
+func (s *MySQLStorage) GetBoardFilesSize(boardID int64) (int64, error) {
+	var size int64
+
+	err := sqlx.Get(s.q(), &size, selectBoardFilesSize, boardID, boardID)
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+//--
+// Upload sessions methods
+//--
+
+// CreateUploadSession - Новая загрузка по частям
+func (s *MySQLStorage) CreateUploadSession(request *UploadSession) (*UploadSession, error) {
+	if _, err := sqlx.NamedExec(s.q(), insertUploadSession, request); err != nil {
+		return nil, err
+	}
+
+	return s.GetUploadSession(request.ID)
+}
+
+// GetUploadSession - Загрузка по ID, в том числе просроченная
+func (s *MySQLStorage) GetUploadSession(id string) (*UploadSession, error) {
+	session := UploadSession{}
+
+	err := sqlx.Get(s.q(), &session, selectUploadSession, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// UpdateUploadSessionOffset - Сдвигает смещение с from на to.
+// false - смещение уже не from: параллельный PATCH успел раньше
+func (s *MySQLStorage) UpdateUploadSessionOffset(id string, from, to int64) (bool, error) {
+	result, err := s.q().Exec(updateUploadSessionOffset, to, id, from)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// DeleteUploadSession - Удаляет загрузку, если она есть
+func (s *MySQLStorage) DeleteUploadSession(id string) error {
+	_, err := s.q().Exec(deleteUploadSession, id)
+
+	return err
+}
+
+// GetExpiredUploadSessions - Загрузки, которые истекли раньше before
+func (s *MySQLStorage) GetExpiredUploadSessions(before int64) ([]*UploadSession, error) {
+	sessions := []*UploadSession{}
+
+	err := sqlx.Select(s.q(), &sessions, selectExpiredUploadSessions, before)
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+//--
+// Replies methods
+//--
+
+// CreateReplies - Save links between posts
+func (s *MySQLStorage) CreateReplies(replies []*Reply) error {
+	for _, reply := range replies {
+		if _, err := sqlx.NamedExec(s.q(), insertReply, reply); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetRepliesByTopicID - Все связи из топика и в топик
+func (s *MySQLStorage) GetRepliesByTopicID(topicID int64) ([]*Reply, error) {
+	replies := []*Reply{}
+
+	err := sqlx.Select(s.q(), &replies, selectRepliesByTopicID, topicID, topicID)
+	if err != nil {
+		return nil, err
+	}
+
+	return replies, nil
+}
+
+// GetReplyTargets - Неудаленные топики и комментарии с такими номерами,
+// для ссылок >>N одним запросом
+func (s *MySQLStorage) GetReplyTargets(ids []int64) ([]*ReplyTarget, error) {
+	targets := []*ReplyTarget{}
+	if len(ids) == 0 {
+		return targets, nil
+	}
+
+	query, args, err := sqlx.In(selectReplyTargets, ids, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sqlx.Select(s.q(), &targets, s.q().Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return targets, nil
+}
+
+//--
+// Tags methods
+//--
+
+// CreatePostTags - Index post hashtags
+// Для топика commentID равен 0.
+func (s *MySQLStorage) CreatePostTags(topicID, commentID int64, tags []string, createdAt int64) error {
+	for _, tag := range tags {
+		result, err := s.q().Exec(insertTag, tag)
+		if err != nil {
+			return err
+		}
+
+		// LAST_INSERT_ID(id) отдает id и для уже существующего тега
+		tagID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		if _, err := s.q().Exec(insertTagPost, tagID, topicID, commentID, createdAt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetTrendingTags - Самые упоминаемые теги с момента since
+func (s *MySQLStorage) GetTrendingTags(since int64, limit int64) ([]*Tag, error) {
+	tags := []*Tag{}
+
+	err := sqlx.Select(s.q(), &tags, selectTrendingTags, since, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+//--
+// Bugs methods
+//--
+
+// GetBugByID - Return bug by ID
+func (s *MySQLStorage) GetBugByID(id int) (*Bug, error) {
+	return &Bug{Number: 1}, errors.New("Bug not found")
+}
+
+// CreateBugReport - Create bug report with data
+func (s *MySQLStorage) CreateBugReport(request *BugCreateRequest) (*Bug, error) {
+	fmt.Println(request)
+	return &Bug{Number: 1}, nil
+}
+
+//--
+// Users methods
+//--
+
+// GetUserByUsername - Return user by username
+func (s *MySQLStorage) GetUserByUsername(username string) (*User, error) {
+	user := User{}
+
+	err := sqlx.Get(s.q(), &user, selectUserByUsername, username)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// GetUserByID - Return user by ID
+func (s *MySQLStorage) GetUserByID(id int64) (*User, error) {
+	user := User{}
+
+	err := sqlx.Get(s.q(), &user, selectUserByID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// CreateUser - Create user and return him, or error
+// Пользователь, профиль и статистика создаются одной транзакцией.
+func (s *MySQLStorage) CreateUser(request *User) (*User, error) {
+	var user *User
+
+	err := s.withTx(context.Background(), func(tx *MySQLStorage) error {
+		result, err := sqlx.NamedExec(tx.q(), inserUser, request)
+		if err != nil {
+			return err
+		}
+
+		UserID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		// And we must create profile and stats to user...
+		request.ID = UserID
+
+		if _, err := sqlx.NamedExec(tx.q(), inserUserProfile, request); err != nil {
+			return err
+		}
+
+		if _, err := sqlx.NamedExec(tx.q(), inserUserStats, request); err != nil {
+			return err
+		}
+
+		user, err = tx.GetUserByID(UserID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// GetUserStatistic - Get user stats
+func (s *MySQLStorage) GetUserStatistic(id int64) (*UserStatistic, error) {
+	statistic := UserStatistic{}
+
+	err := sqlx.Get(s.q(), &statistic, selectUserStatisticByUserID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &statistic, nil
+}
+
+// UpdateUserStatistic - Update user stats fields
+func (s *MySQLStorage) UpdateUserStatistic(id int64, field string) error {
+	column, ok := userStatisticFields[field]
+	if !ok {
+		return ErrUnknownStatistic
+	}
+
+	_, err := s.q().Exec(fmt.Sprintf(updateUserStatistic, column), id)
+
+	return err
+}
+
+//--
+// Moderation log methods
+//--
+
+// CreateModLogEntry - Дописывает действие в журнал
+func (s *MySQLStorage) CreateModLogEntry(request *ModLogEntry) error {
+	_, err := sqlx.NamedExec(s.q(), insertModLogEntry, request)
+
+	return err
+}
+
+// GetModLog - Журнал с фильтрами, новые сверху
+func (s *MySQLStorage) GetModLog(request *ModLogRequest) ([]*ModLogEntry, error) {
+	entries := []*ModLogEntry{}
+	sql := selectModLog
+	where := []string{}
+	args := []interface{}{}
+
+	if request.ModeratorID > 0 {
+		where = append(where, "ml.moderator_id = ?")
+		args = append(args, request.ModeratorID)
+	}
+	if request.BoardID > 0 {
+		where = append(where, "ml.board_id = ?")
+		args = append(args, request.BoardID)
+	}
+	if request.Action != "" {
+		where = append(where, "ml.action = ?")
+		args = append(args, request.Action)
+	}
+	if request.Since > 0 {
+		where = append(where, "ml.created_at >= ?")
+		args = append(args, request.Since)
+	}
+	if request.Until > 0 {
+		where = append(where, "ml.created_at < ?")
+		args = append(args, request.Until)
+	}
+
+	if len(where) > 0 {
+		sql = sql + " where " + strings.Join(where, " and ")
+	}
+
+	sql = sql + " order by ml.id desc limit ? offset ?"
+	args = append(args, request.Limit, request.Limit*(request.Page-1))
+
+	err := sqlx.Select(s.q(), &entries, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+//--
+// Reports methods
+//--
+
+// CreateReport - Сохраняет жалобу. false - от этого жалобщика она уже есть
+func (s *MySQLStorage) CreateReport(request *Report) (bool, error) {
+	result, err := sqlx.NamedExec(s.q(), insertReport, request)
+	if err != nil {
+		return false, err
+	}
+
+	// 1 - новая строка, 2 - обновили открытую, 0 - ничего не поменялось
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+// GetReportByID - Жалоба с числом открытых жалоб на тот же пост
+func (s *MySQLStorage) GetReportByID(id int64) (*Report, error) {
+	report := Report{}
+
+	err := sqlx.Get(s.q(), &report, selectReportByID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// GetReports - Очередь жалоб: сначала посты, на которые жалуются чаще
+func (s *MySQLStorage) GetReports(request *ReportsRequest) ([]*Report, error) {
+	reports := []*Report{}
+	sql := selectReports + " where r.status = ?"
+	args := []interface{}{request.Status}
+
+	if request.BoardID > 0 {
+		sql = sql + " and r.board_id = ?"
+		args = append(args, request.BoardID)
+	}
+
+	sql = sql + " order by target_reports desc, r.id desc limit ? offset ?"
+	args = append(args, request.Limit, request.Limit*(request.Page-1))
+
+	err := sqlx.Select(s.q(), &reports, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+// CloseReports - Закрывает все открытые жалобы на пост, вернет сколько закрыли
+func (s *MySQLStorage) CloseReports(targetType string, targetID int64, status string, moderatorID, closedAt int64) (int64, error) {
+	result, err := s.q().Exec(updateReportsStatus, status, moderatorID, closedAt, targetType, targetID)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+//--
+// Bans methods
+//--
+
+// CreateBan - Сохраняет бан
+func (s *MySQLStorage) CreateBan(request *Ban) (*Ban, error) {
+	result, err := sqlx.NamedExec(s.q(), insertBan, request)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetBanByID(id)
+}
+
+// GetBanByID - Бан по ID, в том числе истекший
+func (s *MySQLStorage) GetBanByID(id int64) (*Ban, error) {
+	ban := Ban{}
+
+	err := sqlx.Get(s.q(), &ban, selectBanByID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ban, nil
+}
+
+// GetActiveBans - Действующие баны юзера, адреса ip и все баны по подсетям:
+// подсеть сверяет вызывающий
+func (s *MySQLStorage) GetActiveBans(userID int64, ip string, now int64) ([]*Ban, error) {
+	bans := []*Ban{}
+
+	err := sqlx.Select(s.q(), &bans, selectActiveBans, userID, ip, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return bans, nil
+}
+
+// GetBans - Действующие баны, новые сверху
+func (s *MySQLStorage) GetBans(request *BansRequest) ([]*Ban, error) {
+	bans := []*Ban{}
+	sql := selectBans + " where (bn.expires_at = 0 or bn.expires_at > ?)"
+	args := []interface{}{request.Now}
+
+	if request.BoardID > 0 {
+		sql = sql + " and bn.board_id = ?"
+		args = append(args, request.BoardID)
+	}
+
+	sql = sql + " order by bn.id desc limit ? offset ?"
+	args = append(args, request.Limit, request.Limit*(request.Page-1))
+
+	err := sqlx.Select(s.q(), &bans, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return bans, nil
+}
+
+// LiftBan - Снимает бан с момента now, если он еще действует
+func (s *MySQLStorage) LiftBan(id, now int64) error {
+	_, err := s.q().Exec(liftBan, now, id, now)
+
+	return err
+}
+
+// CreateBanAppeal - Сохраняет апелляцию. false - от этого юзера она уже есть
+func (s *MySQLStorage) CreateBanAppeal(request *BanAppeal) (bool, error) {
+	result, err := sqlx.NamedExec(s.q(), insertBanAppeal, request)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+// GetBanAppealByID - Апелляция с причиной и доской бана
+func (s *MySQLStorage) GetBanAppealByID(id int64) (*BanAppeal, error) {
+	appeal := BanAppeal{}
+
+	err := sqlx.Get(s.q(), &appeal, selectBanAppealByID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &appeal, nil
+}
+
+// GetBanAppeal - Апелляция на бан от конкретного юзера или адреса
+func (s *MySQLStorage) GetBanAppeal(banID int64, appellantKey string) (*BanAppeal, error) {
+	appeal := BanAppeal{}
+
+	err := sqlx.Get(s.q(), &appeal, selectBanAppeal, banID, appellantKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &appeal, nil
+}
+
+// GetBanAppeals - Апелляции по статусу, старые сверху
+func (s *MySQLStorage) GetBanAppeals(request *BansRequest) ([]*BanAppeal, error) {
+	appeals := []*BanAppeal{}
+	sql := selectBansAppeals + " where ba.status = ?"
+	args := []interface{}{request.Status}
+
+	if request.BoardID > 0 {
+		sql = sql + " and bn.board_id = ?"
+		args = append(args, request.BoardID)
+	}
+
+	sql = sql + " order by ba.id limit ? offset ?"
+	args = append(args, request.Limit, request.Limit*(request.Page-1))
+
+	err := sqlx.Select(s.q(), &appeals, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return appeals, nil
+}
+
+// UpdateBanAppeal - Ответ модератора на апелляцию
+func (s *MySQLStorage) UpdateBanAppeal(request *BanAppeal) error {
+	_, err := sqlx.NamedExec(s.q(), updateBanAppeal, request)
+
+	return err
+}
+
+//--
+// Roles methods
+//--
+
+// GetUserRoles - Роли пользователя, глобальные и на досках
+func (s *MySQLStorage) GetUserRoles(userID int64) ([]*UserRole, error) {
+	roles := []*UserRole{}
+
+	err := sqlx.Select(s.q(), &roles, selectUserRoles, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// GetRolesByUserIDs - Роли сразу нескольких пользователей, для бейджей на постах
+func (s *MySQLStorage) GetRolesByUserIDs(ids []int64) ([]*UserRole, error) {
+	roles := []*UserRole{}
+	if len(ids) == 0 {
+		return roles, nil
+	}
+
+	query, args, err := sqlx.In(selectRolesByUserIDs, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sqlx.Select(s.q(), &roles, s.q().Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// CreateUserRole - Выдает роль, повторная выдача ничего не меняет
+func (s *MySQLStorage) CreateUserRole(request *UserRole) error {
+	_, err := sqlx.NamedExec(s.q(), insertUserRole, request)
+
+	return err
+}
+
+// DeleteUserRole - Снимает роль, если она есть
+func (s *MySQLStorage) DeleteUserRole(userID int64, role string, boardID int64) error {
+	_, err := s.q().Exec(deleteUserRole, userID, role, boardID)
+
+	return err
+}
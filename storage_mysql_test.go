@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// recorderDriver - Фейковый драйвер, который запоминает все запросы
+// и их аргументы, а в ответ отдает пустые выборки.
+type recorderDriver struct {
+	mu      sync.Mutex
+	queries []recordedQuery
+	failOn  string // Exec с этой подстрокой вернет ошибку
+}
+
+type recordedQuery struct {
+	Query string
+	Args  []driver.Value
+}
+
+var recorder = &recorderDriver{}
+
+func init() {
+	sql.Register("recorder", recorder)
+}
+
+func (d *recorderDriver) Open(name string) (driver.Conn, error) { return recorderConn{d}, nil }
+
+func (d *recorderDriver) record(query string, args []driver.Value) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queries = append(d.queries, recordedQuery{query, args})
+}
+
+func (d *recorderDriver) reset() []recordedQuery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	queries := d.queries
+	d.queries = nil
+	d.failOn = ""
+	return queries
+}
+
+func (d *recorderDriver) fail(query string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failOn != "" && strings.Contains(query, d.failOn) {
+		return fmt.Errorf("recorder: %s failed", d.failOn)
+	}
+	return nil
+}
+
+type recorderConn struct{ d *recorderDriver }
+
+func (c recorderConn) Prepare(query string) (driver.Stmt, error) {
+	return recorderStmt{c.d, query}, nil
+}
+func (c recorderConn) Close() error { return nil }
+func (c recorderConn) Begin() (driver.Tx, error) {
+	c.d.record("BEGIN", nil)
+	return recorderTx{c.d}, nil
+}
+
+type recorderTx struct{ d *recorderDriver }
+
+func (tx recorderTx) Commit() error   { tx.d.record("COMMIT", nil); return nil }
+func (tx recorderTx) Rollback() error { tx.d.record("ROLLBACK", nil); return nil }
+
+type recorderStmt struct {
+	d     *recorderDriver
+	query string
+}
+
+func (s recorderStmt) Close() error  { return nil }
+func (s recorderStmt) NumInput() int { return -1 }
+
+func (s recorderStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.record(s.query, args)
+	if err := s.d.fail(s.query); err != nil {
+		return nil, err
+	}
+	return recorderResult{}, nil
+}
+
+func (s recorderStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.record(s.query, args)
+	return recorderRows{}, nil
+}
+
+type recorderResult struct{}
+
+func (recorderResult) LastInsertId() (int64, error) { return 1, nil }
+func (recorderResult) RowsAffected() (int64, error) { return 1, nil }
+
+type recorderRows struct{}
+
+func (recorderRows) Columns() []string              { return []string{} }
+func (recorderRows) Close() error                   { return nil }
+func (recorderRows) Next(dest []driver.Value) error { return io.EOF }
+
+func newRecorderStorage(t *testing.T) *MySQLStorage {
+	db, err := sqlx.Open("recorder", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &MySQLStorage{db: sqlx.NewDb(db.DB, "mysql").Unsafe()}
+}
+
+// Ни один враждебный ввод не должен попасть в текст запроса,
+// только в связанные параметры.
+func TestMySQLStorageHostileInput(t *testing.T) {
+	storage := newRecorderStorage(t)
+	server := httptest.NewServer(NewRouter(storage, NewCookieSession([]byte("test-key")), nil))
+	defer server.Close()
+
+	payloads := []string{
+		"1 or 1=1; drop table users --",
+		"x') union select password from users where (1=1",
+		"b\\ or sleep(10) #",
+	}
+
+	for _, payload := range payloads {
+		testCases := []struct {
+			name   string
+			method string
+			path   string
+			form   url.Values
+		}{
+			{"Topics slug", "GET", "/v1/topics/?slug=" + url.QueryEscape(payload), nil},
+			{"Page slug", "GET", "/v1/pages/" + url.PathEscape(payload) + "/", nil},
+			{"Tag", "GET", "/v1/tags/" + url.PathEscape(payload) + "/topics", nil},
+			{"Topic board", "POST", "/v1/topics/", url.Values{"board": {payload}, "subject": {"Subj"}, "message": {"Some long enough message"}}},
+			{"Login username", "POST", "/v1/users/login", url.Values{"username": {payload}, "password": {"password"}}},
+		}
+
+		for _, tc := range testCases {
+			t.Run(fmt.Sprintf("%s %q", tc.name, payload), func(t *testing.T) {
+				recorder.reset()
+
+				var body io.Reader
+				if tc.form != nil {
+					body = strings.NewReader(tc.form.Encode())
+				}
+				req, _ := http.NewRequest(tc.method, server.URL+tc.path, body)
+				if tc.form != nil {
+					req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+
+				queries := recorder.reset()
+				if len(queries) == 0 {
+					t.Fatal("got no queries; want at least one")
+				}
+
+				forms := []string{payload, html.EscapeString(payload), url.PathEscape(payload)}
+
+				bound := false
+				for _, q := range queries {
+					for _, form := range forms {
+						if strings.Contains(q.Query, form) {
+							t.Errorf("payload spliced into query: %s", q.Query)
+						}
+					}
+					for _, arg := range q.Args {
+						for _, form := range forms {
+							if arg == form {
+								bound = true
+							}
+						}
+					}
+				}
+				if !bound {
+					t.Errorf("got %v; want payload bound as parameter", queries)
+				}
+			})
+		}
+	}
+}
+
+func TestTopicsSortWhitelist(t *testing.T) {
+	storage := newRecorderStorage(t)
+	server := httptest.NewServer(NewRouter(storage, NewCookieSession([]byte("test-key")), nil))
+	defer server.Close()
+
+	testCases := []struct {
+		name string
+		sort string
+		want int
+	}{
+		{"Bumped", "bumped_at", http.StatusOK},
+		{"Created", "created_at", http.StatusOK},
+		{"Injection", "(select sleep(10))", http.StatusBadRequest},
+		{"Other column", "user_ip", http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder.reset()
+
+			resp, err := http.Get(server.URL + "/v1/topics/?sort=" + url.QueryEscape(tc.sort))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tc.want {
+				t.Errorf("got %d; want %d", resp.StatusCode, tc.want)
+			}
+
+			for _, q := range recorder.reset() {
+				if strings.Contains(q.Query, tc.sort) && tc.want != http.StatusOK {
+					t.Errorf("sort spliced into query: %s", q.Query)
+				}
+			}
+		})
+	}
+}
+
+func TestUserStatisticWhitelist(t *testing.T) {
+	storage := newRecorderStorage(t)
+
+	if err := storage.UpdateUserStatistic(1, "created_topics = 0, us.password"); err != ErrUnknownStatistic {
+		t.Errorf("got %v; want %v", err, ErrUnknownStatistic)
+	}
+
+	recorder.reset()
+	if err := storage.UpdateUserStatistic(1, "created_topics"); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := recorder.reset()
+	if len(queries) != 1 || !strings.Contains(queries[0].Query, "us.created_topics = us.created_topics + 1") {
+		t.Errorf("got %v; want created_topics increment", queries)
+	}
+}
+
+// Роли авторов страницы постов - одним запросом с IN
+func TestMySQLStorageRolesByUserIDs(t *testing.T) {
+	storage := newRecorderStorage(t)
+
+	recorder.reset()
+	if _, err := storage.GetRolesByUserIDs(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.GetRolesByUserIDs([]int64{2, 3, 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := recorder.reset()
+	if len(queries) != 1 || !strings.Contains(queries[0].Query, "ur.user_id in (?, ?, ?)") || len(queries[0].Args) != 3 {
+		t.Errorf("got %v; want one query with three bound ids", queries)
+	}
+}
+
+// Посты для ссылок >>N - одним запросом на все сообщение
+func TestMySQLStorageReplyTargets(t *testing.T) {
+	storage := newRecorderStorage(t)
+
+	recorder.reset()
+	if _, err := storage.GetReplyTargets(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.GetReplyTargets([]int64{7, 9}); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := recorder.reset()
+	if len(queries) != 1 || !strings.Contains(queries[0].Query, "t.id in (?, ?)") || !strings.Contains(queries[0].Query, "c.id in (?, ?)") || len(queries[0].Args) != 4 {
+		t.Errorf("got %v; want one query with bound ids", queries)
+	}
+}
+
+// Баны по адресам: точный адрес сверяет база, грузятся только подсети
+func TestMySQLStorageActiveBans(t *testing.T) {
+	storage := newRecorderStorage(t)
+
+	recorder.reset()
+	if _, err := storage.GetActiveBans(2, "10.0.0.1", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := recorder.reset()
+	if len(queries) != 1 || !strings.Contains(queries[0].Query, "bn.ip = ? or bn.ip like '%/%'") || len(queries[0].Args) != 3 || queries[0].Args[1] != "10.0.0.1" {
+		t.Errorf("got %v; want exact ip bound and only subnets loaded", queries)
+	}
+}
+
+// Падение на любой из вставок откатывает всего пользователя
+func TestMySQLStorageCreateUserTx(t *testing.T) {
+	storage := newRecorderStorage(t)
+
+	testCases := []struct {
+		name   string
+		failOn string
+		want   string
+	}{
+		{"Users", "INSERT INTO users (", "ROLLBACK"},
+		{"Profile", "INSERT INTO users_profile", "ROLLBACK"},
+		{"Stats", "INSERT INTO users_stats", "ROLLBACK"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder.reset()
+			recorder.failOn = tc.failOn
+
+			if _, err := storage.CreateUser(&User{Username: "mario"}); err == nil {
+				t.Fatal("got nil error; want insert failure")
+			}
+
+			queries := recorder.reset()
+			if queries[0].Query != "BEGIN" {
+				t.Errorf("got first query %s; want BEGIN", queries[0].Query)
+			}
+			if last := queries[len(queries)-1].Query; last != tc.want {
+				t.Errorf("got last query %s; want %s", last, tc.want)
+			}
+			for _, q := range queries {
+				if q.Query == "COMMIT" {
+					t.Error("got COMMIT after failed insert")
+				}
+			}
+		})
+	}
+}
+
+func TestMySQLStorageWithTx(t *testing.T) {
+	storage := newRecorderStorage(t)
+	recorder.reset()
+
+	err := storage.WithTx(context.Background(), func(tx Storage) error {
+		if err := tx.UpdateTopicBumpTime(&Comment{TopicID: 1, CreatedAt: 100}); err != nil {
+			return err
+		}
+		// Вложенная транзакция присоединяется к внешней
+		return tx.WithTx(context.Background(), func(tx Storage) error {
+			return tx.UpdateUserStatistic(1, "created_comments")
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for _, q := range recorder.reset() {
+		got = append(got, strings.Fields(q.Query)[0])
+	}
+
+	want := []string{"BEGIN", "UPDATE", "UPDATE", "COMMIT"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
@@ -65,6 +65,51 @@ func ErrForbidden(err error) render.Renderer {
 	}
 }
 
+// ErrTooLarge - Возвращает ошибку 413 со статусом
+func ErrTooLarge(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 413,
+		StatusText:     err.Error(),
+	}
+}
+
+// ErrConflict - Возвращает ошибку 409 со статусом
+func ErrConflict(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 409,
+		StatusText:     err.Error(),
+	}
+}
+
+// ErrTooManyRequests - Возвращает ошибку 429 со статусом, Retry-After ставит вызывающий
+func ErrTooManyRequests(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 429,
+		StatusText:     err.Error(),
+	}
+}
+
+// ErrUnprocessable - Возвращает ошибку 422 со статусом
+func ErrUnprocessable(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 422,
+		StatusText:     err.Error(),
+	}
+}
+
+// ErrBadGateway - Возвращает ошибку 502 со статусом, когда не ответило хранилище
+func ErrBadGateway(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 502,
+		StatusText:     err.Error(),
+	}
+}
+
 // ErrMethodNotAllowed - Возвращает ошибку 404 со статусом
 func ErrMethodNotAllowed() render.Renderer {
 	return &ErrResponse{
@@ -99,14 +144,16 @@ func (s *SuccessResponse) Render(w http.ResponseWriter, r *http.Request) error {
 
 // SessionResponse - Состояние юзера
 type SessionResponse struct {
-	User        User   `json:"user"`
-	Auth        bool   `json:"auth"`
-	Permissions string `json:"permissions"`
+	User        User        `json:"user"`
+	Auth        bool        `json:"auth"`
+	Roles       []*UserRole `json:"roles"`
+	Permissions []string    `json:"permissions"` // Права ролей, на доске - право@slug
 }
 
 // Bind - Bind structure with session
 func (sr *SessionResponse) Bind(session *sessions.Session) {
 	sr.User = session.Values["user"].(User)
 	sr.Auth = session.Values["auth"].(bool)
-	sr.Permissions = ""
+	sr.Roles = []*UserRole{}
+	sr.Permissions = []string{}
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuriygr/go-board/utils"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+type tagsResource struct {
+	storage Storage
+	session *Session
+}
+
+func (rs tagsResource) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	r.With(rs.TrendingCtx).Get("/trending", rs.TrendingList)
+	r.Route("/{tag}", func(r chi.Router) {
+		r.With(rs.PaginationCtx).Get("/topics", rs.TopicsList)
+	})
+
+	return r
+}
+
+//--
+// Middleware
+//--
+
+// PaginationCtx - Топики с тегом, пагинация как в TopicsList
+func (rs *tagsResource) PaginationCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tag, err := url.PathUnescape(chi.URLParam(r, "tag"))
+		if err != nil || tag == "" {
+			render.Render(w, r, ErrBadRequest(errors.New("Tag needed")))
+			return
+		}
+
+		request := &TopicsRequest{Sort: "bumped_at", Page: 1, Limit: 30} // Initial state
+		if err := request.Bind(r); err != nil {
+			render.Render(w, r, ErrBadRequest(err))
+			return
+		}
+		request.Tag = strings.ToLower(tag)
+
+		topics, err := rs.storage.GetTopicsList(request)
+		if err == nil {
+			err = setTopicsBadges(rs.storage, topics...)
+		}
+		if err != nil {
+			render.Render(w, r, ErrBadRequest(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), TopicsCtxKey{}, topics)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// TagsCtxKey - Key for context
+type TagsCtxKey struct{}
+
+// TrendingCtx - Популярные теги за период
+func (rs *tagsResource) TrendingCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := &TrendingRequest{Period: 86400, Limit: 10} // Initial state
+		if err := request.Bind(r); err != nil {
+			render.Render(w, r, ErrBadRequest(err))
+			return
+		}
+
+		since := time.Now().Unix() - request.Period
+		tags, err := rs.storage.GetTrendingTags(since, request.Limit)
+		if err != nil {
+			render.Render(w, r, ErrBadRequest(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), TagsCtxKey{}, tags)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+//--
+// Handler methods
+//--
+
+// TopicsList - Вывод топиков с тегом
+func (rs *tagsResource) TopicsList(w http.ResponseWriter, r *http.Request) {
+	topics := r.Context().Value(TopicsCtxKey{}).([]*Topic)
+
+	if err := render.RenderList(w, r, NewTopicsListResponse(topics)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// TrendingList - Вывод популярных тегов
+func (rs *tagsResource) TrendingList(w http.ResponseWriter, r *http.Request) {
+	tags := r.Context().Value(TagsCtxKey{}).([]*Tag)
+
+	if err := render.RenderList(w, r, NewTagsListResponse(tags)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+//--
+// Struct
+//--
+
+// Tag - Хештег со счетчиком упоминаний
+type Tag struct {
+	Name  string `json:"name" db:"tg.name"`
+	Count int64  `json:"count" db:"count"`
+}
+
+// Render - Render, wtf
+func (t *Tag) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// TrendingRequest - Request for trending tags
+type TrendingRequest struct {
+	Period int64 // Окно в секундах
+	Limit  int64
+}
+
+// Bind - Bind HTTP request data and validate it
+func (tr *TrendingRequest) Bind(r *http.Request) error {
+	if period := r.URL.Query().Get("period"); period != "" {
+		if periodInt, err := strconv.ParseInt(period, 10, 64); err == nil {
+			tr.Period = utils.LimitMaxValue(utils.LimitMinValue(periodInt, 60), 86400*30)
+		}
+	}
+
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		if limitInt, err := strconv.ParseInt(limit, 10, 64); err == nil {
+			tr.Limit = utils.LimitMaxValue(utils.LimitMinValue(limitInt, 1), 64)
+		}
+	}
+
+	return nil
+}
+
+// NewTagsListResponse - Условности CHI
+func NewTagsListResponse(tags []*Tag) []render.Renderer {
+	list := []render.Renderer{}
+	for _, tag := range tags {
+		list = append(list, tag)
+	}
+	return list
+}
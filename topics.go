@@ -3,19 +3,21 @@ package main
 import (
 	"context"
 	"errors"
-	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"github.com/yuriygr/go-board/utils"
 )
 
+// maxMessageLength - Длиннее сообщение не принимаем, в символах
+const maxMessageLength = 15000
+
 type topicsResource struct {
-	storage *Storage
+	storage Storage
 	session *Session
 }
 
@@ -24,14 +26,26 @@ func (rs topicsResource) Routes() chi.Router {
 
 	r.Route("/", func(r chi.Router) {
 		r.With(rs.PaginationCtx).Get("/", rs.TopicsList)
-		r.Post("/", rs.TopicCreate)
+		r.With(LimitBody, RateLimit("topic")).Post("/", rs.TopicCreate)
 	})
 
 	r.Route("/{topicID:[0-9]+}", func(r chi.Router) {
 		r.With(rs.TopicCtx).Get("/", rs.TopicGet)
 		r.With(rs.CommentsCtx).Get("/comments", rs.TopicCommentsGet)
-		r.Post("/comments", rs.CommentCreate)
-		r.Post("/report", rs.ReportCreate)
+		r.With(LimitBody, RateLimit("comment")).Post("/comments", rs.CommentCreate)
+		r.With(rs.TopicCtx).Post("/report", rs.ReportCreate)
+
+		// Модерация, роль на доске топика тоже подходит
+		r.Group(func(r chi.Router) {
+			r.Use(rs.TopicCtx, RequirePermission(PermPostsModerate))
+			r.Post("/pin", rs.moderateTopic("pin", func(t *Topic) { t.States.IsPinned = true }))
+			r.Post("/unpin", rs.moderateTopic("unpin", func(t *Topic) { t.States.IsPinned = false }))
+			r.Post("/close", rs.moderateTopic("close", func(t *Topic) { t.States.IsClosed = true }))
+			r.Post("/reopen", rs.moderateTopic("reopen", func(t *Topic) { t.States.IsClosed = false }))
+			r.Post("/delete", rs.moderateTopic("delete", func(t *Topic) { t.States.IsDeleted = true }))
+			r.Post("/restore", rs.moderateTopic("restore", func(t *Topic) { t.States.IsDeleted = false }))
+			r.Post("/move", rs.TopicMove)
+		})
 	})
 
 	return r
@@ -55,6 +69,9 @@ func (rs *topicsResource) PaginationCtx(next http.Handler) http.Handler {
 		}
 
 		topics, err := rs.storage.GetTopicsList(request)
+		if err == nil {
+			err = setTopicsBadges(rs.storage, topics...)
+		}
 		if err != nil {
 			render.Render(w, r, ErrBadRequest(err))
 			return
@@ -71,6 +88,7 @@ type TopicCtxKey struct{}
 // TopicCtx middleware is used to load an Topic object from
 // the URL parameters passed through as the request. In case
 // the Topic could not be found, we stop here and return a 404.
+// Удаленный топик видят только модераторы его доски.
 func (rs *topicsResource) TopicCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var topic *Topic
@@ -85,11 +103,19 @@ func (rs *topicsResource) TopicCtx(next http.Handler) http.Handler {
 			return
 		}
 
+		if err == nil && topic.States.IsDeleted && !canModerate(r, topic.BoardID) {
+			err = errors.New("Topic not exist")
+		}
 		if err != nil {
 			render.Render(w, r, ErrNotFound(err))
 			return
 		}
 
+		if err := setTopicsBadges(rs.storage, topic); err != nil {
+			render.Render(w, r, ErrBadRequest(err))
+			return
+		}
+
 		ctx := context.WithValue(r.Context(), TopicCtxKey{}, topic)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -98,7 +124,8 @@ func (rs *topicsResource) TopicCtx(next http.Handler) http.Handler {
 // CommentsCtxKey middleware для вывода комментариев топика
 type CommentsCtxKey struct{}
 
-// CommentsCtx
+// CommentsCtx - Комментарии топика. Бейджи и видимость
+// удаленных зависят от доски топика
 func (rs *topicsResource) CommentsCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		request := &CommentsRequest{} // Initial state
@@ -107,12 +134,30 @@ func (rs *topicsResource) CommentsCtx(next http.Handler) http.Handler {
 			return
 		}
 
+		topic, err := rs.storage.GetTopicByID(int64(request.TopicID))
+		if err == nil && topic.States.IsDeleted && !canModerate(r, topic.BoardID) {
+			err = errors.New("Topic not exist")
+		}
+		if err != nil {
+			render.Render(w, r, ErrNotFound(err))
+			return
+		}
+
 		comments, err := rs.storage.GetCommentsList(request)
+		if err == nil {
+			err = setCommentsBadges(rs.storage, topic.BoardID, comments...)
+		}
 		if err != nil {
 			render.Render(w, r, ErrBadRequest(err))
 			return
 		}
 
+		if !canModerate(r, topic.BoardID) {
+			for _, comment := range comments {
+				hideDeletedComment(comment)
+			}
+		}
+
 		ctx := context.WithValue(r.Context(), CommentsCtxKey{}, comments)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -163,14 +208,69 @@ func (rs *topicsResource) TopicCreate(w http.ResponseWriter, r *http.Request) {
 	// Set board
 	request.BoardID = board.ID
 
-	topic, err := rs.storage.CreateTopic(request)
-	if err != nil {
-		render.Render(w, r, ErrBadRequest(err))
+	if err := checkBan(rs.storage, r, board.ID); err != nil {
+		render.Render(w, r, err)
+		return
+	}
+	cooldownScope := "board:" + strconv.FormatInt(board.ID, 10)
+	if checkCooldown(w, r, "topic", cooldownScope) {
+		return
+	}
+
+	limits := uploadLimits()
+	if err := limits.CheckPost(request.Uploads); err != nil {
+		render.Render(w, r, ErrUpload(err))
 		return
 	}
 
-	// Tracking user stats
-	go rs.storage.UpdateUserStatistic(topic.UserID, "created_topics")
+	var topic *Topic
+	err = rs.storage.WithTx(r.Context(), func(tx Storage) error {
+		// Links to posts on other boards
+		var replies []*Reply
+		request.Message, replies, err = linkReplies(tx, nil, request.Message)
+		if err != nil {
+			return err
+		}
+
+		// Files are linked by CreateTopic
+		request.Attachments, err = saveAttachments(tx, request.Uploads, request.UserID, canModerate(r, board.ID), limits)
+		if err != nil {
+			return err
+		}
+		if err := limits.CheckBoard(tx, board, 0, request.Attachments); err != nil {
+			return err
+		}
+
+		topic, err = tx.CreateTopic(request)
+		if err != nil {
+			return err
+		}
+
+		if err := saveReplies(tx, replies, topic.ID, 0, topic.CreatedAt); err != nil {
+			return err
+		}
+
+		// Index hashtags
+		if err := tx.CreatePostTags(topic.ID, 0, request.Tags, topic.CreatedAt); err != nil {
+			return err
+		}
+
+		// Tracking user stats
+		if err := tx.UpdateUserStatistic(topic.UserID, "created_topics"); err != nil {
+			return err
+		}
+
+		topic, err = tx.GetTopicByID(topic.ID)
+		if err != nil {
+			return err
+		}
+		return setTopicsBadges(tx, topic)
+	})
+	if err != nil {
+		render.Render(w, r, ErrUpload(err))
+		return
+	}
+	recordCooldown(r, "topic", cooldownScope)
 
 	render.Status(r, http.StatusCreated)
 	render.Render(w, r, topic)
@@ -208,27 +308,100 @@ func (rs *topicsResource) CommentCreate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	comment, err := rs.storage.CreateComment(request)
+	if request.Uploads.Len() > 0 && !topic.Options.AllowAttach {
+		render.Render(w, r, ErrForbidden(errors.New("Attachments are not allowed")))
+		return
+	}
+
+	limits := uploadLimits()
+	if err := limits.CheckPost(request.Uploads); err != nil {
+		render.Render(w, r, ErrUpload(err))
+		return
+	}
+
+	board, err := rs.storage.GetBoardBySlug(topic.Board.Slug)
 	if err != nil {
 		render.Render(w, r, ErrBadRequest(err))
 		return
 	}
 
-	// And then, bump topic
-	go rs.storage.UpdateTopicBumpTime(comment)
+	if err := checkBan(rs.storage, r, board.ID); err != nil {
+		render.Render(w, r, err)
+		return
+	}
+	cooldownScope := "topic:" + strconv.FormatInt(topic.ID, 10)
+	if checkCooldown(w, r, "comment", cooldownScope) {
+		return
+	}
 
-	// Tracking user stats
-	go rs.storage.UpdateUserStatistic(comment.UserID, "created_comments")
+	// Comment, bump and stats go as one unit
+	var comment *Comment
+	err = rs.storage.WithTx(r.Context(), func(tx Storage) error {
+		// Links to other posts
+		var replies []*Reply
+		request.Message, replies, err = linkReplies(tx, topic, request.Message)
+		if err != nil {
+			return err
+		}
+
+		// Files are linked by CreateComment
+		request.Attachments, err = saveAttachments(tx, request.Uploads, request.UserID, canModerate(r, board.ID), limits)
+		if err != nil {
+			return err
+		}
+		if err := limits.CheckBoard(tx, board, topic.ID, request.Attachments); err != nil {
+			return err
+		}
+
+		comment, err = tx.CreateComment(request)
+		if err != nil {
+			return err
+		}
+
+		if err := saveReplies(tx, replies, comment.TopicID, comment.ID, comment.CreatedAt); err != nil {
+			return err
+		}
+
+		// Index hashtags
+		if err := tx.CreatePostTags(comment.TopicID, comment.ID, request.Tags, comment.CreatedAt); err != nil {
+			return err
+		}
+
+		// And then, bump topic
+		if err := tx.UpdateTopicBumpTime(comment); err != nil {
+			return err
+		}
+
+		// Tracking user stats
+		if err := tx.UpdateUserStatistic(comment.UserID, "created_comments"); err != nil {
+			return err
+		}
+
+		comment, err = tx.GetCommentByID(comment.ID)
+		if err != nil {
+			return err
+		}
+		return setCommentsBadges(tx, topic.BoardID, comment)
+	})
+	if err != nil {
+		render.Render(w, r, ErrUpload(err))
+		return
+	}
+	recordCooldown(r, "comment", cooldownScope)
 
 	render.Status(r, http.StatusCreated)
 	render.Render(w, r, comment)
 }
 
-// ReportCreate - Создает жалобы на топик
+// ReportCreate - Создает жалобу на топик
 func (rs *topicsResource) ReportCreate(w http.ResponseWriter, r *http.Request) {
-	render.Render(w, r, &SuccessResponse{
-		HTTPStatusCode: 201,
-		StatusText:     "Report created!",
+	topic := r.Context().Value(TopicCtxKey{}).(*Topic)
+
+	createReport(rs.storage, w, r, &Report{
+		TargetType: "topic",
+		TargetID:   topic.ID,
+		TopicID:    topic.ID,
+		BoardID:    topic.BoardID,
 	})
 }
 
@@ -271,6 +444,7 @@ type Topic struct {
 		ID         int64  `json:"id" db:"up.user_id"`
 		ScreenName string `json:"screen_name" db:"up.screen_name"`
 		IsAdmin    bool   `json:"is_admin" db:"-"`
+		Role       string `json:"role,omitempty" db:"-"` // Бейдж: старшая роль автора на доске
 	} `json:"user" db:""`
 	Board struct {
 		Title string `json:"title" db:"b.title"`
@@ -280,25 +454,34 @@ type Topic struct {
 		IsClosed    bool `json:"is_closed" db:"t.is_closed"`
 		IsPinned    bool `json:"is_pinned" db:"t.is_pinned"`
 		IsFavorited bool `json:"is_favorited" db:"-"`
-		IsDeleted   bool `json:"-" db:"t.is_deleted"`
+		IsDeleted   bool `json:"is_deleted" db:"t.is_deleted"`
 	} `json:"states" db:""`
 	Options struct {
 		AllowAttach     bool `json:"allow_attach" db:"t.allow_attach"`
 		OnlyAnonymously bool `json:"only_anonymously" db:"t.only_anonymously"`
 	} `json:"options" db:""`
 
-	Attachments []*File `json:"attachments" db:""`
+	Attachments []*File    `json:"attachments" db:""`
+	RepliesTo   []*PostRef `json:"replies_to" db:"-"`
+	RepliedBy   []*PostRef `json:"replied_by" db:"-"`
+
+	Tags    []string         `json:"-" db:"-"` // Хештеги для индекса, заполняет Bind
+	Uploads *PostAttachments `json:"-" db:"-"` // Вложения из запроса, заполняет Bind
 }
 
 // Render - Render, wtf
 func (t *Topic) Render(w http.ResponseWriter, r *http.Request) error {
 	t.States.IsFavorited = false
 
+	if t.RepliesTo == nil {
+		t.RepliesTo = []*PostRef{}
+	}
+	if t.RepliedBy == nil {
+		t.RepliedBy = []*PostRef{}
+	}
+
 	for _, file := range t.Attachments {
-		host := os.Getenv("STORAGE_HOST") + "images"
-		file.Origin = fmt.Sprintf("%s/%s.%s", host, file.UUID, file.Type)
-		file.Thumb = fmt.Sprintf("%s/%s-thumb.%s", host, file.UUID, file.Type)
-		file.Resolution = fmt.Sprintf("%dx%d", file.Width, file.Height)
+		file.Render(w, r)
 	}
 
 	return nil
@@ -318,6 +501,9 @@ func (t *Topic) Bind(r *http.Request) error {
 	if len(r.FormValue("message")) < 15 {
 		return errors.New("Message is too short")
 	}
+	if utf8.RuneCountInString(r.FormValue("message")) > maxMessageLength {
+		return errors.New("Message is too long")
+	}
 
 	// Now, we associate the user with the comment
 	if auth, ok := r.Context().Value(AuthCtxKey{}).(*SessionResponse); ok {
@@ -332,12 +518,19 @@ func (t *Topic) Bind(r *http.Request) error {
 		return errors.New("Message so borred")
 	}
 
+	attachments, err := BindAttachments(r)
+	if err != nil {
+		return err
+	}
+
 	t.Type = "normal"
 	t.Subject = r.FormValue("subject")
 	t.Message = message
+	t.Tags = utils.ExtractHashtags(message)
+	t.Uploads = attachments
 	t.CreatedAt = time.Now().Unix()
 	t.BumpedAt = time.Now().Unix()
-	t.UserIP = r.Header.Get("X-FORWARDED-FOR")
+	t.UserIP = requestIP(r)
 	t.UserAgent = r.UserAgent()
 	t.States.IsClosed = false
 	t.States.IsPinned = false
@@ -364,18 +557,37 @@ type Comment struct {
 	User      struct {
 		ScreenName string `json:"screen_name" db:"up.screen_name"`
 		IsAdmin    bool   `json:"is_admin" db:"-"`
+		Role       string `json:"role,omitempty" db:"-"` // Бейдж: старшая роль автора на доске
 	} `json:"user" db:""`
 	States struct {
 		IsPinned  int8 `json:"is_pinned" db:"c.is_pinned"`
 		IsDeleted int8 `json:"is_deleted" db:"c.is_deleted"`
 	} `json:"states" db:""`
 
-	Attachments []File `json:"attachments" db:"-"`
+	Attachments []*File    `json:"attachments" db:"-"`
+	RepliesTo   []*PostRef `json:"replies_to" db:"-"`
+	RepliedBy   []*PostRef `json:"replied_by" db:"-"`
+
+	Tags    []string         `json:"-" db:"-"` // Хештеги для индекса, заполняет Bind
+	Uploads *PostAttachments `json:"-" db:"-"` // Вложения из запроса, заполняет Bind
 }
 
 // Render - Render, wtf
 func (c *Comment) Render(w http.ResponseWriter, r *http.Request) error {
-	c.Attachments = []File{}
+	if c.Attachments == nil {
+		c.Attachments = []*File{}
+	}
+	for _, file := range c.Attachments {
+		file.Render(w, r)
+	}
+
+	if c.RepliesTo == nil {
+		c.RepliesTo = []*PostRef{}
+	}
+	if c.RepliedBy == nil {
+		c.RepliedBy = []*PostRef{}
+	}
+
 	return nil
 }
 
@@ -398,6 +610,9 @@ func (c *Comment) Bind(r *http.Request) error {
 	if r.FormValue("message") == "" {
 		return errors.New("Message must be filled")
 	}
+	if utf8.RuneCountInString(r.FormValue("message")) > maxMessageLength {
+		return errors.New("Message is too long")
+	}
 
 	// Awesome parser for markup
 	message, err := utils.FormatMessage(r.FormValue("message"))
@@ -405,9 +620,16 @@ func (c *Comment) Bind(r *http.Request) error {
 		return errors.New("Message so borred")
 	}
 
+	attachments, err := BindAttachments(r)
+	if err != nil {
+		return err
+	}
+
 	c.Message = message
+	c.Tags = utils.ExtractHashtags(message)
+	c.Uploads = attachments
 	c.CreatedAt = time.Now().Unix()
-	c.UserIP = r.Header.Get("X-FORWARDED-FOR")
+	c.UserIP = requestIP(r)
 	c.UserAgent = r.UserAgent()
 	c.States.IsPinned = 0
 	c.States.IsDeleted = 0
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"image"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"os"
-	"path/filepath"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,14 +22,25 @@ import (
 )
 
 type uploadResource struct {
-	storage *Storage
+	storage Storage
 	session *Session
 }
 
 func (rs uploadResource) Routes() chi.Router {
 	r := chi.NewRouter()
 
-	r.Post("/upload", rs.Upload)
+	r.With(LimitBody, RateLimit("upload")).Post("/upload", rs.Upload)
+
+	// Загрузка по частям: создать, дослать PATCH-ами, собрать
+	r.With(RateLimit("upload")).Post("/sessions", rs.SessionCreate)
+	r.Route("/sessions/{sessionID}", func(r chi.Router) {
+		r.Use(rs.UploadSessionCtx)
+		r.Get("/", rs.SessionGet)
+		r.Head("/", rs.SessionGet)
+		r.Patch("/", rs.SessionPatch)
+		r.Delete("/", rs.SessionDelete)
+		r.Post("/finalize", rs.SessionFinalize)
+	})
 
 	return r
 }
@@ -33,31 +49,64 @@ func (rs uploadResource) Routes() chi.Router {
 // Handler methods
 //--
 
+// Upload - Сохраняет файл на диск и в files.
+// Вернувшийся id потом передается в поле files при создании поста.
 func (rs *uploadResource) Upload(w http.ResponseWriter, r *http.Request) {
-	file, err := UploadFile(r)
+	userID := requestUserID(r)
+
+	if err := checkBan(rs.storage, r, 0); err != nil {
+		render.Render(w, r, err)
+		return
+	}
+
+	var file *File
+	err := rs.storage.WithTx(r.Context(), func(tx Storage) error {
+		upload, err := UploadFile(tx, r, uploadLimits())
+		if err != nil {
+			return err
+		}
+
+		file, err = saveUpload(tx, upload, userID)
+		return err
+	})
 	if err != nil {
-		render.Render(w, r, ErrForbidden(err))
+		render.Render(w, r, ErrUpload(err))
 		return
 	}
 
+	render.Status(r, http.StatusCreated)
 	render.Render(w, r, file)
 }
 
+// requestUserID - Кто прислал запрос: пользователь из сессии или аноним
+func requestUserID(r *http.Request) int64 {
+	if auth, ok := r.Context().Value(AuthCtxKey{}).(*SessionResponse); ok {
+		return auth.User.ID
+	}
+	return 1 // Default Anon profile
+}
+
 //--
 // Struct
 //--
 
 // File - file struc
 type File struct {
-	ID        int64  `json:"-" db:"f.id"`
-	UUID      string `json:"-" db:"f.uuid"`
-	Md5       string `json:"m5" db:"f.md5"`
-	Name      string `json:"-" db:"f.name"`
-	Type      string `json:"type" db:"f.type"`
-	Size      int64  `json:"size" db:"f.size"`
-	Width     int    `json:"-" db:"f.width"`
-	Height    int    `json:"-" db:"f.height"`
-	CreatedAt int64  `json:"-" db:"f.created_at"`
+	ID        int64   `json:"id" db:"f.id"`
+	UUID      string  `json:"-" db:"f.uuid"`
+	UserID    int64   `json:"-" db:"f.user_id"`
+	Md5       string  `json:"m5" db:"f.md5"`
+	Phash     string  `json:"-" db:"f.phash"`
+	Name      string  `json:"-" db:"f.name"`
+	Type      string  `json:"type" db:"f.type"`
+	Kind      string  `json:"kind" db:"f.kind"`             // image или video
+	ThumbType string  `json:"thumb_type" db:"f.thumb_type"` // Формат миниатюры, не всегда как у оригинала
+	Size      int64   `json:"size" db:"f.size"`
+	Width     int     `json:"-" db:"f.width"`
+	Height    int     `json:"-" db:"f.height"`
+	Duration  float64 `json:"duration" db:"f.duration"` // Секунды, у картинок 0
+	CreatedAt int64   `json:"-" db:"f.created_at"`
+	IsFlagged bool    `json:"-" db:"f.is_flagged"` // Похож на забаненный, ждет модератора
 
 	Origin     string `json:"origin" db:"-"`
 	Thumb      string `json:"thumb" db:"-"`
@@ -73,45 +122,396 @@ type ImageDimensions struct {
 
 // Render - Render, wtf
 func (f *File) Render(w http.ResponseWriter, r *http.Request) error {
-	host := os.Getenv("STORAGE_HOST") + "images"
-	f.Origin = fmt.Sprintf("%s/%s.%s", host, f.UUID, f.Type)
-	f.Thumb = fmt.Sprintf("%s/%s-thumb.%s", host, f.UUID, f.Type)
+	store := blobStore()
+	f.Origin = store.URL(f.Key())
+	f.ThumbType = f.thumbType()
+	f.Thumb = store.URL(f.ThumbKey())
 	f.Resolution = fmt.Sprintf("%dx%d", f.Width, f.Height)
 	return nil
 }
 
+// Key - Ключ файла в хранилище
+func (f *File) Key() string {
+	return f.UUID + "." + f.Type
+}
+
+// ThumbKey - Ключ миниатюры, расширение по ее собственному формату
+func (f *File) ThumbKey() string {
+	return f.UUID + "-thumb." + f.thumbType()
+}
+
+// thumbType - Формат миниатюры. До thumb_type у видео был
+// JPEG-постер, а у картинок формат оригинала
+func (f *File) thumbType() string {
+	switch {
+	case f.ThumbType != "":
+		return f.ThumbType
+	case f.Kind == "video":
+		return "jpeg"
+	}
+	return f.Type
+}
+
 // availableFilesType - Fixme!
 func availableFilesType(contentType string) bool {
-	return contentType == "image/png" || contentType == "image/jpeg" || contentType == "image/gif"
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif", "image/webp", "video/webm", "video/mp4":
+		return true
+	}
+	return false
+}
+
+// thumbnailOptions - Размеры миниатюр из THUMB_MAX_WIDTH и THUMB_MAX_HEIGHT,
+// качество из THUMB_QUALITY. WebP кодирует ffmpeg, если он есть
+func thumbnailOptions() uploader.ThumbnailOptions {
+	opts := uploader.ThumbnailOptions{
+		MaxWidth:  envInt("THUMB_MAX_WIDTH", 200),
+		MaxHeight: envInt("THUMB_MAX_HEIGHT", 200),
+		Quality:   envInt("THUMB_QUALITY", 85),
+	}
+	if ffmpeg, err := uploader.NewFFmpeg(os.Getenv("FFMPEG_PATH")); err == nil {
+		opts.WebP = ffmpeg
+	}
+	return opts
+}
+
+// ThumbPolicy - В каком формате делать миниатюры. Оригинал не меняется
+type ThumbPolicy struct {
+	Format  string // jpeg или webp для тяжелых PNG и JPEG, пусто - как у оригинала
+	MinSize int64  // Тяжелый - это больше MinSize байт
+	WebP    bool   // Есть чем кодировать WebP
+}
+
+// thumbPolicy - Политика из THUMB_TRANSCODE и THUMB_TRANSCODE_SIZE (по умолчанию 1 МБ)
+func thumbPolicy(opts uploader.ThumbnailOptions) ThumbPolicy {
+	return ThumbPolicy{
+		Format:  os.Getenv("THUMB_TRANSCODE"),
+		MinSize: int64(envInt("THUMB_TRANSCODE_SIZE", 1<<20)),
+		WebP:    opts.WebP != nil,
+	}
+}
+
+// ThumbType - Формат миниатюры нового файла
+func (p ThumbPolicy) ThumbType(f *File) string {
+	heavy := (f.Type == "png" || f.Type == "jpeg") && f.Size > p.MinSize
+
+	switch {
+	case f.Kind == "video":
+		return "jpeg"
+	case p.Format == "webp" && p.WebP && (heavy || f.Type == "webp"):
+		return "webp"
+	case f.Type == "webp":
+		// Без кодировщика WebP, PNG сохранит прозрачность
+		return "png"
+	case p.Format != "" && heavy:
+		return "jpeg"
+	}
+	return f.Type
+}
+
+// blobStore - Хранилище файлов из BLOB_STORE: local (по умолчанию)
+// пишет в STORAGE_PATH, s3 - в бакет S3_BUCKET
+func blobStore() uploader.BlobStore {
+	if os.Getenv("BLOB_STORE") == "s3" {
+		store := uploader.NewS3Store(
+			os.Getenv("S3_ENDPOINT"),
+			os.Getenv("S3_BUCKET"),
+			os.Getenv("S3_REGION"),
+			os.Getenv("S3_ACCESS_KEY"),
+			os.Getenv("S3_SECRET_KEY"),
+		)
+		store.PublicURL = os.Getenv("S3_PUBLIC_URL")
+		return store
+	}
+	return uploader.NewLocalStore(os.Getenv("STORAGE_PATH"), os.Getenv("STORAGE_HOST")+"images")
+}
+
+// originalsStore - Закрытое хранилище оригиналов с EXIF, nil если
+// ORIGINALS_PATH не задан. Наружу не отдается, поэтому всегда на диске
+func originalsStore() uploader.BlobStore {
+	dir := os.Getenv("ORIGINALS_PATH")
+	if dir == "" {
+		return nil
+	}
+	return &uploader.LocalStore{Dir: dir, Mode: 0600}
+}
+
+// readBlob - Объект из хранилища целиком
+func readBlob(store uploader.BlobStore, key string) ([]byte, error) {
+	blob, err := store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	return ioutil.ReadAll(blob)
+}
+
+// writeThumbnail - Пересоздает миниатюру файла из оригинала в хранилище
+func writeThumbnail(store uploader.BlobStore, file *File) ([]byte, error) {
+	content, err := readBlob(store, file.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	var frame image.Image
+	if file.Kind == "video" {
+		frame = videoFrame(content, file.Type)
+	}
+
+	thumb, err := makeThumbnail(file, content, frame, thumbnailOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.Put(file.ThumbKey(), bytes.NewReader(thumb), contentType(file.ThumbKey())); err != nil {
+		return nil, err
+	}
+
+	return thumb, nil
+}
+
+// makeThumbnail - Миниатюра картинки или постер видео в формате file.ThumbKey().
+// Если кадра нет, постер будет заглушкой
+func makeThumbnail(file *File, content []byte, frame image.Image, opts uploader.ThumbnailOptions) ([]byte, error) {
+	if file.Kind != "video" {
+		thumb, _, err := uploader.TranscodeThumbnail(content, file.Type, file.thumbType(), opts)
+		return thumb, err
+	}
+
+	if frame == nil {
+		frame = uploader.Placeholder(uploader.ThumbSize(file.Width, file.Height, opts))
+	}
+	thumb, _, err := uploader.EncodeThumbnail(frame, file.thumbType(), opts)
+	return thumb, err
+}
+
+// videoFrame - Кадр для постера, nil если ffmpeg нет или он не справился
+func videoFrame(content []byte, format string) image.Image {
+	extractor := frameExtractor()
+	if extractor == nil {
+		return nil
+	}
+
+	frame, err := extractor.Frame(content, format)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	return frame
+}
+
+// frameExtractor - ffmpeg из FFMPEG_PATH или PATH. Без него видео
+// все равно принимаются, только с постером-заглушкой
+func frameExtractor() uploader.FrameExtractor {
+	ffmpeg, err := uploader.NewFFmpeg(os.Getenv("FFMPEG_PATH"))
+	if err != nil {
+		return nil
+	}
+	return ffmpeg
+}
+
+// contentType - Content-Type по расширению ключа
+func contentType(key string) string {
+	switch path.Ext(key) {
+	case ".webm":
+		return "video/webm"
+	case ".mp4":
+		return "video/mp4"
+	}
+	return "image/" + strings.TrimPrefix(path.Ext(key), ".")
+}
+
+// PostAttachments - Вложения поста: ID уже загруженных файлов
+// из поля files и файлы, пришедшие прямо в multipart-поле file.
+type PostAttachments struct {
+	IDs     []int64
+	Uploads []*multipart.FileHeader
+}
+
+// Len - Сколько всего вложений
+func (pa *PostAttachments) Len() int {
+	if pa == nil {
+		return 0
+	}
+	return len(pa.IDs) + len(pa.Uploads)
+}
+
+// BindAttachments - Bind attachments from form
+func BindAttachments(r *http.Request) (*PostAttachments, error) {
+	attachments := &PostAttachments{}
+
+	// FormValue уже разобрал multipart, если он был
+	if r.Form == nil {
+		r.ParseMultipartForm(32 << 20)
+	}
+
+	for _, value := range r.Form["files"] {
+		for _, id := range strings.Split(value, ",") {
+			if id = strings.TrimSpace(id); id == "" {
+				continue
+			}
+			fileID, err := strconv.ParseInt(id, 10, 64)
+			if err != nil || fileID <= 0 {
+				return nil, errors.New("Invalid file ID")
+			}
+			attachments.IDs = append(attachments.IDs, fileID)
+		}
+	}
+
+	if r.MultipartForm != nil {
+		attachments.Uploads = r.MultipartForm.File["file"]
+	}
+
+	return attachments, nil
+}
+
+// saveAttachments - Проверяет загруженные ранее файлы и сохраняет новые.
+// Вызывается внутри транзакции поста. Если она откатится, записанные
+// в хранилище файлы останутся сиротами до прихода сборщика (gc.go).
+// Помеченные для проверки файлы по ID прикрепляет только модератор.
+func saveAttachments(tx Storage, attachments *PostAttachments, userID int64, moderator bool, limits UploadLimits) ([]*File, error) {
+	files := []*File{}
+	if attachments == nil {
+		return files, nil
+	}
+
+	// Один и тот же файл дважды не прикрепляем
+	seen := map[int64]bool{}
+	add := func(file *File) {
+		if !seen[file.ID] {
+			seen[file.ID] = true
+			files = append(files, file)
+		}
+	}
+
+	for _, id := range attachments.IDs {
+		file, err := tx.GetFileByID(id)
+		if err != nil {
+			return nil, errors.New("File not found")
+		}
+		if _, err := tx.GetFileBan(file.Md5); err == nil {
+			return nil, ErrFileBanned
+		}
+		if file.IsFlagged && !moderator {
+			return nil, ErrFileFlagged
+		}
+		add(file)
+	}
+
+	for _, handler := range attachments.Uploads {
+		upload, err := WriteUpload(tx, handler, limits)
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := saveUpload(tx, upload, userID)
+		if err != nil {
+			return nil, err
+		}
+		add(file)
+	}
+
+	return files, nil
+}
+
+// saveUpload - Запись в files и счетчик uploaded_files.
+// Дубликат из WriteUpload уже лежит в files, его просто переиспользуем.
+func saveUpload(tx Storage, upload *File, userID int64) (*File, error) {
+	file := upload
+
+	if upload.ID == 0 {
+		upload.UserID = userID
+
+		var err error
+		file, err = tx.CreateFile(upload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Tracking user stats
+	if err := tx.UpdateUserStatistic(userID, "uploaded_files"); err != nil {
+		return nil, err
+	}
+
+	return file, nil
 }
 
 // UploadFile - Self-sufficient name, yeah?
-func UploadFile(r *http.Request) (*File, error) {
-	file, handler, err := r.FormFile("file")
-	defer file.Close()
+func UploadFile(tx Storage, r *http.Request, limits UploadLimits) (*File, error) {
+	_, handler, err := r.FormFile("file")
 	if err != nil {
 		fmt.Println(err)
 		return nil, errors.New("File upload error")
 	}
 
-	// Check file type
-	mimeType := handler.Header.Get("Content-Type")
-	if !availableFilesType(mimeType) {
-		return nil, errors.New("File format is not valid")
+	return WriteUpload(tx, handler, limits)
+}
+
+// WriteUpload - Проверяет лимиты и пишет файл и миниатюру в хранилище.
+// Если файл с таким md5 уже есть, вернет его и ничего не запишет.
+func WriteUpload(tx Storage, handler *multipart.FileHeader, limits UploadLimits) (*File, error) {
+	if err := limits.CheckFile(handler.Size, 0, 0); err != nil {
+		return nil, err
 	}
-	// File extension
-	extension := strings.Split(mimeType, "/")[1]
 
-	// Generate UUID
-	uuid, err := uuid.NewUUID()
+	file, err := handler.Open()
 	if err != nil {
 		fmt.Println(err)
-		return nil, errors.New("File processing error")
+		return nil, errors.New("File upload error")
+	}
+	defer file.Close()
+
+	// Size is already limited, so work in memory
+	original, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return StoreUpload(tx, handler.Filename, original, limits)
+}
+
+// StoreUpload - Проверяет уже прочитанный файл и пишет его в хранилище.
+// Через нее проходят и обычные загрузки, и собранные по частям
+func StoreUpload(tx Storage, name string, original []byte, limits UploadLimits) (*File, error) {
+	// Check type, dimensions and duration before writing anything
+	media, err := probeUpload(original, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	// Same file again?
+	md5, err := uploader.Md5(bytes.NewReader(media.Content))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.GetFileBan(md5); err == nil {
+		return nil, ErrFileBanned
+	}
+
+	// Re-encoded or resized copy of banned one? Video without frame is not checked
+	phash, flagged := "", false
+	if media.Frame != nil {
+		hash := uploader.DHash(media.Frame)
+		if flagged, err = phashPolicy().Check(tx, hash); err != nil {
+			return nil, err
+		}
+		phash = uploader.FormatHash(hash)
+	}
+
+	if existing, err := tx.GetFileByMd5(md5); err == nil {
+		if flagged && !existing.IsFlagged {
+			existing.IsFlagged = true
+			if err := tx.UpdateFileFlag(existing.ID, true); err != nil {
+				return nil, err
+			}
+		}
+		return existing, nil
 	}
 
-	// Write filte to our storage
-	storagePath := filepath.Join(os.Getenv("STORAGE_PATH"), uuid.String()+"."+extension)
-	dimensions, err := uploader.WriteImageFile(storagePath, file)
+	// Generate UUID
+	uuid, err := uuid.NewUUID()
 	if err != nil {
 		fmt.Println(err)
 		return nil, errors.New("File processing error")
@@ -120,13 +520,137 @@ func UploadFile(r *http.Request) (*File, error) {
 	// And create struct
 	f := File{}
 	f.UUID = uuid.String()
-	f.Md5 = dimensions.Md5
-	f.Name = handler.Filename
-	f.Type = extension
-	f.Size = dimensions.Size
-	f.Width = dimensions.Width
-	f.Height = dimensions.Height
+	f.Md5 = md5
+	f.Phash = phash
+	f.IsFlagged = flagged
+	f.Name = name
+	f.Type = media.Format
+	f.Kind = media.Kind
+	f.Size = int64(len(media.Content))
+	f.Width = media.Width
+	f.Height = media.Height
+	f.Duration = media.Duration
 	f.CreatedAt = time.Now().Unix()
 
+	opts := thumbnailOptions()
+	policy := thumbPolicy(opts)
+	f.ThumbType = policy.ThumbType(&f)
+
+	thumb, err := makeThumbnail(&f, media.Content, media.Frame, opts)
+	if err != nil && f.ThumbType == "webp" {
+		// ffmpeg без libwebp, обойдемся встроенными форматами
+		fmt.Println(err)
+		policy.WebP = false
+		f.ThumbType = policy.ThumbType(&f)
+		thumb, err = makeThumbnail(&f, media.Content, media.Frame, opts)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return nil, errors.New("File processing error")
+	}
+
+	// Write file and thumbnail to our storage
+	store := blobStore()
+	if err := store.Put(f.Key(), bytes.NewReader(media.Content), contentType(f.Key())); err != nil {
+		fmt.Println(err)
+		return nil, errors.New("File processing error")
+	}
+	if err := store.Put(f.ThumbKey(), bytes.NewReader(thumb), contentType(f.ThumbKey())); err != nil {
+		fmt.Println(err)
+		store.Delete(f.Key())
+		return nil, errors.New("File processing error")
+	}
+
+	// Admins may want the untouched file, never served publicly
+	if originals := originalsStore(); originals != nil {
+		if err := originals.Put(f.Key(), bytes.NewReader(original), contentType(f.Key())); err != nil {
+			fmt.Println(err)
+			store.Delete(f.Key())
+			store.Delete(f.ThumbKey())
+			return nil, errors.New("File processing error")
+		}
+	}
+
 	return &f, nil
 }
+
+// uploadMedia - Что узнали о файле до записи
+type uploadMedia struct {
+	Kind     string
+	Format   string // Расширение в хранилище
+	Width    int
+	Height   int
+	Duration float64
+	Content  []byte      // Файл без метаданных, его и храним
+	Frame    image.Image // Для phash и миниатюры, у видео без ffmpeg nil
+}
+
+// probeUpload - Формат по содержимому, заголовок от клиента не важен.
+// Видео проверяется разбором контейнера
+func probeUpload(original []byte, limits UploadLimits) (*uploadMedia, error) {
+	// Декодера AVIF для Go нет, а ftyp с брендом mp4 сошел бы за видео
+	if uploader.IsAVIF(original) {
+		return nil, ErrAVIF
+	}
+
+	mimeType := http.DetectContentType(original)
+	if !availableFilesType(mimeType) {
+		return nil, ErrFileFormat
+	}
+	size := int64(len(original))
+
+	if strings.HasPrefix(mimeType, "video/") {
+		info, err := uploader.ProbeVideo(original)
+		if err != nil {
+			return nil, ErrFileFormat
+		}
+		if err := limits.CheckFile(size, info.Width, info.Height); err != nil {
+			return nil, err
+		}
+		if err := limits.CheckDuration(info.Duration); err != nil {
+			return nil, err
+		}
+
+		return &uploadMedia{
+			Kind:     "video",
+			Format:   info.Format,
+			Width:    info.Width,
+			Height:   info.Height,
+			Duration: info.Duration,
+			Content:  original,
+			Frame:    videoFrame(original, info.Format),
+		}, nil
+	}
+
+	// File extension
+	extension := strings.Split(mimeType, "/")[1]
+
+	// No EXIF and GPS on anonymous board. Hashes are of sanitized file.
+	// WebP decoder can't read extended files with metadata, so strip first
+	content, err := uploader.StripMetadata(original, extension)
+	if err != nil {
+		return nil, ErrFileFormat
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, ErrFileFormat
+	}
+	if err := limits.CheckFile(size, config.Width, config.Height); err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, ErrFileFormat
+	}
+
+	return &uploadMedia{
+		Kind:    "image",
+		Format:  extension,
+		Width:   config.Width,
+		Height:  config.Height,
+		Content: content,
+		Frame:   img,
+	}, nil
+}
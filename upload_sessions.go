@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+)
+
+// Ошибки загрузки по частям
+var (
+	ErrUploadSessionNotFound = errors.New("Upload session not found")
+	ErrUploadOffset          = errors.New("Upload offset mismatch")
+	ErrUploadIncomplete      = errors.New("Upload is incomplete")
+	ErrChecksumFormat        = errors.New("Checksum must be sha256:<hex> or md5:<hex>")
+	ErrChecksumMismatch      = errors.New("Checksum mismatch")
+)
+
+// UploadSession - Загрузка по частям. Пришедшие байты лежат в
+// {UPLOAD_SESSIONS_PATH}/{id}.part, в базе только сколько их
+type UploadSession struct {
+	ID        string `json:"id" db:"ups.id"`
+	UserID    int64  `json:"-" db:"ups.user_id"`
+	Name      string `json:"name" db:"ups.name"`
+	Size      int64  `json:"size" db:"ups.size"`
+	Offset    int64  `json:"offset" db:"ups.received"`
+	Checksum  string `json:"checksum" db:"ups.checksum"` // sha256:<hex> или md5:<hex>
+	CreatedAt int64  `json:"-" db:"ups.created_at"`
+	ExpiresAt int64  `json:"expires_at" db:"ups.expires_at"`
+}
+
+// Render - Смещение дублируется в заголовке, как в tus
+func (us *UploadSession) Render(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(us.Offset, 10))
+	return nil
+}
+
+// partPath - Где лежат уже пришедшие байты
+func (us *UploadSession) partPath() string {
+	return filepath.Join(uploadSessionsDir(), us.ID+".part")
+}
+
+// uploadSessionsDir - Каталог частей из UPLOAD_SESSIONS_PATH.
+// Общий для всех инстансов API, если их несколько
+func uploadSessionsDir() string {
+	if dir := os.Getenv("UPLOAD_SESSIONS_PATH"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "go-board-uploads")
+}
+
+// uploadSessionTTL - Сколько ждем окончания загрузки, UPLOAD_SESSION_TTL секунд
+func uploadSessionTTL() time.Duration {
+	return time.Duration(envInt("UPLOAD_SESSION_TTL", 86400)) * time.Second
+}
+
+// UploadSessionRequest - Запрос на новую загрузку
+type UploadSessionRequest struct {
+	Name     string
+	Size     int64
+	Checksum string
+}
+
+// Bind - Bind HTTP request data and validate it
+func (usr *UploadSessionRequest) Bind(r *http.Request) error {
+	usr.Name = strings.TrimSpace(r.FormValue("name"))
+
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || size <= 0 {
+		return errors.New("Size needed")
+	}
+	usr.Size = size
+
+	checksum, err := parseChecksum(r.FormValue("checksum"))
+	if err != nil {
+		return err
+	}
+	usr.Checksum = checksum
+
+	return nil
+}
+
+// parseChecksum - sha256:<hex> или md5:<hex> в нижнем регистре
+func parseChecksum(value string) (string, error) {
+	parts := strings.SplitN(strings.ToLower(strings.TrimSpace(value)), ":", 2)
+	if len(parts) != 2 {
+		return "", ErrChecksumFormat
+	}
+
+	sum, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrChecksumFormat
+	}
+	if (parts[0] != "sha256" || len(sum) != sha256.Size) && (parts[0] != "md5" || len(sum) != md5.Size) {
+		return "", ErrChecksumFormat
+	}
+
+	return parts[0] + ":" + parts[1], nil
+}
+
+// checksumMatches - Сверяет собранный файл с контрольной суммой клиента
+func checksumMatches(checksum string, data []byte) bool {
+	var sum []byte
+	switch {
+	case strings.HasPrefix(checksum, "sha256:"):
+		s := sha256.Sum256(data)
+		sum = s[:]
+	case strings.HasPrefix(checksum, "md5:"):
+		s := md5.Sum(data)
+		sum = s[:]
+	}
+	return sum != nil && checksum[strings.Index(checksum, ":")+1:] == hex.EncodeToString(sum)
+}
+
+//--
+// Middleware
+//--
+
+// UploadSessionCtxKey - Key for context
+type UploadSessionCtxKey struct{}
+
+// UploadSessionCtx - Загрузка по ID из URL. Чужие и просроченные - 404
+func (rs *uploadResource) UploadSessionCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := rs.storage.GetUploadSession(chi.URLParam(r, "sessionID"))
+		if err != nil || session.UserID != requestUserID(r) || session.ExpiresAt < time.Now().Unix() {
+			render.Render(w, r, ErrUpload(ErrUploadSessionNotFound))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), UploadSessionCtxKey{}, session)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+//--
+// Handler methods
+//--
+
+// SessionCreate - Начинает загрузку по частям. Размер проверяется сразу,
+// содержимое - как у обычной загрузки, после сборки
+func (rs *uploadResource) SessionCreate(w http.ResponseWriter, r *http.Request) {
+	if err := checkBan(rs.storage, r, 0); err != nil {
+		render.Render(w, r, err)
+		return
+	}
+
+	data := &UploadSessionRequest{}
+	if err := data.Bind(r); err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+	if err := uploadLimits().CheckFile(data.Size, 0, 0); err != nil {
+		render.Render(w, r, ErrUpload(err))
+		return
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	now := time.Now()
+	session := &UploadSession{
+		ID:        id.String(),
+		UserID:    requestUserID(r),
+		Name:      data.Name,
+		Size:      data.Size,
+		Checksum:  data.Checksum,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(uploadSessionTTL()).Unix(),
+	}
+
+	err = os.MkdirAll(uploadSessionsDir(), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(session.partPath(), nil, 0600)
+	}
+	if err != nil {
+		fmt.Println(err)
+		render.Render(w, r, ErrBadRequest(errors.New("File upload error")))
+		return
+	}
+
+	session, err = rs.storage.CreateUploadSession(session)
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, session)
+}
+
+// SessionGet - Сколько байт уже пришло: с этого места продолжать
+func (rs *uploadResource) SessionGet(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(UploadSessionCtxKey{}).(*UploadSession)
+
+	render.Render(w, r, session)
+}
+
+// SessionPatch - Дописывает часть. Заголовок Upload-Offset должен
+// совпасть с уже принятым, иначе 409 и текущее смещение в ответе
+func (rs *uploadResource) SessionPatch(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(UploadSessionCtxKey{}).(*UploadSession)
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		render.Render(w, r, ErrBadRequest(errors.New("Upload-Offset header needed")))
+		return
+	}
+	if offset != session.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		render.Render(w, r, ErrUpload(ErrUploadOffset))
+		return
+	}
+
+	// Больше объявленного размера не принимаем
+	remaining := session.Size - offset
+	chunk, err := ioutil.ReadAll(io.LimitReader(r.Body, remaining+1))
+	if err != nil {
+		render.Render(w, r, ErrBadRequest(errors.New("File upload error")))
+		return
+	}
+	if int64(len(chunk)) > remaining {
+		render.Render(w, r, ErrUpload(ErrFileTooLarge))
+		return
+	}
+
+	if err := writePart(session.partPath(), chunk, offset); err != nil {
+		fmt.Println(err)
+		render.Render(w, r, ErrBadRequest(errors.New("File upload error")))
+		return
+	}
+
+	// Кто-то успел раньше: его байты по этому смещению уже учтены
+	moved, err := rs.storage.UpdateUploadSessionOffset(session.ID, offset, offset+int64(len(chunk)))
+	if err != nil || !moved {
+		render.Render(w, r, ErrUpload(ErrUploadOffset))
+		return
+	}
+	session.Offset += int64(len(chunk))
+
+	render.Render(w, r, session)
+}
+
+// SessionFinalize - Сверяет контрольную сумму и пропускает файл через
+// обычную загрузку. При несовпадении загрузка удаляется: начинать заново
+func (rs *uploadResource) SessionFinalize(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(UploadSessionCtxKey{}).(*UploadSession)
+
+	// Забанить могли, пока файл докачивался
+	if err := checkBan(rs.storage, r, 0); err != nil {
+		render.Render(w, r, err)
+		return
+	}
+
+	if session.Offset != session.Size {
+		render.Render(w, r, ErrUpload(ErrUploadIncomplete))
+		return
+	}
+
+	content, err := ioutil.ReadFile(session.partPath())
+	if err != nil || int64(len(content)) != session.Size {
+		fmt.Println(err)
+		render.Render(w, r, ErrBadRequest(errors.New("File upload error")))
+		return
+	}
+
+	if !checksumMatches(session.Checksum, content) {
+		removeUploadSession(rs.storage, session)
+		render.Render(w, r, ErrUpload(ErrChecksumMismatch))
+		return
+	}
+
+	var file *File
+	err = rs.storage.WithTx(r.Context(), func(tx Storage) error {
+		upload, err := StoreUpload(tx, session.Name, content, uploadLimits())
+		if err != nil {
+			return err
+		}
+
+		if file, err = saveUpload(tx, upload, session.UserID); err != nil {
+			return err
+		}
+
+		return tx.DeleteUploadSession(session.ID)
+	})
+	if err != nil {
+		render.Render(w, r, ErrUpload(err))
+		return
+	}
+	os.Remove(session.partPath())
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, file)
+}
+
+// SessionDelete - Отмена загрузки
+func (rs *uploadResource) SessionDelete(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(UploadSessionCtxKey{}).(*UploadSession)
+
+	if err := removeUploadSession(rs.storage, session); err != nil {
+		render.Render(w, r, ErrBadRequest(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writePart - Пишет часть по смещению, а не в конец:
+// повтор того же PATCH перезапишет те же байты
+func writePart(path string, chunk []byte, offset int64) error {
+	part, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = part.WriteAt(chunk, offset)
+	if closeErr := part.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// removeUploadSession - Строка и файл с частями
+func removeUploadSession(storage Storage, session *UploadSession) error {
+	if err := storage.DeleteUploadSession(session.ID); err != nil {
+		return err
+	}
+	if err := os.Remove(session.partPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
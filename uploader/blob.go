@@ -0,0 +1,167 @@
+package uploader
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Ошибки хранилища файлов
+var (
+	ErrBlobNotFound = errors.New("Blob not found")
+	ErrBlobKey      = errors.New("Invalid blob key")
+)
+
+// BlobStore - Где лежат загруженные файлы и миниатюры.
+// Ключ - имя файла вида {uuid}.{ext}, без каталогов.
+type BlobStore interface {
+	Put(key string, r io.Reader, contentType string) error
+	Get(key string) (io.ReadCloser, error)
+	Open(key string) (BlobReader, error)
+	Delete(key string) error
+	URL(key string) string
+}
+
+// BlobReader - Объект, который можно читать с любого места.
+// Для ответов на Range без чтения файла целиком
+type BlobReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// BlobInfo - Объект в хранилище
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobLister - Хранилище, которое умеет перечислить свои объекты.
+// Нужно сборщику мусора, чтобы найти файлы без записи в базе
+type BlobLister interface {
+	List(fn func(blob BlobInfo) error) error
+}
+
+// LocalStore - Файлы в каталоге на диске, отдает их внешний веб-сервер
+type LocalStore struct {
+	Dir  string      // Каталог с файлами
+	Host string      // Префикс публичных ссылок
+	Mode os.FileMode // Права файлов, 0 - 0644
+}
+
+// NewLocalStore - Хранилище в каталоге dir с ссылками от host
+func NewLocalStore(dir, host string) *LocalStore {
+	return &LocalStore{Dir: dir, Host: host}
+}
+
+// path - Путь на диске. Ключ не может выйти за пределы каталога
+func (s *LocalStore) path(key string) (string, error) {
+	if key == "" || key != filepath.Base(key) || strings.HasPrefix(key, ".") {
+		return "", ErrBlobKey
+	}
+	return filepath.Join(s.Dir, key), nil
+}
+
+// Put - Пишет во временный файл и переименовывает,
+// чтобы недописанный файл никто не увидел
+func (s *LocalStore) Put(key string, r io.Reader, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(s.Dir, ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	mode := s.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get - Открывает файл, ErrBlobNotFound если его нет
+func (s *LocalStore) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+// Open - То же, что Get: файл на диске и так умеет Seek
+func (s *LocalStore) Open(key string) (BlobReader, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Delete - Удаляет файл, отсутствие файла не ошибка
+func (s *LocalStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List - Все файлы каталога, кроме скрытых и временных
+func (s *LocalStore) List(fn func(blob BlobInfo) error) error {
+	entries, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if err := fn(BlobInfo{entry.Name(), entry.Size(), entry.ModTime()}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// URL - Публичная ссылка на файл
+func (s *LocalStore) URL(key string) string {
+	return strings.TrimSuffix(s.Host, "/") + "/" + key
+}
@@ -0,0 +1,137 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// FrameExtractor - Достает из видео кадр для постера и перцептивного хеша
+type FrameExtractor interface {
+	Frame(data []byte, format string) (image.Image, error)
+}
+
+// FFmpeg - Кадры через внешний ffmpeg
+type FFmpeg struct {
+	Path    string
+	Timeout time.Duration
+}
+
+// NewFFmpeg - ffmpeg по пути или из PATH. Ошибка, если бинарника нет:
+// тогда видео принимается, но постер будет заглушкой
+func NewFFmpeg(path string) (*FFmpeg, error) {
+	if path == "" {
+		path = "ffmpeg"
+	}
+	path, err := exec.LookPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FFmpeg{Path: path, Timeout: 10 * time.Second}, nil
+}
+
+// Frame - Первый кадр в PNG через stdout. Видео пишется во временный файл:
+// у MP4 moov бывает в конце, из пайпа такое не прочитать
+func (f *FFmpeg) Frame(data []byte, format string) (image.Image, error) {
+	input, err := ioutil.TempFile("", "frame-*."+format)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(input.Name())
+
+	_, err = input.Write(data)
+	if closeErr := input.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.Timeout)
+	defer cancel()
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, f.Path,
+		"-v", "error", "-i", input.Name(),
+		"-frames:v", "1", "-f", "image2pipe", "-c:v", "png", "-",
+	)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %s: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	img, _, err := image.Decode(stdout)
+	return img, err
+}
+
+// EncodeWebP - Кодирует картинку в WebP: PNG на stdin, WebP из stdout.
+// Нужен ffmpeg, собранный с libwebp
+func (f *FFmpeg) EncodeWebP(w io.Writer, img image.Image, quality int) error {
+	input := &bytes.Buffer{}
+	if err := png.Encode(input, img); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.Timeout)
+	defer cancel()
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, f.Path,
+		"-v", "error", "-f", "png_pipe", "-i", "-",
+		"-c:v", "libwebp", "-quality", fmt.Sprint(quality), "-f", "webp", "-",
+	)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = input, stdout, stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %s: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	// Не доверяем выводу вслепую: это должен быть WebP
+	if _, format, err := image.DecodeConfig(bytes.NewReader(stdout.Bytes())); err != nil || format != "webp" {
+		return fmt.Errorf("ffmpeg: output is not webp")
+	}
+
+	_, err := w.Write(stdout.Bytes())
+	return err
+}
+
+// Placeholder - Постер, когда кадр достать нечем: темный фон и светлый треугольник
+func Placeholder(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, maxInt(width, 1), maxInt(height, 1)))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0x22, 0x22, 0x22, 0xff}), image.ZP, draw.Src)
+
+	// Треугольник "play" по центру, высотой в треть меньшей стороны
+	size := minInt(width, height) / 3
+	cx, cy := width/2, height/2
+	for y := -size / 2; y < size/2; y++ {
+		for x := 0; x < size/2-absInt(y); x++ {
+			img.Set(cx-size/4+x, cy+y, color.RGBA{0xdd, 0xdd, 0xdd, 0xff})
+		}
+	}
+
+	return img
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
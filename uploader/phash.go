@@ -0,0 +1,47 @@
+package uploader
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+	"strconv"
+)
+
+// DHash - Difference hash: картинка сжимается до 9x8 в оттенках серого,
+// каждый из 64 бит - ярче ли пиксель своего соседа справа.
+// Переживает пересжатие и изменение размера, в отличие от md5.
+func DHash(img image.Image) uint64 {
+	small := Resize(img, 9, 8)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if luma(small, x, y) > luma(small, x+1, y) {
+				hash |= 1 << uint(y*8+x)
+			}
+		}
+	}
+
+	return hash
+}
+
+// luma - Яркость по BT.601, без деления
+func luma(img *image.RGBA, x, y int) int {
+	i := img.PixOffset(x, y)
+	return 299*int(img.Pix[i]) + 587*int(img.Pix[i+1]) + 114*int(img.Pix[i+2])
+}
+
+// HammingDistance - Сколько бит отличается
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// FormatHash - Хеш в 16 hex-символов, так он хранится в базе
+func FormatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// ParseHash - Обратно к FormatHash
+func ParseHash(hash string) (uint64, error) {
+	return strconv.ParseUint(hash, 16, 64)
+}
@@ -0,0 +1,66 @@
+package uploader
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDHash(t *testing.T) {
+	gradient := func(width, height int, shift uint8) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				v := uint8((x*x + y*3) * 255 / (width*width + height*3))
+				img.Set(x, y, color.RGBA{v + shift, v, 255 - v, 255})
+			}
+		}
+		return img
+	}
+
+	stripes := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			if (x/20)%2 == 0 {
+				stripes.Set(x, y, color.White)
+			} else {
+				stripes.Set(x, y, color.Black)
+			}
+		}
+	}
+
+	original := DHash(gradient(300, 200, 0))
+
+	testCases := []struct {
+		name    string
+		img     image.Image
+		maxDist int
+		minDist int
+	}{
+		{"Same", gradient(300, 200, 0), 0, 0},
+		{"Resized", gradient(150, 100, 0), 6, 0},
+		{"Tinted", gradient(300, 200, 10), 6, 0},
+		{"Different", stripes, 64, 16},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := HammingDistance(original, DHash(tc.img))
+			if got > tc.maxDist || got < tc.minDist {
+				t.Errorf("got distance %d; want %d..%d", got, tc.minDist, tc.maxDist)
+			}
+		})
+	}
+}
+
+func TestFormatHash(t *testing.T) {
+	for _, hash := range []uint64{0, 1, 1 << 63, ^uint64(0)} {
+		got, err := ParseHash(FormatHash(hash))
+		if err != nil || got != hash {
+			t.Errorf("got %x, %v; want %x", got, err, hash)
+		}
+	}
+	if len(FormatHash(1)) != 16 {
+		t.Errorf("got %s; want 16 chars", FormatHash(1))
+	}
+}
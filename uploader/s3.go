@@ -0,0 +1,407 @@
+package uploader
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Store - Бакет в S3 или совместимом хранилище (MinIO и т.п.).
+// Адреса в path-style: {Endpoint}/{Bucket}/{key}, запросы подписываются AWS Signature V4.
+type S3Store struct {
+	Endpoint  string // http://localhost:9000
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	PublicURL string // Префикс публичных ссылок, по умолчанию {Endpoint}/{Bucket}
+	Client    *http.Client
+}
+
+// NewS3Store - Хранилище в бакете, регион по умолчанию us-east-1
+func NewS3Store(endpoint, bucket, region, accessKey, secretKey string) *S3Store {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Store{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Bucket:    bucket,
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// S3Error - Ответ хранилища с кодом не 2xx
+type S3Error struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("S3 error %d: %s", e.StatusCode, e.Body)
+}
+
+// Put - Загружает объект. Тело читается в память целиком:
+// подписи нужен его хеш, а размер файлов и так ограничен
+func (s *S3Store) Put(key string, r io.Reader, contentType string) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	req, err := s.request("PUT", key, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := s.do(req, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Get - Скачивает объект, ErrBlobNotFound если его нет
+func (s *S3Store) Get(key string) (io.ReadCloser, error) {
+	req, err := s.request("GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Open - Узнает размер объекта HEAD-запросом, а читает его GET с Range
+// с текущего места, ErrBlobNotFound если объекта нет
+func (s *S3Store) Open(key string) (BlobReader, error) {
+	req, err := s.request("HEAD", key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &s3Reader{store: s, key: key, size: resp.ContentLength}, nil
+}
+
+// s3Reader - Чтение объекта с любого места. После Seek тело
+// запрашивается заново, следующим Read
+type s3Reader struct {
+	store  *S3Store
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		req, err := r.store.request("GET", r.key, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+
+		resp, err := r.store.do(req, nil)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && r.offset > 0 {
+			resp.Body.Close()
+			return 0, &S3Error{resp.StatusCode, "Range is not supported"}
+		}
+		r.body = resp.Body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position")
+	}
+
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// Delete - Удаляет объект. S3 отвечает 204 и на отсутствующий ключ
+func (s *S3Store) Delete(key string) error {
+	req, err := s.request("DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req, nil)
+	if err == ErrBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// URL - Публичная ссылка на объект
+func (s *S3Store) URL(key string) string {
+	prefix := s.PublicURL
+	if prefix == "" {
+		prefix = s.Endpoint + "/" + s.Bucket
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + escapePath(key)
+}
+
+func (s *S3Store) request(method, key string, body []byte) (*http.Request, error) {
+	if key == "" {
+		return nil, ErrBlobKey
+	}
+	return s.newRequest(method, "/"+s.Bucket+"/"+key, nil, body)
+}
+
+func (s *S3Store) newRequest(method, path string, query url.Values, body []byte) (*http.Request, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.Path = path
+	endpoint.RawPath = escapePath(path)
+	endpoint.RawQuery = canonicalQuery(query)
+
+	return http.NewRequest(method, endpoint.String(), bytes.NewReader(body))
+}
+
+// s3ListResult - Ответ ListObjectsV2
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+}
+
+// List - Все объекты бакета, страницами по 1000 через ListObjectsV2
+func (s *S3Store) List(fn func(blob BlobInfo) error) error {
+	query := url.Values{"list-type": {"2"}}
+
+	for {
+		req, err := s.newRequest("GET", "/"+s.Bucket, query, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := s.do(req, nil)
+		if err != nil {
+			return err
+		}
+
+		result := s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, object := range result.Contents {
+			if err := fn(BlobInfo{object.Key, object.Size, object.LastModified}); err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// do - Подписывает и выполняет запрос. 404 превращается в ErrBlobNotFound,
+// остальные ошибки хранилища в S3Error
+func (s *S3Store) do(req *http.Request, body []byte) (*http.Response, error) {
+	s.sign(req, body, time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, ErrBlobNotFound
+		}
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &S3Error{resp.StatusCode, string(message)}
+	}
+
+	return resp, nil
+}
+
+// sign - AWS Signature V4. Подписываются host и все заголовки запроса
+func (s *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery - Параметры по алфавиту, закодированные как escapeQuery.
+// Так же строка уходит в запрос, чтобы подпись сошлась
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, escapeQuery(key)+"="+escapeQuery(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// escapePath - URI-кодирование по правилам S3: все, кроме A-Za-z0-9-_.~ и /
+func escapePath(path string) string {
+	return escape(path, true)
+}
+
+// escapeQuery - То же, но / тоже кодируется
+func escapeQuery(value string) string {
+	return escape(value, false)
+}
+
+func escape(value string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && keepSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
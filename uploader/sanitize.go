@@ -0,0 +1,267 @@
+package uploader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrBrokenImage - Не получилось разобрать структуру файла
+var ErrBrokenImage = errors.New("Broken image structure")
+
+// StripMetadata - Убирает метаданные без перекодирования: EXIF, XMP
+// и комментарии из JPEG, текстовые чанки и eXIf из PNG, EXIF и XMP из WebP.
+// От EXIF в JPEG остается только поворот, иначе снимок с телефона ляжет набок.
+// Остальные форматы возвращаются как есть.
+func StripMetadata(data []byte, format string) ([]byte, error) {
+	switch format {
+	case "jpeg", "jpg":
+		return stripJPEG(data)
+	case "png":
+		return stripPNG(data)
+	case "webp":
+		return stripWebP(data)
+	}
+	return data, nil
+}
+
+// jpegKeepMarkers - APPn, которые влияют на отображение:
+// JFIF, ICC-профиль и Adobe (цветовое преобразование)
+var jpegKeepMarkers = map[byte]bool{
+	0xE0: true,
+	0xE2: true,
+	0xEE: true,
+}
+
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, ErrBrokenImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	rotated := false
+	i := 2
+	for {
+		if i+4 > len(data) || data[i] != 0xFF {
+			return nil, ErrBrokenImage
+		}
+		marker := data[i+1]
+
+		// Заполнители 0xFF перед маркером
+		if marker == 0xFF {
+			i++
+			continue
+		}
+
+		// Дальше сжатые данные, их не трогаем
+		if marker == 0xDA {
+			out.Write(data[i:])
+			return out.Bytes(), nil
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, ErrBrokenImage
+		}
+
+		isApp := marker >= 0xE1 && marker <= 0xEF
+		switch {
+		case marker == 0xE1 && !rotated:
+			if orientation, order := exifOrientation(data[i+4 : end]); orientation > 1 {
+				out.Write(exifOrientationSegment(orientation, order))
+				rotated = true
+			}
+		case !(isApp && !jpegKeepMarkers[marker]) && marker != 0xFE:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// exifOrientationTag - Тег Orientation в IFD0
+const exifOrientationTag = 0x0112
+
+// exifOrientation - Значение Orientation из APP1 и порядок байт EXIF.
+// 0, если сегмент не EXIF или тега нет
+func exifOrientation(payload []byte) (uint16, binary.ByteOrder) {
+	if !bytes.HasPrefix(payload, exifHeader) {
+		return 0, nil
+	}
+	tiff := payload[len(exifHeader):]
+	if len(tiff) < 8 {
+		return 0, nil
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, nil
+	}
+	if order.Uint16(tiff[2:4]) != 42 {
+		return 0, nil
+	}
+
+	offset := int64(order.Uint32(tiff[4:8]))
+	if offset+2 > int64(len(tiff)) {
+		return 0, nil
+	}
+	count := int64(order.Uint16(tiff[offset:]))
+	for n := int64(0); n < count; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > int64(len(tiff)) {
+			break
+		}
+		// SHORT, одно значение
+		if order.Uint16(tiff[entry:]) == exifOrientationTag && order.Uint16(tiff[entry+2:]) == 3 {
+			value := order.Uint16(tiff[entry+8:])
+			if value >= 1 && value <= 8 {
+				return value, order
+			}
+			break
+		}
+	}
+
+	return 0, nil
+}
+
+// exifOrientationSegment - APP1 с одним тегом Orientation в IFD0
+func exifOrientationSegment(orientation uint16, order binary.ByteOrder) []byte {
+	tiff := make([]byte, 26)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], exifOrientationTag)
+	order.PutUint16(tiff[12:], 3)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], orientation)
+	// Дальше два байта выравнивания значения и ноль - следующего IFD нет
+
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(exifHeader)+len(tiff)))
+	segment = append(segment, exifHeader...)
+	return append(segment, tiff...)
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngDropChunks - Текст, EXIF и время последнего изменения
+var pngDropChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"tIME": true,
+}
+
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, ErrBrokenImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+
+	i := len(pngSignature)
+	for i < len(data) {
+		if i+8 > len(data) {
+			return nil, ErrBrokenImage
+		}
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		kind := string(data[i+4 : i+8])
+
+		// length + type + data + crc
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, ErrBrokenImage
+		}
+
+		if !pngDropChunks[kind] {
+			out.Write(data[i:end])
+		}
+		i = end
+
+		if kind == "IEND" {
+			break
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+// webpDropChunks - Чанки метаданных расширенного формата
+var webpDropChunks = map[string]bool{
+	"EXIF": true,
+	"XMP ": true,
+}
+
+// webpMetadataFlags - Биты EXIF и XMP в заголовке VP8X
+const webpMetadataFlags = 0x08 | 0x04
+
+// stripWebP - Убирает EXIF и XMP. Если после этого от расширенного
+// формата остался один кадр, VP8X тоже не нужен: получается простой WebP
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, ErrBrokenImage
+	}
+
+	chunks := [][]byte{}
+	var header []byte
+
+	i := 12
+	for i < len(data) {
+		if i+8 > len(data) {
+			return nil, ErrBrokenImage
+		}
+		kind := string(data[i : i+4])
+		length := int(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+
+		// Данные чанка выравниваются до четной длины,
+		// но у последнего чанка байт выравнивания иногда теряют
+		end := i + 8 + length + length&1
+		if end == len(data)+1 && length&1 == 1 {
+			end = len(data)
+		}
+		if length < 0 || end > len(data) {
+			return nil, ErrBrokenImage
+		}
+
+		switch {
+		case kind == "VP8X" && length >= 1:
+			header = append([]byte{}, data[i:end]...)
+			header[8] &^= webpMetadataFlags
+		case !webpDropChunks[kind]:
+			chunks = append(chunks, data[i:end])
+		}
+		i = end
+	}
+
+	if header != nil && !(len(chunks) == 1 && (string(chunks[0][:4]) == "VP8 " || string(chunks[0][:4]) == "VP8L")) {
+		chunks = append([][]byte{header}, chunks...)
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+	for _, chunk := range chunks {
+		out.Write(chunk)
+	}
+
+	// Размер RIFF считается после "RIFF" и самого размера
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+
+	return stripped, nil
+}
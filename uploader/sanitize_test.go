@@ -0,0 +1,290 @@
+package uploader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// withJPEGSegments - Вставляет сегменты сразу после SOI
+func withJPEGSegments(data []byte, segments ...[]byte) []byte {
+	out := append([]byte{}, data[:2]...)
+	for _, segment := range segments {
+		out = append(out, segment...)
+	}
+	return append(out, data[2:]...)
+}
+
+func jpegSegment(marker byte, payload string) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// exifSegment - APP1 с IFD0 из Make, Orientation и GPS-указателя.
+// Строка Make лежит после IFD и должна пропасть вместе с ним
+func exifSegment(order binary.ByteOrder, orientation uint16) []byte {
+	tiff := make([]byte, 8+2+3*12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 3)
+
+	entries := []struct {
+		tag, kind uint16
+		count     uint32
+		value     uint32
+	}{
+		{0x010F, 2, 11, uint32(len(tiff))},
+		{0x0112, 3, 1, uint32(orientation)},
+		{0x8825, 4, 1, 0},
+	}
+	for n, entry := range entries {
+		e := tiff[10+n*12:]
+		order.PutUint16(e, entry.tag)
+		order.PutUint16(e[2:], entry.kind)
+		order.PutUint32(e[4:], entry.count)
+		if entry.kind == 3 {
+			order.PutUint16(e[8:], uint16(entry.value))
+		} else {
+			order.PutUint32(e[8:], entry.value)
+		}
+	}
+	tiff = append(tiff, "GPS-Phone\x00\x00"...)
+
+	return jpegSegment(0xE1, "Exif\x00\x00"+string(tiff))
+}
+
+// jpegAPP1 - Сегменты APP1 до начала сжатых данных
+func jpegAPP1(data []byte) [][]byte {
+	segments := [][]byte{}
+	for i := 2; i+4 <= len(data) && data[i+1] != 0xDA; {
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if data[i+1] == 0xE1 {
+			segments = append(segments, data[i+4:end])
+		}
+		i = end
+	}
+	return segments
+}
+
+// withPNGChunk - Вставляет чанк сразу после IHDR
+func withPNGChunk(data []byte, kind, payload string) []byte {
+	chunk := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, payload...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc...)
+
+	ihdrEnd := 8 + 12 + 13
+	out := append([]byte{}, data[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, data[ihdrEnd:]...)
+}
+
+// testWebP - Lossless WebP одного цвета. Все коды Хаффмана из одного
+// символа, поэтому на сами пиксели не уходит ни бита
+func testWebP(width, height int, c color.NRGBA) []byte {
+	// Биты пишутся с младшего
+	vp8l, n := []byte{0x2f}, uint(0)
+	write := func(value uint64, count uint) {
+		for i := uint(0); i < count; i, n = i+1, n+1 {
+			if n%8 == 0 {
+				vp8l = append(vp8l, 0)
+			}
+			vp8l[len(vp8l)-1] |= byte(value>>i&1) << (n % 8)
+		}
+	}
+
+	write(uint64(width-1), 14)
+	write(uint64(height-1), 14)
+	write(1, 1) // Есть альфа
+	write(0, 3) // Версия
+	write(0, 1) // Без преобразований
+	write(0, 1) // Без кеша цветов
+	write(0, 1) // Без мета-кодов
+
+	// Зеленый, красный, синий, альфа и расстояние
+	for _, symbol := range []uint8{c.G, c.R, c.B, c.A, 0} {
+		write(1, 1) // Простой код
+		write(0, 1) // Один символ
+		write(1, 1) // Символ в 8 битах
+		write(uint64(symbol), 8)
+	}
+
+	return webpFile(webpChunk("VP8L", vp8l))
+}
+
+// webpChunk - Чанк RIFF с выравниванием до четной длины
+func webpChunk(kind string, payload []byte) []byte {
+	chunk := make([]byte, 8, 8+len(payload)+1)
+	copy(chunk, kind)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// webpFile - Контейнер RIFF WEBP из готовых чанков
+func webpFile(chunks ...[]byte) []byte {
+	body := bytes.Join(chunks, nil)
+	header := make([]byte, 12)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+len(body)))
+	copy(header[8:], "WEBP")
+	return append(header, body...)
+}
+
+// withWebPMetadata - Расширенный формат: VP8X, кадр и чанки метаданных
+func withWebPMetadata(data []byte, chunks ...[]byte) []byte {
+	vp8x := make([]byte, 10)
+	vp8x[0] = webpMetadataFlags
+	width, height, _ := webpSize(data)
+	vp8x[4], vp8x[5], vp8x[6] = byte(width-1), byte((width-1)>>8), byte((width-1)>>16)
+	vp8x[7], vp8x[8], vp8x[9] = byte(height-1), byte((height-1)>>8), byte((height-1)>>16)
+
+	return webpFile(append([][]byte{webpChunk("VP8X", vp8x), data[12:]}, chunks...)...)
+}
+
+func webpSize(data []byte) (int, int, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	return config.Width, config.Height, err
+}
+
+func TestWebP(t *testing.T) {
+	data := testWebP(16, 8, color.NRGBA{0x10, 0x80, 0xf0, 0xff})
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "webp" || img.Bounds() != image.Rect(0, 0, 16, 8) {
+		t.Fatalf("got %s %v; want webp 16x8", format, img.Bounds())
+	}
+	if r, g, b, _ := img.At(3, 3).RGBA(); r>>8 != 0x10 || g>>8 != 0x80 || b>>8 != 0xf0 {
+		t.Errorf("got color %v", img.At(3, 3))
+	}
+}
+
+func TestStripMetadata(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+
+	jpegBuf, pngBuf := &bytes.Buffer{}, &bytes.Buffer{}
+	jpeg.Encode(jpegBuf, img, nil)
+	png.Encode(pngBuf, img)
+	webpData := testWebP(16, 16, color.NRGBA{0x10, 0x80, 0xf0, 0xff})
+
+	testCases := []struct {
+		name   string
+		format string
+		data   []byte
+		secret string
+		kept   string
+	}{
+		{"JPEG EXIF", "jpeg", withJPEGSegments(jpegBuf.Bytes(), jpegSegment(0xE1, "Exif\x00\x00GPS 59.43N 24.75E")), "GPS", ""},
+		{"JPEG XMP", "jpeg", withJPEGSegments(jpegBuf.Bytes(), jpegSegment(0xE1, "http://ns.adobe.com/xap/1.0/ serial 1234")), "serial", ""},
+		{"JPEG comment", "jpeg", withJPEGSegments(jpegBuf.Bytes(), jpegSegment(0xFE, "taken by mario")), "mario", ""},
+		{"JPEG ICC kept", "jpeg", withJPEGSegments(jpegBuf.Bytes(), jpegSegment(0xE2, "ICC_PROFILE\x00sRGB"), jpegSegment(0xE1, "Exif\x00\x00GPS")), "GPS", "ICC_PROFILE"},
+		{"PNG text", "png", withPNGChunk(pngBuf.Bytes(), "tEXt", "Author\x00mario"), "mario", ""},
+		{"PNG exif", "png", withPNGChunk(pngBuf.Bytes(), "eXIf", "GPS 59.43N"), "GPS", ""},
+		{"PNG gamma kept", "png", withPNGChunk(withPNGChunk(pngBuf.Bytes(), "gAMA", "\x00\x00\xb1\x8f"), "iTXt", "Comment\x00\x00\x00\x00\x00secret"), "secret", "gAMA"},
+		{"WebP EXIF", "webp", withWebPMetadata(webpData, webpChunk("EXIF", []byte("GPS 59.43N"))), "GPS", ""},
+		{"WebP XMP", "webp", withWebPMetadata(webpData, webpChunk("XMP ", []byte("serial 1234")), webpChunk("EXIF", []byte("GPS"))), "serial", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if !bytes.Contains(tc.data, []byte(tc.secret)) {
+				t.Fatal("bad fixture")
+			}
+
+			got, err := StripMetadata(tc.data, tc.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(got, []byte(tc.secret)) {
+				t.Errorf("got %q left in file", tc.secret)
+			}
+			if tc.kept != "" && !bytes.Contains(got, []byte(tc.kept)) {
+				t.Errorf("got %q stripped; want kept", tc.kept)
+			}
+
+			decoded, _, err := image.Decode(bytes.NewReader(got))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Bounds() != img.Bounds() {
+				t.Errorf("got bounds %v; want %v", decoded.Bounds(), img.Bounds())
+			}
+		})
+	}
+
+	if _, err := StripMetadata([]byte("GIF89a"), "jpeg"); err != ErrBrokenImage {
+		t.Errorf("got %v; want %v", err, ErrBrokenImage)
+	}
+	if _, err := StripMetadata(pngBuf.Bytes()[:40], "png"); err != ErrBrokenImage {
+		t.Errorf("got %v; want %v for truncated png", err, ErrBrokenImage)
+	}
+	if _, err := StripMetadata(webpData[:20], "webp"); err != ErrBrokenImage {
+		t.Errorf("got %v; want %v for truncated webp", err, ErrBrokenImage)
+	}
+}
+
+// От EXIF в JPEG остается только поворот, и только если он не нулевой
+func TestStripMetadataOrientation(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	buf := &bytes.Buffer{}
+	jpeg.Encode(buf, img, nil)
+
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		data := withJPEGSegments(buf.Bytes(), exifSegment(order, 6), jpegSegment(0xE1, "http://ns.adobe.com/xap/1.0/ serial"))
+		if orientation, _ := exifOrientation(jpegAPP1(data)[0]); orientation != 6 {
+			t.Fatalf("%v: bad fixture, orientation %d", order, orientation)
+		}
+
+		got, err := StripMetadata(data, "jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(got, []byte("GPS-Phone")) || bytes.Contains(got, []byte("serial")) {
+			t.Errorf("%v: got metadata left in file", order)
+		}
+
+		segments := jpegAPP1(got)
+		if len(segments) != 1 {
+			t.Fatalf("%v: got %d APP1 segments; want 1", order, len(segments))
+		}
+		if orientation, gotOrder := exifOrientation(segments[0]); orientation != 6 || gotOrder != order {
+			t.Errorf("%v: got orientation %d in %v; want 6", order, orientation, gotOrder)
+		}
+
+		decoded, _, err := image.Decode(bytes.NewReader(got))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Bounds() != img.Bounds() {
+			t.Errorf("got bounds %v; want %v", decoded.Bounds(), img.Bounds())
+		}
+	}
+
+	got, _ := StripMetadata(withJPEGSegments(buf.Bytes(), exifSegment(binary.BigEndian, 1)), "jpeg")
+	if segments := jpegAPP1(got); len(segments) != 0 {
+		t.Errorf("got %d APP1 segments; want none for normal orientation", len(segments))
+	}
+}
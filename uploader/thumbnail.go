@@ -0,0 +1,201 @@
+package uploader
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// thumbSuffix - Миниатюра лежит рядом с оригиналом: {uuid}-thumb.{ext}
+const thumbSuffix = "-thumb"
+
+// ErrUnknownFormat - Формат, для которого не умеем делать миниатюру
+var ErrUnknownFormat = errors.New("Unknown image format")
+
+// ThumbnailOptions - Максимальные размеры миниатюры и чем кодировать
+type ThumbnailOptions struct {
+	MaxWidth  int
+	MaxHeight int
+	Quality   int         // JPEG и WebP, 0 - 85
+	WebP      WebPEncoder // Без него WebP-миниатюры не делаются
+}
+
+// WebPEncoder - Кодировщик WebP. В стандартной библиотеке и x/image его нет
+type WebPEncoder interface {
+	EncodeWebP(w io.Writer, img image.Image, quality int) error
+}
+
+// ThumbPath - Путь миниатюры для оригинала
+func ThumbPath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + thumbSuffix + ext
+}
+
+// IsThumbPath - Это путь миниатюры, а не оригинала
+func IsThumbPath(path string) bool {
+	ext := filepath.Ext(path)
+	return strings.HasSuffix(strings.TrimSuffix(path, ext), thumbSuffix)
+}
+
+// ThumbSize - Размер миниатюры с сохранением пропорций.
+// Маленькие картинки не увеличиваем.
+func ThumbSize(width, height int, opts ThumbnailOptions) (int, int) {
+	if width <= 0 || height <= 0 {
+		return 0, 0
+	}
+	if width <= opts.MaxWidth && height <= opts.MaxHeight {
+		return width, height
+	}
+
+	// Сравниваем width/MaxWidth и height/MaxHeight без float
+	if width*opts.MaxHeight >= height*opts.MaxWidth {
+		return opts.MaxWidth, maxInt(height*opts.MaxWidth/width, 1)
+	}
+	return maxInt(width*opts.MaxHeight/height, 1), opts.MaxHeight
+}
+
+// Thumbnail - Миниатюра в том же формате, что и оригинал.
+// У GIF берется первый кадр.
+func Thumbnail(data []byte, format string, opts ThumbnailOptions) ([]byte, *ImageDimensions, error) {
+	return TranscodeThumbnail(data, format, format, opts)
+}
+
+// TranscodeThumbnail - Миниатюра в другом формате, например JPEG для тяжелого PNG
+func TranscodeThumbnail(data []byte, format, thumbFormat string, opts ThumbnailOptions) ([]byte, *ImageDimensions, error) {
+	src, err := decodeFirstFrame(bytes.NewReader(data), format)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return EncodeThumbnail(src, thumbFormat, opts)
+}
+
+// EncodeThumbnail - Уменьшает готовую картинку и кодирует в format.
+// Так делаются постеры видео из кадра
+func EncodeThumbnail(src image.Image, format string, opts ThumbnailOptions) ([]byte, *ImageDimensions, error) {
+	var err error
+
+	bounds := src.Bounds()
+	width, height := ThumbSize(bounds.Dx(), bounds.Dy(), opts)
+	thumb := Resize(src, width, height)
+
+	quality := opts.Quality
+	if quality == 0 {
+		quality = 85
+	}
+
+	out := &bytes.Buffer{}
+	switch {
+	case format == "jpeg" || format == "jpg":
+		err = jpeg.Encode(out, flatten(thumb), &jpeg.Options{Quality: quality})
+	case format == "png":
+		err = png.Encode(out, thumb)
+	case format == "gif":
+		err = gif.Encode(out, thumb, nil)
+	case format == "webp" && opts.WebP != nil:
+		err = opts.WebP.EncodeWebP(out, thumb, quality)
+	default:
+		err = ErrUnknownFormat
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return out.Bytes(), &ImageDimensions{width, height, int64(out.Len()), ""}, nil
+}
+
+// flatten - Прозрачность на белом фоне: в JPEG альфы нет,
+// и без этого прозрачные места стали бы черными
+func flatten(img *image.RGBA) *image.RGBA {
+	if img.Opaque() {
+		return img
+	}
+
+	out := image.NewRGBA(img.Bounds())
+	draw.Draw(out, out.Bounds(), image.White, image.ZP, draw.Src)
+	draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Over)
+	return out
+}
+
+// decodeFirstFrame - image.Decode, но GIF собирается на полный холст,
+// так как кадр может быть меньше логического экрана.
+func decodeFirstFrame(r io.Reader, format string) (image.Image, error) {
+	if format != "gif" {
+		img, _, err := image.Decode(r)
+		return img, err
+	}
+
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	frame := g.Image[0]
+	draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+	return canvas, nil
+}
+
+// Resize - Уменьшение усреднением по площади (box filter).
+// Работает и на увеличение, но тогда это просто nearest neighbour.
+func Resize(src image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	bounds := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok || bounds.Min != image.ZP {
+		rgba = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	}
+
+	sw, sh := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+	if sw == 0 || sh == 0 {
+		return dst
+	}
+
+	for y := 0; y < height; y++ {
+		sy0 := y * sh / height
+		sy1 := maxInt((y+1)*sh/height, sy0+1)
+
+		for x := 0; x < width; x++ {
+			sx0 := x * sw / width
+			sx1 := maxInt((x+1)*sw/width, sx0+1)
+
+			var r, g, b, a, n int
+			for sy := sy0; sy < sy1; sy++ {
+				i := rgba.PixOffset(sx0, sy)
+				for sx := sx0; sx < sx1; sx++ {
+					r += int(rgba.Pix[i])
+					g += int(rgba.Pix[i+1])
+					b += int(rgba.Pix[i+2])
+					a += int(rgba.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,207 @@
+package uploader
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestThumbSize(t *testing.T) {
+	opts := ThumbnailOptions{MaxWidth: 200, MaxHeight: 100}
+
+	testCases := []struct {
+		name          string
+		width, height int
+		wantW, wantH  int
+	}{
+		{"Small", 50, 40, 50, 40},
+		{"Wide", 1000, 200, 200, 40},
+		{"Tall", 300, 600, 50, 100},
+		{"Exact ratio", 400, 200, 200, 100},
+		{"Line", 10000, 1, 200, 1},
+		{"Empty", 0, 0, 0, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w, h := ThumbSize(tc.width, tc.height, opts)
+			if w != tc.wantW || h != tc.wantH {
+				t.Errorf("got %dx%d; want %dx%d", w, h, tc.wantW, tc.wantH)
+			}
+		})
+	}
+}
+
+func TestThumbPath(t *testing.T) {
+	if got := ThumbPath("/data/abc.png"); got != "/data/abc-thumb.png" {
+		t.Errorf("got %s; want /data/abc-thumb.png", got)
+	}
+	if !IsThumbPath("/data/abc-thumb.png") || IsThumbPath("/data/abc.png") {
+		t.Error("IsThumbPath mismatch")
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			src.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+
+	// Первый кадр красный, второй синий
+	first := image.NewPaletted(image.Rect(0, 0, 400, 300), palette.Plan9)
+	second := image.NewPaletted(image.Rect(0, 0, 400, 300), palette.Plan9)
+	for i := range first.Pix {
+		first.Pix[i] = uint8(first.Palette.Index(color.RGBA{255, 0, 0, 255}))
+		second.Pix[i] = uint8(second.Palette.Index(color.RGBA{0, 0, 255, 255}))
+	}
+
+	writers := map[string]func(w io.Writer) error{
+		"png":  func(w io.Writer) error { return png.Encode(w, src) },
+		"jpeg": func(w io.Writer) error { return jpeg.Encode(w, src, nil) },
+		"gif": func(w io.Writer) error {
+			return gif.EncodeAll(w, &gif.GIF{Image: []*image.Paletted{first, second}, Delay: []int{10, 10}})
+		},
+	}
+
+	opts := ThumbnailOptions{MaxWidth: 200, MaxHeight: 200}
+
+	for name, write := range writers {
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			if err := write(buf); err != nil {
+				t.Fatal(err)
+			}
+
+			thumb, dimensions, err := Thumbnail(buf.Bytes(), name, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dimensions.Width != 200 || dimensions.Height != 150 || dimensions.Size != int64(len(thumb)) {
+				t.Errorf("got %+v; want 200x150 of %d bytes", dimensions, len(thumb))
+			}
+
+			img, format, err := image.Decode(bytes.NewReader(thumb))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != name {
+				t.Errorf("got format %s for %s", format, name)
+			}
+			if b := img.Bounds(); b.Dx() != 200 || b.Dy() != 150 {
+				t.Errorf("got thumb %v; want 200x150", b)
+			}
+
+			if format == "gif" {
+				if r, _, b, _ := img.At(10, 10).RGBA(); r < b {
+					t.Error("got second GIF frame; want first")
+				}
+			}
+		})
+	}
+
+	if _, _, err := Thumbnail([]byte("nope"), "bmp", opts); err == nil {
+		t.Error("got nil error for unknown format")
+	}
+}
+
+// fakeWebP - Вместо настоящего кодировщика пишет однотонный lossless WebP
+type fakeWebP struct {
+	quality int
+}
+
+func (f *fakeWebP) EncodeWebP(w io.Writer, img image.Image, quality int) error {
+	f.quality = quality
+	b := img.Bounds()
+	_, err := w.Write(testWebP(b.Dx(), b.Dy(), color.NRGBA{0, 0, 0, 255}))
+	return err
+}
+
+func TestTranscodeThumbnail(t *testing.T) {
+	opts := ThumbnailOptions{MaxWidth: 200, MaxHeight: 200}
+
+	// Левая половина прозрачная
+	src := image.NewNRGBA(image.Rect(0, 0, 400, 300))
+	for y := 0; y < 300; y++ {
+		for x := 200; x < 400; x++ {
+			src.Set(x, y, color.NRGBA{0, 0, 255, 255})
+		}
+	}
+	pngBuf := &bytes.Buffer{}
+	png.Encode(pngBuf, src)
+
+	thumb, _, err := TranscodeThumbnail(pngBuf.Bytes(), "png", "jpeg", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, format, err := image.Decode(bytes.NewReader(thumb))
+	if err != nil || format != "jpeg" {
+		t.Fatalf("got %s, %v; want jpeg", format, err)
+	}
+	if r, g, b, _ := img.At(10, 10).RGBA(); r>>8 < 240 || g>>8 < 240 || b>>8 < 240 {
+		t.Errorf("got transparent area %v; want white", img.At(10, 10))
+	}
+
+	webpData := testWebP(400, 300, color.NRGBA{0x10, 0x80, 0xf0, 0xff})
+	thumb, dimensions, err := TranscodeThumbnail(webpData, "webp", "png", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, format, _ := image.DecodeConfig(bytes.NewReader(thumb)); format != "png" || dimensions.Width != 200 || dimensions.Height != 150 {
+		t.Errorf("got %s %+v; want png 200x150", format, dimensions)
+	}
+
+	if _, _, err := TranscodeThumbnail(webpData, "webp", "webp", opts); err != ErrUnknownFormat {
+		t.Errorf("got %v without encoder; want ErrUnknownFormat", err)
+	}
+
+	encoder := &fakeWebP{}
+	opts.WebP, opts.Quality = encoder, 70
+	thumb, dimensions, err = TranscodeThumbnail(pngBuf.Bytes(), "png", "webp", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, format, _ := image.DecodeConfig(bytes.NewReader(thumb)); format != "webp" || dimensions.Width != 200 || encoder.quality != 70 {
+		t.Errorf("got %s %+v quality %d; want webp 200x150 quality 70", format, dimensions, encoder.quality)
+	}
+}
+
+func TestImageDimensionsByPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dimensions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string, width int) string {
+		path := filepath.Join(dir, name)
+		f, _ := os.Create(path)
+		png.Encode(f, image.NewRGBA(image.Rect(0, 0, width, 10)))
+		f.Close()
+		return path
+	}
+
+	a, err := ImageDimensionsByPath(write("a.png", 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ImageDimensionsByPath(write("b.png", 10))
+	c, _ := ImageDimensionsByPath(write("c.png", 20))
+
+	if a.Width != 10 || a.Height != 10 {
+		t.Errorf("got %dx%d; want 10x10", a.Width, a.Height)
+	}
+	if a.Md5 != b.Md5 || a.Md5 == c.Md5 || a.Md5 == "d41d8cd98f00b204e9800998ecf8427e" {
+		t.Errorf("got md5 %s, %s, %s; want same for equal files only", a.Md5, b.Md5, c.Md5)
+	}
+}
@@ -11,14 +11,16 @@ import (
 	"io/ioutil"
 
 	"io"
-	"mime/multipart"
 	"os"
+
+	"golang.org/x/image/webp"
 )
 
 func init() {
 	image.RegisterFormat("jpeg", "jpeg", jpeg.Decode, jpeg.DecodeConfig)
 	image.RegisterFormat("png", "png", png.Decode, png.DecodeConfig)
 	image.RegisterFormat("gif", "gif", gif.Decode, gif.DecodeConfig)
+	image.RegisterFormat("webp", "RIFF????WEBPVP8", webp.Decode, webp.DecodeConfig)
 }
 
 // ImageDimensions - Структура с параметрами изображения
@@ -30,7 +32,7 @@ type ImageDimensions struct {
 }
 
 // WriteImageFile - Write file to path
-func WriteImageFile(path string, file multipart.File) (*ImageDimensions, error) {
+func WriteImageFile(path string, file io.Reader) (*ImageDimensions, error) {
 	tempFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, err
@@ -45,36 +47,39 @@ func WriteImageFile(path string, file multipart.File) (*ImageDimensions, error)
 	return ImageDimensionsByPath(path)
 }
 
+// Md5 - Хеш содержимого, как в ImageDimensions.Md5
+func Md5(r io.Reader) (string, error) {
+	hash := md5.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
 // ImageDimensionsByPath - Get file dimensions
 func ImageDimensionsByPath(path string) (*ImageDimensions, error) {
-	file, err := os.Open(path)
+	// Читаем один раз: и для хеша, и для размеров
+	content, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	stat, err := file.Stat()
-	if err != nil {
-		return nil, err
-	}
+	return ImageDimensionsByBytes(content)
+}
 
-	var fileBuffer bytes.Buffer
-	tee := io.TeeReader(file, &fileBuffer)
-	hash := md5.New()
-	fileReaderBuffer, _ := ioutil.ReadAll(&fileBuffer)
-	_, err = io.Copy(hash, bytes.NewReader(fileReaderBuffer))
+// ImageDimensionsByBytes - Размеры и md5 файла, уже прочитанного в память
+func ImageDimensionsByBytes(content []byte) (*ImageDimensions, error) {
+	md5, err := Md5(bytes.NewReader(content))
 	if err != nil {
 		return nil, err
 	}
-	md5 := fmt.Sprintf("%x", hash.Sum(nil))
 
-	fileReader, _ := ioutil.ReadAll(tee)
-	image, _, err := image.DecodeConfig(bytes.NewReader(fileReader))
+	image, _, err := image.DecodeConfig(bytes.NewReader(content))
 	if err != nil {
 		return nil, err
 	}
 
-	return &ImageDimensions{image.Width, image.Height, stat.Size(), md5}, nil
+	return &ImageDimensions{image.Width, image.Height, int64(len(content)), md5}, nil
 }
 
 // ImageDimensionsByFile - Get file dimensions
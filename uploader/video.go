@@ -0,0 +1,366 @@
+package uploader
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// ErrBrokenVideo - Контейнер не разобрался или в нем нет видеодорожки
+var ErrBrokenVideo = errors.New("Broken video container")
+
+// VideoInfo - Что удалось узнать из заголовков контейнера
+type VideoInfo struct {
+	Format   string // mp4 или webm
+	Width    int
+	Height   int
+	Duration float64 // Секунды, 0 если контейнер не знает
+}
+
+// ProbeVideo - Разбирает заголовки MP4 или WebM. Содержимое кадров не проверяется
+func ProbeVideo(data []byte) (*VideoInfo, error) {
+	if len(data) >= 8 && string(data[4:8]) == "ftyp" {
+		return probeMP4(data)
+	}
+	if len(data) >= 4 && binary.BigEndian.Uint32(data) == ebmlHeader {
+		return probeWebM(data)
+	}
+	return nil, ErrBrokenVideo
+}
+
+//--
+// MP4 (ISO BMFF)
+//--
+
+// IsAVIF - AVIF тоже лежит в ISO BMFF: узнается по бренду в ftyp
+func IsAVIF(data []byte) bool {
+	if len(data) < 16 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	size := int(binary.BigEndian.Uint32(data))
+	if size < 16 || size > len(data) {
+		return false
+	}
+
+	// Основной бренд, версия и совместимые бренды
+	brands := append([]byte{}, data[8:12]...)
+	brands = append(brands, data[16:size]...)
+	for i := 0; i+4 <= len(brands); i += 4 {
+		if brand := string(brands[i : i+4]); brand == "avif" || brand == "avis" {
+			return true
+		}
+	}
+	return false
+}
+
+// mp4Boxes - Обходит боксы одного уровня
+func mp4Boxes(data []byte, fn func(kind string, payload []byte) error) error {
+	for i := 0; i < len(data); {
+		if i+8 > len(data) {
+			return ErrBrokenVideo
+		}
+		size := uint64(binary.BigEndian.Uint32(data[i:]))
+		kind := string(data[i+4 : i+8])
+		header := uint64(8)
+
+		switch size {
+		case 0: // До конца файла
+			size = uint64(len(data) - i)
+		case 1: // 64-битный размер
+			if i+16 > len(data) {
+				return ErrBrokenVideo
+			}
+			size = binary.BigEndian.Uint64(data[i+8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)-i) {
+			return ErrBrokenVideo
+		}
+
+		if err := fn(kind, data[i+int(header):i+int(size)]); err != nil {
+			return err
+		}
+		i += int(size)
+	}
+	return nil
+}
+
+func probeMP4(data []byte) (*VideoInfo, error) {
+	info := &VideoInfo{Format: "mp4"}
+	foundMoov := false
+
+	err := mp4Boxes(data, func(kind string, payload []byte) error {
+		if kind != "moov" {
+			return nil
+		}
+		foundMoov = true
+
+		return mp4Boxes(payload, func(kind string, payload []byte) error {
+			switch kind {
+			case "mvhd":
+				duration, err := mp4Duration(payload)
+				info.Duration = duration
+				return err
+			case "trak":
+				width, height, err := mp4Track(payload)
+				if err == nil && info.Width == 0 {
+					info.Width, info.Height = width, height
+				}
+				return err
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !foundMoov || info.Width <= 0 || info.Height <= 0 {
+		return nil, ErrBrokenVideo
+	}
+
+	return info, nil
+}
+
+// mp4Duration - mvhd: timescale и duration, в версии 1 поля шире
+func mp4Duration(payload []byte) (float64, error) {
+	var timescale, duration uint64
+	switch {
+	case len(payload) >= 20 && payload[0] == 0:
+		timescale = uint64(binary.BigEndian.Uint32(payload[12:]))
+		duration = uint64(binary.BigEndian.Uint32(payload[16:]))
+	case len(payload) >= 32 && payload[0] == 1:
+		timescale = uint64(binary.BigEndian.Uint32(payload[20:]))
+		duration = binary.BigEndian.Uint64(payload[24:])
+	default:
+		return 0, ErrBrokenVideo
+	}
+	if timescale == 0 {
+		return 0, ErrBrokenVideo
+	}
+	return float64(duration) / float64(timescale), nil
+}
+
+// mp4Track - Размеры из tkhd, если дорожка видео (hdlr vide). Иначе 0x0
+func mp4Track(payload []byte) (int, int, error) {
+	var width, height uint32
+	video := false
+
+	err := mp4Boxes(payload, func(kind string, payload []byte) error {
+		switch kind {
+		case "tkhd":
+			// Ширина и высота в 16.16 в конце бокса
+			offset := 76
+			if len(payload) > 0 && payload[0] == 1 {
+				offset = 88
+			}
+			if len(payload) < offset+8 {
+				return ErrBrokenVideo
+			}
+			width = binary.BigEndian.Uint32(payload[offset:]) >> 16
+			height = binary.BigEndian.Uint32(payload[offset+4:]) >> 16
+		case "mdia":
+			return mp4Boxes(payload, func(kind string, payload []byte) error {
+				if kind == "hdlr" && len(payload) >= 12 {
+					video = string(payload[8:12]) == "vide"
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil || !video {
+		return 0, 0, err
+	}
+
+	return int(width), int(height), nil
+}
+
+//--
+// WebM (EBML)
+//--
+
+// ID элементов EBML, которые нам нужны
+const (
+	ebmlHeader        = 0x1A45DFA3
+	ebmlDocType       = 0x4282
+	ebmlSegment       = 0x18538067
+	ebmlInfo          = 0x1549A966
+	ebmlTimecodeScale = 0x2AD7B1
+	ebmlDuration      = 0x4489
+	ebmlCluster       = 0x1F43B675
+	ebmlTracks        = 0x1654AE6B
+	ebmlTrackEntry    = 0xAE
+	ebmlTrackType     = 0x83
+	ebmlVideo         = 0xE0
+	ebmlPixelWidth    = 0xB0
+	ebmlPixelHeight   = 0xBA
+)
+
+// ebmlVint - Число переменной длины. Для ID маркер длины остается в значении,
+// для размеров снимается. unknown - все биты размера единицы
+func ebmlVint(data []byte, keepMarker bool) (value uint64, length int, unknown bool, err error) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0, false, ErrBrokenVideo
+	}
+
+	length = 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 || length > len(data) {
+		return 0, 0, false, ErrBrokenVideo
+	}
+
+	value = uint64(data[0])
+	if !keepMarker {
+		value &= uint64(0xFF >> uint(length))
+	}
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+	}
+
+	unknown = !keepMarker && value == 1<<uint(7*length)-1
+	return value, length, unknown, nil
+}
+
+// ebmlElements - Обходит элементы одного уровня.
+// Элемент неизвестного размера тянется до конца данных
+func ebmlElements(data []byte, fn func(id uint64, payload []byte) error) error {
+	for i := 0; i < len(data); {
+		id, idLength, _, err := ebmlVint(data[i:], true)
+		if err != nil || idLength > 4 {
+			return ErrBrokenVideo
+		}
+		i += idLength
+
+		size, sizeLength, unknown, err := ebmlVint(data[i:], false)
+		if err != nil {
+			return err
+		}
+		i += sizeLength
+
+		end := len(data)
+		if !unknown {
+			if size > uint64(len(data)-i) {
+				return ErrBrokenVideo
+			}
+			end = i + int(size)
+		}
+
+		if err := fn(id, data[i:end]); err != nil {
+			return err
+		}
+		i = end
+	}
+	return nil
+}
+
+func ebmlUint(payload []byte) uint64 {
+	var value uint64
+	for _, b := range payload {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func ebmlFloat(payload []byte) float64 {
+	switch len(payload) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(payload)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(payload))
+	}
+	return 0
+}
+
+func probeWebM(data []byte) (*VideoInfo, error) {
+	info := &VideoInfo{Format: "webm"}
+	docType := ""
+	scale := uint64(1000000) // Наносекунд в единице времени по умолчанию
+	duration := 0.0
+
+	// Треки и Info лежат до кластеров, дальше не читаем
+	errDone := errors.New("done")
+
+	err := ebmlElements(data, func(id uint64, payload []byte) error {
+		switch id {
+		case ebmlHeader:
+			return ebmlElements(payload, func(id uint64, payload []byte) error {
+				if id == ebmlDocType {
+					docType = string(payload)
+				}
+				return nil
+			})
+		case ebmlSegment:
+			if docType != "webm" {
+				return ErrBrokenVideo
+			}
+			return ebmlElements(payload, func(id uint64, payload []byte) error {
+				switch id {
+				case ebmlInfo:
+					return ebmlElements(payload, func(id uint64, payload []byte) error {
+						switch id {
+						case ebmlTimecodeScale:
+							scale = ebmlUint(payload)
+						case ebmlDuration:
+							duration = ebmlFloat(payload)
+						}
+						return nil
+					})
+				case ebmlTracks:
+					return ebmlElements(payload, func(id uint64, payload []byte) error {
+						if id == ebmlTrackEntry && info.Width == 0 {
+							return webmTrack(payload, info)
+						}
+						return nil
+					})
+				case ebmlCluster:
+					return errDone
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil && err != errDone {
+		return nil, err
+	}
+	if docType != "webm" || info.Width <= 0 || info.Height <= 0 {
+		return nil, ErrBrokenVideo
+	}
+
+	info.Duration = duration * float64(scale) / 1e9
+	return info, nil
+}
+
+// webmTrack - Размеры из TrackEntry, если это видео (TrackType 1)
+func webmTrack(payload []byte, info *VideoInfo) error {
+	trackType := uint64(0)
+	width, height := 0, 0
+
+	err := ebmlElements(payload, func(id uint64, payload []byte) error {
+		switch id {
+		case ebmlTrackType:
+			trackType = ebmlUint(payload)
+		case ebmlVideo:
+			return ebmlElements(payload, func(id uint64, payload []byte) error {
+				switch id {
+				case ebmlPixelWidth:
+					width = int(ebmlUint(payload))
+				case ebmlPixelHeight:
+					height = int(ebmlUint(payload))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if trackType == 1 {
+		info.Width, info.Height = width, height
+	}
+	return nil
+}
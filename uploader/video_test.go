@@ -0,0 +1,228 @@
+package uploader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mp4Box - Бокс ISO BMFF
+func mp4Box(kind string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	box := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(box, uint32(8+len(body)))
+	copy(box[4:], kind)
+	return append(box, body...)
+}
+
+// testMP4 - ftyp и moov с одной дорожкой handler
+func testMP4(width, height int, handler string) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000) // timescale
+	binary.BigEndian.PutUint32(mvhd[16:], 2500) // duration
+
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], uint32(width)<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], uint32(height)<<16)
+
+	hdlr := append(make([]byte, 8), handler+"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"...)
+
+	return bytes.Join([][]byte{
+		mp4Box("ftyp", []byte("mp42\x00\x00\x00\x00isommp42")),
+		mp4Box("moov",
+			mp4Box("mvhd", mvhd),
+			mp4Box("trak", mp4Box("tkhd", tkhd), mp4Box("mdia", mp4Box("hdlr", hdlr))),
+		),
+		mp4Box("mdat", []byte("frames")),
+	}, nil)
+}
+
+// ebml - Элемент EBML, размер всегда восьмибайтовый
+func ebml(id uint32, payload ...[]byte) []byte {
+	idBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(idBytes, id)
+	for len(idBytes) > 1 && idBytes[0] == 0 {
+		idBytes = idBytes[1:]
+	}
+
+	body := bytes.Join(payload, nil)
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(body)))
+	size[0] = 0x01
+
+	return bytes.Join([][]byte{idBytes, size, body}, nil)
+}
+
+func ebmlUintBytes(value uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, value)
+	return b
+}
+
+// testWebM - Заголовок, Info и одна дорожка типа trackType
+func testWebM(docType string, trackType uint64, unknownSegment bool) []byte {
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(2500))
+
+	segment := ebml(ebmlSegment,
+		ebml(ebmlInfo, ebml(ebmlTimecodeScale, ebmlUintBytes(1000000)), ebml(ebmlDuration, duration)),
+		ebml(ebmlTracks, ebml(ebmlTrackEntry,
+			ebml(ebmlTrackType, []byte{byte(trackType)}),
+			ebml(ebmlVideo, ebml(ebmlPixelWidth, []byte{0x02, 0x80}), ebml(ebmlPixelHeight, []byte{0x01, 0x68})),
+		)),
+		ebml(ebmlCluster, []byte("frames")),
+	)
+	if unknownSegment {
+		// Размер из одних единиц - как у живой записи
+		copy(segment[4:], []byte{0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	}
+
+	return append(ebml(ebmlHeader, ebml(ebmlDocType, []byte(docType))), segment...)
+}
+
+func TestProbeVideo(t *testing.T) {
+	testCases := []struct {
+		name   string
+		data   []byte
+		format string
+	}{
+		{"MP4", testMP4(640, 360, "vide"), "mp4"},
+		{"WebM", testWebM("webm", 1, false), "webm"},
+		{"WebM unknown size", testWebM("webm", 1, true), "webm"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			info, err := ProbeVideo(tc.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Format != tc.format || info.Width != 640 || info.Height != 360 || info.Duration != 2.5 {
+				t.Errorf("got %+v; want %s 640x360 2.5s", info, tc.format)
+			}
+		})
+	}
+
+	if IsAVIF(testMP4(640, 360, "vide")) {
+		t.Error("got MP4 detected as AVIF")
+	}
+
+	broken := map[string][]byte{
+		"Audio only MP4":  testMP4(0, 0, "soun"),
+		"Matroska":        testWebM("matroska", 1, false),
+		"Audio only WebM": testWebM("webm", 2, false),
+		"Truncated MP4":   testMP4(640, 360, "vide")[:40],
+		"Truncated WebM":  testWebM("webm", 1, false)[:30],
+		"PNG":             []byte("\x89PNG\r\n\x1a\n"),
+		"Empty":           nil,
+	}
+	for name, data := range broken {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ProbeVideo(data); err != ErrBrokenVideo {
+				t.Errorf("got %v; want ErrBrokenVideo", err)
+			}
+		})
+	}
+}
+
+func TestFFmpeg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ffmpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewFFmpeg(filepath.Join(dir, "missing")); err == nil {
+		t.Error("got nil error for missing binary")
+	}
+
+	// Вместо ffmpeg скрипт, который отдает готовый кадр
+	frame := filepath.Join(dir, "frame.png")
+	f, _ := os.Create(frame)
+	png.Encode(f, image.NewRGBA(image.Rect(0, 0, 64, 36)))
+	f.Close()
+
+	script := filepath.Join(dir, "ffmpeg")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\ncat "+frame+"\n"), 0755)
+
+	ffmpeg, err := NewFFmpeg(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := ffmpeg.Frame(testMP4(64, 36, "vide"), "mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 64 || b.Dy() != 36 {
+		t.Errorf("got frame %v; want 64x36", b)
+	}
+
+	// WebP приходит из stdout, но его проверяем
+	encoded := filepath.Join(dir, "thumb.webp")
+	ioutil.WriteFile(encoded, testWebP(64, 36, color.NRGBA{0, 0, 0, 255}), 0644)
+	ioutil.WriteFile(script, []byte("#!/bin/sh\ncat >/dev/null\ncat "+encoded+"\n"), 0755)
+
+	out := &bytes.Buffer{}
+	if err := ffmpeg.EncodeWebP(out, img, 80); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(out.Bytes(), []byte("RIFF")) {
+		t.Errorf("got %q; want webp", out.Bytes()[:4])
+	}
+	ioutil.WriteFile(script, []byte("#!/bin/sh\ncat "+frame+"\n"), 0755)
+	if err := ffmpeg.EncodeWebP(out, img, 80); err == nil {
+		t.Error("got nil error for png output")
+	}
+
+	ioutil.WriteFile(script, []byte("#!/bin/sh\necho 'Invalid data' >&2\nexit 1\n"), 0755)
+	if _, err := ffmpeg.Frame(nil, "mp4"); err == nil {
+		t.Error("got nil error for failed ffmpeg")
+	}
+	if err := ffmpeg.EncodeWebP(out, img, 80); err == nil {
+		t.Error("got nil error for failed ffmpeg")
+	}
+}
+
+func TestPlaceholder(t *testing.T) {
+	img := Placeholder(200, 100)
+	if b := img.Bounds(); b.Dx() != 200 || b.Dy() != 100 {
+		t.Errorf("got %v; want 200x100", b)
+	}
+	if bg, mark := img.At(5, 5), img.At(100, 50); bg == mark {
+		t.Error("got blank placeholder")
+	}
+}
+
+func TestIsAVIF(t *testing.T) {
+	testCases := []struct {
+		name string
+		ftyp string
+		want bool
+	}{
+		{"Major brand", "avif\x00\x00\x00\x00mif1miaf", true},
+		{"Sequence", "avis\x00\x00\x00\x00msf1iso8", true},
+		{"Compatible brand", "mif1\x00\x00\x00\x00mp41avif", true},
+		{"HEIC", "heic\x00\x00\x00\x00mif1heic", false},
+		{"MP4", "mp42\x00\x00\x00\x00isommp42", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := append(mp4Box("ftyp", []byte(tc.ftyp)), mp4Box("meta")...)
+			if got := IsAVIF(data); got != tc.want {
+				t.Errorf("got %v; want %v", got, tc.want)
+			}
+		})
+	}
+
+	if IsAVIF([]byte("\x00\x00\x00\x18ftypavif")) {
+		t.Error("got truncated ftyp detected as AVIF")
+	}
+}
@@ -14,7 +14,7 @@ import (
 )
 
 type usersResource struct {
-	storage *Storage
+	storage Storage
 	session *Session
 }
 
@@ -25,9 +25,12 @@ func (rs usersResource) Routes() chi.Router {
 		r.Use(rs.UserCtx)
 		r.Get("/", rs.UserGet)
 		r.Get("/statistic", rs.StatisticGet)
+		r.Get("/roles", rs.RolesGet)
+		r.Post("/roles", rs.RoleGrant)
+		r.Delete("/roles/{role}", rs.RoleRevoke)
 	})
-	r.Post("/login", rs.UserLogin)
-	r.Post("/create", rs.UserCreate)
+	r.With(RateLimit("login")).Post("/login", rs.UserLogin)
+	r.With(RateLimit("register")).Post("/create", rs.UserCreate)
 	r.Get("/session", rs.UserSession)
 
 	return r
@@ -103,6 +106,8 @@ func (rs *usersResource) UserLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Логины хранятся экранированными (см. User.Bind),
+	// к SQL это отношения не имеет
 	username := r.FormValue("username")
 	username = utils.EscapeString(username)
 	user, err := rs.storage.GetUserByUsername(username)
@@ -141,8 +146,7 @@ func (rs *usersResource) UserLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sessionResponse := &SessionResponse{}
-	sessionResponse.Bind(sessionNew)
+	sessionResponse := newSessionResponse(rs.storage, sessionNew)
 
 	render.Render(w, r, &SuccessResponse{
 		HTTPStatusCode: 200,
@@ -182,8 +186,7 @@ func (rs *usersResource) UserCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sessionResponse := &SessionResponse{}
-	sessionResponse.Bind(sessionNew)
+	sessionResponse := newSessionResponse(rs.storage, sessionNew)
 
 	render.Render(w, r, &SuccessResponse{
 		HTTPStatusCode: 201,
@@ -201,8 +204,7 @@ func (rs *usersResource) UserSession(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sessionNew, _ := rs.session.Auth(r)
-	sessionResponse := &SessionResponse{}
-	sessionResponse.Bind(sessionNew)
+	sessionResponse := newSessionResponse(rs.storage, sessionNew)
 
 	render.Render(w, r, &SuccessResponse{
 		HTTPStatusCode: 201,
@@ -10,7 +10,9 @@ const (
 	reNewLines       = `\r?\n`
 	reReduceNewLines = `(<br(?: \/)?>\s*){3,}`
 	reURL            = `(http|ftp|https):\/\/([\w\p{L}\-_]+(?:(?:\.[\w\p{L}\-_]+)+))([\w\p{L}\-\.,@?^=%&amp;:/~\+#]*[\w\p{L}\-\@?^=%&amp;/~\+#])?`
-	reTags           = `#[A-Za-z0-9\_]*` // TODO: Make it better
+	// Перед # не должно быть буквы, цифры, & (сущности вида &#39;) и / (якоря в URL)
+	reTags    = `(^|[^\p{L}\p{N}_&#/])#([\p{L}\p{N}_]{1,64})`
+	reTagLink = `<a class="markup --tag" href="/tags/([^"]+)">`
 )
 
 // FormatMessage - Форматирование текста в около html
@@ -19,8 +21,8 @@ func FormatMessage(str string) (string, error) {
 	str = Nl2br(str)
 	str = ReduceNewLines(str)
 	str = MarkupURLs(str)
-	str = MarkupHashtags(str)
 	str = Markup(str)
+	str = MarkupHashtags(str)
 	return str, nil
 }
 
@@ -50,32 +52,43 @@ func MarkupURLs(str string) string {
 }
 
 // ExtractHashtags - Извлекает список всех хештегов
-// и возвращает _уникальный_ массив тегов.
-// В разметке поста не используется.
+// и возвращает _уникальный_ массив тегов в нижнем регистре,
+// в порядке появления. Понимает и сырой текст, и уже размеченный
+// MarkupHashtags. Теги без букв и цифр (#___) не считаются.
 func ExtractHashtags(str string) []string {
-	re := regexp.MustCompile(reTags)
-	tags := re.FindAllString(str, -1)
-
+	uniqueTags := []string{}
 	findedTags := map[string]bool{}
-	for _, tag := range tags {
-		findedTags[strings.TrimLeft(tag, "#")] = true
+
+	add := func(tag string) {
+		tag = strings.ToLower(tag)
+		if !findedTags[tag] && strings.Trim(tag, "_") != "" {
+			findedTags[tag] = true
+			uniqueTags = append(uniqueTags, tag)
+		}
 	}
 
-	uniqueTags := []string{}
-	for tag := range findedTags {
-		uniqueTags = append(uniqueTags, tag)
+	for _, match := range regexp.MustCompile(reTagLink).FindAllStringSubmatch(str, -1) {
+		add(html.UnescapeString(match[1]))
 	}
 
+	replaceOutsideTags(str, regexp.MustCompile(reTags), func(match []string) string {
+		add(match[2])
+		return match[0]
+	})
+
 	return uniqueTags
 }
 
 // MarkupHashtags - Форматирование хештегов
+// Ссылки, код и прочие теги не трогаем.
 func MarkupHashtags(str string) string {
-	return str
-}
+	re := regexp.MustCompile(reTags)
 
-// Markup - Форматирование разметки
-// a.k.a. корень всего зла
-func Markup(str string) string {
-	return str
+	return replaceOutsideTags(str, re, func(match []string) string {
+		tag := strings.ToLower(match[2])
+		if strings.Trim(tag, "_") == "" {
+			return match[0]
+		}
+		return match[1] + `<a class="markup --tag" href="/tags/` + EscapeString(tag) + `">#` + match[2] + `</a>`
+	})
 }
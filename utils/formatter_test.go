@@ -1,6 +1,11 @@
 package utils
 
-import "testing"
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestEscapeString(t *testing.T) {
 	testCases := []struct {
@@ -56,6 +61,21 @@ func TestMarkup(t *testing.T) {
 		{"Bold & Italic", `***Italic***`, `<b><i>Italic</i></b>`},
 		{"Strike", `~~Strike~~`, `<s>Strike</s>`},
 		{"Spoiler", `\%\%Spoiler\%\%`, `<span class="markup --spoiler">Spoiler</span>`},
+		{"Spoiler short", `%%Spoiler%%`, `<span class="markup --spoiler">Spoiler</span>`},
+		{"Text around", `a **b** c`, `a <b>b</b> c`},
+		{"Nested", `**bold *italic* ~~strike~~**`, `<b>bold <i>italic</i> <s>strike</s></b>`},
+		{"Italic with bold", `*a **b** c*`, `<i>a <b>b</b> c</i>`},
+		{"Spoiler with bold", `%%**secret**%%`, `<span class="markup --spoiler"><b>secret</b></span>`},
+		{"Unclosed", `**Bold`, `**Bold`},
+		{"Unclosed inner", `**a *b**`, `<b>a *b</b>`},
+		{"Unclosed outer", `~~a ~~b~~`, `~~a <s>b</s>`},
+		{"Crossed", `*a **b* c**`, `<i>a **b</i> c**`},
+		{"Empty", `~~~~`, `~~~~`},
+		{"Math", `2 * 3 * 4`, `2 * 3 * 4`},
+		{"Many stars", `****`, `****`},
+		{"Inline code", "`**not bold**`", `<code class="markup --code">**not bold**</code>`},
+		{"Unclosed code", "`code", "`code"},
+		{"Link untouched", `<a href="http://a.com/~~x~~">http://a.com/~~x~~</a> ~~y~~`, `<a href="http://a.com/~~x~~">http://a.com/~~x~~</a> <s>y</s>`},
 	}
 
 	for _, tc := range testCases {
@@ -68,6 +88,75 @@ func TestMarkup(t *testing.T) {
 	}
 }
 
+func TestMarkupUnclosedIsLinear(t *testing.T) {
+	inputs := []string{
+		strings.Repeat("*a **b ~~c %%d ***e ", 500),
+		strings.Repeat("~~a ", 5000),
+		strings.Repeat("%%a ~~b ", 2500),
+	}
+
+	for _, input := range inputs {
+		start := time.Now()
+		got, _ := FormatMessage(input)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%d bytes formatted in %s", len(input), elapsed)
+		}
+		if strings.Contains(got, "<s>") || strings.Contains(got, "<b>") {
+			t.Errorf("unclosed markers formatted: %.80s", got)
+		}
+	}
+}
+
+func TestMarkupBlocks(t *testing.T) {
+	testCases := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"Quote", `&gt;implying<br>text`, `<span class="markup --quote">&gt;implying</span><br>text`},
+		{"Quote with markup", `&gt;**be me**`, `<span class="markup --quote">&gt;<b>be me</b></span>`},
+		{"Reply is not quote", `&gt;&gt;123`, `&gt;&gt;123`},
+		{"Board link is not quote", `&gt;&gt;&gt;/b/123`, `&gt;&gt;&gt;/b/123`},
+		{"Double arrow quote", `&gt;&gt;text`, `<span class="markup --quote">&gt;&gt;text</span>`},
+		{"Fenced code", "before<br>```<br>**a**<br>&gt;b<br>```<br>after", `before<pre class="markup --code"><code>**a**` + "\n" + `&gt;b</code></pre>after`},
+		{"Fenced code with lang", "```go<br>x := 1<br>```", `<pre class="markup --code"><code>x := 1</code></pre>`},
+		{"Fenced code strips links", "```<br><a href=\"http://a.com\">http://a.com</a><br>```", `<pre class="markup --code"><code>http://a.com</code></pre>`},
+		{"Unclosed fence", "```<br>**a**", "```<br><b>a</b>"},
+		{"Markup does not cross lines", `**a<br>b**`, `**a<br>b**`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Markup(tc.got)
+			if got != tc.want {
+				t.Errorf("got %s; want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatMessage(t *testing.T) {
+	testCases := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"XSS inside markup", `**<script>alert(1)</script>**`, `<b>&lt;script&gt;alert(1)&lt;/script&gt;</b>`},
+		{"XSS inside code", "`<img src=x onerror=alert(1)>`", `<code class="markup --code">&lt;img src=x onerror=alert(1)&gt;</code>`},
+		{"Greentext", ">be me\n>**anon**", `<span class="markup --quote">&gt;be me</span><br><span class="markup --quote">&gt;<b>anon</b></span>`},
+		{"Code block", "```\n<b>\n```", `<pre class="markup --code"><code>&lt;b&gt;</code></pre>`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, _ := FormatMessage(tc.got)
+			if got != tc.want {
+				t.Errorf("got %s; want %s", got, tc.want)
+			}
+		})
+	}
+}
+
 func TestExtractHashtags(t *testing.T) {
 	testCases := []struct {
 		name string
@@ -76,15 +165,44 @@ func TestExtractHashtags(t *testing.T) {
 	}{
 		{"Star Wars", `#jedi #star #wars #hello_there`, []string{"jedi", "star", "wars", "hello_there"}},
 		{"Deduplicate", `#jedi #jedi #jedi`, []string{"jedi"}},
-		{"Only _", `#____`, []string{""}},
+		{"Only _", `#____`, []string{}},
+		{"Case", `#Jedi #JEDI`, []string{"jedi"}},
+		{"Cyrillic", `#привет мир`, []string{"привет"}},
+		{"Not a tag", `a#b &#39; http://a.com/#frag`, []string{}},
+		{"Formatted", `<a class="markup --tag" href="/tags/go">#Go</a> <code class="markup --code">#include</code>`, []string{"go"}},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			got := ExtractHashtags(tc.got)
-			//if got != tc.want {
-			t.Errorf("got %s; want %s", got, tc.want)
-			//}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %s; want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMarkupHashtags(t *testing.T) {
+	testCases := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"Tag", `#Go rocks`, `<a class="markup --tag" href="/tags/go">#Go</a> rocks`},
+		{"After text", `hello #go`, `hello <a class="markup --tag" href="/tags/go">#go</a>`},
+		{"After tag", `<b>#go</b>`, `<b><a class="markup --tag" href="/tags/go">#go</a></b>`},
+		{"Entity", `it&#39;s`, `it&#39;s`},
+		{"URL anchor", `<a href="http://a.com/#go">http://a.com/#go</a>`, `<a href="http://a.com/#go">http://a.com/#go</a>`},
+		{"Code", `<code class="markup --code">#include</code>`, `<code class="markup --code">#include</code>`},
+		{"Only _", `#___`, `#___`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := MarkupHashtags(tc.got)
+			if got != tc.want {
+				t.Errorf("got %s; want %s", got, tc.want)
+			}
 		})
 	}
 }
@@ -0,0 +1,259 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Разметка работает уже по экранированному тексту, разбитому на строки <br>,
+// поэтому все, что похоже на тег, вставлено нами и копируется как есть.
+
+const (
+	reStripTags = `<[^>]*>`
+
+	markupSpoilerOpen = `<span class="markup --spoiler">`
+	markupQuoteOpen   = `<span class="markup --quote">`
+	markupCodeOpen    = `<code class="markup --code">`
+	markupPreOpen     = `<pre class="markup --code"><code>`
+
+	// markupMaxDepth - Сколько маркеров может одновременно ждать закрытия,
+	// остальные остаются текстом
+	markupMaxDepth = 8
+)
+
+// markupRule - Парный маркер инлайн-разметки
+type markupRule struct {
+	marker, open, close string
+}
+
+// markupRules - Порядок важен: длинные маркеры первыми
+var markupRules = []*markupRule{
+	{"***", "<b><i>", "</i></b>"},
+	{"**", "<b>", "</b>"},
+	{"*", "<i>", "</i>"},
+	{"~~", "<s>", "</s>"},
+	{`\%\%`, markupSpoilerOpen, "</span>"},
+	{"%%", markupSpoilerOpen, "</span>"},
+}
+
+// Markup - Форматирование разметки
+// a.k.a. корень всего зла
+//
+// Блоки: ``` код ```, строки с > (гринтекст).
+// Инлайн: **жирный**, *курсив*, ***оба***, ~~зачеркнутый~~, %%спойлер%%, `код`.
+// Незакрытые маркеры остаются текстом.
+func Markup(str string) string {
+	lines := strings.Split(str, "<br>")
+
+	var b strings.Builder
+	prevBlock := true
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		if isCodeFence(line) {
+			if end := findCodeFence(lines, i+1); end > 0 {
+				b.WriteString(markupPreOpen)
+				b.WriteString(stripTags(strings.Join(lines[i+1:end], "\n")))
+				b.WriteString("</code></pre>")
+				i = end
+				prevBlock = true
+				continue
+			}
+		}
+
+		if !prevBlock {
+			b.WriteString("<br>")
+		}
+		prevBlock = false
+
+		if isQuote(line) {
+			b.WriteString(markupQuoteOpen)
+			b.WriteString(markupInline(line))
+			b.WriteString("</span>")
+			continue
+		}
+
+		b.WriteString(markupInline(line))
+	}
+
+	return b.String()
+}
+
+// isCodeFence - Строка ``` или ```lang
+func isCodeFence(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "```")
+}
+
+func findCodeFence(lines []string, from int) int {
+	for i := from; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == "```" {
+			return i
+		}
+	}
+	return -1
+}
+
+// isQuote - Гринтекст, но не ссылка на пост вида >>123 или >>>/b/123
+func isQuote(line string) bool {
+	line = strings.TrimLeft(line, " ")
+	if !strings.HasPrefix(line, "&gt;") || strings.HasPrefix(line, "&gt;&gt;&gt;/") {
+		return false
+	}
+
+	rest := strings.TrimPrefix(line, "&gt;&gt;")
+	return rest == line || len(rest) == 0 || rest[0] < '0' || rest[0] > '9'
+}
+
+// markupDelim - Открывающий маркер, который ждет закрывающего
+type markupDelim struct {
+	rule  *markupRule
+	token int // Индекс маркера в tokens
+	end   int // Позиция сразу за маркером
+}
+
+// markupInline - Инлайн-разметка одной строки за один проход.
+// Открывающие маркеры копятся в стеке, закрывающий берет ближайший
+// открытый того же вида, а оставшиеся выше него остаются текстом.
+func markupInline(s string) string {
+	var tokens []string
+	var stack []markupDelim
+
+	text := 0
+	flush := func(i int) {
+		if i > text {
+			tokens = append(tokens, s[text:i])
+		}
+	}
+
+	for i := 0; i < len(s); {
+		if n := htmlAtom(s, i); n > 0 {
+			flush(i)
+			tokens = append(tokens, s[i:i+n])
+			i += n
+			text = i
+			continue
+		}
+
+		if n := codeSpan(s, i); n > 0 {
+			flush(i)
+			tokens = append(tokens, markupCodeOpen+stripTags(s[i+1:i+n-1])+"</code>")
+			i += n
+			text = i
+			continue
+		}
+
+		rule, n := matchMarker(s, i)
+		if n == 0 {
+			i++
+			continue
+		}
+		if rule == nil {
+			i += n
+			continue
+		}
+
+		flush(i)
+		if opener := findOpener(stack, rule); opener >= 0 && stack[opener].end < i && !isSpace(s[i-1]) {
+			tokens[stack[opener].token] = rule.open
+			tokens = append(tokens, rule.close)
+			stack = stack[:opener]
+		} else {
+			if len(stack) < markupMaxDepth && isOpener(s, i+n) {
+				stack = append(stack, markupDelim{rule, len(tokens), i + n})
+			}
+			tokens = append(tokens, s[i:i+n])
+		}
+		i += n
+		text = i
+	}
+	flush(len(s))
+
+	return strings.Join(tokens, "")
+}
+
+// findOpener - Ближайший к вершине стека открытый маркер rule или -1
+func findOpener(stack []markupDelim, rule *markupRule) int {
+	for k := len(stack) - 1; k >= 0; k-- {
+		if stack[k].rule == rule {
+			return k
+		}
+	}
+	return -1
+}
+
+// matchMarker - Маркер в позиции i и его длина.
+// Серия из 4+ звездочек это просто текст: rule == nil, n > 0.
+func matchMarker(s string, i int) (*markupRule, int) {
+	if s[i] == '*' {
+		n := 1
+		for i+n < len(s) && s[i+n] == '*' {
+			n++
+		}
+		if n > 3 {
+			return nil, n
+		}
+		for _, rule := range markupRules {
+			if rule.marker == strings.Repeat("*", n) {
+				return rule, n
+			}
+		}
+	}
+
+	for _, rule := range markupRules {
+		if rule.marker[0] != '*' && strings.HasPrefix(s[i:], rule.marker) {
+			return rule, len(rule.marker)
+		}
+	}
+
+	return nil, 0
+}
+
+// isOpener - После открывающего маркера должен быть текст
+func isOpener(s string, i int) bool {
+	return i < len(s) && !isSpace(s[i])
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// htmlAtom - Длина тега в позиции i. Ссылки <a>...</a> целиком,
+// чтобы разметка не разрывала их пополам.
+func htmlAtom(s string, i int) int {
+	if s[i] != '<' {
+		return 0
+	}
+
+	end := strings.IndexByte(s[i:], '>')
+	if end < 0 {
+		return 0
+	}
+
+	if strings.HasPrefix(s[i:], "<a ") {
+		if closeTag := strings.Index(s[i:], "</a>"); closeTag > 0 {
+			return closeTag + len("</a>")
+		}
+	}
+
+	return end + 1
+}
+
+// codeSpan - Длина `кода` в позиции i вместе с кавычками
+func codeSpan(s string, i int) int {
+	if s[i] != '`' {
+		return 0
+	}
+
+	end := strings.IndexByte(s[i+1:], '`')
+	if end <= 0 {
+		return 0
+	}
+
+	return end + 2
+}
+
+// stripTags - Убирает наши теги, оставляя экранированный текст
+func stripTags(str string) string {
+	re := regexp.MustCompile(reStripTags)
+	return re.ReplaceAllString(str, "")
+}
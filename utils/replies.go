@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// По экранированному тексту: >>123 и >>>/b/123
+const reReply = `&gt;&gt;(?:&gt;/([A-Za-z0-9_]+)/)?([0-9]+)`
+
+// ReplyRef - Ссылка на пост из текста сообщения.
+// Board пустой для ссылок внутри топика.
+type ReplyRef struct {
+	Board string
+	ID    int64
+}
+
+// ExtractReplies - Уникальные ссылки на посты в порядке появления
+func ExtractReplies(str string) []ReplyRef {
+	re := regexp.MustCompile(reReply)
+
+	refs := []ReplyRef{}
+	seen := map[ReplyRef]bool{}
+	replaceOutsideTags(str, re, func(match []string) string {
+		if ref, ok := replyRef(match); ok && !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+		return match[0]
+	})
+
+	return refs
+}
+
+// MarkupReplies - Превращает ссылки на посты в <a>.
+// link возвращает адрес поста или "", если поста нет - тогда текст не трогаем.
+func MarkupReplies(str string, link func(ref ReplyRef) string) string {
+	re := regexp.MustCompile(reReply)
+
+	return replaceOutsideTags(str, re, func(match []string) string {
+		ref, ok := replyRef(match)
+		if !ok {
+			return match[0]
+		}
+
+		href := link(ref)
+		if href == "" {
+			return match[0]
+		}
+
+		return `<a class="markup --reply" href="` + EscapeString(href) + `" data-id="` + match[2] + `">` + match[0] + `</a>`
+	})
+}
+
+func replyRef(match []string) (ReplyRef, bool) {
+	id, err := strconv.ParseInt(match[2], 10, 64)
+	if err != nil {
+		return ReplyRef{}, false
+	}
+	return ReplyRef{Board: match[1], ID: id}, true
+}
+
+// replaceOutsideTags - Как ReplaceAllStringSubmatchFunc, но не лезет
+// внутрь тегов, ссылок и блоков кода, вставленных раньше.
+func replaceOutsideTags(str string, re *regexp.Regexp, fn func(match []string) string) string {
+	var b strings.Builder
+
+	text := 0
+	for i := 0; i < len(str); {
+		n := skipElement(str, i)
+		if n == 0 {
+			i++
+			continue
+		}
+
+		b.WriteString(replaceSubmatch(str[text:i], re, fn))
+		b.WriteString(str[i : i+n])
+		i += n
+		text = i
+	}
+	b.WriteString(replaceSubmatch(str[text:], re, fn))
+
+	return b.String()
+}
+
+func replaceSubmatch(str string, re *regexp.Regexp, fn func(match []string) string) string {
+	return re.ReplaceAllStringFunc(str, func(m string) string {
+		return fn(re.FindStringSubmatch(m))
+	})
+}
+
+// skipElement - Длина тега в позиции i; <a>, <code> и <pre> целиком
+func skipElement(s string, i int) int {
+	for _, tag := range []string{"a", "code", "pre"} {
+		if strings.HasPrefix(s[i:], "<"+tag+" ") || strings.HasPrefix(s[i:], "<"+tag+">") {
+			if end := strings.Index(s[i:], "</"+tag+">"); end > 0 {
+				return end + len("</"+tag+">")
+			}
+		}
+	}
+
+	return htmlAtom(s, i)
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtractReplies(t *testing.T) {
+	testCases := []struct {
+		name string
+		got  string
+		want []ReplyRef
+	}{
+		{"Empty", "", []ReplyRef{}},
+		{"Same topic", `&gt;&gt;12 hello &gt;&gt;7`, []ReplyRef{{"", 12}, {"", 7}}},
+		{"Cross board", `&gt;&gt;&gt;/b/42`, []ReplyRef{{"b", 42}}},
+		{"Deduplicate", `&gt;&gt;1 &gt;&gt;1`, []ReplyRef{{"", 1}}},
+		{"Inside link", `<a href="http://a.com/&gt;&gt;5">http://a.com/&gt;&gt;5</a>`, []ReplyRef{}},
+		{"Inside code", `<code class="markup --code">&gt;&gt;5</code>`, []ReplyRef{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ExtractReplies(tc.got)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v; want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMarkupReplies(t *testing.T) {
+	link := func(ref ReplyRef) string {
+		if ref.ID == 404 {
+			return ""
+		}
+		if ref.Board != "" {
+			return "/" + ref.Board + "/1#2"
+		}
+		return "#2"
+	}
+
+	testCases := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"Same topic", `&gt;&gt;2 yes`, `<a class="markup --reply" href="#2" data-id="2">&gt;&gt;2</a> yes`},
+		{"Cross board", `&gt;&gt;&gt;/b/2`, `<a class="markup --reply" href="/b/1#2" data-id="2">&gt;&gt;&gt;/b/2</a>`},
+		{"Not exists", `&gt;&gt;404`, `&gt;&gt;404`},
+		{"Inside code", `<code class="markup --code">&gt;&gt;2</code>`, `<code class="markup --code">&gt;&gt;2</code>`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := MarkupReplies(tc.got, link)
+			if got != tc.want {
+				t.Errorf("got %s; want %s", got, tc.want)
+			}
+		})
+	}
+}